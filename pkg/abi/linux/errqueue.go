@@ -20,10 +20,11 @@ import (
 
 // Socket error origin codes as defined in include/uapi/linux/errqueue.h.
 const (
-	SO_EE_ORIGIN_NONE  = 0
-	SO_EE_ORIGIN_LOCAL = 1
-	SO_EE_ORIGIN_ICMP  = 2
-	SO_EE_ORIGIN_ICMP6 = 3
+	SO_EE_ORIGIN_NONE         = 0
+	SO_EE_ORIGIN_LOCAL        = 1
+	SO_EE_ORIGIN_ICMP         = 2
+	SO_EE_ORIGIN_ICMP6        = 3
+	SO_EE_ORIGIN_TIMESTAMPING = 4
 )
 
 // SockExtendedErr represents struct sock_extended_err in Linux defined in
@@ -91,3 +92,24 @@ func (*SockErrCMsgIPv6) CMsgLevel() uint32 {
 func (*SockErrCMsgIPv6) CMsgType() uint32 {
 	return IPV6_RECVERR
 }
+
+// SCM_TIMESTAMPING is the type of the control message reporting timestamps
+// requested with SO_TIMESTAMPING, from include/uapi/asm-generic/socket.h.
+const SCM_TIMESTAMPING = SO_TIMESTAMPING
+
+// ControlMessageTimestamping represents struct scm_timestamping in Linux
+// defined in include/uapi/linux/errqueue.h.
+//
+// +marshal
+type ControlMessageTimestamping struct {
+	// Software is ts[0], the software timestamp.
+	Software Timespec
+	// Deprecated is ts[1], which is no longer used.
+	Deprecated Timespec
+	// Hardware is ts[2], the raw hardware timestamp.
+	Hardware Timespec
+}
+
+// SizeOfControlMessageTimestamping is the size of a SCM_TIMESTAMPING control
+// message.
+const SizeOfControlMessageTimestamping = 48
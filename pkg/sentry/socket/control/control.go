@@ -383,6 +383,21 @@ func PackOriginalDstAddress(t *kernel.Task, originalDstAddress linux.SockAddr, b
 		buf, level, optType, t.Arch().Width(), originalDstAddress)
 }
 
+// PackTxTimestamp packs a SCM_TIMESTAMPING socket control message reporting a
+// software transmit timestamp.
+func PackTxTimestamp(t *kernel.Task, timestamp time.Time, buf []byte) []byte {
+	timestampP := linux.ControlMessageTimestamping{
+		Software: linux.NsecToTimespec(timestamp.UnixNano()),
+	}
+	return putCmsgStruct(
+		buf,
+		linux.SOL_SOCKET,
+		linux.SCM_TIMESTAMPING,
+		t.Arch().Width(),
+		&timestampP,
+	)
+}
+
 // PackSockExtendedErr packs an IP*_RECVERR socket control message.
 func PackSockExtendedErr(t *kernel.Task, sockErr linux.SockErrCMsg, buf []byte) []byte {
 	return putCmsgStruct(
@@ -430,6 +445,11 @@ func PackControlMessages(t *kernel.Task, cmsgs socket.ControlMessages, buf []byt
 		buf = PackOriginalDstAddress(t, cmsgs.IP.OriginalDstAddress, buf)
 	}
 
+	if cmsgs.IP.HasTxTimestamp {
+		// In Linux, the timestamp is added before IP*_RECVERR.
+		buf = PackTxTimestamp(t, cmsgs.IP.TxTimestamp, buf)
+	}
+
 	if cmsgs.IP.SockErr != nil {
 		buf = PackSockExtendedErr(t, cmsgs.IP.SockErr, buf)
 	}
@@ -475,6 +495,10 @@ func CmsgsSpace(t *kernel.Task, cmsgs socket.ControlMessages) int {
 		space += cmsgSpace(t, cmsgs.IP.OriginalDstAddress.SizeBytes())
 	}
 
+	if cmsgs.IP.HasTxTimestamp {
+		space += cmsgSpace(t, linux.SizeOfControlMessageTimestamping)
+	}
+
 	if cmsgs.IP.SockErr != nil {
 		space += cmsgSpace(t, cmsgs.IP.SockErr.SizeBytes())
 	}
@@ -282,6 +282,9 @@ var Metrics = tcpip.Stats{
 		PacketsSent:              mustCreateMetric("/netstack/udp/packets_sent", "Number of UDP datagrams sent."),
 		PacketSendErrors:         mustCreateMetric("/netstack/udp/packet_send_errors", "Number of UDP datagrams failed to be sent."),
 		ChecksumErrors:           mustCreateMetric("/netstack/udp/checksum_errors", "Number of UDP datagrams dropped due to bad checksums."),
+		ZeroChecksumIPv6:         mustCreateMetric("/netstack/udp/zero_checksum_ipv6", "Number of IPv6 UDP datagrams dropped due to an illegal zero checksum."),
+		Coalesced:                mustCreateMetric("/netstack/udp/coalesced", "Number of UDP datagrams returned as part of a coalesced read."),
+		CoalesceBatches:          mustCreateMetric("/netstack/udp/coalesce_batches", "Number of UDP reads that coalesced more than one datagram."),
 	},
 }
 
@@ -2768,23 +2771,6 @@ func (s *socketOpsCommon) updateTimestamp(cm tcpip.ControlMessages) {
 	}
 }
 
-// dequeueErr is analogous to net/core/skbuff.c:sock_dequeue_err_skb().
-func (s *socketOpsCommon) dequeueErr() *tcpip.SockError {
-	so := s.Endpoint.SocketOptions()
-	err := so.DequeueErr()
-	if err == nil {
-		return nil
-	}
-
-	// Update socket error to reflect ICMP errors in queue.
-	if nextErr := so.PeekErr(); nextErr != nil && nextErr.Cause.Origin().IsICMPErr() {
-		so.SetLastError(nextErr.Err)
-	} else if err.Cause.Origin().IsICMPErr() {
-		so.SetLastError(nil)
-	}
-	return err
-}
-
 // addrFamilyFromNetProto returns the address family identifier for the given
 // network protocol.
 func addrFamilyFromNetProto(net tcpip.NetworkProtocolNumber) int {
@@ -2801,7 +2787,7 @@ func addrFamilyFromNetProto(net tcpip.NetworkProtocolNumber) int {
 // recvErr handles MSG_ERRQUEUE for recvmsg(2).
 // This is analogous to net/ipv4/ip_sockglue.c:ip_recv_error().
 func (s *socketOpsCommon) recvErr(t *kernel.Task, dst usermem.IOSequence) (int, int, linux.SockAddr, uint32, socket.ControlMessages, *syserr.Error) {
-	sockErr := s.dequeueErr()
+	sockErr := s.Endpoint.SocketOptions().DequeueErrAndUpdateLastError()
 	if sockErr == nil {
 		return 0, 0, nil, 0, socket.ControlMessages{}, syserr.ErrTryAgain
 	}
@@ -2818,6 +2804,10 @@ func (s *socketOpsCommon) recvErr(t *kernel.Task, dst usermem.IOSequence) (int,
 	// supplied via msg_name.  -- recvmsg(2)
 	dstAddr, dstAddrLen := socket.ConvertAddress(addrFamilyFromNetProto(sockErr.NetProto), sockErr.Dst)
 	cmgs := socket.ControlMessages{IP: socket.NewIPControlMessages(s.family, tcpip.ControlMessages{SockErr: sockErr})}
+	if _, ok := sockErr.Cause.(*tcpip.TimestampingSockError); ok {
+		cmgs.IP.HasTxTimestamp = true
+		cmgs.IP.TxTimestamp = sockErr.Timestamp
+	}
 	return n, msgFlags, dstAddr, dstAddrLen, cmgs, syserr.FromError(err)
 }
 
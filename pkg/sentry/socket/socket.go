@@ -79,6 +79,8 @@ func errOriginToLinux(origin tcpip.SockErrOrigin) uint8 {
 		return linux.SO_EE_ORIGIN_ICMP
 	case tcpip.SockExtErrorOriginICMP6:
 		return linux.SO_EE_ORIGIN_ICMP6
+	case tcpip.SockExtErrorOriginTimestamping:
+		return linux.SO_EE_ORIGIN_TIMESTAMPING
 	default:
 		panic(fmt.Sprintf("unknown socket origin: %d", origin))
 	}
@@ -197,6 +199,12 @@ type IPControlMessages struct {
 
 	// SockErr is the dequeued socket error on recvmsg(MSG_ERRQUEUE).
 	SockErr linux.SockErrCMsg
+
+	// HasTxTimestamp indicates whether TxTimestamp is valid/set.
+	HasTxTimestamp bool
+
+	// TxTimestamp is the time the packet reported by SockErr was transmitted.
+	TxTimestamp time.Time `state:".(int64)"`
 }
 
 // Release releases Unix domain socket credentials and rights.
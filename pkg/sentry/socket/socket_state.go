@@ -25,3 +25,11 @@ func (i *IPControlMessages) saveTimestamp() int64 {
 func (i *IPControlMessages) loadTimestamp(nsec int64) {
 	i.Timestamp = time.Unix(0, nsec)
 }
+
+func (i *IPControlMessages) saveTxTimestamp() int64 {
+	return i.TxTimestamp.UnixNano()
+}
+
+func (i *IPControlMessages) loadTxTimestamp(nsec int64) {
+	i.TxTimestamp = time.Unix(0, nsec)
+}
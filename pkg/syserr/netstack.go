@@ -31,6 +31,7 @@ var (
 	ErrUnknownProtocolOption = New((&tcpip.ErrUnknownProtocolOption{}).String(), errno.ENOPROTOOPT)
 	ErrDuplicateNICID        = New((&tcpip.ErrDuplicateNICID{}).String(), errno.EEXIST)
 	ErrDuplicateAddress      = New((&tcpip.ErrDuplicateAddress{}).String(), errno.EEXIST)
+	ErrDuplicateMembership   = New((&tcpip.ErrDuplicateMembership{}).String(), errno.EADDRINUSE)
 	ErrAlreadyBound          = New((&tcpip.ErrAlreadyBound{}).String(), errno.EINVAL)
 	ErrInvalidEndpointState  = New((&tcpip.ErrInvalidEndpointState{}).String(), errno.EINVAL)
 	ErrAlreadyConnecting     = New((&tcpip.ErrAlreadyConnecting{}).String(), errno.EALREADY)
@@ -72,6 +73,8 @@ func TranslateNetstackError(err tcpip.Error) *Error {
 		return ErrDuplicateNICID
 	case *tcpip.ErrDuplicateAddress:
 		return ErrDuplicateAddress
+	case *tcpip.ErrDuplicateMembership:
+		return ErrDuplicateMembership
 	case *tcpip.ErrNoRoute:
 		return ErrNoRoute
 	case *tcpip.ErrAlreadyBound:
@@ -126,6 +129,8 @@ func TranslateNetstackError(err tcpip.Error) *Error {
 		return ErrMessageTooLong
 	case *tcpip.ErrNoBufferSpace:
 		return ErrNoBufferSpace
+	case *tcpip.ErrNoMessage:
+		return ErrNoMessage
 	case *tcpip.ErrBroadcastDisabled:
 		return ErrBroadcastDisabled
 	case *tcpip.ErrNotPermitted:
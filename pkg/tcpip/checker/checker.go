@@ -127,6 +127,27 @@ func TTL(ttl uint8) NetworkChecker {
 	}
 }
 
+// HopLimit creates a checker that checks the HopLimit of an IPv6 packet. Unlike
+// TTL, it fails if the packet is not an IPv6 packet.
+func HopLimit(hopLimit uint8) NetworkChecker {
+	return func(t *testing.T, h []header.Network) {
+		t.Helper()
+
+		var v uint8
+		switch ip := h[0].(type) {
+		case header.IPv6:
+			v = ip.HopLimit()
+		case *ipv6HeaderWithExtHdr:
+			v = ip.HopLimit()
+		default:
+			t.Fatalf("got header type %T, want IPv6 header for HopLimit evaluation", ip)
+		}
+		if v != hopLimit {
+			t.Fatalf("Bad IPv6 HopLimit, got = %d, want = %d", v, hopLimit)
+		}
+	}
+}
+
 // IPFullLength creates a checker for the full IP packet length. The
 // expected size is checked against both the Total Length in the
 // header and the number of bytes received.
@@ -299,6 +320,19 @@ func ReceiveTClass(want uint32) ControlMessagesChecker {
 	}
 }
 
+// ReceiveIPv6Info creates a checker that checks the IPv6Info field in
+// ControlMessages.
+func ReceiveIPv6Info(want tcpip.IPv6Info) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if !cm.HasIPv6Info {
+			t.Errorf("got cm.HasIPv6Info = %t, want = true", cm.HasIPv6Info)
+		} else if got := cm.IPv6Info; got != want {
+			t.Errorf("got cm.IPv6Info = %+v, want %+v", got, want)
+		}
+	}
+}
+
 // ReceiveTOS creates a checker that checks the TOS field in ControlMessages.
 func ReceiveTOS(want uint8) ControlMessagesChecker {
 	return func(t *testing.T, cm tcpip.ControlMessages) {
@@ -311,6 +345,56 @@ func ReceiveTOS(want uint8) ControlMessagesChecker {
 	}
 }
 
+// ReceiveIfIndex creates a checker that checks the IfIndex field in
+// ControlMessages.
+func ReceiveIfIndex(want tcpip.NICID) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if !cm.HasIfIndex {
+			t.Errorf("got cm.HasIfIndex = %t, want = true", cm.HasIfIndex)
+		} else if got := cm.IfIndex; got != want {
+			t.Errorf("got cm.IfIndex = %d, want %d", got, want)
+		}
+	}
+}
+
+// ReceiveLinkSource creates a checker that checks the LinkSource field in
+// ControlMessages.
+func ReceiveLinkSource(want tcpip.LinkAddress) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if !cm.HasLinkSource {
+			t.Errorf("got cm.HasLinkSource = %t, want = true", cm.HasLinkSource)
+		} else if got := cm.LinkSource; got != want {
+			t.Errorf("got cm.LinkSource = %s, want %s", got, want)
+		}
+	}
+}
+
+// ReceiveWasFragmented creates a checker that checks the WasFragmented field
+// in ControlMessages.
+func ReceiveWasFragmented(want bool) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if got := cm.WasFragmented; got != want {
+			t.Errorf("got cm.WasFragmented = %t, want = %t", got, want)
+		}
+	}
+}
+
+// ReceiveLinkPriority creates a checker that checks the LinkPriority field in
+// ControlMessages.
+func ReceiveLinkPriority(want uint32) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if !cm.HasLinkPriority {
+			t.Errorf("got cm.HasLinkPriority = %t, want = true", cm.HasLinkPriority)
+		} else if got := cm.LinkPriority; got != want {
+			t.Errorf("got cm.LinkPriority = %d, want %d", got, want)
+		}
+	}
+}
+
 // ReceiveIPPacketInfo creates a checker that checks the PacketInfo field in
 // ControlMessages.
 func ReceiveIPPacketInfo(want tcpip.IPPacketInfo) ControlMessagesChecker {
@@ -350,6 +434,20 @@ func ReceiveOriginalDstAddr(want tcpip.FullAddress) ControlMessagesChecker {
 	}
 }
 
+// ReceiveDestinationType creates a checker that checks the WasBroadcast and
+// WasMulticast fields in ControlMessages.
+func ReceiveDestinationType(wantBroadcast, wantMulticast bool) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if cm.WasBroadcast != wantBroadcast {
+			t.Errorf("got cm.WasBroadcast = %t, want = %t", cm.WasBroadcast, wantBroadcast)
+		}
+		if cm.WasMulticast != wantMulticast {
+			t.Errorf("got cm.WasMulticast = %t, want = %t", cm.WasMulticast, wantMulticast)
+		}
+	}
+}
+
 // TOS creates a checker that checks the TOS field.
 func TOS(tos uint8, label uint32) NetworkChecker {
 	return func(t *testing.T, h []header.Network) {
@@ -927,6 +1025,22 @@ func ICMPv4Pointer(want uint8) TransportChecker {
 	}
 }
 
+// ICMPv4MTU creates a checker that checks the ICMPv4 Next-Hop MTU field of a
+// Fragmentation Needed message.
+func ICMPv4MTU(want uint16) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		t.Helper()
+
+		icmpv4, ok := h.(header.ICMPv4)
+		if !ok {
+			t.Fatalf("unexpected transport header passed to checker, got = %T, want = header.ICMPv4", h)
+		}
+		if got := icmpv4.MTU(); got != want {
+			t.Fatalf("unexpected ICMP Next-Hop MTU, got = %d, want = %d", got, want)
+		}
+	}
+}
+
 // ICMPv4Checksum creates a checker that checks the ICMPv4 Checksum.
 // This assumes that the payload exactly makes up the rest of the slice.
 func ICMPv4Checksum() TransportChecker {
@@ -969,6 +1083,21 @@ func ICMPv4Payload(want []byte) TransportChecker {
 	}
 }
 
+// ICMPv4PayloadPrefix creates a checker that checks that the payload in an
+// ICMPv4 packet is a non-empty prefix of want. It is used to validate the
+// original packet embedded in ICMP errors, which may be truncated.
+func ICMPv4PayloadPrefix(want []byte) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		t.Helper()
+
+		icmpv4, ok := h.(header.ICMPv4)
+		if !ok {
+			t.Fatalf("unexpected transport header passed to checker, got = %T, want = header.ICMPv4", h)
+		}
+		icmpPayloadPrefix(t, icmpv4.Payload(), want)
+	}
+}
+
 // ICMPv6 creates a checker that checks that the transport protocol is ICMPv6 and
 // potentially additional ICMPv6 header fields.
 //
@@ -1069,6 +1198,35 @@ func ICMPv6Payload(want []byte) TransportChecker {
 	}
 }
 
+// ICMPv6PayloadPrefix creates a checker that checks that the payload in an
+// ICMPv6 packet is a non-empty prefix of want. It is used to validate the
+// original packet embedded in ICMP errors, which may be truncated.
+func ICMPv6PayloadPrefix(want []byte) TransportChecker {
+	return func(t *testing.T, h header.Transport) {
+		t.Helper()
+
+		icmpv6, ok := h.(header.ICMPv6)
+		if !ok {
+			t.Fatalf("unexpected transport header passed to checker, got = %T, want = header.ICMPv6", h)
+		}
+		icmpPayloadPrefix(t, icmpv6.Payload(), want)
+	}
+}
+
+func icmpPayloadPrefix(t *testing.T, payload, want []byte) {
+	t.Helper()
+
+	if len(payload) == 0 {
+		t.Fatal("ICMP payload is empty")
+	}
+	if len(payload) > len(want) {
+		t.Fatalf("ICMP payload is longer than the original packet, got len = %d, want len <= %d", len(payload), len(want))
+	}
+	if diff := cmp.Diff(want[:len(payload)], payload); diff != "" {
+		t.Errorf("ICMP payload mismatch (-want +got):\n%s", diff)
+	}
+}
+
 // MLD creates a checker that checks that the packet contains a valid MLD
 // message for type of mldType, with potentially additional checks specified by
 // checkers.
@@ -261,6 +261,20 @@ func (*ErrDuplicateAddress) IgnoreStats() bool {
 }
 func (*ErrDuplicateAddress) String() string { return "duplicate address" }
 
+// ErrDuplicateMembership indicates the endpoint is already a member of the
+// multicast group on the interface.
+//
+// +stateify savable
+type ErrDuplicateMembership struct{}
+
+func (*ErrDuplicateMembership) isError() {}
+
+// IgnoreStats implements Error.
+func (*ErrDuplicateMembership) IgnoreStats() bool {
+	return false
+}
+func (*ErrDuplicateMembership) String() string { return "duplicate multicast membership" }
+
 // ErrDuplicateNICID indicates the operation encountered a duplicate NIC ID.
 //
 // +stateify savable
@@ -367,6 +381,20 @@ func (*ErrNoBufferSpace) IgnoreStats() bool {
 }
 func (*ErrNoBufferSpace) String() string { return "no buffer space available" }
 
+// ErrNoMessage indicates an error queue entry does not describe an error, such
+// as a transmit timestamp report.
+//
+// +stateify savable
+type ErrNoMessage struct{}
+
+func (*ErrNoMessage) isError() {}
+
+// IgnoreStats implements Error.
+func (*ErrNoMessage) IgnoreStats() bool {
+	return true
+}
+func (*ErrNoMessage) String() string { return "no message of desired type" }
+
 // ErrNoPortAvailable indicates no port could be allocated for the operation.
 //
 // +stateify savable
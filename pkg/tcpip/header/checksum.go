@@ -19,6 +19,7 @@ package header
 import (
 	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
@@ -172,12 +173,39 @@ func ChecksumOld(buf []byte, initial uint16) uint16 {
 	return s
 }
 
+// ChecksumFunc is the expected function type for a checksum implementation to
+// be passed to SetChecksumFunc. It must calculate the same checksum as
+// Checksum.
+type ChecksumFunc func(buf []byte, initial uint16) uint16
+
+// checksumFunc holds the ChecksumFunc installed by SetChecksumFunc, if any.
+var checksumFunc atomic.Value
+
+// SetChecksumFunc replaces the implementation used by Checksum, ChecksumVV and
+// Checksumer, and so by every checksum computed or verified on the write and
+// receive paths, e.g. with a SIMD-accelerated one. A nil fn restores the
+// default implementation.
+func SetChecksumFunc(fn ChecksumFunc) {
+	checksumFunc.Store(fn)
+}
+
+// loadChecksumFunc returns the ChecksumFunc installed by SetChecksumFunc, or
+// nil if the default implementation is used.
+func loadChecksumFunc() ChecksumFunc {
+	fn, _ := checksumFunc.Load().(ChecksumFunc)
+	return fn
+}
+
 // Checksum calculates the checksum (as defined in RFC 1071) of the bytes in the
 // given byte array. This function uses an optimized unrolled version of the
-// checksum algorithm.
+// checksum algorithm, unless another implementation was installed with
+// SetChecksumFunc.
 //
 // The initial checksum must have been computed on an even number of bytes.
 func Checksum(buf []byte, initial uint16) uint16 {
+	if fn := loadChecksumFunc(); fn != nil {
+		return fn(buf, initial)
+	}
 	s, _ := unrolledCalculateChecksum(buf, false, uint32(initial))
 	return s
 }
@@ -202,9 +230,15 @@ type Checksumer struct {
 
 // Add adds b to checksum.
 func (c *Checksumer) Add(b []byte) {
-	if len(b) > 0 {
-		c.sum, c.odd = unrolledCalculateChecksum(b, c.odd, uint32(c.sum))
+	if len(b) == 0 {
+		return
+	}
+	// An installed ChecksumFunc can only start on an even number of bytes.
+	if fn := loadChecksumFunc(); fn != nil && !c.odd {
+		c.sum, c.odd = fn(b, c.sum), len(b)%2 == 1
+		return
 	}
+	c.sum, c.odd = unrolledCalculateChecksum(b, c.odd, uint32(c.sum))
 }
 
 // Checksum returns the latest checksum value.
@@ -99,6 +99,33 @@ func TestChecksumer(t *testing.T) {
 	}
 }
 
+func TestChecksumerChunks(t *testing.T) {
+	var bufSizes = []int{0, 1, 2, 3, 1023, 1024, 1500, 4097, 65535}
+	var chunkSizes = []int{1, 2, 3, 7, 64, 4096}
+
+	// Ensure same buffer generation for test consistency.
+	rnd := rand.New(rand.NewSource(42))
+	for _, bufSz := range bufSizes {
+		buf := make([]byte, bufSz)
+		rnd.Read(buf)
+		want := header.Checksum(buf, 0 /* initial */)
+		for _, chunkSz := range chunkSizes {
+			var c header.Checksumer
+			for b := buf; len(b) != 0; {
+				n := chunkSz
+				if n > len(b) {
+					n = len(b)
+				}
+				c.Add(b[:n])
+				b = b[n:]
+			}
+			if got := c.Checksum(); got != want {
+				t.Errorf("got incremental checksum of %d bytes in %d byte chunks = %d, want = %d", bufSz, chunkSz, got, want)
+			}
+		}
+	}
+}
+
 func TestChecksum(t *testing.T) {
 	var bufSizes = []int{0, 1, 2, 3, 4, 7, 8, 15, 16, 31, 32, 63, 64, 127, 128, 255, 256, 257, 1023, 1024}
 	type testCase struct {
@@ -159,6 +186,42 @@ func BenchmarkChecksum(b *testing.B) {
 	}
 }
 
+// BenchmarkChecksumerChunks compares accumulating a checksum while the data is
+// copied in chunks with copying all the data and then computing its checksum.
+func BenchmarkChecksumerChunks(b *testing.B) {
+	const chunkSize = 4096
+	var bufSizes = []int{1500, 16384, 65535}
+
+	for _, bufSz := range bufSizes {
+		// Ensure same buffer generation for test consistency.
+		rnd := rand.New(rand.NewSource(42))
+		src := make([]byte, bufSz)
+		rnd.Read(src)
+		dst := make([]byte, bufSz)
+
+		b.Run(fmt.Sprintf("full_%d", bufSz), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				copy(dst, src)
+				_ = header.Checksum(dst, 0 /* initial */)
+			}
+		})
+		b.Run(fmt.Sprintf("incremental_%d", bufSz), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var c header.Checksumer
+				for off := 0; off < bufSz; off += chunkSize {
+					end := off + chunkSize
+					if end > bufSz {
+						end = bufSz
+					}
+					copy(dst[off:end], src[off:end])
+					c.Add(dst[off:end])
+				}
+				_ = c.Checksum()
+			}
+		})
+	}
+}
+
 func testICMPChecksum(t *testing.T, headerChecksum func() uint16, icmpChecksum func() uint16, want uint16, pktStr string) {
 	// icmpChecksum should not do any modifications of the header to
 	// calculate its checksum. Let's call it from a few go-routines and the
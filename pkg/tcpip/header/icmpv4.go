@@ -109,6 +109,7 @@ const (
 	ICMPv4ProtoUnreachable    ICMPv4Code = 2
 	ICMPv4PortUnreachable     ICMPv4Code = 3
 	ICMPv4FragmentationNeeded ICMPv4Code = 4
+	ICMPv4SourceRouteFailed   ICMPv4Code = 5
 )
 
 // ICMPv4UnusedCode is a code to use in ICMP messages where no code is needed.
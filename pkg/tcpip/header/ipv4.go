@@ -1131,6 +1131,70 @@ func (o *IPv4SerializableRouterAlertOption) serializeInto(buffer []byte) uint8 {
 	return o.length()
 }
 
+var _ IPv4SerializableOptionPayload = (*IPv4SerializableRecordRouteOption)(nil)
+var _ IPv4SerializableOption = (*IPv4SerializableRecordRouteOption)(nil)
+
+// IPv4SerializableRecordRouteOption provides serialization of an empty Record
+// Route IPv4 option according to RFC 791, with room for Slots addresses.
+type IPv4SerializableRecordRouteOption struct {
+	Slots uint8
+}
+
+// Type implements IPv4SerializableOption.
+func (*IPv4SerializableRecordRouteOption) optionType() IPv4OptionType {
+	return IPv4OptionRecordRouteType
+}
+
+// Length implements IPv4SerializableOption.
+func (o *IPv4SerializableRecordRouteOption) length() uint8 {
+	return IPv4OptionRecordRouteHdrLength - 2 + o.Slots*IPv4AddressSize
+}
+
+// SerializeInto implements IPv4SerializableOption.
+func (o *IPv4SerializableRecordRouteOption) serializeInto(buffer []byte) uint8 {
+	l := o.length()
+	// The pointer is relative to the option and points at the first free
+	// slot, just past the option header.
+	buffer[0] = IPv4OptionRecordRouteHdrLength + 1
+	for i := range buffer[1:l] {
+		buffer[1+i] = 0
+	}
+	return l
+}
+
+var _ IPv4SerializableOptionPayload = (*IPv4SerializableTimestampOption)(nil)
+var _ IPv4SerializableOption = (*IPv4SerializableTimestampOption)(nil)
+
+// IPv4SerializableTimestampOption provides serialization of an empty
+// timestamps-only Timestamp IPv4 option according to RFC 791, with room for
+// Slots timestamps.
+type IPv4SerializableTimestampOption struct {
+	Slots uint8
+}
+
+// Type implements IPv4SerializableOption.
+func (*IPv4SerializableTimestampOption) optionType() IPv4OptionType {
+	return IPv4OptionTimestampType
+}
+
+// Length implements IPv4SerializableOption.
+func (o *IPv4SerializableTimestampOption) length() uint8 {
+	return IPv4OptionTimestampHdrLength - 2 + o.Slots*IPv4OptionTimestampSize
+}
+
+// SerializeInto implements IPv4SerializableOption.
+func (o *IPv4SerializableTimestampOption) serializeInto(buffer []byte) uint8 {
+	l := o.length()
+	// The pointer is relative to the option and points at the first free
+	// slot, just past the option header.
+	buffer[0] = IPv4OptionTimestampHdrLength + 1
+	buffer[1] = uint8(IPv4OptionTimestampOnlyFlag)
+	for i := range buffer[2:l] {
+		buffer[2+i] = 0
+	}
+	return l
+}
+
 var _ IPv4SerializableOption = (*IPv4SerializableNOPOption)(nil)
 
 // IPv4SerializableNOPOption provides serialization for the IPv4 no-op option.
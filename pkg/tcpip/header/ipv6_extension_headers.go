@@ -66,6 +66,10 @@ const (
 	// from the action value for an unrecognized option identifier.
 	ipv6UnknownExtHdrOptionActionShift = 6
 
+	// ipv6RoutingExtHdrRoutingTypeIdx is the index to the Routing Type field
+	// within an IPv6RoutingExtHdr.
+	ipv6RoutingExtHdrRoutingTypeIdx = 0
+
 	// ipv6RoutingExtHdrSegmentsLeftIdx is the index to the Segments Left field
 	// within an IPv6RoutingExtHdr.
 	ipv6RoutingExtHdrSegmentsLeftIdx = 1
@@ -256,6 +260,10 @@ const (
 	// Alert Hop by Hop option as defined in RFC 2711 section 2.1.
 	ipv6RouterAlertHopByHopOptionIdentifier IPv6ExtHdrOptionIdentifier = 5
 
+	// ipv6JumboPayloadHopByHopOptionIdentifier is the identifier for the Jumbo
+	// Payload Hop by Hop option as defined in RFC 2675 section 2.
+	ipv6JumboPayloadHopByHopOptionIdentifier IPv6ExtHdrOptionIdentifier = 0xC2
+
 	// ipv6ExtHdrOptionTypeOffset is the option type offset in an extension header
 	// option as defined in RFC 8200 section 4.2.
 	ipv6ExtHdrOptionTypeOffset = 0
@@ -409,6 +417,11 @@ type IPv6RoutingExtHdr []byte
 // isIPv6PayloadHeader implements IPv6PayloadHeader.isIPv6PayloadHeader.
 func (IPv6RoutingExtHdr) isIPv6PayloadHeader() {}
 
+// RoutingType returns the Routing Type field.
+func (b IPv6RoutingExtHdr) RoutingType() uint8 {
+	return b[ipv6RoutingExtHdrRoutingTypeIdx]
+}
+
 // SegmentsLeft returns the Segments Left field.
 func (b IPv6RoutingExtHdr) SegmentsLeft() uint8 {
 	return b[ipv6RoutingExtHdrSegmentsLeftIdx]
@@ -743,14 +756,15 @@ func (IPv6SerializableHopByHopExtHdr) identifier() IPv6ExtensionHeaderIdentifier
 
 // length implements IPv6SerializableExtHdr.
 func (h IPv6SerializableHopByHopExtHdr) length() int {
-	var total int
+	// Options are aligned relative to the start of the header, so account for
+	// the next header and total length fields first.
+	total := ipv6HopByHopExtHdrOptionsOffset
 	for _, opt := range h {
 		align, alignOffset := opt.alignment()
 		total += ipv6OptionsAlignmentPadding(total, align, alignOffset)
 		total += ipv6ExtHdrOptionPayloadOffset + int(opt.length())
 	}
-	// Account for next header and total length fields and add padding.
-	return padIPv6OptionsLength(ipv6HopByHopExtHdrOptionsOffset + total)
+	return padIPv6OptionsLength(total)
 }
 
 // serializeInto implements IPv6SerializableExtHdr.
@@ -888,6 +902,139 @@ func (o *IPv6RouterAlertOption) serializeInto(b []byte) uint8 {
 	return ipv6RouterAlertPayloadLength
 }
 
+var _ IPv6SerializableHopByHopOption = (*IPv6JumboPayloadOption)(nil)
+
+// IPv6JumboPayloadOption is the IPv6 Jumbo Payload Hop by Hop option defined in
+// RFC 2675 section 2. It carries the length of a jumbogram, whose Payload
+// Length field is zero.
+type IPv6JumboPayloadOption struct {
+	// Length is the length of the packet in octets, excluding the IPv6 header
+	// but including the Hop-by-Hop Options header.
+	Length uint32
+}
+
+const (
+	// ipv6JumboPayloadPayloadLength is the length of the Jumbo Payload
+	// option's payload as defined in RFC 2675 section 2.
+	ipv6JumboPayloadPayloadLength = 4
+
+	// ipv6JumboPayloadAlignmentRequirement is the alignment requirement for
+	// the Jumbo Payload option defined as 4n+2 in RFC 2675 section 2.
+	ipv6JumboPayloadAlignmentRequirement = 4
+
+	// ipv6JumboPayloadAlignmentOffsetRequirement is the alignment offset
+	// requirement for the Jumbo Payload option defined as 4n+2 in RFC 2675
+	// section 2.
+	ipv6JumboPayloadAlignmentOffsetRequirement = 2
+
+	// IPv6JumboPayloadExtHdrLength is the length of a Hop-by-Hop Options
+	// extension header that only carries a Jumbo Payload option.
+	IPv6JumboPayloadExtHdrLength = 8
+)
+
+// identifier implements IPv6SerializableHopByHopOption.
+func (*IPv6JumboPayloadOption) identifier() IPv6ExtHdrOptionIdentifier {
+	return ipv6JumboPayloadHopByHopOptionIdentifier
+}
+
+// length implements IPv6SerializableHopByHopOption.
+func (*IPv6JumboPayloadOption) length() uint8 {
+	return ipv6JumboPayloadPayloadLength
+}
+
+// alignment implements IPv6SerializableHopByHopOption.
+func (*IPv6JumboPayloadOption) alignment() (int, int) {
+	// From RFC 2675 section 2:
+	//   The Jumbo Payload option has an alignment requirement of 4n + 2.
+	return ipv6JumboPayloadAlignmentRequirement, ipv6JumboPayloadAlignmentOffsetRequirement
+}
+
+// serializeInto implements IPv6SerializableHopByHopOption.
+func (o *IPv6JumboPayloadOption) serializeInto(b []byte) uint8 {
+	binary.BigEndian.PutUint32(b, o.Length)
+	return ipv6JumboPayloadPayloadLength
+}
+
+var _ IPv6SerializableExtHdr = (*IPv6SerializableRoutingExtHdr)(nil)
+
+// IPv6SerializableRoutingExtHdr implements serialization of the Routing
+// extension header as outlined in RFC 8200 section 4.4.
+type IPv6SerializableRoutingExtHdr struct {
+	// RoutingType is the Routing Type field.
+	RoutingType uint8
+
+	// SegmentsLeft is the Segments Left field.
+	SegmentsLeft uint8
+
+	// Data is the type-specific data. It is zero padded so that the header is
+	// a multiple of 8 octets long.
+	Data []byte
+}
+
+// ipv6RoutingExtHdrDataOffset is the offset of the type-specific data in a
+// Routing extension header as defined in RFC 8200 section 4.4.
+const ipv6RoutingExtHdrDataOffset = 4
+
+// ipv6RoutingExtHdrFinalDestinationOffset is the offset of the final
+// destination within the type-specific data of Type 2 (RFC 6275 section 6.4)
+// and Segment Routing (RFC 8754 section 2) headers. Both precede the address
+// with 4 octets of fixed fields; the Segment List is encoded in reverse order
+// so Segment List[0] is the final segment.
+const ipv6RoutingExtHdrFinalDestinationOffset = 4
+
+// Routing Types that carry the final destination at
+// ipv6RoutingExtHdrFinalDestinationOffset.
+const (
+	ipv6RoutingExtHdrType2          = 2
+	ipv6RoutingExtHdrSegmentRouting = 4
+)
+
+// FinalDestination returns the final destination of a packet carrying this
+// header, as used in upper-layer pseudo-header checksums (RFC 8200 section
+// 8.1). ok is false if the final destination can't be determined from the
+// header.
+func (h *IPv6SerializableRoutingExtHdr) FinalDestination() (tcpip.Address, bool) {
+	switch h.RoutingType {
+	case ipv6RoutingExtHdrType2, ipv6RoutingExtHdrSegmentRouting:
+	default:
+		return "", false
+	}
+	const end = ipv6RoutingExtHdrFinalDestinationOffset + IPv6AddressSize
+	if len(h.Data) < end {
+		return "", false
+	}
+	return tcpip.Address(h.Data[ipv6RoutingExtHdrFinalDestinationOffset:end]), true
+}
+
+// identifier implements IPv6SerializableExtHdr.
+func (*IPv6SerializableRoutingExtHdr) identifier() IPv6ExtensionHeaderIdentifier {
+	return IPv6RoutingExtHdrIdentifier
+}
+
+// length implements IPv6SerializableExtHdr.
+func (h *IPv6SerializableRoutingExtHdr) length() int {
+	l := ipv6RoutingExtHdrDataOffset + len(h.Data)
+	return (l + ipv6ExtHdrLenBytesPerUnit - 1) &^ (ipv6ExtHdrLenBytesPerUnit - 1)
+}
+
+// serializeInto implements IPv6SerializableExtHdr.
+func (h *IPv6SerializableRoutingExtHdr) serializeInto(nextHeader uint8, b []byte) int {
+	l := h.length()
+	wordsLen := l/ipv6ExtHdrLenBytesPerUnit - 1
+	if wordsLen > math.MaxUint8 {
+		panic(fmt.Sprintf("IPv6 routing header too large: %d+1 64-bit words", wordsLen))
+	}
+	b[0] = nextHeader
+	b[1] = uint8(wordsLen)
+	b[2] = h.RoutingType
+	b[3] = h.SegmentsLeft
+	n := copy(b[ipv6RoutingExtHdrDataOffset:l], h.Data)
+	for i := range b[ipv6RoutingExtHdrDataOffset+n : l] {
+		b[ipv6RoutingExtHdrDataOffset+n+i] = 0
+	}
+	return l
+}
+
 // IPv6ExtHdrSerializer provides serialization of IPv6 extension headers.
 type IPv6ExtHdrSerializer []IPv6SerializableExtHdr
 
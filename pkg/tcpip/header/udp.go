@@ -62,6 +62,11 @@ const (
 
 	// UDPProtocolNumber is UDP's transport protocol number.
 	UDPProtocolNumber tcpip.TransportProtocolNumber = 17
+
+	// UDPLiteProtocolNumber is UDP-Lite's transport protocol number (RFC
+	// 3828). UDP-Lite uses the UDP header format, with the Length field
+	// holding the checksum coverage.
+	UDPLiteProtocolNumber tcpip.TransportProtocolNumber = 136
 )
 
 // SourcePort returns the "source port" field of the UDP header.
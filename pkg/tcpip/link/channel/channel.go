@@ -19,6 +19,7 @@ package channel
 
 import (
 	"context"
+	"math/rand"
 
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -71,15 +72,6 @@ func (q *queue) Read() (PacketInfo, bool) {
 	}
 }
 
-func (q *queue) ReadContext(ctx context.Context) (PacketInfo, bool) {
-	select {
-	case pkt := <-q.c:
-		return pkt, true
-	case <-ctx.Done():
-		return PacketInfo{}, false
-	}
-}
-
 func (q *queue) Write(p PacketInfo) bool {
 	wrote := false
 	select {
@@ -137,8 +129,33 @@ type Endpoint struct {
 	LinkEPCapabilities stack.LinkEndpointCapabilities
 	SupportedGSOKind   stack.SupportedGSO
 
+	// ReportFullQueue causes writes to return ErrWouldBlock when the outbound
+	// packet queue is full instead of silently dropping the packet.
+	ReportFullQueue bool
+
 	// Outbound packet queue.
 	q *queue
+
+	// reorderMu protects the fields below.
+	reorderMu sync.Mutex
+	// reorderProb is the probability that a written packet is delayed behind
+	// the next one.
+	reorderProb float64
+	reorderRand *rand.Rand
+	// reorderHeld is the packet delayed behind the next written packet, if
+	// any.
+	reorderHeld *PacketInfo
+	// reorderHeldC is signalled when a packet is delayed, so that blocked
+	// readers can release it.
+	reorderHeldC chan struct{}
+
+	// lossMu protects the fields below.
+	lossMu sync.Mutex
+	// lossProb is the probability that a written packet is dropped.
+	lossProb float64
+	lossRand *rand.Rand
+	// lost is the number of written packets dropped.
+	lost uint64
 }
 
 // New creates a new channel endpoint.
@@ -147,8 +164,9 @@ func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) *Endpoint {
 		q: &queue{
 			c: make(chan PacketInfo, size),
 		},
-		mtu:      mtu,
-		linkAddr: linkAddr,
+		mtu:          mtu,
+		linkAddr:     linkAddr,
+		reorderHeldC: make(chan struct{}, 1),
 	}
 }
 
@@ -160,13 +178,139 @@ func (e *Endpoint) Close() {
 
 // Read does non-blocking read one packet from the outbound packet queue.
 func (e *Endpoint) Read() (PacketInfo, bool) {
-	return e.q.Read()
+	p, ok := e.q.Read()
+	if !ok {
+		// A packet delayed by reordering is released once nothing else is
+		// queued, so that it is eventually read.
+		p, ok = e.releaseHeld()
+	}
+	if ok {
+		e.notifyWritable()
+	}
+	return p, ok
 }
 
 // ReadContext does blocking read for one packet from the outbound packet queue.
 // It can be cancelled by ctx, and in this case, it returns false.
 func (e *Endpoint) ReadContext(ctx context.Context) (PacketInfo, bool) {
-	return e.q.ReadContext(ctx)
+	for {
+		if p, ok := e.Read(); ok {
+			return p, true
+		}
+		select {
+		case p := <-e.q.c:
+			e.notifyWritable()
+			return p, true
+		case <-e.reorderHeldC:
+			// A packet was delayed while the queue was empty; Read releases
+			// it.
+		case <-ctx.Done():
+			return PacketInfo{}, false
+		}
+	}
+}
+
+// SetReorderProbability makes the endpoint delay each written packet behind
+// the next written packet with probability prob, to simulate reordering on the
+// link. The choice of packets to delay is deterministic for a given seed. A
+// prob of 0 disables reordering.
+func (e *Endpoint) SetReorderProbability(prob float64, seed int64) {
+	e.reorderMu.Lock()
+	defer e.reorderMu.Unlock()
+
+	e.reorderProb = prob
+	e.reorderRand = rand.New(rand.NewSource(seed))
+}
+
+// SetLossProbability makes the endpoint drop each written packet with
+// probability prob, to simulate loss on the link. The choice of packets to
+// drop is deterministic for a given seed. A prob of 0 disables loss.
+func (e *Endpoint) SetLossProbability(prob float64, seed int64) {
+	e.lossMu.Lock()
+	defer e.lossMu.Unlock()
+
+	e.lossProb = prob
+	e.lossRand = rand.New(rand.NewSource(seed))
+}
+
+// Lost returns the number of written packets dropped to simulate loss.
+func (e *Endpoint) Lost() uint64 {
+	e.lossMu.Lock()
+	defer e.lossMu.Unlock()
+
+	return e.lost
+}
+
+// write writes p to the outbound packet queue, possibly dropping it or
+// delaying it behind the next written packet. It returns false if the queue is
+// full.
+func (e *Endpoint) write(p PacketInfo) bool {
+	e.lossMu.Lock()
+	if e.lossProb > 0 && e.lossRand.Float64() < e.lossProb {
+		e.lost++
+		e.lossMu.Unlock()
+		return true
+	}
+	e.lossMu.Unlock()
+
+	e.reorderMu.Lock()
+	if e.reorderHeld == nil && e.reorderProb > 0 && e.reorderRand.Float64() < e.reorderProb {
+		e.reorderHeld = &p
+		e.reorderMu.Unlock()
+		select {
+		case e.reorderHeldC <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	held := e.reorderHeld
+	if held != nil && e.ReportFullQueue && cap(e.q.c)-len(e.q.c) < 2 {
+		// Writing p would leave no room for the delayed packet, which would
+		// then be dropped without the writer being told.
+		e.reorderMu.Unlock()
+		return false
+	}
+	e.reorderHeld = nil
+	e.reorderMu.Unlock()
+
+	if !e.q.Write(p) {
+		if held != nil {
+			e.reorderMu.Lock()
+			e.reorderHeld = held
+			e.reorderMu.Unlock()
+		}
+		return false
+	}
+	if held != nil {
+		// Unless full queues are reported, the delayed packet is dropped
+		// like any other if the queue is full.
+		e.q.Write(*held)
+	}
+	return true
+}
+
+// releaseHeld returns the packet delayed by reordering, if any.
+func (e *Endpoint) releaseHeld() (PacketInfo, bool) {
+	e.reorderMu.Lock()
+	defer e.reorderMu.Unlock()
+
+	held := e.reorderHeld
+	if held == nil {
+		return PacketInfo{}, false
+	}
+	e.reorderHeld = nil
+	return *held, true
+}
+
+// notifyWritable tells the dispatcher that the outbound packet queue has room
+// again. It is a no-op unless the endpoint reports a full queue to writers.
+func (e *Endpoint) notifyWritable() {
+	if !e.ReportFullQueue {
+		return
+	}
+	if d, ok := e.dispatcher.(stack.LinkWritableDispatcher); ok {
+		d.DeliverLinkWritable()
+	}
 }
 
 // Drain removes all outbound packets from the channel and counts them.
@@ -180,8 +324,21 @@ func (e *Endpoint) Drain() int {
 	}
 }
 
+// Writable returns true if the outbound packet queue has room for at least
+// one more packet.
+func (e *Endpoint) Writable() bool {
+	return e.q.Num() < cap(e.q.c)
+}
+
 // NumQueued returns the number of packet queued for outbound.
 func (e *Endpoint) NumQueued() int {
+	e.reorderMu.Lock()
+	held := e.reorderHeld != nil
+	e.reorderMu.Unlock()
+
+	if held {
+		return e.q.Num() + 1
+	}
 	return e.q.Num()
 }
 
@@ -248,8 +405,11 @@ func (e *Endpoint) WritePacket(r stack.RouteInfo, protocol tcpip.NetworkProtocol
 
 	// Write returns false if the queue is full. A full queue is not an error
 	// from the perspective of a LinkEndpoint so we ignore Write's return
-	// value and always return nil from this method.
-	_ = e.q.Write(p)
+	// value and return nil from this method, unless the endpoint was asked to
+	// report a full queue.
+	if !e.write(p) && e.ReportFullQueue {
+		return &tcpip.ErrWouldBlock{}
+	}
 
 	return nil
 }
@@ -264,7 +424,10 @@ func (e *Endpoint) WritePackets(r stack.RouteInfo, pkts stack.PacketBufferList,
 			Route: r,
 		}
 
-		if !e.q.Write(p) {
+		if !e.write(p) {
+			if e.ReportFullQueue {
+				return n, &tcpip.ErrWouldBlock{}
+			}
 			break
 		}
 		n++
@@ -305,8 +468,11 @@ func (e *Endpoint) WriteRawPacket(pkt *stack.PacketBuffer) tcpip.Error {
 
 	// Write returns false if the queue is full. A full queue is not an error
 	// from the perspective of a LinkEndpoint so we ignore Write's return
-	// value and always return nil from this method.
-	_ = e.q.Write(p)
+	// value and return nil from this method, unless the endpoint was asked to
+	// report a full queue.
+	if !e.write(p) && e.ReportFullQueue {
+		return &tcpip.ErrWouldBlock{}
+	}
 
 	return nil
 }
@@ -89,6 +89,29 @@ func (*icmpv4DestinationPortUnreachableSockError) Kind() stack.TransportErrorKin
 	return stack.DestinationPortUnreachableTransportError
 }
 
+var _ stack.TransportError = (*icmpv4SourceRouteFailedSockError)(nil)
+
+// icmpv4SourceRouteFailedSockError is an ICMPv4 Destination Unreachable error
+// due to a failed source route.
+//
+// It indicates that a router was not able to forward the packet along its
+// source route.
+//
+// +stateify savable
+type icmpv4SourceRouteFailedSockError struct {
+	icmpv4DestinationUnreachableSockError
+}
+
+// Code implements tcpip.SockErrorCause.
+func (*icmpv4SourceRouteFailedSockError) Code() uint8 {
+	return uint8(header.ICMPv4SourceRouteFailed)
+}
+
+// Kind implements stack.TransportError.
+func (*icmpv4SourceRouteFailedSockError) Kind() stack.TransportErrorKind {
+	return stack.SourceRouteFailedTransportError
+}
+
 var _ stack.TransportError = (*icmpv4FragmentationNeededSockError)(nil)
 
 // icmpv4FragmentationNeededSockError is an ICMPv4 Destination Unreachable error
@@ -120,6 +143,39 @@ func (*icmpv4FragmentationNeededSockError) Kind() stack.TransportErrorKind {
 	return stack.PacketTooBigTransportError
 }
 
+var _ stack.TransportError = (*icmpv4TimeExceededSockError)(nil)
+
+// icmpv4TimeExceededSockError is an ICMPv4 Time Exceeded error due to the
+// packet's time to live reaching zero in transit.
+//
+// +stateify savable
+type icmpv4TimeExceededSockError struct{}
+
+// Origin implements tcpip.SockErrorCause.
+func (*icmpv4TimeExceededSockError) Origin() tcpip.SockErrOrigin {
+	return tcpip.SockExtErrorOriginICMP
+}
+
+// Type implements tcpip.SockErrorCause.
+func (*icmpv4TimeExceededSockError) Type() uint8 {
+	return uint8(header.ICMPv4TimeExceeded)
+}
+
+// Code implements tcpip.SockErrorCause.
+func (*icmpv4TimeExceededSockError) Code() uint8 {
+	return uint8(header.ICMPv4TTLExceeded)
+}
+
+// Info implements tcpip.SockErrorCause.
+func (*icmpv4TimeExceededSockError) Info() uint32 {
+	return 0
+}
+
+// Kind implements stack.TransportError.
+func (*icmpv4TimeExceededSockError) Kind() stack.TransportErrorKind {
+	return stack.TimeExceededTransportError
+}
+
 func (e *endpoint) checkLocalAddress(addr tcpip.Address) bool {
 	if e.nic.Spoofing() {
 		return true
@@ -351,6 +407,8 @@ func (e *endpoint) handleICMP(pkt *stack.PacketBuffer) {
 				networkMTU = 0
 			}
 			e.handleControl(&icmpv4FragmentationNeededSockError{mtu: networkMTU}, pkt)
+		case header.ICMPv4SourceRouteFailed:
+			e.handleControl(&icmpv4SourceRouteFailedSockError{}, pkt)
 		}
 	case header.ICMPv4SrcQuench:
 		received.srcQuench.Increment()
@@ -361,6 +419,10 @@ func (e *endpoint) handleICMP(pkt *stack.PacketBuffer) {
 	case header.ICMPv4TimeExceeded:
 		received.timeExceeded.Increment()
 
+		if h.Code() == header.ICMPv4TTLExceeded {
+			e.handleControl(&icmpv4TimeExceededSockError{}, pkt)
+		}
+
 	case header.ICMPv4ParamProblem:
 		received.paramProblem.Increment()
 
@@ -467,7 +529,11 @@ func (*icmpReasonNetworkUnreachable) isForwarding() bool {
 // icmpReasonFragmentationNeeded is an error where a packet requires
 // fragmentation while also having the Don't Fragment flag set, as per RFC 792
 // page 3, Destination Unreachable Message.
-type icmpReasonFragmentationNeeded struct{}
+type icmpReasonFragmentationNeeded struct {
+	// mtu is the MTU of the next-hop network, reported in the Next-Hop MTU
+	// field as per RFC 1191 section 4.
+	mtu uint16
+}
 
 func (*icmpReasonFragmentationNeeded) isICMPReason() {}
 func (*icmpReasonFragmentationNeeded) isForwarding() bool {
@@ -674,6 +740,9 @@ func (p *protocol) returnError(reason icmpReason, pkt *stack.PacketBuffer) tcpip
 	icmpHdr.SetCode(icmpCode)
 	icmpHdr.SetType(icmpType)
 	icmpHdr.SetPointer(pointer)
+	if reason, ok := reason.(*icmpReasonFragmentationNeeded); ok {
+		icmpHdr.SetMTU(reason.mtu)
+	}
 	icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr, icmpPkt.Data().AsRange().Checksum()))
 
 	if err := route.WritePacket(
@@ -389,7 +389,7 @@ func (e *endpoint) addIPHeader(srcAddr, dstAddr tcpip.Address, pkt *stack.Packet
 		DstAddr:     dstAddr,
 		Options:     options,
 	})
-	ipH.SetChecksum(^ipH.CalculateChecksum())
+	e.protocol.setChecksum(ipH)
 	pkt.NetworkProtocolNumber = ProtocolNumber
 	return nil
 }
@@ -407,6 +407,9 @@ func (e *endpoint) handleFragments(_ *stack.Route, networkMTU uint32, pkt *stack
 	var n int
 	for {
 		fragPkt, more := buildNextFragment(&pf, networkHeader)
+		if e.protocol.stack.IPv4ChecksumOffload() {
+			header.IPv4(fragPkt.NetworkHeader().View()).SetChecksum(0)
+		}
 		if err := handler(fragPkt); err != nil {
 			return n, pf.RemainingFragmentCount() + 1, err
 		}
@@ -419,7 +422,7 @@ func (e *endpoint) handleFragments(_ *stack.Route, networkMTU uint32, pkt *stack
 
 // WritePacket writes a packet to the given destination address and protocol.
 func (e *endpoint) WritePacket(r *stack.Route, params stack.NetworkHeaderParams, pkt *stack.PacketBuffer) tcpip.Error {
-	if err := e.addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, nil /* options */); err != nil {
+	if err := e.addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, params.IPv4Options); err != nil {
 		return err
 	}
 
@@ -519,7 +522,7 @@ func (e *endpoint) WritePackets(r *stack.Route, pkts stack.PacketBufferList, par
 	stats := e.stats.ip
 
 	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
-		if err := e.addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, nil /* options */); err != nil {
+		if err := e.addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, params.IPv4Options); err != nil {
 			return 0, err
 		}
 
@@ -632,8 +635,7 @@ func (e *endpoint) WriteHeaderIncludedPacket(r *stack.Route, pkt *stack.PacketBu
 	}
 
 	// Always set the checksum.
-	ipH.SetChecksum(0)
-	ipH.SetChecksum(^ipH.CalculateChecksum())
+	e.protocol.setChecksum(ipH)
 
 	// Populate the packet buffer's network header and don't allow an invalid
 	// packet to be sent.
@@ -766,8 +768,7 @@ func (e *endpoint) forwardPacket(pkt *stack.PacketBuffer) ip.ForwardingError {
 	// We perform a full checksum as we may have updated options above. The IP
 	// header is relatively small so this is not expected to be an expensive
 	// operation.
-	newHdr.SetChecksum(0)
-	newHdr.SetChecksum(^newHdr.CalculateChecksum())
+	e.protocol.setChecksum(newHdr)
 
 	forwardToEp, ok := e.protocol.getEndpointForNIC(r.NICID())
 	if !ok {
@@ -788,7 +789,11 @@ func (e *endpoint) forwardPacket(pkt *stack.PacketBuffer) ip.ForwardingError {
 		// WriteHeaderIncludedPacket checks for the presence of the Don't Fragment bit
 		// while sending the packet and returns this error iff fragmentation is
 		// necessary and the bit is also set.
-		_ = e.protocol.returnError(&icmpReasonFragmentationNeeded{}, pkt)
+		mtu := forwardToEp.nic.MTU()
+		if mtu > math.MaxUint16 {
+			mtu = math.MaxUint16
+		}
+		_ = e.protocol.returnError(&icmpReasonFragmentationNeeded{mtu: uint16(mtu)}, pkt)
 		return &ip.ErrMessageTooLong{}
 	default:
 		return &ip.ErrOther{Err: err}
@@ -807,7 +812,10 @@ func (e *endpoint) HandlePacket(pkt *stack.PacketBuffer) {
 		return
 	}
 
-	h, ok := e.protocol.parseAndValidate(pkt)
+	// Packets looped back by the loopback interface never had their checksum
+	// filled in by hardware.
+	skipChecksum := e.nic.IsLoopback() && e.protocol.stack.IPv4ChecksumOffload()
+	h, ok := e.protocol.parseAndValidate(pkt, skipChecksum)
 	if !ok {
 		stats.MalformedPacketsReceived.Increment()
 		return
@@ -833,9 +841,13 @@ func (e *endpoint) HandlePacket(pkt *stack.PacketBuffer) {
 
 				// The source address is one of our own, so we never should have gotten
 				// a packet like this unless HandleLocal is false or our NIC is the
-				// loopback interface.
-				stats.InvalidSourceAddressesReceived.Increment()
-				return
+				// loopback interface. UDP endpoints may still opt in to receiving
+				// such datagrams.
+				if h.TransportProtocol() != header.UDPProtocolNumber || !e.protocol.stack.HasLocalSourceListeners() {
+					stats.InvalidSourceAddressesReceived.Increment()
+					return
+				}
+				pkt.NetworkPacketInfo.LocalSource = true
 			}
 		}
 
@@ -861,7 +873,8 @@ func (e *endpoint) handleLocalPacket(pkt *stack.PacketBuffer, canSkipRXChecksum
 	pkt = pkt.CloneToInbound()
 	pkt.RXTransportChecksumValidated = canSkipRXChecksum
 
-	h, ok := e.protocol.parseAndValidate(pkt)
+	// Locally delivered packets never had their checksum filled in by hardware.
+	h, ok := e.protocol.parseAndValidate(pkt, e.protocol.stack.IPv4ChecksumOffload())
 	if !ok {
 		stats.MalformedPacketsReceived.Increment()
 		return
@@ -1008,6 +1021,7 @@ func (e *endpoint) handleValidatedPacket(h header.IPv4, pkt *stack.PacketBuffer,
 			return
 		}
 		pkt = resPkt
+		pkt.NetworkPacketInfo.Reassembled = true
 		h = header.IPv4(pkt.NetworkHeader().View())
 
 		// The reassembler doesn't take care of fixing up the header, so we need
@@ -1291,10 +1305,11 @@ func (*protocol) Close() {}
 func (*protocol) Wait() {}
 
 // parseAndValidate parses the packet (including its transport layer header) and
-// returns the parsed IP header.
+// returns the parsed IP header. The header checksum is not verified if
+// skipChecksum is true.
 //
 // Returns true if the IP header was successfully parsed.
-func (p *protocol) parseAndValidate(pkt *stack.PacketBuffer) (header.IPv4, bool) {
+func (p *protocol) parseAndValidate(pkt *stack.PacketBuffer, skipChecksum bool) (header.IPv4, bool) {
 	transProtoNum, hasTransportHdr, ok := p.Parse(pkt)
 	if !ok {
 		return nil, false
@@ -1307,7 +1322,7 @@ func (p *protocol) parseAndValidate(pkt *stack.PacketBuffer) (header.IPv4, bool)
 		return nil, false
 	}
 
-	if !h.IsChecksumValid() {
+	if !skipChecksum && !h.IsChecksumValid() {
 		return nil, false
 	}
 
@@ -1401,6 +1416,15 @@ func addressToUint32(addr tcpip.Address) uint32 {
 	return uint32(addr[0]) | uint32(addr[1])<<8 | uint32(addr[2])<<16 | uint32(addr[3])<<24
 }
 
+// setChecksum sets the header checksum of h, or zeroes it if IPv4 checksum
+// offload is enabled on the stack.
+func (p *protocol) setChecksum(h header.IPv4) {
+	h.SetChecksum(0)
+	if !p.stack.IPv4ChecksumOffload() {
+		h.SetChecksum(^h.CalculateChecksum())
+	}
+}
+
 // hashRoute calculates a hash value for the given source/destination pair using
 // the addresses, transport protocol number and a 32-bit number to generate the
 // hash.
@@ -1422,16 +1446,24 @@ type Options struct {
 
 // NewProtocolWithOptions returns an IPv4 network protocol.
 func NewProtocolWithOptions(opts Options) stack.NetworkProtocolFactory {
-	ids := make([]uint32, buckets)
-
-	// Randomly initialize hashIV and the ids.
-	r := hash.RandN32(1 + buckets)
-	for i := range ids {
-		ids[i] = r[i]
-	}
-	hashIV := r[buckets]
-
 	return func(s *stack.Stack) stack.NetworkProtocol {
+		// Randomly initialize hashIV and the ids. IDs must not be predictable,
+		// so they come from a CSPRNG unless the stack was given a random
+		// source to make them reproducible.
+		var r []uint32
+		if s.HasCustomRandSource() {
+			rng := s.Rand()
+			r = make([]uint32, 1+buckets)
+			for i := range r {
+				r[i] = rng.Uint32()
+			}
+		} else {
+			r = hash.RandN32(1 + buckets)
+		}
+		ids := make([]uint32, buckets)
+		copy(ids, r)
+		hashIV := r[buckets]
+
 		p := &protocol{
 			stack:      s,
 			ids:        ids,
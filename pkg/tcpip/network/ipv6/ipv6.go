@@ -674,12 +674,24 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 
 func addIPHeader(srcAddr, dstAddr tcpip.Address, pkt *stack.PacketBuffer, params stack.NetworkHeaderParams, extensionHeaders header.IPv6ExtHdrSerializer) tcpip.Error {
 	extHdrsLen := extensionHeaders.Length()
-	length := pkt.Size() + extensionHeaders.Length()
-	if length > math.MaxUint16 {
-		return &tcpip.ErrMessageTooLong{}
+	length := pkt.Size() + extHdrsLen
+	payloadLength := uint16(length)
+	if length > maxPayloadSize {
+		// As per RFC 2675 section 2, the length of a payload that does not fit in
+		// the Payload Length field is carried in a Jumbo Payload option and the
+		// Payload Length field is set to zero.
+		jumbo := &header.IPv6JumboPayloadOption{}
+		extensionHeaders = withJumboPayloadOption(extensionHeaders, jumbo)
+		extHdrsLen = extensionHeaders.Length()
+		length = pkt.Size() + extHdrsLen
+		if uint64(length) > math.MaxUint32 {
+			return &tcpip.ErrMessageTooLong{}
+		}
+		jumbo.Length = uint32(length)
+		payloadLength = 0
 	}
 	header.IPv6(pkt.NetworkHeader().Push(header.IPv6MinimumSize + extHdrsLen)).Encode(&header.IPv6Fields{
-		PayloadLength:     uint16(length),
+		PayloadLength:     payloadLength,
 		TransportProtocol: params.Protocol,
 		HopLimit:          params.TTL,
 		TrafficClass:      params.TOS,
@@ -691,6 +703,32 @@ func addIPHeader(srcAddr, dstAddr tcpip.Address, pkt *stack.PacketBuffer, params
 	return nil
 }
 
+// withJumboPayloadOption returns a copy of hdrs with opt added to the
+// Hop-by-Hop Options header, which must be the first extension header.
+func withJumboPayloadOption(hdrs header.IPv6ExtHdrSerializer, opt *header.IPv6JumboPayloadOption) header.IPv6ExtHdrSerializer {
+	if len(hdrs) != 0 {
+		if hbh, ok := hdrs[0].(header.IPv6SerializableHopByHopExtHdr); ok {
+			withOpt := make(header.IPv6ExtHdrSerializer, len(hdrs))
+			copy(withOpt, hdrs)
+			withOpt[0] = append(append(header.IPv6SerializableHopByHopExtHdr(nil), hbh...), opt)
+			return withOpt
+		}
+	}
+	return append(header.IPv6ExtHdrSerializer{header.IPv6SerializableHopByHopExtHdr{opt}}, hdrs...)
+}
+
+// jumbogramFits returns true if pkt is a jumbogram that fits in the link MTU.
+// Jumbograms are only built for payloads that don't fit in the Payload Length
+// field, so they are exempt from the maxPayloadSize cap on the network MTU.
+func jumbogramFits(pkt *stack.PacketBuffer, linkMTU uint32) bool {
+	ip := header.IPv6(pkt.NetworkHeader().View())
+	if ip.PayloadLength() != 0 {
+		return false
+	}
+	size := len(ip) + pkt.TransportHeader().View().Size() + pkt.Data().Size()
+	return uint64(size) <= uint64(linkMTU)
+}
+
 func packetMustBeFragmented(pkt *stack.PacketBuffer, networkMTU uint32) bool {
 	payload := pkt.TransportHeader().View().Size() + pkt.Data().Size()
 	return pkt.GSOOptions.Type == stack.GSONone && uint32(payload) > networkMTU
@@ -741,7 +779,7 @@ func (e *endpoint) handleFragments(r *stack.Route, networkMTU uint32, pkt *stack
 
 // WritePacket writes a packet to the given destination address and protocol.
 func (e *endpoint) WritePacket(r *stack.Route, params stack.NetworkHeaderParams, pkt *stack.PacketBuffer) tcpip.Error {
-	if err := addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, nil /* extensionHeaders */); err != nil {
+	if err := addIPHeader(r.LocalAddress(), r.RemoteAddress(), pkt, params, params.IPv6ExtensionHeaders); err != nil {
 		return err
 	}
 
@@ -795,19 +833,27 @@ func (e *endpoint) writePacket(r *stack.Route, pkt *stack.PacketBuffer, protocol
 	}
 
 	stats := e.stats.ip
-	networkMTU, err := calculateNetworkMTU(e.nic.MTU(), uint32(pkt.NetworkHeader().View().Size()))
+	linkMTU := e.nic.MTU()
+	if pkt.NetworkPacketInfo.UseMinMTU && linkMTU > header.IPv6MinimumMTU {
+		linkMTU = header.IPv6MinimumMTU
+	}
+	networkMTU, err := calculateNetworkMTU(linkMTU, uint32(pkt.NetworkHeader().View().Size()))
 	if err != nil {
 		stats.OutgoingPacketErrors.Increment()
 		return err
 	}
 
-	if packetMustBeFragmented(pkt, networkMTU) {
+	if packetMustBeFragmented(pkt, networkMTU) && !jumbogramFits(pkt, linkMTU) {
 		if pkt.NetworkPacketInfo.IsForwardedPacket {
 			// As per RFC 2460, section 4.5:
 			//   Unlike IPv4, fragmentation in IPv6 is performed only by source nodes,
 			//   not by routers along a packet's delivery path.
 			return &tcpip.ErrMessageTooLong{}
 		}
+		if header.IPv6(pkt.NetworkHeader().View()).PayloadLength() == 0 {
+			// Jumbograms cannot be fragmented (RFC 2675 section 5).
+			return &tcpip.ErrMessageTooLong{}
+		}
 		sent, remain, err := e.handleFragments(r, networkMTU, pkt, protocol, func(fragPkt *stack.PacketBuffer) tcpip.Error {
 			// TODO(gvisor.dev/issue/3884): Evaluate whether we want to send each
 			// fragment one by one using WritePacket() (current strategy) or if we
@@ -841,7 +887,7 @@ func (e *endpoint) WritePackets(r *stack.Route, pkts stack.PacketBufferList, par
 	stats := e.stats.ip
 	linkMTU := e.nic.MTU()
 	for pb := pkts.Front(); pb != nil; pb = pb.Next() {
-		if err := addIPHeader(r.LocalAddress(), r.RemoteAddress(), pb, params, nil /* extensionHeaders */); err != nil {
+		if err := addIPHeader(r.LocalAddress(), r.RemoteAddress(), pb, params, params.IPv6ExtensionHeaders); err != nil {
 			return 0, err
 		}
 
@@ -1092,9 +1138,13 @@ func (e *endpoint) HandlePacket(pkt *stack.PacketBuffer) {
 
 				// The source address is one of our own, so we never should have gotten
 				// a packet like this unless HandleLocal is false or our NIC is the
-				// loopback interface.
-				stats.InvalidSourceAddressesReceived.Increment()
-				return
+				// loopback interface. UDP endpoints may still opt in to receiving
+				// such datagrams.
+				if tcpip.TransportProtocolNumber(h.NextHeader()) != header.UDPProtocolNumber || !e.protocol.stack.HasLocalSourceListeners() {
+					stats.InvalidSourceAddressesReceived.Increment()
+					return
+				}
+				pkt.NetworkPacketInfo.LocalSource = true
 			}
 		}
 
@@ -1479,6 +1529,11 @@ func (e *endpoint) processExtensionHeaders(h header.IPv6, pkt *stack.PacketBuffe
 
 			if ready {
 				pkt = resPkt
+				// An atomic fragment (RFC 6946) is complete on its own and was not
+				// split across fragments.
+				if start != 0 || extHdr.More() {
+					pkt.NetworkPacketInfo.Reassembled = true
+				}
 
 				// We create a new iterator with the reassembled packet because we could
 				// have more extension headers in the reassembled payload, as per RFC
@@ -2381,7 +2436,14 @@ func buildNextFragment(pf *fragmentation.PacketFragmenter, originalIPHeaders hea
 
 	nextHeader, _ := s.Serialize(transportProto, fragmentIPHeaders[originalIPHeadersLength:])
 
-	fragmentIPHeaders.SetNextHeader(nextHeader)
+	// The extension headers already populated are all part of the
+	// unfragmentable part (RFC 8200 section 4.5), so the Fragment header is
+	// chained after the last of them rather than after the IPv6 header.
+	nextHeaderOffset := header.IPv6NextHeaderOffset
+	for off := header.IPv6MinimumSize; off < originalIPHeadersLength; off += (int(fragmentIPHeaders[off+1]) + 1) * 8 {
+		nextHeaderOffset = off
+	}
+	fragmentIPHeaders[nextHeaderOffset] = nextHeader
 	fragmentIPHeaders.SetPayloadLength(uint16(copied + fragmentIPHeadersLength - header.IPv6MinimumSize))
 
 	return fragPkt, more
@@ -17,18 +17,30 @@
 package ports
 
 import (
+	"encoding/binary"
 	"math"
 	"math/rand"
+	"sort"
 	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/hash/jenkins"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/hash"
 )
 
 const (
 	firstEphemeral               = 16000
 	anyIPAddress   tcpip.Address = ""
+
+	// MaxRandomizedBits is the number of bits in a port number. Randomizing
+	// this many bits picks each ephemeral port uniformly at random.
+	MaxRandomizedBits = 16
+
+	// perturbationTableSize is the number of counters in the table of the
+	// double-hash port selection algorithm (RFC 6056 section 3.3.4).
+	perturbationTableSize = 256
 )
 
 // Reservation describes a port reservation.
@@ -221,10 +233,31 @@ type PortManager struct {
 	// be reused.
 	allocatedPorts map[portDescriptor]addrToDevice
 
-	// ephemeralMu protects firstEphemeral and numEphemeral.
+	// ephemeralMu protects firstEphemeral, numEphemeral, randomizedBits and
+	// reservedEphemeral.
 	ephemeralMu    sync.RWMutex
 	firstEphemeral uint16
 	numEphemeral   uint16
+	// reservedEphemeral holds the ports that are never picked as ephemeral
+	// ports. It is replaced, never modified, so it may be read after
+	// ephemeralMu is released.
+	reservedEphemeral map[uint16]struct{}
+	// randomizedBits is the number of high bits of the ephemeral port offset
+	// picked at random by PickEphemeralPort. The remaining low bits come from
+	// the double-hash algorithm.
+	randomizedBits int
+
+	// offsetSecret and indexSecret key the two hashes of the double-hash
+	// port selection algorithm.
+	offsetSecret uint32
+	indexSecret  uint32
+
+	// perturbation holds the sequential component of ports picked when fewer
+	// than MaxRandomizedBits bits are randomized, indexed by a hash of the
+	// flow the port is picked for.
+	//
+	// Elements must be accessed using atomic operations.
+	perturbation [perturbationTableSize]uint32
 
 	// hint is used to pick ports ephemeral ports in a stable order for
 	// a given port offset.
@@ -236,10 +269,14 @@ type PortManager struct {
 
 // NewPortManager creates new PortManager.
 func NewPortManager() *PortManager {
+	secrets := hash.RandN32(2)
 	return &PortManager{
 		allocatedPorts: make(map[portDescriptor]addrToDevice),
 		firstEphemeral: firstEphemeral,
 		numEphemeral:   math.MaxUint16 - firstEphemeral + 1,
+		randomizedBits: MaxRandomizedBits,
+		offsetSecret:   secrets[0],
+		indexSecret:    secrets[1],
 	}
 }
 
@@ -253,15 +290,60 @@ type PortTester func(port uint16) (good bool, err tcpip.Error)
 // is suitable for its needs, and stopping when a port is found or an error
 // occurs.
 func (pm *PortManager) PickEphemeralPort(rng *rand.Rand, testPort PortTester) (port uint16, err tcpip.Error) {
+	return pm.pickFlowEphemeralPort(rng, anyIPAddress, tcpip.FullAddress{}, testPort)
+}
+
+// pickFlowEphemeralPort is like PickEphemeralPort, but the ports it picks
+// depend on the local address and the remote address and port of the flow the
+// port is for.
+func (pm *PortManager) pickFlowEphemeralPort(rng *rand.Rand, local tcpip.Address, remote tcpip.FullAddress, testPort PortTester) (port uint16, err tcpip.Error) {
 	pm.ephemeralMu.RLock()
 	firstEphemeral := pm.firstEphemeral
 	numEphemeral := pm.numEphemeral
+	randomizedBits := pm.randomizedBits
+	testPort = skipReserved(pm.reservedEphemeral, testPort)
 	pm.ephemeralMu.RUnlock()
 
-	offset := uint32(rng.Int31n(int32(numEphemeral)))
+	if randomizedBits >= MaxRandomizedBits {
+		offset := uint32(rng.Int31n(int32(numEphemeral)))
+		return pickEphemeralPort(offset, firstEphemeral, numEphemeral, testPort)
+	}
+
+	// Use the double-hash algorithm of RFC 6056 section 3.3.4: a per-flow
+	// offset plus a counter from a table indexed by a second hash of the
+	// flow, so successive ports of a flow are sequential while the sequences
+	// of different flows are unrelated. The high bits are then randomized.
+	offset := flowHash(pm.offsetSecret, local, remote)
+	idx := flowHash(pm.indexSecret, local, remote) % perturbationTableSize
+	offset += atomic.AddUint32(&pm.perturbation[idx], 1) - 1
+	if randomizedBits > 0 {
+		offset += uint32(rng.Int31n(1<<randomizedBits)) << (MaxRandomizedBits - randomizedBits)
+	}
 	return pickEphemeralPort(offset, firstEphemeral, numEphemeral, testPort)
 }
 
+// flowHash returns a hash of the local address and the remote address and
+// port of a flow, keyed by secret.
+func flowHash(secret uint32, local tcpip.Address, remote tcpip.FullAddress) uint32 {
+	var portBuf [2]byte
+	binary.LittleEndian.PutUint16(portBuf[:], remote.Port)
+
+	h := jenkins.Sum32(secret)
+	for _, s := range [][]byte{
+		[]byte(local),
+		[]byte(remote.Addr),
+		portBuf[:],
+	} {
+		// Per io.Writer.Write:
+		//
+		// Write must return a non-nil error if it returns n < len(p).
+		if _, err := h.Write(s); err != nil {
+			panic(err)
+		}
+	}
+	return h.Sum32()
+}
+
 // portHint atomically reads and returns the pm.hint value.
 func (pm *PortManager) portHint() uint32 {
 	return atomic.LoadUint32(&pm.hint)
@@ -280,6 +362,7 @@ func (pm *PortManager) PickEphemeralPortStable(offset uint32, testPort PortTeste
 	pm.ephemeralMu.RLock()
 	firstEphemeral := pm.firstEphemeral
 	numEphemeral := pm.numEphemeral
+	testPort = skipReserved(pm.reservedEphemeral, testPort)
 	pm.ephemeralMu.RUnlock()
 
 	p, err := pickEphemeralPort(pm.portHint()+offset, firstEphemeral, numEphemeral, testPort)
@@ -289,6 +372,20 @@ func (pm *PortManager) PickEphemeralPortStable(offset uint32, testPort PortTeste
 	return p, err
 }
 
+// skipReserved returns a PortTester that rejects the reserved ports and defers
+// to testPort for all others.
+func skipReserved(reserved map[uint16]struct{}, testPort PortTester) PortTester {
+	if len(reserved) == 0 {
+		return testPort
+	}
+	return func(port uint16) (bool, tcpip.Error) {
+		if _, ok := reserved[port]; ok {
+			return false, nil
+		}
+		return testPort(port)
+	}
+}
+
 // pickEphemeralPort starts at the offset specified from the FirstEphemeral port
 // and iterates over the number of ports specified by count and allows the
 // caller to decide whether a given port is suitable for its needs, and stopping
@@ -342,7 +439,7 @@ func (pm *PortManager) ReservePort(rng *rand.Rand, res Reservation, testPort Por
 	}
 
 	// A port wasn't specified, so try to find one.
-	return pm.PickEphemeralPort(rng, func(p uint16) (bool, tcpip.Error) {
+	return pm.pickFlowEphemeralPort(rng, res.Addr, res.Dest, func(p uint16) (bool, tcpip.Error) {
 		res.Port = p
 		if !pm.reserveSpecificPortLocked(res, false /* portSpecified */) {
 			return false, nil
@@ -504,6 +601,89 @@ func (pm *PortManager) releasePortLocked(res Reservation) {
 	}
 }
 
+// PortReservation describes a group of identical port reservations, as
+// reported by Dump.
+type PortReservation struct {
+	// Network is the network protocol the reservation applies to.
+	Network tcpip.NetworkProtocolNumber
+
+	// Addr is the reserved local address. It is empty for the "any" address.
+	Addr tcpip.Address
+
+	// Port is the reserved local port.
+	Port uint16
+
+	// Flags are the port reuse flags of the reservation.
+	Flags Flags
+
+	// BindToDevice is the NIC the reservation is restricted to, or zero if it
+	// applies to all NICs.
+	BindToDevice tcpip.NICID
+
+	// Dest is the destination of a connected reservation. It is empty for
+	// reservations made by unconnected endpoints.
+	Dest tcpip.FullAddress
+
+	// Refs is the number of endpoints holding this reservation.
+	Refs int
+}
+
+// Dump returns the port reservations held for the given transport protocol,
+// ordered by network protocol, port, address, device and destination. It is
+// intended for diagnosing unexpected port conflicts.
+func (pm *PortManager) Dump(transport tcpip.TransportProtocolNumber) []PortReservation {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var rs []PortReservation
+	for desc, addrs := range pm.allocatedPorts {
+		if desc.transport != transport {
+			continue
+		}
+		for addr, devices := range addrs {
+			for nic, dests := range devices {
+				for dest, counter := range dests {
+					for flags, refs := range counter.refs {
+						if refs == 0 {
+							continue
+						}
+						rs = append(rs, PortReservation{
+							Network:      desc.network,
+							Addr:         addr,
+							Port:         desc.port,
+							Flags:        BitFlags(flags).ToFlags(),
+							BindToDevice: nic,
+							Dest:         tcpip.FullAddress{Addr: dest.addr, Port: dest.port},
+							Refs:         refs,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		a, b := rs[i], rs[j]
+		switch {
+		case a.Network != b.Network:
+			return a.Network < b.Network
+		case a.Port != b.Port:
+			return a.Port < b.Port
+		case a.Addr != b.Addr:
+			return a.Addr < b.Addr
+		case a.BindToDevice != b.BindToDevice:
+			return a.BindToDevice < b.BindToDevice
+		case a.Dest.Addr != b.Dest.Addr:
+			return a.Dest.Addr < b.Dest.Addr
+		case a.Dest.Port != b.Dest.Port:
+			return a.Dest.Port < b.Dest.Port
+		default:
+			return a.Flags.Bits() < b.Flags.Bits()
+		}
+	})
+	return rs
+}
+
 // PortRange returns the UDP and TCP inclusive range of ephemeral ports used in
 // both IPv4 and IPv6.
 func (pm *PortManager) PortRange() (uint16, uint16) {
@@ -512,6 +692,59 @@ func (pm *PortManager) PortRange() (uint16, uint16) {
 	return pm.firstEphemeral, pm.firstEphemeral + pm.numEphemeral - 1
 }
 
+// SetRandomizedBits sets the number of high bits of ephemeral ports that are
+// picked at random, with the remaining bits allocated sequentially. Zero makes
+// ephemeral port allocation fully sequential and MaxRandomizedBits makes it
+// fully random.
+func (pm *PortManager) SetRandomizedBits(bits int) tcpip.Error {
+	if bits < 0 || bits > MaxRandomizedBits {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	pm.ephemeralMu.Lock()
+	defer pm.ephemeralMu.Unlock()
+	pm.randomizedBits = bits
+	return nil
+}
+
+// RandomizedBits returns the number of high bits of ephemeral ports that are
+// picked at random.
+func (pm *PortManager) RandomizedBits() int {
+	pm.ephemeralMu.RLock()
+	defer pm.ephemeralMu.RUnlock()
+	return pm.randomizedBits
+}
+
+// SetReservedEphemeralPorts sets the ports that are never picked as UDP and TCP
+// ephemeral ports, replacing any previously set. The ports may still be
+// bound explicitly.
+func (pm *PortManager) SetReservedEphemeralPorts(ports []uint16) {
+	var reserved map[uint16]struct{}
+	if len(ports) != 0 {
+		reserved = make(map[uint16]struct{}, len(ports))
+		for _, p := range ports {
+			reserved[p] = struct{}{}
+		}
+	}
+	pm.ephemeralMu.Lock()
+	defer pm.ephemeralMu.Unlock()
+	pm.reservedEphemeral = reserved
+}
+
+// ReservedEphemeralPorts returns the ports that are never picked as ephemeral
+// ports, in ascending order.
+func (pm *PortManager) ReservedEphemeralPorts() []uint16 {
+	pm.ephemeralMu.RLock()
+	reserved := pm.reservedEphemeral
+	pm.ephemeralMu.RUnlock()
+
+	ports := make([]uint16, 0, len(reserved))
+	for p := range reserved {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
 // SetPortRange sets the UDP and TCP IPv4 and IPv6 ephemeral port range
 // (inclusive).
 func (pm *PortManager) SetPortRange(start uint16, end uint16) tcpip.Error {
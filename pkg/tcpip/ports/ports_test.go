@@ -17,6 +17,7 @@ package ports
 import (
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -523,3 +524,43 @@ func TestOverflow(t *testing.T) {
 		}
 	}
 }
+
+func TestPickEphemeralPortSequentialConcurrent(t *testing.T) {
+	const numPicks = 100
+
+	pm := NewPortManager()
+	if err := pm.SetRandomizedBits(0); err != nil {
+		t.Fatalf("pm.SetRandomizedBits(0): %s", err)
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Every pick accepts the first port it tests, so concurrent picks for the
+	// same flow must each be handed a distinct position in the sequence.
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		ports = make(map[uint16]struct{})
+	)
+	for i := 0; i < numPicks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// rng is unused when no bits are randomized.
+			port, err := pm.PickEphemeralPort(rng, func(uint16) (bool, tcpip.Error) {
+				return true, nil
+			})
+			if err != nil {
+				t.Errorf("PickEphemeralPort(..) failed: %s", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ports[port] = struct{}{}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(ports); got != numPicks {
+		t.Errorf("got %d distinct ports, want = %d", got, numPicks)
+	}
+}
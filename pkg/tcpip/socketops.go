@@ -16,6 +16,7 @@ package tcpip
 
 import (
 	"sync/atomic"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/atomicbitops"
 	"gvisor.dev/gvisor/pkg/sync"
@@ -41,6 +42,10 @@ type SocketOptionsHandler interface {
 	// OnCorkOptionSet is invoked when TCP_CORK is set for an endpoint.
 	OnCorkOptionSet(v bool)
 
+	// OnIncomingCPUSet is invoked when SO_INCOMING_CPU is set for an
+	// endpoint.
+	OnIncomingCPUSet(v int)
+
 	// LastError is invoked when SO_ERROR is read for an endpoint.
 	LastError() Error
 
@@ -85,6 +90,9 @@ func (*DefaultSocketOptionsHandler) OnDelayOptionSet(bool) {}
 // OnCorkOptionSet implements SocketOptionsHandler.OnCorkOptionSet.
 func (*DefaultSocketOptionsHandler) OnCorkOptionSet(bool) {}
 
+// OnIncomingCPUSet implements SocketOptionsHandler.OnIncomingCPUSet.
+func (*DefaultSocketOptionsHandler) OnIncomingCPUSet(int) {}
+
 // LastError implements SocketOptionsHandler.LastError.
 func (*DefaultSocketOptionsHandler) LastError() Error {
 	return nil
@@ -170,6 +178,11 @@ type SocketOptions struct {
 	// message is passed with incoming packets.
 	receiveTClassEnabled uint32
 
+	// receiveIPv6InfoEnabled is used to specify if the traffic class and flow
+	// label of incoming IPv6 packets are reported together in control
+	// messages.
+	receiveIPv6InfoEnabled uint32
+
 	// receivePacketInfoEnabled is used to specify if more information is
 	// provided with incoming IPv4 packets.
 	receivePacketInfoEnabled uint32
@@ -204,17 +217,69 @@ type SocketOptions struct {
 	// the incoming packet should be returned as an ancillary message.
 	receiveOriginalDstAddress uint32
 
+	// receiveIPIDEnabled is used to specify if the IPv4 identification field of
+	// incoming packets is passed as an ancillary message.
+	receiveIPIDEnabled uint32
+
+	// receiveDestinationTypeEnabled is used to specify if incoming packets
+	// report whether they were sent to a broadcast or multicast address.
+	receiveDestinationTypeEnabled uint32
+
 	// recvErrEnabled determines whether extended reliable error message passing
 	// is enabled.
 	recvErrEnabled uint32
 
+	// txTimestampEnabled is used to specify if the transmit time of each
+	// outgoing datagram is reported through the error queue.
+	txTimestampEnabled uint32
+
+	// udpGROEnabled is used to specify if consecutive equal-sized datagrams
+	// from the same flow may be returned by a single read.
+	udpGROEnabled uint32
+
+	// receiveLinkPriorityEnabled is used to specify if the link-layer priority
+	// of incoming packets is reported in control messages.
+	receiveLinkPriorityEnabled uint32
+
+	// receiveLinkSourceEnabled is used to specify if the link-layer source
+	// address of incoming packets is reported in control messages.
+	receiveLinkSourceEnabled uint32
+
+	// receiveWasFragmentedEnabled is used to specify if control messages
+	// report whether incoming packets were reassembled from IP fragments.
+	receiveWasFragmentedEnabled uint32
+
+	// receiveInterfaceIndexEnabled is used to specify if the index of the
+	// interface incoming packets arrived on is reported in control messages.
+	receiveInterfaceIndexEnabled uint32
+
 	// errQueue is the per-socket error queue. It is protected by errQueueMu.
 	errQueueMu sync.Mutex `state:"nosave"`
 	errQueue   sockErrorList
 
+	// errQueueLen is the number of errors in errQueue. It is protected by
+	// errQueueMu.
+	errQueueLen int
+
+	// errQueueLimit is the maximum number of errors held in errQueue, or zero
+	// if DefaultErrorQueueLimit applies. It is protected by errQueueMu.
+	errQueueLimit int
+
+	// errQueueDropped is the number of errors dropped from errQueue because
+	// it was full. It is accessed atomically.
+	errQueueDropped uint64
+
 	// bindToDevice determines the device to which the socket is bound.
 	bindToDevice int32
 
+	// incomingCPU is the receive steering hint set with SO_INCOMING_CPU, or -1
+	// if no hint is set.
+	incomingCPU int32
+
+	// useMinMTU holds the value of the IPV6_USE_MIN_MTU option. It is one of
+	// UseMinMTUMulticast, UseMinMTUNever or UseMinMTUAlways.
+	useMinMTU int32
+
 	// getSendBufferLimits provides the handler to get the min, default and
 	// max size for send buffer. It  is initialized at the creation time and
 	// will not change.
@@ -246,6 +311,8 @@ func (so *SocketOptions) InitHandler(handler SocketOptionsHandler, stack StackHa
 	so.stackHandler = stack
 	so.getSendBufferLimits = getSendBufferLimits
 	so.getReceiveBufferLimits = getReceiveBufferLimits
+	atomic.StoreInt32(&so.incomingCPU, -1)
+	atomic.StoreInt32(&so.useMinMTU, UseMinMTUMulticast)
 }
 
 func storeAtomicBool(addr *uint32, v bool) {
@@ -354,6 +421,18 @@ func (so *SocketOptions) SetReceiveTClass(v bool) {
 	storeAtomicBool(&so.receiveTClassEnabled, v)
 }
 
+// GetReceiveIPv6Info gets value for the option reporting the traffic class
+// and flow label of incoming IPv6 packets.
+func (so *SocketOptions) GetReceiveIPv6Info() bool {
+	return atomic.LoadUint32(&so.receiveIPv6InfoEnabled) != 0
+}
+
+// SetReceiveIPv6Info sets value for the option reporting the traffic class
+// and flow label of incoming IPv6 packets.
+func (so *SocketOptions) SetReceiveIPv6Info(v bool) {
+	storeAtomicBool(&so.receiveIPv6InfoEnabled, v)
+}
+
 // GetReceivePacketInfo gets value for IP_PKTINFO option.
 func (so *SocketOptions) GetReceivePacketInfo() bool {
 	return atomic.LoadUint32(&so.receivePacketInfoEnabled) != 0
@@ -438,11 +517,103 @@ func (so *SocketOptions) SetReceiveOriginalDstAddress(v bool) {
 	storeAtomicBool(&so.receiveOriginalDstAddress, v)
 }
 
+// GetReceiveIPID gets value for the receive IP ID option.
+func (so *SocketOptions) GetReceiveIPID() bool {
+	return atomic.LoadUint32(&so.receiveIPIDEnabled) != 0
+}
+
+// SetReceiveIPID sets value for the receive IP ID option.
+func (so *SocketOptions) SetReceiveIPID(v bool) {
+	storeAtomicBool(&so.receiveIPIDEnabled, v)
+}
+
+// GetReceiveDestinationType gets value for the receive destination type
+// option.
+func (so *SocketOptions) GetReceiveDestinationType() bool {
+	return atomic.LoadUint32(&so.receiveDestinationTypeEnabled) != 0
+}
+
+// SetReceiveDestinationType sets value for the receive destination type
+// option.
+func (so *SocketOptions) SetReceiveDestinationType(v bool) {
+	storeAtomicBool(&so.receiveDestinationTypeEnabled, v)
+}
+
 // GetRecvError gets value for IP*_RECVERR option.
 func (so *SocketOptions) GetRecvError() bool {
 	return atomic.LoadUint32(&so.recvErrEnabled) != 0
 }
 
+// GetTxTimestamp gets value for the SO_TIMESTAMPING transmit software
+// timestamp option.
+func (so *SocketOptions) GetTxTimestamp() bool {
+	return atomic.LoadUint32(&so.txTimestampEnabled) != 0
+}
+
+// SetTxTimestamp sets value for the SO_TIMESTAMPING transmit software
+// timestamp option.
+func (so *SocketOptions) SetTxTimestamp(v bool) {
+	storeAtomicBool(&so.txTimestampEnabled, v)
+}
+
+// GetUDPGRO gets value for UDP_GRO option.
+func (so *SocketOptions) GetUDPGRO() bool {
+	return atomic.LoadUint32(&so.udpGROEnabled) != 0
+}
+
+// SetUDPGRO sets value for UDP_GRO option.
+func (so *SocketOptions) SetUDPGRO(v bool) {
+	storeAtomicBool(&so.udpGROEnabled, v)
+}
+
+// GetReceiveLinkPriority gets value for the option reporting the link-layer
+// priority of incoming packets.
+func (so *SocketOptions) GetReceiveLinkPriority() bool {
+	return atomic.LoadUint32(&so.receiveLinkPriorityEnabled) != 0
+}
+
+// SetReceiveLinkPriority sets value for the option reporting the link-layer
+// priority of incoming packets.
+func (so *SocketOptions) SetReceiveLinkPriority(v bool) {
+	storeAtomicBool(&so.receiveLinkPriorityEnabled, v)
+}
+
+// GetReceiveLinkSource gets value for the option reporting the link-layer
+// source address of incoming packets.
+func (so *SocketOptions) GetReceiveLinkSource() bool {
+	return atomic.LoadUint32(&so.receiveLinkSourceEnabled) != 0
+}
+
+// SetReceiveLinkSource sets value for the option reporting the link-layer
+// source address of incoming packets.
+func (so *SocketOptions) SetReceiveLinkSource(v bool) {
+	storeAtomicBool(&so.receiveLinkSourceEnabled, v)
+}
+
+// GetReceiveWasFragmented gets value for the option reporting whether
+// incoming packets were reassembled from IP fragments.
+func (so *SocketOptions) GetReceiveWasFragmented() bool {
+	return atomic.LoadUint32(&so.receiveWasFragmentedEnabled) != 0
+}
+
+// SetReceiveWasFragmented sets value for the option reporting whether
+// incoming packets were reassembled from IP fragments.
+func (so *SocketOptions) SetReceiveWasFragmented(v bool) {
+	storeAtomicBool(&so.receiveWasFragmentedEnabled, v)
+}
+
+// GetReceiveInterfaceIndex gets value for the option reporting the index of
+// the interface incoming packets arrived on.
+func (so *SocketOptions) GetReceiveInterfaceIndex() bool {
+	return atomic.LoadUint32(&so.receiveInterfaceIndexEnabled) != 0
+}
+
+// SetReceiveInterfaceIndex sets value for the option reporting the index of
+// the interface incoming packets arrived on.
+func (so *SocketOptions) SetReceiveInterfaceIndex(v bool) {
+	storeAtomicBool(&so.receiveInterfaceIndexEnabled, v)
+}
+
 // SetRecvError sets value for IP*_RECVERR option.
 func (so *SocketOptions) SetRecvError(v bool) {
 	storeAtomicBool(&so.recvErrEnabled, v)
@@ -495,6 +666,9 @@ const (
 
 	// SockExtErrorOriginICMP6 indicates an IPv6 ICMP error.
 	SockExtErrorOriginICMP6
+
+	// SockExtErrorOriginTimestamping indicates a transmit timestamp report.
+	SockExtErrorOriginTimestamping
 )
 
 // IsICMPErr indicates if the error originated from an ICMP error.
@@ -544,6 +718,35 @@ func (l *LocalSockError) Info() uint32 {
 	return l.info
 }
 
+// TimestampingSockError is the cause of an error queue entry reporting the
+// transmit timestamp of a datagram.
+//
+// +stateify savable
+type TimestampingSockError struct{}
+
+// Origin implements SockErrorCause.
+func (*TimestampingSockError) Origin() SockErrOrigin {
+	return SockExtErrorOriginTimestamping
+}
+
+// Type implements SockErrorCause.
+func (*TimestampingSockError) Type() uint8 {
+	return 0
+}
+
+// Code implements SockErrorCause.
+func (*TimestampingSockError) Code() uint8 {
+	return 0
+}
+
+// Info implements SockErrorCause.
+//
+// Transmit timestamps are always taken when the datagram is handed to the
+// network layer, which Linux reports as SCM_TSTAMP_SND (0).
+func (*TimestampingSockError) Info() uint32 {
+	return 0
+}
+
 // SockError represents a queue entry in the per-socket error queue.
 //
 // +stateify savable
@@ -563,15 +766,85 @@ type SockError struct {
 	Offender FullAddress
 	// NetProto is the network protocol being used to transmit the packet.
 	NetProto NetworkProtocolNumber
+	// Timestamp is the time the packet was transmitted. It is only set for
+	// entries whose cause is a TimestampingSockError.
+	Timestamp time.Time `state:".(int64)"`
+	// Soft is true if the error is transient and did not fail the socket,
+	// e.g. an ICMP Destination Host Unreachable on a connected UDP socket.
+	// Soft errors are only reported through the error queue.
+	Soft bool
 }
 
+// DefaultErrorQueueLimit is the default maximum number of errors held in a
+// socket's error queue.
+//
+// Linux bounds the error queue by the socket's receive buffer rather than by
+// a count; this is roughly the number of small ICMP errors that fit in its
+// default receive buffer.
+const DefaultErrorQueueLimit = 256
+
 // pruneErrQueue resets the queue.
 func (so *SocketOptions) pruneErrQueue() {
 	so.errQueueMu.Lock()
 	so.errQueue.Reset()
+	so.errQueueLen = 0
 	so.errQueueMu.Unlock()
 }
 
+// GetErrorQueueLimit gets the maximum number of errors held in the error
+// queue.
+func (so *SocketOptions) GetErrorQueueLimit() int {
+	so.errQueueMu.Lock()
+	defer so.errQueueMu.Unlock()
+	return so.errQueueLimitLocked()
+}
+
+// errQueueLimitLocked returns the maximum number of errors held in the error
+// queue.
+//
+// Precondition: so.errQueueMu must be held.
+func (so *SocketOptions) errQueueLimitLocked() int {
+	if so.errQueueLimit == 0 {
+		return DefaultErrorQueueLimit
+	}
+	return so.errQueueLimit
+}
+
+// SetErrorQueueLimit sets the maximum number of errors held in the error
+// queue. Once the queue is full, the oldest error is dropped to make room for
+// a new one. Values less than 1 are treated as 1.
+//
+// If the queue holds more than n errors, the oldest errors are dropped
+// immediately.
+func (so *SocketOptions) SetErrorQueueLimit(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	so.errQueueMu.Lock()
+	defer so.errQueueMu.Unlock()
+	so.errQueueLimit = n
+	for so.errQueueLen > n {
+		so.dropOldestErrLocked()
+	}
+}
+
+// ErrorQueueDropped returns the number of errors dropped from the error queue
+// because it was full.
+func (so *SocketOptions) ErrorQueueDropped() uint64 {
+	return atomic.LoadUint64(&so.errQueueDropped)
+}
+
+// dropOldestErrLocked removes the error at the front of the error queue and
+// counts it as dropped.
+//
+// Precondition: so.errQueueMu must be held and the queue must not be empty.
+func (so *SocketOptions) dropOldestErrLocked() {
+	so.errQueue.Remove(so.errQueue.Front())
+	so.errQueueLen--
+	atomic.AddUint64(&so.errQueueDropped, 1)
+}
+
 // DequeueErr dequeues a socket extended error from the error queue and returns
 // it. Returns nil if queue is empty.
 func (so *SocketOptions) DequeueErr() *SockError {
@@ -581,6 +854,28 @@ func (so *SocketOptions) DequeueErr() *SockError {
 	err := so.errQueue.Front()
 	if err != nil {
 		so.errQueue.Remove(err)
+		so.errQueueLen--
+	}
+	return err
+}
+
+// DequeueErrAndUpdateLastError dequeues a socket extended error from the error
+// queue like DequeueErr, and updates the last error to reflect the ICMP errors
+// left in the queue. Soft errors are only reported through the error queue, so
+// they never become the last error.
+//
+// This is analogous to net/core/skbuff.c:sock_dequeue_err_skb().
+func (so *SocketOptions) DequeueErrAndUpdateLastError() *SockError {
+	err := so.DequeueErr()
+	if err == nil {
+		return nil
+	}
+
+	// Update socket error to reflect ICMP errors in queue.
+	if nextErr := so.PeekErr(); nextErr != nil && nextErr.Cause.Origin().IsICMPErr() && !nextErr.Soft {
+		so.SetLastError(nextErr.Err)
+	} else if err.Cause.Origin().IsICMPErr() && !err.Soft {
+		so.SetLastError(nil)
 	}
 	return err
 }
@@ -593,13 +888,18 @@ func (so *SocketOptions) PeekErr() *SockError {
 	return so.errQueue.Front()
 }
 
-// QueueErr inserts the error at the back of the error queue.
+// QueueErr inserts the error at the back of the error queue. If the queue is
+// full, the oldest error is dropped.
 //
 // Preconditions: so.GetRecvError() == true.
 func (so *SocketOptions) QueueErr(err *SockError) {
 	so.errQueueMu.Lock()
 	defer so.errQueueMu.Unlock()
+	for so.errQueueLen >= so.errQueueLimitLocked() {
+		so.dropOldestErrLocked()
+	}
 	so.errQueue.PushBack(err)
+	so.errQueueLen++
 }
 
 // QueueLocalErr queues a local error onto the local queue.
@@ -629,6 +929,70 @@ func (so *SocketOptions) SetBindToDevice(bindToDevice int32) Error {
 	return nil
 }
 
+// GetBindToNIC gets value for SO_BINDTOIFINDEX option. It shares its value
+// with SO_BINDTODEVICE.
+func (so *SocketOptions) GetBindToNIC() NICID {
+	return NICID(so.GetBindToDevice())
+}
+
+// SetBindToNIC sets value for SO_BINDTOIFINDEX option, binding the socket to
+// the NIC with the given ID. If nicID is zero, the socket device binding is
+// removed.
+func (so *SocketOptions) SetBindToNIC(nicID NICID) Error {
+	return so.SetBindToDevice(int32(nicID))
+}
+
+// GetIncomingCPU gets value for SO_INCOMING_CPU option.
+func (so *SocketOptions) GetIncomingCPU() int {
+	return int(atomic.LoadInt32(&so.incomingCPU))
+}
+
+// SetIncomingCPU sets value for SO_INCOMING_CPU option. Among endpoints
+// sharing a port, packets whose receive steering bucket matches cpu are
+// delivered to this endpoint. A value of -1 removes the hint.
+//
+// Buckets are numbered from 0 up to the number of endpoints in the group, so
+// a hint outside that range matches no packets until the group grows large
+// enough.
+func (so *SocketOptions) SetIncomingCPU(cpu int) {
+	atomic.StoreInt32(&so.incomingCPU, int32(cpu))
+	so.handler.OnIncomingCPUSet(cpu)
+}
+
+const (
+	// UseMinMTUMulticast is a setting of the IPV6_USE_MIN_MTU option to only
+	// limit outgoing multicast packets to the IPv6 minimum MTU. This is the
+	// default.
+	UseMinMTUMulticast = -1
+
+	// UseMinMTUNever is a setting of the IPV6_USE_MIN_MTU option to never limit
+	// outgoing packets to the IPv6 minimum MTU.
+	UseMinMTUNever = 0
+
+	// UseMinMTUAlways is a setting of the IPV6_USE_MIN_MTU option to limit all
+	// outgoing packets to the IPv6 minimum MTU.
+	UseMinMTUAlways = 1
+)
+
+// GetUseMinMTU gets value for IPV6_USE_MIN_MTU option.
+func (so *SocketOptions) GetUseMinMTU() int {
+	return int(atomic.LoadInt32(&so.useMinMTU))
+}
+
+// SetUseMinMTU sets value for IPV6_USE_MIN_MTU option. When enabled, outgoing
+// IPv6 packets are fragmented to fit in the IPv6 minimum MTU regardless of the
+// MTU of the outgoing link.
+func (so *SocketOptions) SetUseMinMTU(v int) Error {
+	switch v {
+	case UseMinMTUMulticast, UseMinMTUNever, UseMinMTUAlways:
+	default:
+		return &ErrInvalidOptionValue{}
+	}
+
+	atomic.StoreInt32(&so.useMinMTU, int32(v))
+	return nil
+}
+
 // GetSendBufferSize gets value for SO_SNDBUF option.
 func (so *SocketOptions) GetSendBufferSize() int64 {
 	return so.sendBufferSize.Load()
@@ -0,0 +1,96 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ClassifyInbound reports how the stack categorizes the raw network-layer
+// packet b: the network protocol it is parsed as, the transport protocol it
+// carries and whether the headers are well formed. A zero protocol number is
+// returned when the respective header could not be identified.
+//
+// Only headers are validated; checksums are not verified. Transport headers
+// are only validated for UDP, and not at all for non-initial fragments.
+//
+// It is intended for conformance tests that feed arbitrary bytes to the stack.
+func ClassifyInbound(b []byte) (tcpip.NetworkProtocolNumber, tcpip.TransportProtocolNumber, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		h := header.IPv4(b)
+		if !h.IsValid(len(b)) {
+			return header.IPv4ProtocolNumber, 0, false
+		}
+		transProto := h.TransportProtocol()
+		if h.FragmentOffset() != 0 {
+			return header.IPv4ProtocolNumber, transProto, true
+		}
+		return header.IPv4ProtocolNumber, transProto, isValidTransportHeader(transProto, b[h.HeaderLength():h.TotalLength()])
+
+	case header.IPv6Version:
+		h := header.IPv6(b)
+		if !h.IsValid(len(b)) {
+			return header.IPv6ProtocolNumber, 0, false
+		}
+		payload := buffer.View(b[header.IPv6MinimumSize:][:h.PayloadLength()])
+		it := header.MakeIPv6PayloadIterator(header.IPv6ExtensionHeaderIdentifier(h.NextHeader()), payload.ToVectorisedView())
+		fragmented := false
+		for {
+			extHdr, done, err := it.Next()
+			if err != nil {
+				return header.IPv6ProtocolNumber, 0, false
+			}
+			if done {
+				// There is no upper-layer header (e.g. No Next Header).
+				return header.IPv6ProtocolNumber, 0, true
+			}
+			switch extHdr := extHdr.(type) {
+			case header.IPv6FragmentExtHdr:
+				fragmented = fragmented || extHdr.FragmentOffset() != 0
+			case header.IPv6RawPayloadHeader:
+				transProto := tcpip.TransportProtocolNumber(extHdr.Identifier)
+				if fragmented {
+					return header.IPv6ProtocolNumber, transProto, true
+				}
+				return header.IPv6ProtocolNumber, transProto, isValidTransportHeader(transProto, extHdr.Buf.ToView())
+			}
+		}
+
+	default:
+		return 0, 0, false
+	}
+}
+
+// isValidTransportHeader performs basic validation of the transport header at
+// the start of payload. Only UDP is validated.
+func isValidTransportHeader(transProto tcpip.TransportProtocolNumber, payload []byte) bool {
+	switch transProto {
+	case header.UDPProtocolNumber:
+		if len(payload) < header.UDPMinimumSize {
+			return false
+		}
+		length := int(header.UDP(payload).Length())
+		return length >= header.UDPMinimumSize && length <= len(payload)
+	default:
+		return true
+	}
+}
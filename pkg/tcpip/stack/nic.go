@@ -72,6 +72,10 @@ type nic struct {
 		sync.RWMutex
 		spoofing    bool
 		promiscuous bool
+		// multicastTTL is the default TTL of multicast packets sent through
+		// this NIC, if multicastTTLSet is true.
+		multicastTTL    uint8
+		multicastTTLSet bool
 	}
 
 	packetEPs struct {
@@ -82,6 +86,16 @@ type nic struct {
 		// +checklocks:mu
 		eps map[tcpip.NetworkProtocolNumber]*packetEndpointList
 	}
+
+	writableWaiters struct {
+		mu sync.Mutex
+
+		// fns are called once, the next time the link endpoint reports that
+		// it can accept outbound packets again.
+		//
+		// +checklocks:mu
+		fns []func()
+	}
 }
 
 // makeNICStats initializes the NIC statistics and associates them to the global
@@ -378,6 +392,7 @@ func (n *nic) writePacket(r RouteInfo, protocol tcpip.NetworkProtocolNumber, pkt
 	pkt.EgressRoute = r
 	pkt.NetworkProtocolNumber = protocol
 	n.deliverOutboundPacket(r.RemoteLinkAddress, pkt)
+	n.stack.udpConntrack.track(pkt)
 
 	if err := n.LinkEndpoint.WritePacket(r, protocol, pkt); err != nil {
 		return err
@@ -398,6 +413,7 @@ func (n *nic) writePackets(r RouteInfo, protocol tcpip.NetworkProtocolNumber, pk
 		pkt.EgressRoute = r
 		pkt.NetworkProtocolNumber = protocol
 		n.deliverOutboundPacket(r.RemoteLinkAddress, pkt)
+		n.stack.udpConntrack.track(pkt)
 	}
 
 	writtenPackets, err := n.LinkEndpoint.WritePackets(r, pkts, protocol)
@@ -411,6 +427,23 @@ func (n *nic) writePackets(r RouteInfo, protocol tcpip.NetworkProtocolNumber, pk
 	return writtenPackets, err
 }
 
+// setMulticastTTL sets the default TTL of multicast packets sent through
+// this NIC.
+func (n *nic) setMulticastTTL(ttl uint8) {
+	n.mu.Lock()
+	n.mu.multicastTTL = ttl
+	n.mu.multicastTTLSet = true
+	n.mu.Unlock()
+}
+
+// getMulticastTTL returns the default TTL of multicast packets sent through
+// this NIC and whether one was set.
+func (n *nic) getMulticastTTL() (uint8, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.mu.multicastTTL, n.mu.multicastTTLSet
+}
+
 // setSpoofing enables or disables address spoofing.
 func (n *nic) setSpoofing(enable bool) {
 	n.mu.Lock()
@@ -707,6 +740,33 @@ func (n *nic) isInGroup(addr tcpip.Address) bool {
 	return false
 }
 
+// notifyWhenWritable registers f to be called once the link endpoint can
+// accept outbound packets again. If the link endpoint already reports room for
+// more packets, f is called immediately.
+func (n *nic) notifyWhenWritable(f func()) {
+	n.writableWaiters.mu.Lock()
+	n.writableWaiters.fns = append(n.writableWaiters.fns, f)
+	n.writableWaiters.mu.Unlock()
+
+	// The link endpoint may have drained between the failed write and the
+	// registration above, in which case no further notification would arrive.
+	if w, ok := n.LinkEndpoint.(interface{ Writable() bool }); ok && w.Writable() {
+		n.DeliverLinkWritable()
+	}
+}
+
+// DeliverLinkWritable implements LinkWritableDispatcher.
+func (n *nic) DeliverLinkWritable() {
+	n.writableWaiters.mu.Lock()
+	fns := n.writableWaiters.fns
+	n.writableWaiters.fns = nil
+	n.writableWaiters.mu.Unlock()
+
+	for _, f := range fns {
+		f()
+	}
+}
+
 // DeliverNetworkPacket finds the appropriate network protocol endpoint and
 // hands the packet over for further processing. This function is called when
 // the NIC receives a packet from the link endpoint.
@@ -736,6 +796,9 @@ func (n *nic) DeliverNetworkPacket(remote, local tcpip.LinkAddress, protocol tcp
 	if local == "" {
 		local = n.LinkEndpoint.LinkAddress()
 	}
+	if pkt.LinkSource == "" {
+		pkt.LinkSource = remote
+	}
 	pkt.RXTransportChecksumValidated = n.LinkEndpoint.Capabilities()&CapabilityRXChecksumOffload != 0
 
 	// Deliver to interested packet endpoints without holding NIC lock.
@@ -856,6 +919,21 @@ func (n *nic) DeliverTransportPacket(protocol tcpip.TransportProtocolNumber, pkt
 		RemotePort:    srcPort,
 		RemoteAddress: src,
 	}
+	// Packets from one of our own addresses are only delivered to UDP
+	// endpoints that accept them.
+	if pkt.NetworkPacketInfo.LocalSource {
+		if protocol != header.UDPProtocolNumber || !n.stack.demux.deliverPacket(protocol, pkt, id) {
+			n.stack.Stats().IP.InvalidSourceAddressesReceived.Increment()
+		}
+		return TransportPacketHandled
+	}
+
+	if protocol == header.UDPProtocolNumber {
+		if tap := n.stack.UDPTap(); tap != nil {
+			tap(UDPTapIncoming, pkt)
+		}
+		n.stack.udpConntrack.track(pkt)
+	}
 	if n.stack.demux.deliverPacket(protocol, pkt, id) {
 		return TransportPacketHandled
 	}
@@ -913,6 +991,12 @@ func (n *nic) DeliverTransportError(local, remote tcpip.Address, net tcpip.Netwo
 
 // DeliverRawPacket implements TransportDispatcher.
 func (n *nic) DeliverRawPacket(protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer) {
+	// Packets from one of our own addresses are only let through for UDP
+	// endpoints that accept them.
+	if pkt.NetworkPacketInfo.LocalSource {
+		return
+	}
+
 	// For ICMPv4 only we validate the header length for compatibility with
 	// raw(7) ICMP_FILTER. The same check is made in Linux here:
 	// https://github.com/torvalds/linux/blob/70585216/net/ipv4/raw.c#L189.
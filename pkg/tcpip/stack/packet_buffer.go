@@ -38,6 +38,11 @@ type PacketBufferOptions struct {
 	// number of bytes pushed onto the headers must not exceed this value.
 	ReserveHeaderBytes int
 
+	// ReserveHeaderStorage, if at least ReserveHeaderBytes long, is used as the
+	// storage of the reserved header space instead of a new allocation. It will
+	// be owned by the new packet.
+	ReserveHeaderStorage []byte
+
 	// Data is the initial unparsed data for the new packet. If set, it will be
 	// owned by the new packet.
 	Data tcpipbuffer.VectorisedView
@@ -45,6 +50,14 @@ type PacketBufferOptions struct {
 	// IsForwardedPacket identifies that the PacketBuffer being created is for a
 	// forwarded packet.
 	IsForwardedPacket bool
+
+	// LinkPriority is the priority carried by the link layer (e.g. the VLAN
+	// priority code point) of an inbound packet.
+	LinkPriority uint32
+
+	// LinkSource is the link-layer source address of an inbound packet. If
+	// unset, the remote link address the packet is delivered with is used.
+	LinkSource tcpip.LinkAddress
 }
 
 // A PacketBuffer contains all the data of a network packet.
@@ -145,19 +158,42 @@ type PacketBuffer struct {
 	// may be safely skipped.
 	RXTransportChecksumValidated bool
 
+	// LinkPriority is the priority carried by the link layer of an inbound
+	// packet, if any.
+	LinkPriority uint32
+
+	// LinkSource is the link-layer source address of an inbound packet, if
+	// known.
+	LinkSource tcpip.LinkAddress
+
 	// NetworkPacketInfo holds an incoming packet's network-layer information.
 	NetworkPacketInfo NetworkPacketInfo
 
+	// IncomingCPU is the receive steering bucket used to select the endpoint
+	// the packet was delivered to among endpoints sharing a port, or -1 if the
+	// packet was not steered. It is set by the transport demuxer.
+	IncomingCPU int
+
+	// ReusePortMiss is set by the transport demuxer when the packet was
+	// delivered to another member of a SO_REUSEPORT group because the member
+	// it was hashed to was closing.
+	ReusePortMiss bool
+
 	tuple *tuple
 }
 
 // NewPacketBuffer creates a new PacketBuffer with opts.
 func NewPacketBuffer(opts PacketBufferOptions) *PacketBuffer {
 	pk := &PacketBuffer{
-		buf: &buffer.Buffer{},
+		buf:         &buffer.Buffer{},
+		IncomingCPU: -1,
 	}
 	if opts.ReserveHeaderBytes != 0 {
-		pk.buf.AppendOwned(make([]byte, opts.ReserveHeaderBytes))
+		hdr := opts.ReserveHeaderStorage
+		if len(hdr) < opts.ReserveHeaderBytes {
+			hdr = make([]byte, opts.ReserveHeaderBytes)
+		}
+		pk.buf.AppendOwned(hdr[:opts.ReserveHeaderBytes:opts.ReserveHeaderBytes])
 		pk.reserved = opts.ReserveHeaderBytes
 	}
 	for _, v := range opts.Data.Views() {
@@ -166,6 +202,8 @@ func NewPacketBuffer(opts PacketBufferOptions) *PacketBuffer {
 	if opts.IsForwardedPacket {
 		pk.NetworkPacketInfo.IsForwardedPacket = opts.IsForwardedPacket
 	}
+	pk.LinkPriority = opts.LinkPriority
+	pk.LinkSource = opts.LinkSource
 	return pk
 }
 
@@ -308,7 +346,11 @@ func (pk *PacketBuffer) Clone() *PacketBuffer {
 		PktType:                      pk.PktType,
 		NICID:                        pk.NICID,
 		RXTransportChecksumValidated: pk.RXTransportChecksumValidated,
+		LinkPriority:                 pk.LinkPriority,
+		LinkSource:                   pk.LinkSource,
 		NetworkPacketInfo:            pk.NetworkPacketInfo,
+		IncomingCPU:                  pk.IncomingCPU,
+		ReusePortMiss:                pk.ReusePortMiss,
 		tuple:                        pk.tuple,
 	}
 }
@@ -336,8 +378,9 @@ func (pk *PacketBuffer) CloneToInbound() *PacketBuffer {
 	newPk := &PacketBuffer{
 		buf: pk.buf.Clone(),
 		// Treat unfilled header portion as reserved.
-		reserved: pk.AvailableHeaderBytes(),
-		tuple:    pk.tuple,
+		reserved:    pk.AvailableHeaderBytes(),
+		IncomingCPU: -1,
+		tuple:       pk.tuple,
 	}
 	return newPk
 }
@@ -58,6 +58,19 @@ type NetworkPacketInfo struct {
 
 	// IsForwardedPacket is true if the packet is being forwarded.
 	IsForwardedPacket bool
+
+	// UseMinMTU is true if an outgoing IPv6 packet must be fragmented to fit
+	// in the IPv6 minimum MTU, regardless of the MTU of the outgoing link.
+	UseMinMTU bool
+
+	// LocalSource is true if an incoming packet's source address is one of
+	// the stack's own addresses although the stack handles local traffic
+	// itself. Such packets are only delivered to endpoints that accept them.
+	LocalSource bool
+
+	// Reassembled is true if an incoming packet was reassembled from multiple
+	// IP fragments.
+	Reassembled bool
 }
 
 // TransportErrorKind enumerates error types that are handled by the transport
@@ -82,6 +95,14 @@ const (
 	// DestinationNetworkUnreachableTransportError indicates that the destination
 	// network was unreachable.
 	DestinationNetworkUnreachableTransportError
+
+	// TimeExceededTransportError indicates that a packet's time to live expired
+	// before it reached its destination.
+	TimeExceededTransportError
+
+	// SourceRouteFailedTransportError indicates that a packet's source route
+	// could not be followed.
+	SourceRouteFailedTransportError
 )
 
 // TransportError is a marker interface for errors that may be handled by the
@@ -295,6 +316,14 @@ type NetworkHeaderParams struct {
 
 	// TOS refers to TypeOfService or TrafficClass field of the IP-header.
 	TOS uint8
+
+	// IPv6ExtensionHeaders are inserted between the IPv6 header and the
+	// transport header. They are ignored by other network protocols.
+	IPv6ExtensionHeaders header.IPv6ExtHdrSerializer
+
+	// IPv4Options are included in the IPv4 header. They are ignored by other
+	// network protocols.
+	IPv4Options header.IPv4OptionsSerializer
 }
 
 // GroupAddressableEndpoint is an endpoint that supports group addressing.
@@ -752,6 +781,15 @@ type NetworkDispatcher interface {
 	DeliverNetworkPacket(remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *PacketBuffer)
 }
 
+// LinkWritableDispatcher is implemented by NetworkDispatchers that want to be
+// told when a link endpoint which previously returned ErrWouldBlock can accept
+// outbound packets again.
+type LinkWritableDispatcher interface {
+	// DeliverLinkWritable is called by the link endpoint when there is room
+	// for at least one more outbound packet.
+	DeliverLinkWritable()
+}
+
 // LinkEndpointCapabilities is the type associated with the capabilities
 // supported by a link-layer endpoint. It is a set of bitfields.
 type LinkEndpointCapabilities uint
@@ -492,6 +492,11 @@ func (r *Route) MTU() uint32 {
 	return r.outgoingNIC.getNetworkEndpoint(r.NetProto()).MTU()
 }
 
+// LinkMTU returns the MTU of the link the route's packets are written to.
+func (r *Route) LinkMTU() uint32 {
+	return r.outgoingNIC.MTU()
+}
+
 // Release decrements the reference counter of the resources associated with the
 // route.
 func (r *Route) Release() {
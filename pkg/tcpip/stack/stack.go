@@ -81,6 +81,12 @@ type Stack struct {
 
 	// LOCK ORDERING: mu > route.mu.
 	route struct {
+		// generation is incremented every time the route table changes so that
+		// cached routes can be revalidated.
+		//
+		// Must be accessed using atomic operations.
+		generation uint32
+
 		mu struct {
 			sync.RWMutex
 
@@ -102,12 +108,50 @@ type Stack struct {
 	// invoked everytime they receive a TCP segment.
 	tcpProbeFunc atomic.Value // TCPProbeFunc
 
+	// If not nil, then udpTapFunc will be invoked for every UDP datagram
+	// received or sent by the stack.
+	udpTapFunc atomic.Value // UDPTapFunc
+
+	// If not nil, then udpSourcePortRewriter is consulted for the source port
+	// of every UDP datagram sent by the stack.
+	udpSourcePortRewriter atomic.Value // UDPSourcePortRewriter
+
+	// If not nil, then udpPromiscuousReceiveCheck is consulted before a UDP
+	// endpoint is made a promiscuous listener. Without it, promiscuous
+	// listeners are not permitted.
+	udpPromiscuousReceiveCheck atomic.Value // UDPPromiscuousReceiveCheck
+
+	// If not nil, then portEventHandler is invoked whenever a UDP port is
+	// reserved or released.
+	portEventHandler atomic.Value // PortEventHandler
+
+	// If not nil, then malformedPacketCapture is invoked for every UDP
+	// datagram dropped as malformed.
+	malformedPacketCapture atomic.Value // MalformedPacketCaptureFunc
+
+	// udpConntrack tracks the UDP flows sent and received by the stack when
+	// enabled with SetUDPConntrack.
+	udpConntrack udpConntrack
+
 	// clock is used to generate user-visible times.
 	clock tcpip.Clock
 
 	// handleLocal allows non-loopback interfaces to loop packets.
 	handleLocal bool
 
+	// localSourceListeners is the number of UDP endpoints that accept
+	// datagrams whose source is one of the stack's own addresses even though
+	// handleLocal is set. Accessed atomically.
+	localSourceListeners int32
+
+	// ipv4ChecksumOffload is non-zero if the IPv4 header checksum of outgoing
+	// packets is left to be filled in by hardware. Accessed atomically.
+	ipv4ChecksumOffload uint32
+
+	// defaultReceiveTOS is non-zero if new endpoints report the TOS/TClass of
+	// received packets by default. Accessed atomically.
+	defaultReceiveTOS uint32
+
 	// tables are the iptables packet filtering and manipulation rules.
 	// TODO(gvisor.dev/issue/4595): S/R this field.
 	tables *IPTables
@@ -139,6 +183,10 @@ type Stack struct {
 	// used when a random number is required.
 	randomGenerator *rand.Rand
 
+	// customRandSource is true if randomGenerator uses the source given in
+	// Options.RandSource.
+	customRandSource bool
+
 	// secureRNG is a cryptographically secure random number generator.
 	secureRNG io.Reader
 
@@ -381,6 +429,7 @@ func New(opts Options) *Stack {
 		uniqueIDGenerator:            opts.UniqueID,
 		nudDisp:                      opts.NUDDisp,
 		randomGenerator:              randomGenerator,
+		customRandSource:             opts.RandSource != nil,
 		secureRNG:                    opts.SecureRNG,
 		sendBufferSize: tcpip.SendBufferSizeOption{
 			Min:     MinBufferSize,
@@ -441,6 +490,16 @@ func (s *Stack) SetNetworkProtocolOption(network tcpip.NetworkProtocolNumber, op
 	return netProto.SetOption(option)
 }
 
+// SetDefaultTTL sets the TTL (IPv4) or hop limit (IPv6) used by packets of the
+// given network protocol when the sending endpoint has not set one explicitly.
+func (s *Stack) SetDefaultTTL(network tcpip.NetworkProtocolNumber, ttl uint8) tcpip.Error {
+	if ttl == 0 {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	opt := tcpip.DefaultTTLOption(ttl)
+	return s.SetNetworkProtocolOption(network, &opt)
+}
+
 // NetworkProtocolOption allows retrieving individual protocol level option
 // values. This method returns an error if the protocol is not supported or
 // option is not supported by the protocol implementation.
@@ -511,6 +570,15 @@ func (s *Stack) Stats() tcpip.Stats {
 	return s.stats
 }
 
+// ResetUDPStats zeroes the stack's UDP statistics and returns their values
+// before the reset.
+//
+// Note that counters exported as cumulative metrics will appear to go
+// backwards after a reset.
+func (s *Stack) ResetUDPStats() tcpip.UDPStats {
+	return s.stats.UDP.Reset()
+}
+
 // SetNICForwarding enables or disables packet forwarding on the specified NIC
 // for the passed protocol.
 func (s *Stack) SetNICForwarding(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, enable bool) tcpip.Error {
@@ -580,6 +648,34 @@ func (s *Stack) SetPortRange(start uint16, end uint16) tcpip.Error {
 	return s.PortManager.SetPortRange(start, end)
 }
 
+// SetReservedEphemeralPorts sets the ports that are never picked as UDP and
+// TCP ephemeral ports, like Linux's ip_local_reserved_ports. The ports may
+// still be bound explicitly.
+func (s *Stack) SetReservedEphemeralPorts(ports []uint16) {
+	s.PortManager.SetReservedEphemeralPorts(ports)
+}
+
+// ReservedEphemeralPorts returns the ports that are never picked as ephemeral
+// ports, in ascending order.
+func (s *Stack) ReservedEphemeralPorts() []uint16 {
+	return s.PortManager.ReservedEphemeralPorts()
+}
+
+// DumpPortReservations returns the ports currently reserved for the given
+// transport protocol. It is intended for debugging unexpected ErrPortInUse
+// errors.
+func (s *Stack) DumpPortReservations(transport tcpip.TransportProtocolNumber) []ports.PortReservation {
+	return s.PortManager.Dump(transport)
+}
+
+// SetEphemeralPortRandomization sets how many high bits of randomly picked
+// ephemeral ports are random; the remaining low bits are allocated
+// sequentially. Zero makes allocation sequential and ports.MaxRandomizedBits,
+// the default, makes it fully random.
+func (s *Stack) SetEphemeralPortRandomization(bits int) tcpip.Error {
+	return s.PortManager.SetRandomizedBits(bits)
+}
+
 // SetRouteTable assigns the route table to be used by this stack. It
 // specifies which NIC to use for given destination address ranges.
 //
@@ -588,6 +684,22 @@ func (s *Stack) SetRouteTable(table []tcpip.Route) {
 	s.route.mu.Lock()
 	defer s.route.mu.Unlock()
 	s.route.mu.table = table
+	s.routeTableChangedLocked()
+}
+
+// routeTableChangedLocked invalidates routes cached against the previous
+// route table.
+//
+// s.route.mu must be locked.
+func (s *Stack) routeTableChangedLocked() {
+	atomic.AddUint32(&s.route.generation, 1)
+}
+
+// RouteTableGeneration returns a value that changes every time the route table
+// is modified. Endpoints that cache a route can compare it against the value
+// observed when the route was looked up to detect that it may be stale.
+func (s *Stack) RouteTableGeneration() uint32 {
+	return atomic.LoadUint32(&s.route.generation)
 }
 
 // GetRouteTable returns the route table which is currently in use.
@@ -602,6 +714,7 @@ func (s *Stack) AddRoute(route tcpip.Route) {
 	s.route.mu.Lock()
 	defer s.route.mu.Unlock()
 	s.route.mu.table = append(s.route.mu.table, route)
+	s.routeTableChangedLocked()
 }
 
 // RemoveRoutes removes matching routes from the route table.
@@ -616,6 +729,7 @@ func (s *Stack) RemoveRoutes(match func(tcpip.Route) bool) {
 		}
 	}
 	s.route.mu.table = filteredRoutes
+	s.routeTableChangedLocked()
 }
 
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
@@ -628,6 +742,56 @@ func (s *Stack) NewEndpoint(transport tcpip.TransportProtocolNumber, network tcp
 	return t.proto.NewEndpoint(network, waiterQueue)
 }
 
+// EndpointConfig holds the configuration of an endpoint that is copied by
+// NewEndpointFromConfig. It does not include binding or connection state.
+type EndpointConfig struct {
+	TransProto tcpip.TransportProtocolNumber
+	NetProto   tcpip.NetworkProtocolNumber
+
+	// TTL, IPv4TOS and IPv6TrafficClass hold the values of the corresponding
+	// integer socket options.
+	TTL              uint8
+	IPv4TOS          uint8
+	IPv6TrafficClass uint8
+
+	Broadcast    bool
+	ReuseAddress bool
+	ReusePort    bool
+	V6Only       bool
+}
+
+// NewEndpointFromConfig creates a new transport layer endpoint configured
+// with the socket options in cfg.
+func (s *Stack) NewEndpointFromConfig(cfg EndpointConfig, waiterQueue *waiter.Queue) (tcpip.Endpoint, tcpip.Error) {
+	ep, err := s.NewEndpoint(cfg.TransProto, cfg.NetProto, waiterQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range []struct {
+		opt tcpip.SockOptInt
+		v   uint8
+	}{
+		{tcpip.TTLOption, cfg.TTL},
+		{tcpip.IPv4TOSOption, cfg.IPv4TOS},
+		{tcpip.IPv6TrafficClassOption, cfg.IPv6TrafficClass},
+	} {
+		if err := ep.SetSockOptInt(opt.opt, int(opt.v)); err != nil {
+			ep.Close()
+			return nil, err
+		}
+	}
+
+	ops := ep.SocketOptions()
+	ops.SetBroadcast(cfg.Broadcast)
+	ops.SetReuseAddress(cfg.ReuseAddress)
+	ops.SetReusePort(cfg.ReusePort)
+	if cfg.NetProto == header.IPv6ProtocolNumber {
+		ops.SetV6Only(cfg.V6Only)
+	}
+	return ep, nil
+}
+
 // NewRawEndpoint creates a new raw transport layer endpoint of the given
 // protocol. Raw endpoints receive all traffic for a given protocol regardless
 // of address.
@@ -807,6 +971,7 @@ func (s *Stack) removeNICLocked(id tcpip.NICID) tcpip.Error {
 		}
 	}
 	s.route.mu.table = s.route.mu.table[:n]
+	s.routeTableChangedLocked()
 	s.route.mu.Unlock()
 
 	return nic.remove()
@@ -851,6 +1016,21 @@ func (s *Stack) HasNIC(id tcpip.NICID) bool {
 	return ok
 }
 
+// MaxLinkMTU returns the largest MTU of the stack's NICs' link endpoints, or 0
+// if the stack has no NICs.
+func (s *Stack) MaxLinkMTU() uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var mtu uint32
+	for _, nic := range s.nics {
+		if m := nic.LinkEndpoint.MTU(); m > mtu {
+			mtu = m
+		}
+	}
+	return mtu
+}
+
 // NICInfo returns a map of NICIDs to their associated information.
 func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 	s.mu.RLock()
@@ -1063,6 +1243,63 @@ func (s *Stack) HandleLocal() bool {
 	return s.handleLocal
 }
 
+// AddLocalSourceListener records that a UDP endpoint accepts datagrams whose
+// source is one of the stack's own addresses. It must be balanced by a call to
+// RemoveLocalSourceListener.
+func (s *Stack) AddLocalSourceListener() {
+	atomic.AddInt32(&s.localSourceListeners, 1)
+}
+
+// RemoveLocalSourceListener undoes a call to AddLocalSourceListener.
+func (s *Stack) RemoveLocalSourceListener() {
+	atomic.AddInt32(&s.localSourceListeners, -1)
+}
+
+// HasLocalSourceListeners returns true if any UDP endpoint accepts datagrams
+// whose source is one of the stack's own addresses. Network endpoints then
+// hand such datagrams to the transport layer marked with
+// NetworkPacketInfo.LocalSource instead of dropping them.
+func (s *Stack) HasLocalSourceListeners() bool {
+	return atomic.LoadInt32(&s.localSourceListeners) > 0
+}
+
+// SetIPv4ChecksumOffload sets whether the IPv4 header checksum of outgoing
+// packets is left zero to be filled in by hardware.
+//
+// Only intended for testing hardware offload paths; a link endpoint that does
+// not fill in the checksum will have its packets dropped by the receiver.
+func (s *Stack) SetIPv4ChecksumOffload(v bool) {
+	var b uint32
+	if v {
+		b = 1
+	}
+	atomic.StoreUint32(&s.ipv4ChecksumOffload, b)
+}
+
+// IPv4ChecksumOffload returns true if the IPv4 header checksum of outgoing
+// packets is left to be filled in by hardware.
+func (s *Stack) IPv4ChecksumOffload() bool {
+	return atomic.LoadUint32(&s.ipv4ChecksumOffload) != 0
+}
+
+// SetDefaultReceiveTOS sets whether endpoints created after this call report
+// the TOS (IPv4) or Traffic Class (IPv6) of received packets without having to
+// enable IP_RECVTOS/IPV6_RECVTCLASS individually. Endpoints may still override
+// the option.
+func (s *Stack) SetDefaultReceiveTOS(v bool) {
+	var b uint32
+	if v {
+		b = 1
+	}
+	atomic.StoreUint32(&s.defaultReceiveTOS, b)
+}
+
+// DefaultReceiveTOS returns true if new endpoints report the TOS/TClass of
+// received packets by default.
+func (s *Stack) DefaultReceiveTOS() bool {
+	return atomic.LoadUint32(&s.defaultReceiveTOS) != 0
+}
+
 func isNICForwarding(nic *nic, proto tcpip.NetworkProtocolNumber) bool {
 	switch forwarding, err := nic.forwarding(proto); err.(type) {
 	case nil:
@@ -1294,6 +1531,51 @@ func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) tcpip.Error {
 	return nil
 }
 
+// NotifyWhenLinkWritable registers f to be called once the given NIC's link
+// endpoint can accept outbound packets again after having returned
+// ErrWouldBlock. f is called at most once per registration.
+func (s *Stack) NotifyWhenLinkWritable(nicID tcpip.NICID, f func()) tcpip.Error {
+	s.mu.RLock()
+	nic, ok := s.nics[nicID]
+	s.mu.RUnlock()
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+
+	nic.notifyWhenWritable(f)
+	return nil
+}
+
+// SetNICMulticastTTL sets the default TTL (IPv4) or hop limit (IPv6) of
+// multicast packets sent through the given NIC by endpoints that have not set
+// their own with MulticastTTLOption.
+func (s *Stack) SetNICMulticastTTL(nicID tcpip.NICID, ttl uint8) tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic, ok := s.nics[nicID]
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+
+	nic.setMulticastTTL(ttl)
+
+	return nil
+}
+
+// NICMulticastTTL returns the default multicast TTL of the given NIC and
+// whether one was set with SetNICMulticastTTL.
+func (s *Stack) NICMulticastTTL(nicID tcpip.NICID) (uint8, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic, ok := s.nics[nicID]
+	if !ok {
+		return 0, false
+	}
+	return nic.getMulticastTTL()
+}
+
 // SetSpoofing enables or disables address spoofing in the given NIC, allowing
 // endpoints to bind to any address in the NIC.
 func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) tcpip.Error {
@@ -1417,6 +1699,13 @@ func (s *Stack) UnregisterTransportEndpoint(netProtos []tcpip.NetworkProtocolNum
 	s.demux.unregisterEndpoint(netProtos, protocol, id, ep, flags, bindToDevice)
 }
 
+// UpdateTransportEndpointSteering recomputes the receive steering of the
+// endpoints sharing the given id with ep. It is called when an endpoint that
+// is already registered changes its SO_INCOMING_CPU hint.
+func (s *Stack) UpdateTransportEndpointSteering(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, bindToDevice tcpip.NICID) {
+	s.demux.updateSteering(netProtos, protocol, id, bindToDevice)
+}
+
 // StartTransportEndpointCleanup removes the endpoint with the given id from
 // the stack transport dispatcher. It also transitions it to the cleanup stage.
 func (s *Stack) StartTransportEndpointCleanup(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, flags ports.Flags, bindToDevice tcpip.NICID) {
@@ -1454,6 +1743,20 @@ func (s *Stack) UnregisterRawTransportEndpoint(netProto tcpip.NetworkProtocolNum
 	s.demux.unregisterRawEndpoint(netProto, transProto, ep)
 }
 
+// RegisterPromiscuousTransportEndpoint registers ep to receive a copy of every
+// packet sent to id.LocalPort, and to id.LocalAddress if it is specified,
+// regardless of the other endpoints bound to the port. The port is not
+// reserved. Only UDP supports promiscuous endpoints.
+func (s *Stack) RegisterPromiscuousTransportEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) tcpip.Error {
+	return s.demux.registerPromiscuousEndpoint(netProtos, protocol, id, ep)
+}
+
+// UnregisterPromiscuousTransportEndpoint removes an endpoint registered with
+// RegisterPromiscuousTransportEndpoint.
+func (s *Stack) UnregisterPromiscuousTransportEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	s.demux.unregisterPromiscuousEndpoint(netProtos, protocol, id, ep)
+}
+
 // RegisterRestoredEndpoint records e as an endpoint that has been restored on
 // this stack.
 func (s *Stack) RegisterRestoredEndpoint(e ResumableEndpoint) {
@@ -1501,6 +1804,7 @@ func (s *Stack) Close() {
 	for _, e := range s.RegisteredEndpoints() {
 		e.Abort()
 	}
+	s.udpConntrack.setEnabled(nil, false)
 	for _, p := range s.transportProtocols {
 		p.proto.Close()
 	}
@@ -1698,6 +2002,148 @@ func (s *Stack) RemoveTCPProbe() {
 	s.tcpProbeFunc.Store(TCPProbeFunc(nil))
 }
 
+// SetUDPTap installs a tap function that will be invoked for every UDP
+// datagram received or sent by the stack, regardless of which endpoint (if
+// any) it is delivered to or sent from. The tap observes datagrams but does
+// not affect their delivery. Passing nil removes an installed tap.
+func (s *Stack) SetUDPTap(tap UDPTapFunc) {
+	// tap is always stored as a UDPTapFunc, even when nil, because
+	// atomic.Value.Store(nil) panics.
+	s.udpTapFunc.Store(tap)
+}
+
+// UDPTap returns the UDPTapFunc if installed with SetUDPTap, nil otherwise.
+func (s *Stack) UDPTap() UDPTapFunc {
+	t := s.udpTapFunc.Load()
+	if t == nil {
+		return nil
+	}
+	return t.(UDPTapFunc)
+}
+
+// SetUDPSourcePortRewriter installs a function that may rewrite the source
+// port of every UDP datagram sent by the stack, e.g. to emulate a NAT box. The
+// rewrite is applied before the checksum is computed. Passing nil removes an
+// installed rewriter.
+func (s *Stack) SetUDPSourcePortRewriter(f UDPSourcePortRewriter) {
+	// f is always stored as a UDPSourcePortRewriter, even when nil, because
+	// atomic.Value.Store(nil) panics.
+	s.udpSourcePortRewriter.Store(f)
+}
+
+// UDPSourcePortRewriter returns the UDPSourcePortRewriter if installed with
+// SetUDPSourcePortRewriter, nil otherwise.
+func (s *Stack) UDPSourcePortRewriter() UDPSourcePortRewriter {
+	f := s.udpSourcePortRewriter.Load()
+	if f == nil {
+		return nil
+	}
+	return f.(UDPSourcePortRewriter)
+}
+
+// SetUDPPromiscuousReceiveCheck installs the privilege check consulted before a
+// UDP endpoint is made a promiscuous listener. Passing nil removes an installed
+// check, which denies all promiscuous listeners.
+func (s *Stack) SetUDPPromiscuousReceiveCheck(f UDPPromiscuousReceiveCheck) {
+	// f is always stored as a UDPPromiscuousReceiveCheck, even when nil,
+	// because atomic.Value.Store(nil) panics.
+	s.udpPromiscuousReceiveCheck.Store(f)
+}
+
+// UDPPromiscuousReceiveCheck returns the UDPPromiscuousReceiveCheck if
+// installed with SetUDPPromiscuousReceiveCheck, nil otherwise.
+func (s *Stack) UDPPromiscuousReceiveCheck() UDPPromiscuousReceiveCheck {
+	f := s.udpPromiscuousReceiveCheck.Load()
+	if f == nil {
+		return nil
+	}
+	return f.(UDPPromiscuousReceiveCheck)
+}
+
+// SetPortEventHandler installs a handler invoked whenever a UDP port is
+// reserved or released through the stack, e.g. so that an external port
+// manager can track port usage. Passing nil removes an installed handler.
+//
+// The handler is invoked after the port manager's lock is released, so it may
+// reserve or release ports itself. It is invoked synchronously by the
+// endpoint reserving or releasing the port, however, so it must not call into
+// that endpoint.
+func (s *Stack) SetPortEventHandler(f PortEventHandler) {
+	// f is always stored as a PortEventHandler, even when nil, because
+	// atomic.Value.Store(nil) panics.
+	s.portEventHandler.Store(f)
+}
+
+// SetMalformedPacketCapture installs a function that is invoked with the
+// offending bytes of every UDP datagram dropped as malformed, for debugging.
+// Capturing is off by default. Passing nil removes an installed function.
+//
+// The function is invoked synchronously on the receive path, so it should
+// return quickly.
+func (s *Stack) SetMalformedPacketCapture(f MalformedPacketCaptureFunc) {
+	// f is always stored as a MalformedPacketCaptureFunc, even when nil,
+	// because atomic.Value.Store(nil) panics.
+	s.malformedPacketCapture.Store(f)
+}
+
+// CaptureMalformedPacket passes pkt to the function installed with
+// SetMalformedPacketCapture, if any. The reason is built from format and args
+// only when a function is installed.
+func (s *Stack) CaptureMalformedPacket(pkt *PacketBuffer, format string, args ...interface{}) {
+	f, _ := s.malformedPacketCapture.Load().(MalformedPacketCaptureFunc)
+	if f == nil {
+		return
+	}
+
+	raw := make([]byte, 0, MaxMalformedPacketCaptureSize)
+	views := append([]buffer.View{pkt.NetworkHeader().View(), pkt.TransportHeader().View()}, pkt.Data().Views()...)
+	for _, v := range views {
+		if n := MaxMalformedPacketCaptureSize - len(raw); len(v) > n {
+			v = v[:n]
+		}
+		raw = append(raw, v...)
+	}
+	f(fmt.Sprintf(format, args...), raw)
+}
+
+// notifyPortEvent invokes the installed PortEventHandler, if any, for a UDP
+// port reservation.
+func (s *Stack) notifyPortEvent(kind PortEventKind, res ports.Reservation) {
+	if res.Transport != header.UDPProtocolNumber {
+		return
+	}
+	f, _ := s.portEventHandler.Load().(PortEventHandler)
+	if f == nil {
+		return
+	}
+	f(PortEvent{
+		Kind:         kind,
+		Addr:         res.Addr,
+		Port:         res.Port,
+		Flags:        res.Flags,
+		BindToDevice: res.BindToDevice,
+	})
+}
+
+// ReservePort reserves a port like ports.PortManager.ReservePort, and reports
+// the reservation to the handler installed with SetPortEventHandler.
+func (s *Stack) ReservePort(rng *rand.Rand, res ports.Reservation, testPort ports.PortTester) (uint16, tcpip.Error) {
+	port, err := s.PortManager.ReservePort(rng, res, testPort)
+	if err != nil {
+		return 0, err
+	}
+	res.Port = port
+	s.notifyPortEvent(PortReserved, res)
+	return port, nil
+}
+
+// ReleasePort releases a port like ports.PortManager.ReleasePort, and reports
+// the release to the handler installed with SetPortEventHandler.
+func (s *Stack) ReleasePort(res ports.Reservation) {
+	s.PortManager.ReleasePort(res)
+	s.notifyPortEvent(PortReleased, res)
+}
+
 // JoinGroup joins the given multicast group on the given NIC.
 func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICID, multicastAddr tcpip.Address) tcpip.Error {
 	s.mu.RLock()
@@ -1823,6 +2269,13 @@ func (s *Stack) Rand() *rand.Rand {
 	return s.randomGenerator
 }
 
+// HasCustomRandSource returns true if the stack was created with
+// Options.RandSource, in which case the numbers returned by Rand are
+// reproducible.
+func (s *Stack) HasCustomRandSource() bool {
+	return s.customRandSource
+}
+
 // SecureRNG returns the stack's cryptographically secure random number
 // generator.
 func (s *Stack) SecureRNG() io.Reader {
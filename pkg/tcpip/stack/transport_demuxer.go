@@ -40,6 +40,28 @@ type transportEndpoints struct {
 	//
 	// +checklocks:mu
 	rawEndpoints []RawTransportEndpoint
+	// promiscuousEndpoints contains endpoints that receive a copy of every
+	// packet sent to their port, keyed by the port and, optionally, address
+	// they are bound to.
+	//
+	// +checklocks:mu
+	promiscuousEndpoints map[TransportEndpointID][]TransportEndpoint
+}
+
+// findPromiscuousEndpointsLocked returns the promiscuous endpoints that should
+// receive a packet with the given id.
+//
+// +checklocksread:eps.mu
+func (eps *transportEndpoints) findPromiscuousEndpointsLocked(id TransportEndpointID) []TransportEndpoint {
+	if len(eps.promiscuousEndpoints) == 0 {
+		return nil
+	}
+	// Copy the endpoints to avoid packet handling under lock.
+	matched := append([]TransportEndpoint(nil), eps.promiscuousEndpoints[TransportEndpointID{LocalPort: id.LocalPort}]...)
+	if id.LocalAddress != "" {
+		matched = append(matched, eps.promiscuousEndpoints[TransportEndpointID{LocalPort: id.LocalPort, LocalAddress: id.LocalAddress}]...)
+	}
+	return matched
 }
 
 // unregisterEndpoint unregisters the endpoint with the given id such that it
@@ -57,6 +79,16 @@ func (eps *transportEndpoints) unregisterEndpoint(id TransportEndpointID, ep Tra
 	delete(eps.endpoints, id)
 }
 
+// updateSteering recomputes the receive steering buckets of the endpoints
+// registered with the given id and device.
+func (eps *transportEndpoints) updateSteering(id TransportEndpointID, bindToDevice tcpip.NICID) {
+	eps.mu.RLock()
+	defer eps.mu.RUnlock()
+	if epsByNIC, ok := eps.endpoints[id]; ok {
+		epsByNIC.updateSteering(bindToDevice)
+	}
+}
+
 func (eps *transportEndpoints) transportEndpoints() []TransportEndpoint {
 	eps.mu.RLock()
 	defer eps.mu.RUnlock()
@@ -170,12 +202,15 @@ func (epsByNIC *endpointsByNIC) handlePacket(id TransportEndpointID, pkt *Packet
 	// If this is a broadcast or multicast datagram, deliver the datagram to all
 	// endpoints bound to the right device.
 	if isInboundMulticastOrBroadcast(pkt, id.LocalAddress) {
+		pkt.IncomingCPU = -1
 		mpep.handlePacketAll(id, pkt)
 		epsByNIC.mu.RUnlock() // Don't use defer for performance reasons.
 		return true
 	}
 	// multiPortEndpoints are guaranteed to have at least one element.
-	transEP := mpep.selectEndpoint(id, epsByNIC.seed)
+	transEP, cpu := mpep.selectEndpoint(id, epsByNIC.seed)
+	pkt.IncomingCPU = cpu
+	transEP, pkt.ReusePortMiss = mpep.replaceClosingEndpoint(transEP)
 	if queuedProtocol, mustQueue := mpep.demux.queuedProtocols[protocolIDs{mpep.netProto, mpep.transProto}]; mustQueue {
 		queuedProtocol.QueuePacket(transEP, id, pkt)
 		epsByNIC.mu.RUnlock()
@@ -204,7 +239,8 @@ func (epsByNIC *endpointsByNIC) handleError(n *nic, id TransportEndpointID, tran
 	// broadcast like we are doing with handlePacket above?
 
 	// multiPortEndpoints are guaranteed to have at least one element.
-	mpep.selectEndpoint(id, epsByNIC.seed).HandleError(transErr, pkt)
+	transEP, _ := mpep.selectEndpoint(id, epsByNIC.seed)
+	transEP.HandleError(transErr, pkt)
 }
 
 // registerEndpoint returns true if it succeeds. It fails and returns
@@ -259,6 +295,18 @@ func (epsByNIC *endpointsByNIC) unregisterEndpoint(bindToDevice tcpip.NICID, t T
 	return len(epsByNIC.endpoints) == 0
 }
 
+// updateSteering recomputes the receive steering buckets of the endpoints
+// bound to bindToDevice.
+func (epsByNIC *endpointsByNIC) updateSteering(bindToDevice tcpip.NICID) {
+	epsByNIC.mu.RLock()
+	defer epsByNIC.mu.RUnlock()
+	if multiPortEp, ok := epsByNIC.endpoints[bindToDevice]; ok {
+		multiPortEp.mu.Lock()
+		multiPortEp.updateSteeringLocked()
+		multiPortEp.mu.Unlock()
+	}
+}
+
 // transportDemuxer demultiplexes packets targeted at a transport endpoint
 // (i.e., after they've been parsed by the network layer). It does two levels
 // of demultiplexing: first based on the network and transport protocols, then
@@ -279,6 +327,14 @@ type queuedTransportProtocol interface {
 	QueuePacket(ep TransportEndpoint, id TransportEndpointID, pkt *PacketBuffer)
 }
 
+// closingTransportEndpoint if implemented by a transport endpoint allows the
+// dispatcher to detect endpoints that are still registered but are being
+// closed, so that packets aren't queued on endpoints that are going away.
+type closingTransportEndpoint interface {
+	// IsClosing returns true if the endpoint is closing.
+	IsClosing() bool
+}
+
 func newTransportDemuxer(stack *Stack) *transportDemuxer {
 	d := &transportDemuxer{
 		stack:           stack,
@@ -349,6 +405,14 @@ type multiPortEndpoint struct {
 	//
 	// +checklocks:mu
 	endpoints []TransportEndpoint
+
+	// steeredEndpoints maps receive steering buckets to the endpoint that
+	// asked for them with SO_INCOMING_CPU. It is computed when the group
+	// changes, so a hint only takes effect for endpoints registered after it
+	// was set. Packets are only steered if it isn't empty.
+	//
+	// +checklocks:mu
+	steeredEndpoints map[int]TransportEndpoint
 }
 
 func (ep *multiPortEndpoint) transportEndpoints() []TransportEndpoint {
@@ -369,16 +433,21 @@ func reciprocalScale(val, n uint32) uint32 {
 // selectEndpoint calculates a hash of destination and source addresses and
 // ports then uses it to select a socket. In this case, all packets from one
 // address will be sent to same endpoint.
-func (ep *multiPortEndpoint) selectEndpoint(id TransportEndpointID, seed uint32) TransportEndpoint {
+//
+// If any endpoint in the group has set SO_INCOMING_CPU, the hash also
+// determines the packet's receive steering bucket, one per endpoint, and the
+// endpoint that asked for the bucket is selected instead. The bucket is
+// returned alongside the endpoint, or -1 if the packet was not steered.
+func (ep *multiPortEndpoint) selectEndpoint(id TransportEndpointID, seed uint32) (TransportEndpoint, int) {
 	ep.mu.RLock()
 	defer ep.mu.RUnlock()
 
 	if len(ep.endpoints) == 1 {
-		return ep.endpoints[0]
+		return ep.endpoints[0], -1
 	}
 
 	if ep.flags.SharedFlags().ToFlags().Effective().MostRecent {
-		return ep.endpoints[len(ep.endpoints)-1]
+		return ep.endpoints[len(ep.endpoints)-1], -1
 	}
 
 	payload := []byte{
@@ -395,7 +464,68 @@ func (ep *multiPortEndpoint) selectEndpoint(id TransportEndpointID, seed uint32)
 	hash := h.Sum32()
 
 	idx := reciprocalScale(hash, uint32(len(ep.endpoints)))
-	return ep.endpoints[idx]
+	if len(ep.steeredEndpoints) == 0 {
+		return ep.endpoints[idx], -1
+	}
+	cpu := int(idx)
+	if endpoint, ok := ep.steeredEndpoints[cpu]; ok {
+		return endpoint, cpu
+	}
+	return ep.endpoints[idx], cpu
+}
+
+// updateSteeringLocked recomputes the receive steering buckets requested by
+// the endpoints in the group.
+//
+// +checklocks:ep.mu
+func (ep *multiPortEndpoint) updateSteeringLocked() {
+	ep.steeredEndpoints = nil
+	for _, endpoint := range ep.endpoints {
+		so, ok := endpoint.(interface{ SocketOptions() *tcpip.SocketOptions })
+		if !ok {
+			continue
+		}
+		cpu := so.SocketOptions().GetIncomingCPU()
+		if cpu < 0 {
+			continue
+		}
+		if _, ok := ep.steeredEndpoints[cpu]; ok {
+			// The first endpoint to ask for a bucket keeps it.
+			continue
+		}
+		if ep.steeredEndpoints == nil {
+			ep.steeredEndpoints = make(map[int]TransportEndpoint)
+		}
+		ep.steeredEndpoints[cpu] = endpoint
+	}
+}
+
+// replaceClosingEndpoint returns the group member following t that is not
+// closing if t is closing, and true to indicate that t was replaced. t is
+// returned unchanged if it is not closing or if no other member can take its
+// place.
+func (ep *multiPortEndpoint) replaceClosingEndpoint(t TransportEndpoint) (TransportEndpoint, bool) {
+	if c, ok := t.(closingTransportEndpoint); !ok || !c.IsClosing() {
+		return t, false
+	}
+
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+
+	start := 0
+	for i, endpoint := range ep.endpoints {
+		if endpoint == t {
+			start = i
+			break
+		}
+	}
+	for i := 1; i < len(ep.endpoints); i++ {
+		endpoint := ep.endpoints[(start+i)%len(ep.endpoints)]
+		if c, ok := endpoint.(closingTransportEndpoint); !ok || !c.IsClosing() {
+			return endpoint, true
+		}
+	}
+	return t, false
 }
 
 func (ep *multiPortEndpoint) handlePacketAll(id TransportEndpointID, pkt *PacketBuffer) {
@@ -434,6 +564,7 @@ func (ep *multiPortEndpoint) singleRegisterEndpoint(t TransportEndpoint, flags p
 
 	ep.endpoints = append(ep.endpoints, t)
 	ep.flags.AddRef(bits)
+	ep.updateSteeringLocked()
 
 	return nil
 }
@@ -466,6 +597,7 @@ func (ep *multiPortEndpoint) unregisterEndpoint(t TransportEndpoint, flags ports
 			ep.endpoints = ep.endpoints[:len(ep.endpoints)-1]
 
 			ep.flags.DropRef(flags.Bits() & ports.MultiBindFlagMask)
+			ep.updateSteeringLocked()
 			break
 		}
 	}
@@ -539,6 +671,17 @@ func (d *transportDemuxer) unregisterEndpoint(netProtos []tcpip.NetworkProtocolN
 	}
 }
 
+// updateSteering recomputes the receive steering buckets of the endpoints
+// registered with the given id and device, after one of them changed its
+// SO_INCOMING_CPU hint.
+func (d *transportDemuxer) updateSteering(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, bindToDevice tcpip.NICID) {
+	for _, n := range netProtos {
+		if eps, ok := d.protocol[protocolIDs{n, protocol}]; ok {
+			eps.updateSteering(id, bindToDevice)
+		}
+	}
+}
+
 // deliverPacket attempts to find one or more matching transport endpoints, and
 // then, if matches are found, delivers the packet to them. Returns true if
 // the packet no longer needs to be handled.
@@ -548,6 +691,18 @@ func (d *transportDemuxer) deliverPacket(protocol tcpip.TransportProtocolNumber,
 		return false
 	}
 
+	// Promiscuous UDP listeners receive their own copy of the packet in
+	// addition to the endpoints the packet would otherwise be delivered to.
+	var promiscuousEPs []TransportEndpoint
+	if protocol == header.UDPProtocolNumber {
+		eps.mu.RLock()
+		promiscuousEPs = eps.findPromiscuousEndpointsLocked(id)
+		eps.mu.RUnlock()
+		for _, ep := range promiscuousEPs {
+			ep.HandlePacket(id, pkt.Clone())
+		}
+	}
+
 	// If the packet is a UDP broadcast or multicast, then find all matching
 	// transport endpoints.
 	if protocol == header.UDPProtocolNumber && isInboundMulticastOrBroadcast(pkt, id.LocalAddress) {
@@ -556,6 +711,9 @@ func (d *transportDemuxer) deliverPacket(protocol tcpip.TransportProtocolNumber,
 		eps.mu.RUnlock()
 		// Fail if we didn't find at least one matching transport endpoint.
 		if len(destEPs) == 0 {
+			if len(promiscuousEPs) != 0 {
+				return true
+			}
 			d.stack.stats.UDP.UnknownPortErrors.Increment()
 			return false
 		}
@@ -583,6 +741,9 @@ func (d *transportDemuxer) deliverPacket(protocol tcpip.TransportProtocolNumber,
 	ep := eps.findEndpointLocked(id)
 	eps.mu.RUnlock()
 	if ep == nil {
+		if len(promiscuousEPs) != 0 {
+			return true
+		}
 		if protocol == header.UDPProtocolNumber {
 			d.stack.stats.UDP.UnknownPortErrors.Increment()
 		}
@@ -667,7 +828,7 @@ func (d *transportDemuxer) findTransportEndpoint(netProto tcpip.NetworkProtocolN
 		}
 	}
 
-	ep := mpep.selectEndpoint(id, epsByNIC.seed)
+	ep, _ := mpep.selectEndpoint(id, epsByNIC.seed)
 	epsByNIC.mu.RUnlock()
 	return ep
 }
@@ -710,6 +871,55 @@ func (d *transportDemuxer) unregisterRawEndpoint(netProto tcpip.NetworkProtocolN
 	eps.mu.Unlock()
 }
 
+// registerPromiscuousEndpoint registers ep to receive a copy of every packet
+// matching id on each of the given network protocols.
+func (d *transportDemuxer) registerPromiscuousEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) tcpip.Error {
+	if protocol != header.UDPProtocolNumber {
+		return &tcpip.ErrNotSupported{}
+	}
+	for _, n := range netProtos {
+		if _, ok := d.protocol[protocolIDs{n, protocol}]; !ok {
+			return &tcpip.ErrNotSupported{}
+		}
+	}
+
+	for _, n := range netProtos {
+		eps := d.protocol[protocolIDs{n, protocol}]
+		eps.mu.Lock()
+		if eps.promiscuousEndpoints == nil {
+			eps.promiscuousEndpoints = make(map[TransportEndpointID][]TransportEndpoint)
+		}
+		eps.promiscuousEndpoints[id] = append(eps.promiscuousEndpoints[id], ep)
+		eps.mu.Unlock()
+	}
+	return nil
+}
+
+// unregisterPromiscuousEndpoint unregisters an endpoint registered with
+// registerPromiscuousEndpoint.
+func (d *transportDemuxer) unregisterPromiscuousEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	for _, n := range netProtos {
+		eps, ok := d.protocol[protocolIDs{n, protocol}]
+		if !ok {
+			continue
+		}
+		eps.mu.Lock()
+		promiscuousEPs := eps.promiscuousEndpoints[id]
+		for i, e := range promiscuousEPs {
+			if e == ep {
+				promiscuousEPs = append(promiscuousEPs[:i], promiscuousEPs[i+1:]...)
+				break
+			}
+		}
+		if len(promiscuousEPs) == 0 {
+			delete(eps.promiscuousEndpoints, id)
+		} else {
+			eps.promiscuousEndpoints[id] = promiscuousEPs
+		}
+		eps.mu.Unlock()
+	}
+}
+
 func isInboundMulticastOrBroadcast(pkt *PacketBuffer, localAddr tcpip.Address) bool {
 	return pkt.NetworkPacketInfo.LocalAddressBroadcast || header.IsV4MulticastAddress(localAddr) || header.IsV6MulticastAddress(localAddr)
 }
@@ -15,6 +15,7 @@
 package stack_test
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -51,7 +52,7 @@ type testContext struct {
 }
 
 // newDualTestContextMultiNIC creates the testing context and also linkEpIDs NICs.
-func newDualTestContextMultiNIC(t *testing.T, mtu uint32, linkEpIDs []tcpip.NICID) *testContext {
+func newDualTestContextMultiNIC(t testing.TB, mtu uint32, linkEpIDs []tcpip.NICID) *testContext {
 	s := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
@@ -452,3 +453,312 @@ func TestBindToDeviceDistribution(t *testing.T) {
 		}
 	}
 }
+
+// TestIncomingCPUSteering checks that packets are steered to the endpoint
+// whose SO_INCOMING_CPU hint matches the packet's receive steering bucket, and
+// that a given 4-tuple is always steered to the same endpoint. The hint must
+// take effect whether it is set before or after the endpoint is bound.
+func TestIncomingCPUSteering(t *testing.T) {
+	const numEndpoints = 4
+
+	for _, test := range []struct {
+		name      string
+		afterBind bool
+	}{
+		{name: "before bind", afterBind: false},
+		{name: "after bind", afterBind: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{1})
+
+			var eps []tcpip.Endpoint
+			for i := 0; i < numEndpoints; i++ {
+				var wq waiter.Queue
+				ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+				if err != nil {
+					t.Fatalf("NewEndpoint failed: %s", err)
+				}
+				t.Cleanup(ep.Close)
+				ep.SocketOptions().SetReusePort(true)
+				if !test.afterBind {
+					ep.SocketOptions().SetIncomingCPU(i)
+				}
+				if err := ep.Bind(tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}); err != nil {
+					t.Fatalf("ep.Bind(...) on endpoint %d failed: %s", i, err)
+				}
+				eps = append(eps, ep)
+			}
+			if test.afterBind {
+				for i, ep := range eps {
+					ep.SocketOptions().SetIncomingCPU(i)
+				}
+			}
+
+			// receive returns the index of the endpoint that received the
+			// packet and the steering bucket reported with it.
+			receive := func(port uint16) (int, int) {
+				t.Helper()
+				c.sendV4Packet(newPayload(), &headers{srcPort: port, dstPort: testDstPort}, 1)
+				got := -1
+				var cpu int
+				for i, ep := range eps {
+					res, err := ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+					if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+						continue
+					}
+					if err != nil {
+						t.Fatalf("Read on endpoint %d failed: %s", i, err)
+					}
+					if got != -1 {
+						t.Fatalf("packet from port %d received on endpoints %d and %d", port, got, i)
+					}
+					if !res.ControlMessages.HasIncomingCPU {
+						t.Fatalf("packet from port %d received on endpoint %d without a steering bucket", port, i)
+					}
+					got, cpu = i, res.ControlMessages.IncomingCPU
+				}
+				if got == -1 {
+					t.Fatalf("packet from port %d was not received", port)
+				}
+				return got, cpu
+			}
+
+			for port := uint16(testSrcPort); port < testSrcPort+200; port++ {
+				ep, cpu := receive(port)
+				if cpu < 0 || cpu >= numEndpoints {
+					t.Fatalf("packet from port %d: got steering bucket = %d, want in [0, %d)", port, cpu, numEndpoints)
+				}
+				if ep != cpu {
+					t.Errorf("packet from port %d with steering bucket %d received on endpoint %d, want = %d", port, cpu, ep, cpu)
+				}
+				if gotEP, gotCPU := receive(port); gotEP != ep || gotCPU != cpu {
+					t.Errorf("packet from port %d: got (endpoint, bucket) = (%d, %d), previously (%d, %d)", port, gotEP, gotCPU, ep, cpu)
+				}
+			}
+		})
+	}
+}
+
+// TestIncomingCPUWithoutHints checks that packets aren't steered, and no
+// steering bucket is reported, when no endpoint sharing the port has set
+// SO_INCOMING_CPU.
+func TestIncomingCPUWithoutHints(t *testing.T) {
+	const numEndpoints = 2
+
+	c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{1})
+
+	var eps []tcpip.Endpoint
+	for i := 0; i < numEndpoints; i++ {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		t.Cleanup(ep.Close)
+		ep.SocketOptions().SetReusePort(true)
+		if err := ep.Bind(tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}); err != nil {
+			t.Fatalf("ep.Bind(...) on endpoint %d failed: %s", i, err)
+		}
+		eps = append(eps, ep)
+	}
+
+	for port := uint16(testSrcPort); port < testSrcPort+20; port++ {
+		c.sendV4Packet(newPayload(), &headers{srcPort: port, dstPort: testDstPort}, 1)
+		for i, ep := range eps {
+			res, err := ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+			if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Read on endpoint %d failed: %s", i, err)
+			}
+			if res.ControlMessages.HasIncomingCPU {
+				t.Errorf("packet from port %d received on endpoint %d with steering bucket %d, want none", port, i, res.ControlMessages.IncomingCPU)
+			}
+		}
+	}
+}
+
+// writeNotifier is a channel.Notification that calls itself when a packet is
+// written.
+type writeNotifier func()
+
+// WriteNotify implements channel.Notification.WriteNotify.
+func (f writeNotifier) WriteNotify() {
+	f()
+}
+
+// TestReusePortMiss checks that a packet hashed to a member of a SO_REUSEPORT
+// group that is being closed is delivered to a surviving member.
+func TestReusePortMiss(t *testing.T) {
+	const numPorts = 100
+
+	c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{1})
+
+	bindAddr := tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}
+	var eps []tcpip.Endpoint
+	for i := 0; i < 2; i++ {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		t.Cleanup(ep.Close)
+		ep.SocketOptions().SetReusePort(true)
+		if err := ep.Bind(bindAddr); err != nil {
+			t.Fatalf("ep.Bind(%#v) on endpoint %d failed: %s", bindAddr, i, err)
+		}
+		eps = append(eps, ep)
+	}
+	closing, survivor := eps[0], eps[1]
+
+	// Find a source port whose 4-tuple hashes to the member that is closed.
+	srcPort := uint16(0)
+	for port := uint16(testSrcPort); port < testSrcPort+numPorts && srcPort == 0; port++ {
+		c.sendV4Packet(newPayload(), &headers{srcPort: port, dstPort: testDstPort}, 1)
+		if _, err := closing.Read(ioutil.Discard, tcpip.ReadOptions{}); err == nil {
+			srcPort = port
+		}
+		survivor.Read(ioutil.Discard, tcpip.ReadOptions{})
+	}
+	if srcPort == 0 {
+		t.Fatalf("no source port in [%d, %d) hashes to the first member", testSrcPort, testSrcPort+numPorts)
+	}
+	closingReceived := closing.Stats().(*tcpip.TransportEndpointStats).PacketsReceived.Value()
+
+	// The closing member flushes a datagram built with MSG_MORE when it is
+	// closed. Deliver a packet for the 4-tuple while that datagram is being
+	// written, i.e. after Close started but before the member is
+	// unregistered.
+	closing.(interface{ SetFlushOnClose(bool) }).SetFlushOnClose(true)
+	var r bytes.Reader
+	r.Reset(newPayload())
+	to := tcpip.FullAddress{Addr: testSrcAddrV4, Port: testSrcPort}
+	if _, err := closing.Write(&r, tcpip.WriteOptions{To: &to, More: true}); err != nil {
+		t.Fatalf("Write(_, {To: %#v, More: true}): %s", to, err)
+	}
+	injected := false
+	c.linkEps[1].AddNotify(writeNotifier(func() {
+		if injected {
+			return
+		}
+		injected = true
+		c.sendV4Packet(newPayload(), &headers{srcPort: srcPort, dstPort: testDstPort}, 1)
+	}))
+	closing.Close()
+	if !injected {
+		t.Fatal("closing the member didn't write the pending datagram")
+	}
+
+	if _, err := survivor.Read(ioutil.Discard, tcpip.ReadOptions{}); err != nil {
+		t.Errorf("survivor.Read(...) = %s, want the packet hashed to the closing member", err)
+	}
+	if got := survivor.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ReusePortMiss.Value(); got != 1 {
+		t.Errorf("got ReusePortMiss = %d on the surviving member, want = 1", got)
+	}
+	if got := closing.Stats().(*tcpip.TransportEndpointStats).PacketsReceived.Value(); got != closingReceived {
+		t.Errorf("got closing member PacketsReceived = %d, want = %d", got, closingReceived)
+	}
+}
+
+// TestDemuxPrecedence checks that a packet is delivered to the endpoint that
+// most closely matches its 4-tuple.
+func TestDemuxPrecedence(t *testing.T) {
+	c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{1})
+
+	newEndpoint := func(name string, addr tcpip.FullAddress, peer *tcpip.FullAddress) tcpip.Endpoint {
+		t.Helper()
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		t.Cleanup(ep.Close)
+		ep.SocketOptions().SetReusePort(true)
+		if err := ep.Bind(addr); err != nil {
+			t.Fatalf("%s: ep.Bind(%#v): %s", name, addr, err)
+		}
+		if peer != nil {
+			if err := ep.Connect(*peer); err != nil {
+				t.Fatalf("%s: ep.Connect(%#v): %s", name, *peer, err)
+			}
+		}
+		return ep
+	}
+
+	connected := newEndpoint("connected", tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}, &tcpip.FullAddress{Addr: testSrcAddrV4, Port: testSrcPort})
+	bound := newEndpoint("bound", tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}, nil)
+	wildcard := newEndpoint("wildcard", tcpip.FullAddress{Port: testDstPort}, nil)
+
+	eps := map[tcpip.Endpoint]string{
+		connected: "connected",
+		bound:     "bound",
+		wildcard:  "wildcard",
+	}
+	checkDelivery := func(srcPort uint16, want tcpip.Endpoint) {
+		t.Helper()
+		c.sendV4Packet(newPayload(), &headers{srcPort: srcPort, dstPort: testDstPort}, 1)
+		for ep, name := range eps {
+			_, err := ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+			if ep == want {
+				if err != nil {
+					t.Errorf("packet from port %d: Read on %s endpoint failed: %s", srcPort, name, err)
+				}
+			} else if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+				t.Errorf("packet from port %d: got Read on %s endpoint = %v, want = %s", srcPort, name, err, &tcpip.ErrWouldBlock{})
+			}
+		}
+	}
+
+	checkDelivery(testSrcPort, connected)
+	checkDelivery(testSrcPort+1, bound)
+
+	bound.Close()
+	delete(eps, bound)
+	checkDelivery(testSrcPort, connected)
+	checkDelivery(testSrcPort+1, wildcard)
+}
+
+// BenchmarkDemuxConnected measures the per-packet cost of demultiplexing to
+// one of many connected endpoints sharing a local port. Connected endpoints
+// are found with an exact match on their 4-tuple before any wildcard is
+// considered, so the cost must not grow with the number of endpoints.
+func BenchmarkDemuxConnected(b *testing.B) {
+	// Packets are only sent to the first few endpoints so that the work done
+	// per packet, other than the lookup, is the same for every group size.
+	const numTargets = 16
+
+	for _, numEndpoints := range []int{numTargets, 1_000, 10_000} {
+		b.Run(strconv.Itoa(numEndpoints), func(b *testing.B) {
+			c := newDualTestContextMultiNIC(b, defaultMTU, []tcpip.NICID{1})
+
+			eps := make([]tcpip.Endpoint, numEndpoints)
+			for i := range eps {
+				var wq waiter.Queue
+				ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+				if err != nil {
+					b.Fatalf("NewEndpoint failed: %s", err)
+				}
+				defer ep.Close()
+				ep.SocketOptions().SetReusePort(true)
+				if err := ep.Bind(tcpip.FullAddress{Addr: testDstAddrV4, Port: testDstPort}); err != nil {
+					b.Fatalf("ep.Bind(...) on endpoint %d failed: %s", i, err)
+				}
+				if err := ep.Connect(tcpip.FullAddress{Addr: testSrcAddrV4, Port: uint16(testSrcPort + i)}); err != nil {
+					b.Fatalf("ep.Connect(...) on endpoint %d failed: %s", i, err)
+				}
+				eps[i] = ep
+			}
+
+			payload := newPayload()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx := i % numTargets
+				c.sendV4Packet(payload, &headers{srcPort: uint16(testSrcPort + idx), dstPort: testDstPort}, 1)
+				if _, err := eps[idx].Read(ioutil.Discard, tcpip.ReadOptions{}); err != nil {
+					b.Fatalf("Read on endpoint %d failed: %s", idx, err)
+				}
+			}
+		})
+	}
+}
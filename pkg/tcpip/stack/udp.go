@@ -0,0 +1,406 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/ports"
+)
+
+// UDPTapDirection indicates whether a datagram passed to a UDPTapFunc was
+// received or sent by the stack.
+type UDPTapDirection int
+
+const (
+	// UDPTapIncoming indicates a datagram received by the stack.
+	UDPTapIncoming UDPTapDirection = iota
+
+	// UDPTapOutgoing indicates a datagram sent by the stack.
+	UDPTapOutgoing
+)
+
+// UDPTapFunc is the expected function type for a UDP tap function to be
+// passed to Stack.SetUDPTap.
+//
+// The tap must not modify or hold on to pkt after it returns; it should clone
+// the packet if it needs to keep it.
+type UDPTapFunc func(dir UDPTapDirection, pkt *PacketBuffer)
+
+// UDPSourcePortRewriter is the expected function type for a source port
+// rewriter to be passed to Stack.SetUDPSourcePortRewriter.
+//
+// id describes the outgoing datagram from the sender's point of view. If ok is
+// true, the datagram is sent with newSrcPort as its source port instead of
+// id.LocalPort.
+type UDPSourcePortRewriter func(id TransportEndpointID) (newSrcPort uint16, ok bool)
+
+// UDPPromiscuousReceiveCheck is the expected function type for a privilege
+// check to be passed to Stack.SetUDPPromiscuousReceiveCheck. It returns true if
+// the caller may open a promiscuous UDP listener.
+type UDPPromiscuousReceiveCheck func() bool
+
+// PortEventKind indicates whether a PortEvent reports a port reservation or
+// release.
+type PortEventKind int
+
+const (
+	// PortReserved indicates that a port was reserved.
+	PortReserved PortEventKind = iota
+
+	// PortReleased indicates that a port reservation was released.
+	PortReleased
+)
+
+// PortEvent describes a UDP port reservation or release, for
+// Stack.SetPortEventHandler.
+type PortEvent struct {
+	Kind PortEventKind
+
+	// Addr is the local address the port is reserved on, or empty for all
+	// addresses.
+	Addr tcpip.Address
+
+	// Port is the reserved port.
+	Port uint16
+
+	// Flags are the port's sharing flags.
+	Flags ports.Flags
+
+	// BindToDevice is the NIC the reservation is limited to, or 0 for all
+	// NICs.
+	BindToDevice tcpip.NICID
+}
+
+// PortEventHandler is the expected function type for a handler to be passed
+// to Stack.SetPortEventHandler.
+type PortEventHandler func(ev PortEvent)
+
+// MaxMalformedPacketCaptureSize is the maximum number of bytes of a malformed
+// packet passed to a MalformedPacketCaptureFunc.
+const MaxMalformedPacketCaptureSize = 256
+
+// MalformedPacketCaptureFunc is the expected function type for a capture
+// function to be passed to Stack.SetMalformedPacketCapture.
+//
+// reason describes why the packet was dropped. raw holds the packet from its
+// network header onwards, truncated to MaxMalformedPacketCaptureSize bytes.
+// raw is not used by the stack after the function returns.
+type MalformedPacketCaptureFunc func(reason string, raw []byte)
+
+// udpReceiveQueueFlusher is implemented by UDP endpoints that can discard the
+// datagrams queued for reading.
+type udpReceiveQueueFlusher interface {
+	// FlushReceiveQueue discards all queued datagrams and returns the number
+	// of datagrams discarded.
+	FlushReceiveQueue() int
+}
+
+// udpEndpointNamer is implemented by UDP endpoints that can be labelled for
+// diagnostics.
+type udpEndpointNamer interface {
+	// Name returns the endpoint's label.
+	Name() string
+}
+
+// UDPEndpointInfo describes a registered UDP endpoint.
+type UDPEndpointInfo struct {
+	// ID is the endpoint's local and remote addresses and ports.
+	ID TransportEndpointID
+
+	// NetProto is the endpoint's network protocol.
+	NetProto tcpip.NetworkProtocolNumber
+
+	// Name is the label set on the endpoint for diagnostics, if any.
+	Name string
+}
+
+// udpEndpoints returns a snapshot of the registered UDP endpoints.
+//
+// Only the demuxer's locks are held while the snapshot is taken, so callers
+// may call into the returned endpoints without risking a lock order inversion
+// with endpoints that call into the stack while holding their own locks.
+func (s *Stack) udpEndpoints() []TransportEndpoint {
+	// Dual-stack endpoints are registered for both network protocols.
+	seen := make(map[TransportEndpoint]struct{})
+	var es []TransportEndpoint
+	for ids, eps := range s.demux.protocol {
+		if ids.transport != header.UDPProtocolNumber {
+			continue
+		}
+		for _, ep := range eps.transportEndpoints() {
+			if _, ok := seen[ep]; ok {
+				continue
+			}
+			seen[ep] = struct{}{}
+			es = append(es, ep)
+		}
+	}
+	return es
+}
+
+// FlushUDPReceiveQueues discards the datagrams queued for reading on all
+// registered UDP endpoints and returns the number of datagrams discarded.
+func (s *Stack) FlushUDPReceiveQueues() int {
+	n := 0
+	for _, ep := range s.udpEndpoints() {
+		if f, ok := ep.(udpReceiveQueueFlusher); ok {
+			n += f.FlushReceiveQueue()
+		}
+	}
+	return n
+}
+
+// UDPEndpoints returns a description of every registered UDP endpoint, in no
+// particular order.
+func (s *Stack) UDPEndpoints() []UDPEndpointInfo {
+	var infos []UDPEndpointInfo
+	for _, ep := range s.udpEndpoints() {
+		var info UDPEndpointInfo
+		if i, ok := ep.(interface{ Info() tcpip.EndpointInfo }); ok {
+			if ti, ok := i.Info().(*TransportEndpointInfo); ok {
+				info.ID = ti.ID
+				info.NetProto = ti.NetProto
+			}
+		}
+		if n, ok := ep.(udpEndpointNamer); ok {
+			info.Name = n.Name()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+const (
+	// udpConntrackTimeout is how long a UDP flow that has only seen packets
+	// in its original direction is tracked after its last packet. It matches
+	// Linux's nf_conntrack_udp_timeout.
+	udpConntrackTimeout = 30 * time.Second
+
+	// udpConntrackStreamTimeout is how long a UDP flow that has seen packets
+	// in both directions is tracked after its last packet. It matches Linux's
+	// nf_conntrack_udp_timeout_stream.
+	udpConntrackStreamTimeout = 120 * time.Second
+)
+
+// UDPConntrackTuple identifies a tracked UDP flow in one direction.
+type UDPConntrackTuple struct {
+	NetProto tcpip.NetworkProtocolNumber
+	SrcAddr  tcpip.Address
+	SrcPort  uint16
+	DstAddr  tcpip.Address
+	DstPort  uint16
+}
+
+// reply returns the tuple of the opposite direction.
+func (t UDPConntrackTuple) reply() UDPConntrackTuple {
+	return UDPConntrackTuple{
+		NetProto: t.NetProto,
+		SrcAddr:  t.DstAddr,
+		SrcPort:  t.DstPort,
+		DstAddr:  t.SrcAddr,
+		DstPort:  t.SrcPort,
+	}
+}
+
+// UDPConntrackEntry is the state of a tracked UDP flow.
+type UDPConntrackEntry struct {
+	// Original is the tuple of the first packet seen on the flow.
+	Original UDPConntrackTuple
+
+	// Reply is the tuple of packets in the opposite direction.
+	Reply UDPConntrackTuple
+
+	// LastSeen is the time the last packet was seen on the flow.
+	LastSeen tcpip.MonotonicTime
+
+	// OriginalPackets is the number of packets seen in the original direction.
+	OriginalPackets uint64
+
+	// ReplyPackets is the number of packets seen in the reply direction.
+	ReplyPackets uint64
+}
+
+func (e *UDPConntrackEntry) expired(now tcpip.MonotonicTime) bool {
+	timeout := udpConntrackTimeout
+	if e.ReplyPackets != 0 {
+		timeout = udpConntrackStreamTimeout
+	}
+	return now.Sub(e.LastSeen) > timeout
+}
+
+// udpConntrack tracks the UDP flows sent and received by the stack.
+type udpConntrack struct {
+	// enabled is non-zero if flows are tracked. Accessed atomically.
+	enabled uint32
+
+	mu sync.Mutex
+	// +checklocks:mu
+	clock tcpip.Clock
+	// entries holds every tracked flow keyed by both its original and reply
+	// tuples.
+	//
+	// +checklocks:mu
+	entries map[UDPConntrackTuple]*UDPConntrackEntry
+	// reapTimer removes expired entries. It is nil when there are no entries.
+	//
+	// +checklocks:mu
+	reapTimer tcpip.Timer
+	// reapGen identifies the latest reapTimer. A reap that already fired
+	// when its timer was replaced sees a different generation and does
+	// nothing.
+	//
+	// +checklocks:mu
+	reapGen uint64
+}
+
+func (ct *udpConntrack) setEnabled(clock tcpip.Clock, v bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if v {
+		ct.clock = clock
+		atomic.StoreUint32(&ct.enabled, 1)
+		return
+	}
+	atomic.StoreUint32(&ct.enabled, 0)
+	ct.clock = nil
+	ct.entries = nil
+	if ct.reapTimer != nil {
+		ct.reapTimer.Stop()
+		ct.reapTimer = nil
+	}
+}
+
+// track records pkt, an outgoing or incoming UDP packet, on its flow.
+func (ct *udpConntrack) track(pkt *PacketBuffer) {
+	if atomic.LoadUint32(&ct.enabled) == 0 || pkt.TransportProtocolNumber != header.UDPProtocolNumber {
+		return
+	}
+	udp := header.UDP(pkt.TransportHeader().View())
+	if len(udp) < header.UDPMinimumSize {
+		return
+	}
+	netHdr := pkt.Network()
+	t := UDPConntrackTuple{
+		NetProto: pkt.NetworkProtocolNumber,
+		SrcAddr:  netHdr.SourceAddress(),
+		SrcPort:  udp.SourcePort(),
+		DstAddr:  netHdr.DestinationAddress(),
+		DstPort:  udp.DestinationPort(),
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.clock == nil {
+		// Tracking was disabled concurrently.
+		return
+	}
+	now := ct.clock.NowMonotonic()
+	e, ok := ct.entries[t]
+	if ok && e.expired(now) {
+		ct.removeLocked(e)
+		ok = false
+	}
+	if !ok {
+		e = &UDPConntrackEntry{
+			Original: t,
+			Reply:    t.reply(),
+		}
+		if ct.entries == nil {
+			ct.entries = make(map[UDPConntrackTuple]*UDPConntrackEntry)
+		}
+		ct.entries[e.Original] = e
+		ct.entries[e.Reply] = e
+		if ct.reapTimer == nil {
+			ct.scheduleReapLocked()
+		}
+	}
+	if t == e.Original {
+		e.OriginalPackets++
+	} else {
+		e.ReplyPackets++
+	}
+	e.LastSeen = now
+}
+
+// +checklocks:ct.mu
+func (ct *udpConntrack) removeLocked(e *UDPConntrackEntry) {
+	delete(ct.entries, e.Original)
+	delete(ct.entries, e.Reply)
+}
+
+// +checklocks:ct.mu
+func (ct *udpConntrack) scheduleReapLocked() {
+	ct.reapGen++
+	gen := ct.reapGen
+	ct.reapTimer = ct.clock.AfterFunc(udpConntrackTimeout, func() {
+		ct.reap(gen)
+	})
+}
+
+// reap removes expired entries and reschedules itself while entries remain.
+// gen is the generation of the timer that fired.
+func (ct *udpConntrack) reap(gen uint64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.reapTimer == nil || gen != ct.reapGen {
+		// Tracking was disabled after the timer fired, and possibly
+		// re-enabled with a new timer.
+		return
+	}
+	now := ct.clock.NowMonotonic()
+	for _, e := range ct.entries {
+		if e.expired(now) {
+			ct.removeLocked(e)
+		}
+	}
+	if len(ct.entries) == 0 {
+		ct.reapTimer = nil
+		return
+	}
+	ct.scheduleReapLocked()
+}
+
+// SetUDPConntrack enables or disables tracking of the UDP flows sent and
+// received by the stack. Disabling tracking discards all tracked flows.
+func (s *Stack) SetUDPConntrack(v bool) {
+	s.udpConntrack.setEnabled(s.clock, v)
+}
+
+// UDPConntrackEntries returns the UDP flows tracked since SetUDPConntrack
+// enabled tracking, in no particular order. Flows age out after 30 seconds
+// without packets, or 120 seconds once packets were seen in both directions.
+func (s *Stack) UDPConntrackEntries() []UDPConntrackEntry {
+	ct := &s.udpConntrack
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.clock == nil {
+		return nil
+	}
+	now := ct.clock.NowMonotonic()
+	var entries []UDPConntrackEntry
+	for t, e := range ct.entries {
+		// Each entry is keyed by both of its tuples; only report it once.
+		if t != e.Original || e.expired(now) {
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	return entries
+}
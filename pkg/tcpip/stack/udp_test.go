@@ -0,0 +1,65 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/faketime"
+)
+
+func TestUDPConntrackStaleReap(t *testing.T) {
+	clock := faketime.NewManualClock()
+	var ct udpConntrack
+	ct.setEnabled(clock, true)
+
+	tuple := UDPConntrackTuple{SrcPort: 1, DstPort: 2}
+	addEntry := func() {
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		e := &UDPConntrackEntry{Original: tuple, Reply: tuple.reply()}
+		ct.entries = map[UDPConntrackTuple]*UDPConntrackEntry{e.Original: e, e.Reply: e}
+		ct.scheduleReapLocked()
+	}
+
+	// A reap whose timer fired right before tracking was disabled, re-enabled
+	// and a new timer was scheduled must not schedule a second timer.
+	addEntry()
+	ct.mu.Lock()
+	stale := ct.reapGen
+	ct.mu.Unlock()
+	ct.setEnabled(nil, false)
+	ct.setEnabled(clock, true)
+	addEntry()
+	ct.mu.Lock()
+	timer, gen := ct.reapTimer, ct.reapGen
+	ct.mu.Unlock()
+
+	ct.reap(stale)
+	ct.mu.Lock()
+	if ct.reapTimer != timer || ct.reapGen != gen {
+		t.Errorf("stale reap replaced the reap timer: got generation %d, want %d", ct.reapGen, gen)
+	}
+	ct.mu.Unlock()
+
+	// The current timer still reaps the entry once it expires.
+	clock.Advance(udpConntrackTimeout)
+	clock.Advance(udpConntrackTimeout)
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if len(ct.entries) != 0 || ct.reapTimer != nil {
+		t.Errorf("got %d entries and reap timer %v after the timeout, want none", len(ct.entries), ct.reapTimer)
+	}
+}
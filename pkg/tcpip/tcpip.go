@@ -457,6 +457,13 @@ type ControlMessages struct {
 	// IPv6PacketInfo holds interface and address data on an incoming packet.
 	IPv6PacketInfo IPv6PacketInfo
 
+	// HasIPv6Info indicates whether IPv6Info is set.
+	HasIPv6Info bool
+
+	// IPv6Info holds the traffic class and flow label of an incoming IPv6
+	// packet.
+	IPv6Info IPv6Info
+
 	// HasOriginalDestinationAddress indicates whether OriginalDstAddress is
 	// set.
 	HasOriginalDstAddress bool
@@ -465,6 +472,60 @@ type ControlMessages struct {
 	// and port of the incoming packet.
 	OriginalDstAddress FullAddress
 
+	// HasIPID indicates whether IPID is set.
+	HasIPID bool
+
+	// IPID is the identification field of the IPv4 header of the incoming
+	// packet.
+	IPID uint16
+
+	// HasIncomingCPU indicates whether IncomingCPU is set.
+	HasIncomingCPU bool
+
+	// IncomingCPU is the receive steering bucket that selected this endpoint
+	// among the endpoints sharing its port.
+	IncomingCPU int
+
+	// WasBroadcast indicates the incoming packet was sent to a broadcast
+	// address. It is only set if destination type reporting is enabled.
+	WasBroadcast bool
+
+	// WasMulticast indicates the incoming packet was sent to a multicast
+	// address. It is only set if destination type reporting is enabled.
+	WasMulticast bool
+
+	// HasGROSegmentSize indicates whether GROSegmentSize is set.
+	HasGROSegmentSize bool
+
+	// GROSegmentSize is the size of each datagram merged into the read when
+	// UDP_GRO is enabled. The last datagram may be shorter.
+	GROSegmentSize uint16
+
+	// HasIfIndex indicates whether IfIndex is set.
+	HasIfIndex bool
+
+	// IfIndex is the ID of the NIC the incoming packet arrived on. Unlike
+	// PacketInfo, it does not carry the packet's addresses.
+	IfIndex NICID
+
+	// HasLinkPriority indicates whether LinkPriority is set.
+	HasLinkPriority bool
+
+	// LinkPriority is the priority carried by the link layer of the incoming
+	// packet, e.g. the VLAN priority code point.
+	LinkPriority uint32
+
+	// HasLinkSource indicates whether LinkSource is set.
+	HasLinkSource bool
+
+	// LinkSource is the link-layer source address of the incoming packet,
+	// e.g. the source MAC address of an Ethernet frame.
+	LinkSource LinkAddress
+
+	// WasFragmented indicates that the incoming packet was reassembled from
+	// multiple IP fragments. It is only reported if the socket asked for it.
+	WasFragmented bool
+
 	// SockErr is the dequeued socket error on recvmsg(MSG_ERRQUEUE).
 	SockErr *SockError
 }
@@ -490,6 +551,17 @@ type ReadOptions struct {
 	// NeedLinkPacketInfo indicates whether to return the link-layer information,
 	// if supported.
 	NeedLinkPacketInfo bool
+
+	// NeedInboundNIC indicates whether to return the ID of the NIC the packet
+	// was received on, if supported.
+	NeedInboundNIC bool
+
+	// Continue indicates that the read should return the remainder of the
+	// last datagram that was only partially read with Continue, instead of
+	// the next datagram, if supported. Without such a remainder, the next
+	// datagram is read. If the datagram doesn't fit, its remainder is kept for
+	// the next read with Continue; without Continue, it is discarded.
+	Continue bool
 }
 
 // ReadResult represents result for a successful Endpoint.Read.
@@ -510,6 +582,10 @@ type ReadResult struct {
 	// LinkPacketInfo is the link-layer information of the received packet if
 	// ReadOptions.NeedLinkPacketInfo is true.
 	LinkPacketInfo LinkPacketInfo
+
+	// InboundNIC is the ID of the NIC the packet was received on if
+	// ReadOptions.NeedInboundNIC is true.
+	InboundNIC NICID
 }
 
 // Endpoint is the interface implemented by transport protocols (e.g., tcp, udp)
@@ -687,6 +763,128 @@ type WriteOptions struct {
 	// endpoint. If Atomic is false, then data fetched from the Payloader may be
 	// discarded if available endpoint buffer space is unsufficient.
 	Atomic bool
+
+	// SourcePort, if non-zero, is the source port to use for this write. The
+	// port must be reserved by the endpoint.
+	SourcePort uint16
+
+	// IPv6RoutingHeader, if not nil, is included as a Routing extension header
+	// between the IPv6 header and the transport header. It is only valid for
+	// writes sent over IPv6.
+	IPv6RoutingHeader *IPv6RoutingHeader
+
+	// IPv4Options, if not nil, describes IP options to include in the IPv4
+	// header. It is only valid for writes sent over IPv4.
+	IPv4Options *IPv4WriteOptions
+
+	// WantDetail, if not nil, is filled with details of the write, such as the
+	// route that was resolved and the stage at which the write failed.
+	WantDetail *WriteResult
+
+	// NIC, if non-zero, is the NIC the datagram is sent out of. It overrides
+	// route selection, the NIC in To and the endpoint's SO_BINDTODEVICE
+	// setting for this write only. The write fails with ErrNoRoute if the
+	// destination is not reachable through NIC.
+	NIC NICID
+}
+
+// WriteStage identifies a step in sending a datagram.
+type WriteStage int
+
+const (
+	// WriteStageNone indicates that the write did not fail.
+	WriteStageNone WriteStage = iota
+
+	// WriteStagePrepare indicates that the write was rejected while it was
+	// validated, e.g. because of the endpoint's state or the payload size.
+	WriteStagePrepare
+
+	// WriteStageRoute indicates that no usable route to the destination was
+	// found.
+	WriteStageRoute
+
+	// WriteStageSend indicates that the network layer failed to send the
+	// packet.
+	WriteStageSend
+)
+
+// String implements fmt.Stringer.
+func (s WriteStage) String() string {
+	switch s {
+	case WriteStageNone:
+		return "none"
+	case WriteStagePrepare:
+		return "prepare"
+	case WriteStageRoute:
+		return "route resolution"
+	case WriteStageSend:
+		return "send"
+	default:
+		return fmt.Sprintf("WriteStage(%d)", int(s))
+	}
+}
+
+// WriteResult holds the details of a write requested with
+// WriteOptions.WantDetail.
+type WriteResult struct {
+	// LocalAddress is the source address chosen for the datagram.
+	// RemoteAddress is the destination the route was resolved for, and
+	// NextHop is the gateway the datagram is sent through, if any. They are
+	// empty if the write failed before a route was resolved.
+	LocalAddress  Address
+	RemoteAddress Address
+	NextHop       Address
+
+	// EgressNIC is the NIC a successful write sent the datagram out of. It is
+	// zero if the write failed.
+	EgressNIC NICID
+
+	// FailedStage is the stage at which the write failed, or WriteStageNone if
+	// it succeeded.
+	FailedStage WriteStage
+}
+
+// RouteInfo describes the route a datagram to a destination would take.
+type RouteInfo struct {
+	// NIC is the interface the datagram would be sent out of.
+	NIC NICID
+
+	// LocalAddress is the source address that would be used.
+	LocalAddress Address
+
+	// RemoteAddress is the destination the route was resolved for.
+	RemoteAddress Address
+
+	// NextHop is the gateway the datagram would be sent through, or empty if
+	// the destination is on-link.
+	NextHop Address
+}
+
+// IPv4WriteOptions describes the IPv4 options included in an outgoing
+// datagram. Together the options must fit in the 40 bytes available for IPv4
+// options.
+type IPv4WriteOptions struct {
+	// RecordRouteSlots, if non-zero, includes an empty Record Route option
+	// (RFC 791) with room for this many addresses.
+	RecordRouteSlots uint8
+
+	// TimestampSlots, if non-zero, includes an empty timestamps-only Timestamp
+	// option (RFC 791) with room for this many timestamps.
+	TimestampSlots uint8
+}
+
+// IPv6RoutingHeader holds the fields of an IPv6 Routing extension header as
+// defined in RFC 8200 section 4.4.
+type IPv6RoutingHeader struct {
+	// RoutingType is the Routing Type field. Type 0 is deprecated by RFC 5095
+	// and may not be sent.
+	RoutingType uint8
+
+	// SegmentsLeft is the Segments Left field.
+	SegmentsLeft uint8
+
+	// Data is the type-specific data.
+	Data []byte
 }
 
 // SockOptInt represents socket options which values have the int type.
@@ -715,8 +913,7 @@ const (
 	// MTUDiscoverOption is used to set/get the path MTU discovery setting.
 	//
 	// NOTE: Setting this option to any other value than PMTUDiscoveryDont
-	// is not supported and will fail as such, and getting this option will
-	// always return PMTUDiscoveryDont.
+	// or PMTUDiscoveryInterface is not supported and will fail as such.
 	MTUDiscoverOption
 
 	// MulticastTTLOption is used by SetSockOptInt/GetSockOptInt to control
@@ -750,6 +947,13 @@ const (
 	//
 	// NOTE: This option is currently only stubed out and is a no-op
 	TCPWindowClampOption
+
+	// PriorityOption is used by SetSockOptInt/GetSockOptInt to set the
+	// priority (0-7) of the endpoint's outgoing packets. Unless a traffic
+	// class is set explicitly with IPv6TrafficClassOption, outgoing IPv6
+	// packets carry the class selector code point for the priority (RFC 2474
+	// section 4.2.2).
+	PriorityOption
 )
 
 const (
@@ -768,6 +972,11 @@ const (
 	// PMTUDiscoveryProbe is a setting of the MTUDiscoverOption to set DF
 	// but ignore path MTU.
 	PMTUDiscoveryProbe
+
+	// PMTUDiscoveryInterface is a setting of the MTUDiscoverOption to ignore
+	// path MTU information and never fragment, rejecting packets larger than
+	// the outgoing interface's MTU.
+	PMTUDiscoveryInterface
 )
 
 // GettableNetworkProtocolOption is a marker interface for network protocol
@@ -1106,6 +1315,15 @@ type RemoveMembershipOption MembershipOption
 
 func (*RemoveMembershipOption) isSettableSocketOption() {}
 
+// MembershipInfo describes a multicast group an endpoint has joined.
+type MembershipInfo struct {
+	// NIC is the interface the group was joined on.
+	NIC NICID
+
+	// MulticastAddr is the address of the multicast group.
+	MulticastAddr Address
+}
+
 // SocketDetachFilterOption is used by SetSockOpt to detach a previously attached
 // classic BPF filter on a given endpoint.
 type SocketDetachFilterOption int
@@ -1146,6 +1364,24 @@ const (
 	TCPTimeWaitReuseLoopbackOnly
 )
 
+// UDPSeparateZeroChecksumStatsOption controls whether received IPv6 UDP
+// datagrams with an illegal zero checksum are only counted in
+// UDPStats.ZeroChecksumIPv6, instead of also being counted as checksum errors.
+type UDPSeparateZeroChecksumStatsOption bool
+
+func (*UDPSeparateZeroChecksumStatsOption) isGettableTransportProtocolOption() {}
+
+func (*UDPSeparateZeroChecksumStatsOption) isSettableTransportProtocolOption() {}
+
+// UDPWriteAndReturnPacketOption enables the debugging-only
+// WriteAndReturnPacket method of UDP endpoints, which returns a clone of each
+// emitted packet.
+type UDPWriteAndReturnPacketOption bool
+
+func (*UDPWriteAndReturnPacketOption) isGettableTransportProtocolOption() {}
+
+func (*UDPWriteAndReturnPacketOption) isSettableTransportProtocolOption() {}
+
 // LingerOption is used by SetSockOpt/GetSockOpt to set/get the
 // duration for which a socket lingers before returning from Close.
 //
@@ -1178,6 +1414,14 @@ type IPv6PacketInfo struct {
 	NIC  NICID
 }
 
+// IPv6Info holds the traffic class and flow label of an IPv6 packet.
+//
+// +stateify savable
+type IPv6Info struct {
+	TrafficClass uint8
+	FlowLabel    uint32
+}
+
 // SendBufferSizeOption is used by stack.(Stack*).Option/SetOption to
 // get/set the default, min and max send buffer sizes.
 type SendBufferSizeOption struct {
@@ -1295,6 +1539,14 @@ func (s *StatCounter) IncrementBy(v uint64) {
 	s.count.Add(v)
 }
 
+// swapZero zeroes the counter and returns its prior value. Increments racing
+// with the reset are not lost.
+func (s *StatCounter) swapZero() uint64 {
+	v := s.count.Load()
+	s.count.Add(-v)
+	return v
+}
+
 func (s *StatCounter) String() string {
 	return strconv.FormatUint(s.Value(), 10)
 }
@@ -1898,6 +2150,20 @@ type UDPStats struct {
 
 	// ChecksumErrors is the number of datagrams dropped due to bad checksums.
 	ChecksumErrors *StatCounter
+
+	// ZeroChecksumIPv6 is the number of IPv6 datagrams dropped because their
+	// checksum was zero, which is not allowed on IPv6. Unless
+	// UDPSeparateZeroChecksumStatsOption is set, these datagrams are also
+	// counted in ChecksumErrors.
+	ZeroChecksumIPv6 *StatCounter
+
+	// Coalesced is the number of datagrams returned as part of a coalesced
+	// read.
+	Coalesced *StatCounter
+
+	// CoalesceBatches is the number of reads that coalesced more than one
+	// datagram.
+	CoalesceBatches *StatCounter
 }
 
 // NICNeighborStats holds metrics for the neighbor table.
@@ -2091,6 +2357,15 @@ type ReceiveErrors struct {
 
 	// ChecksumErrors is the number of packets dropped due to bad checksums.
 	ChecksumErrors StatCounter
+
+	// ReusePortMiss is the number of received packets that were hashed to
+	// another member of the endpoint's SO_REUSEPORT group that was closing,
+	// and were delivered to this endpoint instead.
+	ReusePortMiss StatCounter
+
+	// SourcePortFiltered is the number of received packets dropped because
+	// their source port was not in the endpoint's allow-list.
+	SourcePortFiltered StatCounter
 }
 
 // SendErrors collects packet send errors within the transport layer for an
@@ -2150,6 +2425,12 @@ type TransportEndpointStats struct {
 	// PacketsSent is the number of successful packet sends.
 	PacketsSent StatCounter
 
+	// ReceivedUnicast, ReceivedMulticast and ReceivedBroadcast break
+	// PacketsReceived down by the type of the packets' destination address.
+	ReceivedUnicast   StatCounter
+	ReceivedMulticast StatCounter
+	ReceivedBroadcast StatCounter
+
 	// ReceiveErrors collects packet receive errors within transport layer.
 	ReceiveErrors ReceiveErrors
 
@@ -2213,6 +2494,42 @@ func clone(dst reflect.Value, src reflect.Value) {
 	}
 }
 
+// Reset zeroes every counter of src and returns a copy holding the values
+// they had before the reset. Each counter is reset atomically, but the
+// counters are not reset together as a single atomic operation.
+func (src *TransportEndpointStats) Reset() TransportEndpointStats {
+	var dst TransportEndpointStats
+	cloneAndReset(reflect.ValueOf(&dst).Elem(), reflect.ValueOf(src).Elem())
+	return dst
+}
+
+func cloneAndReset(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		d := dst.Field(i)
+		s := src.Field(i)
+		if c, ok := s.Addr().Interface().(*StatCounter); ok {
+			d.Addr().Interface().(*StatCounter).IncrementBy(c.swapZero())
+		} else {
+			cloneAndReset(d, s)
+		}
+	}
+}
+
+// Reset zeroes every counter of s and returns a copy holding the values they
+// had before the reset. Each counter is reset atomically, but the counters are
+// not reset together as a single atomic operation.
+func (s *UDPStats) Reset() UDPStats {
+	var prev UDPStats
+	dst := reflect.ValueOf(&prev).Elem()
+	InitStatCounters(dst)
+	src := reflect.ValueOf(s).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		c := src.Field(i).Interface().(*StatCounter)
+		dst.Field(i).Interface().(*StatCounter).IncrementBy(c.swapZero())
+	}
+	return prev
+}
+
 // String implements the fmt.Stringer interface.
 func (a Address) String() string {
 	switch len(a) {
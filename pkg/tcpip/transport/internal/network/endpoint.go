@@ -18,6 +18,7 @@ package network
 
 import (
 	"fmt"
+	"sort"
 	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/sync"
@@ -51,6 +52,11 @@ type Endpoint struct {
 	effectiveNetProto tcpip.NetworkProtocolNumber
 	// +checklocks:mu
 	connectedRoute *stack.Route `state:"manual"`
+	// connectedRouteGen is the stack's route table generation observed when
+	// connectedRoute was looked up.
+	//
+	// +checklocks:mu
+	connectedRouteGen uint32
 	// +checklocks:mu
 	multicastMemberships map[multicastMembership]struct{}
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
@@ -59,16 +65,33 @@ type Endpoint struct {
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
 	// +checklocks:mu
 	multicastTTL uint8
+	// multicastTTLSet is true if multicastTTL was set through
+	// MulticastTTLOption, in which case it takes precedence over the NIC's
+	// default multicast TTL.
+	//
+	// +checklocks:mu
+	multicastTTLSet bool
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
 	// +checklocks:mu
 	multicastAddr tcpip.Address
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
 	// +checklocks:mu
 	multicastNICID tcpip.NICID
+	// pmtud is the path MTU discovery mode set through MTUDiscoverOption.
+	//
+	// +checklocks:mu
+	pmtud int
 	// +checklocks:mu
 	ipv4TOS uint8
 	// +checklocks:mu
 	ipv6TClass uint8
+	// ipv6TClassSet is true if ipv6TClass was set explicitly, in which case
+	// it takes precedence over the traffic class derived from priority.
+	//
+	// +checklocks:mu
+	ipv6TClassSet bool
+	// +checklocks:mu
+	priority uint8
 
 	// Lock ordering: mu > infoMu.
 	infoMu sync.RWMutex `state:"nosave"`
@@ -134,6 +157,7 @@ func (e *Endpoint) Init(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, tr
 		// Linux defaults to TTL=1.
 		multicastTTL:         1,
 		multicastMemberships: make(map[multicastMembership]struct{}),
+		pmtud:                tcpip.PMTUDiscoveryDont,
 	}
 
 	e.mu.Lock()
@@ -210,6 +234,16 @@ type WriteContext struct {
 	ttl        uint8
 	tos        uint8
 	owner      tcpip.PacketOwner
+	useMinMTU  bool
+	extHdrs    header.IPv6ExtHdrSerializer
+	ipv4Opts   header.IPv4OptionsSerializer
+	// finalDst is the final destination listed in a routing header with
+	// segments left. It is empty if packets are delivered to the route's
+	// remote address.
+	finalDst tcpip.Address
+	// interfaceMTU is true if packets larger than the interface MTU must be
+	// rejected rather than fragmented.
+	interfaceMTU bool
 }
 
 // Release releases held resources.
@@ -220,8 +254,13 @@ func (c *WriteContext) Release() {
 
 // WritePacketInfo is the properties of a packet that may be written.
 type WritePacketInfo struct {
+	NICID                       tcpip.NICID
 	NetProto                    tcpip.NetworkProtocolNumber
 	LocalAddress, RemoteAddress tcpip.Address
+	// FinalRemoteAddress is the address used in upper-layer pseudo-header
+	// checksums. It differs from RemoteAddress when a routing header lists
+	// further segments to visit.
+	FinalRemoteAddress          tcpip.Address
 	MaxHeaderLength             uint16
 	RequiresTXTransportChecksum bool
 }
@@ -229,31 +268,98 @@ type WritePacketInfo struct {
 // PacketInfo returns the properties of a packet that will be written.
 func (c *WriteContext) PacketInfo() WritePacketInfo {
 	return WritePacketInfo{
+		NICID:                       c.route.NICID(),
 		NetProto:                    c.route.NetProto(),
 		LocalAddress:                c.route.LocalAddress(),
 		RemoteAddress:               c.route.RemoteAddress(),
-		MaxHeaderLength:             c.route.MaxHeaderLength(),
+		FinalRemoteAddress:          c.finalRemoteAddress(),
+		MaxHeaderLength:             c.route.MaxHeaderLength() + uint16(c.extHdrs.Length()) + uint16(c.ipv4Opts.Length()),
 		RequiresTXTransportChecksum: c.route.RequiresTXTransportChecksum(),
 	}
 }
 
+// finalRemoteAddress returns the address packets are ultimately delivered to.
+func (c *WriteContext) finalRemoteAddress() tcpip.Address {
+	if len(c.finalDst) != 0 {
+		return c.finalDst
+	}
+	return c.route.RemoteAddress()
+}
+
+// LinkMTU returns the MTU of the link packets are written to.
+func (c *WriteContext) LinkMTU() uint32 {
+	return c.route.LinkMTU()
+}
+
 // WritePacket attempts to write the packet.
 func (c *WriteContext) WritePacket(pkt *stack.PacketBuffer, headerIncluded bool) tcpip.Error {
 	pkt.Owner = c.owner
+	pkt.NetworkPacketInfo.UseMinMTU = c.useMinMTU
 
 	if headerIncluded {
 		return c.route.WriteHeaderIncludedPacket(pkt)
 	}
 
+	if c.interfaceMTU && pkt.Size()+c.extHdrs.Length()+int(c.ipv4Opts.Length()) > int(c.route.MTU()) {
+		return &tcpip.ErrMessageTooLong{}
+	}
+
 	return c.route.WritePacket(stack.NetworkHeaderParams{
-		Protocol: c.transProto,
-		TTL:      c.ttl,
-		TOS:      c.tos,
+		Protocol:             c.transProto,
+		TTL:                  c.ttl,
+		TOS:                  c.tos,
+		IPv6ExtensionHeaders: c.extHdrs,
+		IPv4Options:          c.ipv4Opts,
 	}, pkt)
 }
 
+// revalidateConnectedRoute looks up the connected route again if the stack's
+// route table changed since it was cached, so that writes do not keep using a
+// route that no longer exists.
+func (e *Endpoint) revalidateConnectedRoute() tcpip.Error {
+	gen := e.stack.RouteTableGeneration()
+
+	e.mu.RLock()
+	stale := e.State() == transport.DatagramEndpointStateConnected && !e.writeShutdown && e.connectedRouteGen != gen
+	e.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The endpoint may have changed while the lock was released.
+	if e.State() != transport.DatagramEndpointStateConnected || e.connectedRouteGen == gen {
+		return nil
+	}
+
+	r, _, err := e.connectRouteRLocked(e.Info().RegisterNICID, tcpip.FullAddress{Addr: e.connectedRoute.RemoteAddress()}, e.connectedRoute.NetProto())
+	if err != nil {
+		return err
+	}
+	e.connectedRoute.Release()
+	e.connectedRoute = r
+	e.connectedRouteGen = gen
+	return nil
+}
+
 // AcquireContextForWrite acquires a WriteContext.
 func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext, tcpip.Error) {
+	// routeErr reports err as a failure to resolve a route.
+	routeErr := func(err tcpip.Error) (WriteContext, tcpip.Error) {
+		if d := opts.WantDetail; d != nil {
+			d.FailedStage = tcpip.WriteStageRoute
+		}
+		return WriteContext{}, err
+	}
+
+	if opts.To == nil {
+		if err := e.revalidateConnectedRoute(); err != nil {
+			return routeErr(err)
+		}
+	}
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -278,7 +384,29 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 			return WriteContext{}, &tcpip.ErrDestinationRequired{}
 		}
 
-		route.Acquire()
+		if opts.NIC == 0 {
+			route.Acquire()
+		} else {
+			var err tcpip.Error
+			route, err = e.routeThroughNICRLocked(opts.NIC, tcpip.FullAddress{Addr: route.RemoteAddress()}, route.NetProto())
+			if err != nil {
+				return routeErr(err)
+			}
+		}
+	} else if opts.NIC != 0 {
+		if opts.To.NIC != 0 && opts.To.NIC != opts.NIC {
+			return routeErr(&tcpip.ErrNoRoute{})
+		}
+
+		dst, netProto, err := e.checkV4Mapped(*opts.To)
+		if err != nil {
+			return routeErr(err)
+		}
+
+		route, err = e.routeThroughNICRLocked(opts.NIC, dst, netProto)
+		if err != nil {
+			return routeErr(err)
+		}
 	} else {
 		// Reject destination address if it goes through a different
 		// NIC than the endpoint was bound to.
@@ -289,7 +417,7 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 		info := e.Info()
 		if info.BindNICID != 0 {
 			if nicID != 0 && nicID != info.BindNICID {
-				return WriteContext{}, &tcpip.ErrNoRoute{}
+				return routeErr(&tcpip.ErrNoRoute{})
 			}
 
 			nicID = info.BindNICID
@@ -300,36 +428,115 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 
 		dst, netProto, err := e.checkV4Mapped(*opts.To)
 		if err != nil {
-			return WriteContext{}, err
+			return routeErr(err)
 		}
 
 		route, _, err = e.connectRouteRLocked(nicID, dst, netProto)
 		if err != nil {
-			return WriteContext{}, err
+			return routeErr(err)
 		}
 	}
 
 	if !e.ops.GetBroadcast() && route.IsOutboundBroadcast() {
 		route.Release()
-		return WriteContext{}, &tcpip.ErrBroadcastDisabled{}
+		return routeErr(&tcpip.ErrBroadcastDisabled{})
+	}
+
+	if d := opts.WantDetail; d != nil {
+		d.LocalAddress = route.LocalAddress()
+		d.RemoteAddress = route.RemoteAddress()
+		d.NextHop = route.NextHop()
 	}
 
 	var tos uint8
+	var useMinMTU bool
 	switch netProto := route.NetProto(); netProto {
 	case header.IPv4ProtocolNumber:
 		tos = e.ipv4TOS
 	case header.IPv6ProtocolNumber:
-		tos = e.ipv6TClass
+		tos = e.ipv6TClassRLocked()
+		switch e.ops.GetUseMinMTU() {
+		case tcpip.UseMinMTUMulticast:
+			useMinMTU = header.IsV6MulticastAddress(route.RemoteAddress())
+		case tcpip.UseMinMTUAlways:
+			useMinMTU = true
+		}
 	default:
 		panic(fmt.Sprintf("invalid protocol number = %d", netProto))
 	}
 
+	var (
+		extHdrs  header.IPv6ExtHdrSerializer
+		finalDst tcpip.Address
+	)
+	if rh := opts.IPv6RoutingHeader; rh != nil {
+		// Type 0 routing headers are deprecated as per RFC 5095 section 3.
+		if route.NetProto() != header.IPv6ProtocolNumber || rh.RoutingType == 0 {
+			route.Release()
+			return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
+		}
+		rhdr := &header.IPv6SerializableRoutingExtHdr{
+			RoutingType:  rh.RoutingType,
+			SegmentsLeft: rh.SegmentsLeft,
+			Data:         rh.Data,
+		}
+		// Upper-layer checksums are computed against the final destination
+		// when there are segments left to visit, as per RFC 8200 section 8.1.
+		if rh.SegmentsLeft > 0 {
+			addr, ok := rhdr.FinalDestination()
+			if !ok {
+				route.Release()
+				return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
+			}
+			finalDst = addr
+		}
+		extHdrs = header.IPv6ExtHdrSerializer{rhdr}
+	}
+
+	var ipv4Opts header.IPv4OptionsSerializer
+	if o := opts.IPv4Options; o != nil {
+		if route.NetProto() != header.IPv4ProtocolNumber {
+			route.Release()
+			return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
+		}
+		// Compute the size in bytes to avoid overflowing the uint8 lengths
+		// of oversized options.
+		size := 0
+		if o.RecordRouteSlots != 0 {
+			size += header.IPv4OptionRecordRouteHdrLength + int(o.RecordRouteSlots)*header.IPv4AddressSize
+			ipv4Opts = append(ipv4Opts, &header.IPv4SerializableRecordRouteOption{Slots: o.RecordRouteSlots})
+		}
+		if o.TimestampSlots != 0 {
+			size += header.IPv4OptionTimestampHdrLength + int(o.TimestampSlots)*header.IPv4OptionTimestampSize
+			ipv4Opts = append(ipv4Opts, &header.IPv4SerializableTimestampOption{Slots: o.TimestampSlots})
+		}
+		if size > header.IPv4MaximumOptionsSize {
+			route.Release()
+			return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
+		}
+	}
+
+	// The NIC default is only looked up for multicast destinations so that
+	// unicast writes don't contend on the stack's lock.
+	multicastTTL := e.multicastTTL
+	if remote := route.RemoteAddress(); !e.multicastTTLSet && (header.IsV4MulticastAddress(remote) || header.IsV6MulticastAddress(remote)) {
+		if ttl, ok := e.stack.NICMulticastTTL(route.NICID()); ok {
+			multicastTTL = ttl
+		}
+	}
+
 	return WriteContext{
 		transProto: e.transProto,
 		route:      route,
-		ttl:        calculateTTL(route, e.ttl, e.multicastTTL),
+		ttl:        calculateTTL(route, e.ttl, multicastTTL),
 		tos:        tos,
 		owner:      e.owner,
+		useMinMTU:  useMinMTU,
+		extHdrs:    extHdrs,
+		ipv4Opts:   ipv4Opts,
+		finalDst:   finalDst,
+
+		interfaceMTU: e.pmtud == tcpip.PMTUDiscoveryInterface,
 	}, nil
 }
 
@@ -388,6 +595,26 @@ func (e *Endpoint) connectRouteRLocked(nicID tcpip.NICID, addr tcpip.FullAddress
 	return r, nicID, nil
 }
 
+// routeThroughNICRLocked finds a route to addr that goes out of the NIC
+// with the given ID. It is used for writes that explicitly select their
+// outgoing NIC.
+//
+// Returns ErrNoRoute if addr is not reachable through the NIC, or if the
+// endpoint is bound to an address on a different NIC.
+//
+// Precondition: e.mu must be read locked.
+func (e *Endpoint) routeThroughNICRLocked(nicID tcpip.NICID, addr tcpip.FullAddress, netProto tcpip.NetworkProtocolNumber) (*stack.Route, tcpip.Error) {
+	if bindNICID := e.Info().BindNICID; bindNICID != 0 && bindNICID != nicID {
+		return nil, &tcpip.ErrNoRoute{}
+	}
+
+	r, _, err := e.connectRouteRLocked(nicID, addr, netProto)
+	if err != nil {
+		return nil, &tcpip.ErrNoRoute{}
+	}
+	return r, nil
+}
+
 // Connect connects the endpoint to the address.
 func (e *Endpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
 	return e.ConnectAndThen(addr, func(_ tcpip.NetworkProtocolNumber, _, _ stack.TransportEndpointID) tcpip.Error {
@@ -431,11 +658,19 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 		return err
 	}
 
+	routeGen := e.stack.RouteTableGeneration()
 	r, nicID, err := e.connectRouteRLocked(nicID, addr, netProto)
 	if err != nil {
 		return err
 	}
 
+	// Like Linux, only allow connecting to a broadcast address if broadcasts
+	// may be sent.
+	if !e.ops.GetBroadcast() && r.IsOutboundBroadcast() {
+		r.Release()
+		return &tcpip.ErrBroadcastDisabled{}
+	}
+
 	id := stack.TransportEndpointID{
 		LocalAddress:  info.ID.LocalAddress,
 		RemoteAddress: r.RemoteAddress(),
@@ -453,6 +688,7 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 		e.connectedRoute.Release()
 	}
 	e.connectedRoute = r
+	e.connectedRouteGen = routeGen
 	info.ID = id
 	info.RegisterNICID = nicID
 	e.setInfo(info)
@@ -488,6 +724,23 @@ func (e *Endpoint) checkV4Mapped(addr tcpip.FullAddress) (tcpip.FullAddress, tcp
 	return unwrapped, netProto, nil
 }
 
+// nicHasAddressOfFamilyLocked returns true if the NIC has an address of a
+// network protocol the endpoint may currently send packets with.
+//
+// +checklocksread:e.mu
+func (e *Endpoint) nicHasAddressOfFamilyLocked(nicID tcpip.NICID) bool {
+	netProtos := []tcpip.NetworkProtocolNumber{e.effectiveNetProto}
+	if e.netProto == header.IPv6ProtocolNumber && !e.ops.GetV6Only() && e.State() == transport.DatagramEndpointStateInitial {
+		netProtos = append(netProtos, header.IPv4ProtocolNumber)
+	}
+	for _, netProto := range netProtos {
+		if addr, err := e.stack.GetMainNICAddress(nicID, netProto); err == nil && addr.Address != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Endpoint) isBroadcastOrMulticast(nicID tcpip.NICID, netProto tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
 	return addr == header.IPv4Broadcast || header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr) || e.stack.IsSubnetBroadcast(nicID, netProto, addr)
 }
@@ -548,6 +801,28 @@ func (e *Endpoint) BindAndThen(addr tcpip.FullAddress, f func(tcpip.NetworkProto
 	return nil
 }
 
+// Unbind returns a bound endpoint to the initial state, undoing a previous
+// call to Bind or BindAndThen. It is a no-op if the endpoint is not bound.
+func (e *Endpoint) Unbind() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.State() != transport.DatagramEndpointStateBound {
+		return
+	}
+
+	e.wasBound = false
+
+	info := e.Info()
+	info.ID = stack.TransportEndpointID{}
+	info.BindNICID = 0
+	info.RegisterNICID = 0
+	info.BindAddr = ""
+	e.setInfo(info)
+	e.effectiveNetProto = e.netProto
+	e.setEndpointState(transport.DatagramEndpointStateInitial)
+}
+
 // WasBound returns true iff the endpoint was ever bound.
 func (e *Endpoint) WasBound() bool {
 	e.mu.RLock()
@@ -572,6 +847,135 @@ func (e *Endpoint) GetLocalAddress() tcpip.FullAddress {
 	}
 }
 
+// defaultMembershipNIC returns the NIC a multicast group is joined on when no
+// NIC or interface address is given, or 0 if there is no route to the group.
+func (e *Endpoint) defaultMembershipNIC(multicastAddr tcpip.Address) tcpip.NICID {
+	r, err := e.stack.FindRoute(0, "", multicastAddr, e.netProto, false /* multicastLoop */)
+	if err != nil {
+		return 0
+	}
+	defer r.Release()
+	return r.NICID()
+}
+
+// SetMemberships leaves the multicast groups in remove and then joins the
+// groups in add. A group given with NIC 0 is joined on or left from the NIC
+// that routes to it. If any change fails, the changes already made are rolled
+// back and the memberships are left as they were.
+func (e *Endpoint) SetMemberships(add, remove []tcpip.MembershipInfo) tcpip.Error {
+	resolve := func(infos []tcpip.MembershipInfo) ([]multicastMembership, tcpip.Error) {
+		mems := make([]multicastMembership, 0, len(infos))
+		for _, info := range infos {
+			if !header.IsV4MulticastAddress(info.MulticastAddr) && !header.IsV6MulticastAddress(info.MulticastAddr) {
+				return nil, &tcpip.ErrInvalidOptionValue{}
+			}
+			nicID := info.NIC
+			if nicID == 0 {
+				nicID = e.defaultMembershipNIC(info.MulticastAddr)
+			}
+			if nicID == 0 {
+				return nil, &tcpip.ErrUnknownDevice{}
+			}
+			mems = append(mems, multicastMembership{nicID: nicID, multicastAddr: info.MulticastAddr})
+		}
+		return mems, nil
+	}
+	toAdd, err := resolve(add)
+	if err != nil {
+		return err
+	}
+	toRemove, err := resolve(remove)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Check all the changes against the memberships they would apply to
+	// before making any of them.
+	removed := make(map[multicastMembership]struct{}, len(toRemove))
+	for _, mem := range toRemove {
+		if _, ok := e.multicastMemberships[mem]; !ok {
+			return &tcpip.ErrBadLocalAddress{}
+		}
+		if _, ok := removed[mem]; ok {
+			return &tcpip.ErrBadLocalAddress{}
+		}
+		removed[mem] = struct{}{}
+	}
+	added := make(map[multicastMembership]struct{}, len(toAdd))
+	for _, mem := range toAdd {
+		_, isMember := e.multicastMemberships[mem]
+		_, isRemoved := removed[mem]
+		if _, ok := added[mem]; ok || (isMember && !isRemoved) {
+			return &tcpip.ErrDuplicateMembership{}
+		}
+		added[mem] = struct{}{}
+	}
+
+	// Leave and join the groups, undoing the changes made so far on failure.
+	for i, mem := range toRemove {
+		if err := e.stack.LeaveGroup(e.netProto, mem.nicID, mem.multicastAddr); err != nil {
+			for _, mem := range toRemove[:i] {
+				_ = e.stack.JoinGroup(e.netProto, mem.nicID, mem.multicastAddr)
+			}
+			return err
+		}
+	}
+	for i, mem := range toAdd {
+		if err := e.stack.JoinGroup(e.netProto, mem.nicID, mem.multicastAddr); err != nil {
+			for _, mem := range toAdd[:i] {
+				_ = e.stack.LeaveGroup(e.netProto, mem.nicID, mem.multicastAddr)
+			}
+			for _, mem := range toRemove {
+				_ = e.stack.JoinGroup(e.netProto, mem.nicID, mem.multicastAddr)
+			}
+			return err
+		}
+	}
+
+	for _, mem := range toRemove {
+		delete(e.multicastMemberships, mem)
+	}
+	for _, mem := range toAdd {
+		e.multicastMemberships[mem] = struct{}{}
+	}
+	return nil
+}
+
+// HasMembership returns true if the endpoint has joined the multicast group
+// addr on the NIC nicID.
+func (e *Endpoint) HasMembership(nicID tcpip.NICID, addr tcpip.Address) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	_, ok := e.multicastMemberships[multicastMembership{nicID: nicID, multicastAddr: addr}]
+	return ok
+}
+
+// MulticastMemberships returns the multicast groups the endpoint has joined,
+// ordered by NIC and then by group address.
+func (e *Endpoint) MulticastMemberships() []tcpip.MembershipInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	memberships := make([]tcpip.MembershipInfo, 0, len(e.multicastMemberships))
+	for mem := range e.multicastMemberships {
+		memberships = append(memberships, tcpip.MembershipInfo{
+			NIC:           mem.nicID,
+			MulticastAddr: mem.multicastAddr,
+		})
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		if memberships[i].NIC != memberships[j].NIC {
+			return memberships[i].NIC < memberships[j].NIC
+		}
+		return memberships[i].MulticastAddr < memberships[j].MulticastAddr
+	})
+	return memberships
+}
+
 // GetRemoteAddress returns the address that the endpoint is connected to.
 func (e *Endpoint) GetRemoteAddress() (tcpip.FullAddress, bool) {
 	e.mu.RLock()
@@ -591,15 +995,21 @@ func (e *Endpoint) GetRemoteAddress() (tcpip.FullAddress, bool) {
 func (e *Endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 	switch opt {
 	case tcpip.MTUDiscoverOption:
-		// Return not supported if the value is not disabling path
-		// MTU discovery.
-		if v != tcpip.PMTUDiscoveryDont {
+		// Path MTU discovery is not supported, so only modes that ignore path
+		// MTU information may be selected.
+		switch v {
+		case tcpip.PMTUDiscoveryDont, tcpip.PMTUDiscoveryInterface:
+		default:
 			return &tcpip.ErrNotSupported{}
 		}
+		e.mu.Lock()
+		e.pmtud = v
+		e.mu.Unlock()
 
 	case tcpip.MulticastTTLOption:
 		e.mu.Lock()
 		e.multicastTTL = uint8(v)
+		e.multicastTTLSet = true
 		e.mu.Unlock()
 
 	case tcpip.TTLOption:
@@ -615,18 +1025,44 @@ func (e *Endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 	case tcpip.IPv6TrafficClassOption:
 		e.mu.Lock()
 		e.ipv6TClass = uint8(v)
+		e.ipv6TClassSet = true
+		e.mu.Unlock()
+
+	case tcpip.PriorityOption:
+		if v < 0 || v > maxPriority {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		e.mu.Lock()
+		e.priority = uint8(v)
 		e.mu.Unlock()
 	}
 
 	return nil
 }
 
+// maxPriority is the largest value accepted for PriorityOption.
+const maxPriority = 7
+
+// ipv6TClassRLocked returns the traffic class for outgoing IPv6 packets: the
+// explicitly set value if any, otherwise the class selector code point for the
+// endpoint's priority.
+//
+// +checklocksread:e.mu
+func (e *Endpoint) ipv6TClassRLocked() uint8 {
+	if e.ipv6TClassSet {
+		return e.ipv6TClass
+	}
+	return e.priority << 5
+}
+
 // GetSockOptInt returns the socket option.
 func (e *Endpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
 	switch opt {
 	case tcpip.MTUDiscoverOption:
-		// The only supported setting is path MTU discovery disabled.
-		return tcpip.PMTUDiscoveryDont, nil
+		e.mu.RLock()
+		v := e.pmtud
+		e.mu.RUnlock()
+		return v, nil
 
 	case tcpip.MulticastTTLOption:
 		e.mu.Lock()
@@ -648,7 +1084,13 @@ func (e *Endpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
 
 	case tcpip.IPv6TrafficClassOption:
 		e.mu.RLock()
-		v := int(e.ipv6TClass)
+		v := int(e.ipv6TClassRLocked())
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.PriorityOption:
+		e.mu.RLock()
+		v := int(e.priority)
 		e.mu.RUnlock()
 		return v, nil
 
@@ -666,8 +1108,11 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 
 		fa := tcpip.FullAddress{Addr: v.InterfaceAddr}
 		fa, netProto, err := e.checkV4Mapped(fa)
-		if err != nil {
-			return err
+		// The interface address must be of a family the endpoint can send
+		// multicast packets with. Native IPv6 addresses are left as they are
+		// for IPv4 endpoints.
+		if err != nil || (netProto == header.IPv4ProtocolNumber && len(fa.Addr) == header.IPv6AddressSize) {
+			return &tcpip.ErrInvalidOptionValue{}
 		}
 		nic := v.NIC
 		addr := fa.Addr
@@ -682,6 +1127,9 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 			if !e.stack.CheckNIC(nic) {
 				return &tcpip.ErrBadLocalAddress{}
 			}
+			if addr == "" && !e.nicHasAddressOfFamilyLocked(nic) {
+				return &tcpip.ErrInvalidOptionValue{}
+			}
 		} else {
 			nic = e.stack.CheckLocalAddress(0, netProto, addr)
 			if nic == 0 {
@@ -700,15 +1148,15 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		if !header.IsV4MulticastAddress(v.MulticastAddr) && !header.IsV6MulticastAddress(v.MulticastAddr) {
 			return &tcpip.ErrInvalidOptionValue{}
 		}
+		if !v.InterfaceAddr.Unspecified() && len(v.InterfaceAddr) != len(v.MulticastAddr) {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
 
 		nicID := v.NIC
 
 		if v.InterfaceAddr.Unspecified() {
 			if nicID == 0 {
-				if r, err := e.stack.FindRoute(0, "", v.MulticastAddr, e.netProto, false /* multicastLoop */); err == nil {
-					nicID = r.NICID()
-					r.Release()
-				}
+				nicID = e.defaultMembershipNIC(v.MulticastAddr)
 			}
 		} else {
 			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
@@ -723,7 +1171,7 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		defer e.mu.Unlock()
 
 		if _, ok := e.multicastMemberships[memToInsert]; ok {
-			return &tcpip.ErrPortInUse{}
+			return &tcpip.ErrDuplicateMembership{}
 		}
 
 		if err := e.stack.JoinGroup(e.netProto, nicID, v.MulticastAddr); err != nil {
@@ -736,14 +1184,14 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		if !header.IsV4MulticastAddress(v.MulticastAddr) && !header.IsV6MulticastAddress(v.MulticastAddr) {
 			return &tcpip.ErrInvalidOptionValue{}
 		}
+		if !v.InterfaceAddr.Unspecified() && len(v.InterfaceAddr) != len(v.MulticastAddr) {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
 
 		nicID := v.NIC
 		if v.InterfaceAddr.Unspecified() {
 			if nicID == 0 {
-				if r, err := e.stack.FindRoute(0, "", v.MulticastAddr, e.netProto, false /* multicastLoop */); err == nil {
-					nicID = r.NICID()
-					r.Release()
-				}
+				nicID = e.defaultMembershipNIC(v.MulticastAddr)
 			}
 		} else {
 			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
@@ -190,9 +190,11 @@ func TestEndpointStateTransitions(t *testing.T) {
 			defer ctx.Release()
 			info := ctx.PacketInfo()
 			if diff := cmp.Diff(network.WritePacketInfo{
+				NICID:                       nicID,
 				NetProto:                    test.expectedNetProto,
 				LocalAddress:                test.expectedLocalAddr,
 				RemoteAddress:               test.expectedRemoteAddr,
+				FinalRemoteAddress:          test.expectedRemoteAddr,
 				MaxHeaderLength:             test.expectedMaxHeaderLength,
 				RequiresTXTransportChecksum: true,
 			}, info); diff != "" {
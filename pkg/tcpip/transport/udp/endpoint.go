@@ -15,8 +15,12 @@
 package udp
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
+	"sync/atomic"
 	"time"
 
 	"gvisor.dev/gvisor/pkg/sync"
@@ -41,8 +45,96 @@ type udpPacket struct {
 	receivedAt         time.Time             `state:".(int64)"`
 	// tos stores either the receiveTOS or receiveTClass value.
 	tos uint8
+	// ipID stores the identification field of an IPv4 packet.
+	ipID uint16
+	// flowLabel stores the flow label of an IPv6 packet.
+	flowLabel uint32
+	// incomingCPU is the receive steering bucket that delivered the packet.
+	incomingCPU int
+	// wasBroadcast and wasMulticast classify the packet's destination address.
+	wasBroadcast bool
+	wasMulticast bool
+	// linkPriority is the link-layer priority of the packet.
+	linkPriority uint32
+	// linkSource is the link-layer source address of the packet, if known.
+	linkSource tcpip.LinkAddress
+	// wasFragmented is true if the packet was reassembled from IP fragments.
+	wasFragmented bool
+	// group is the fair queuing group the packet is queued in, if any.
+	// groupPrev and groupNext link the packets of the group in the order they
+	// were received.
+	group     *rcvGroup
+	groupPrev *udpPacket
+	groupNext *udpPacket
 }
 
+// rcvGroup holds the queued datagrams sent to one destination address when
+// fair queuing is enabled.
+//
+// +stateify savable
+type rcvGroup struct {
+	head *udpPacket
+	tail *udpPacket
+	// ordered is true while the group is in the endpoint's rcvGroupOrder.
+	ordered bool
+}
+
+func (g *rcvGroup) pushBack(p *udpPacket) {
+	p.group = g
+	p.groupPrev = g.tail
+	if g.tail != nil {
+		g.tail.groupNext = p
+	} else {
+		g.head = p
+	}
+	g.tail = p
+}
+
+func (g *rcvGroup) remove(p *udpPacket) {
+	if p.groupPrev != nil {
+		p.groupPrev.groupNext = p.groupNext
+	} else {
+		g.head = p.groupNext
+	}
+	if p.groupNext != nil {
+		p.groupNext.groupPrev = p.groupPrev
+	} else {
+		g.tail = p.groupPrev
+	}
+	p.group, p.groupPrev, p.groupNext = nil, nil, nil
+}
+
+// QueuedDatagram is a datagram removed from an endpoint's receive queue by
+// DrainReceiveQueue.
+type QueuedDatagram struct {
+	// Payload is the datagram's payload.
+	Payload []byte
+
+	// Sender is the address and port the datagram was sent from.
+	Sender tcpip.FullAddress
+
+	// Destination is the address and port the datagram was sent to.
+	Destination tcpip.FullAddress
+}
+
+// ReceiveQueueDropPolicy determines which datagram is dropped when a datagram
+// arrives at an endpoint whose receive queue is full.
+type ReceiveQueueDropPolicy int
+
+const (
+	// DropTail drops the arriving datagram. This is the default. If the
+	// receive buffer limit is lowered below the queue's occupancy, queued
+	// datagrams are kept and arriving ones are dropped until reads bring the
+	// occupancy below the new limit.
+	DropTail ReceiveQueueDropPolicy = iota
+
+	// DropHead evicts the oldest queued datagrams to make room for the
+	// arriving datagram. If the receive buffer limit is lowered below the
+	// queue's occupancy, the next arrival evicts datagrams until the queue
+	// fits the new limit.
+	DropHead
+)
+
 // endpoint represents a UDP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
 // have concurrent goroutines make calls into the endpoint, they are properly
@@ -62,6 +154,8 @@ type endpoint struct {
 	net         network.Endpoint
 	stats       tcpip.TransportEndpointStats
 	ops         tcpip.SocketOptions
+	// transProto is ProtocolNumber or LiteProtocolNumber.
+	transProto tcpip.TransportProtocolNumber
 
 	// The following fields are used to manage the receive queue, and are
 	// protected by rcvMu.
@@ -70,10 +164,75 @@ type endpoint struct {
 	rcvList    udpPacketList
 	rcvBufSize int
 	rcvClosed  bool
+	// rcvHUp is true once both the read and write ends were shut down, after
+	// which the endpoint reports EventHUp like Linux datagram sockets do.
+	rcvHUp bool
+	// rcvAcceptedPorts, if not nil, holds the only source ports the endpoint
+	// accepts datagrams from. It is consulted on the receive path, which must
+	// not take mu.
+	rcvAcceptedPorts map[uint16]struct{}
+	// rcvFair is true if reads round-robin across the destination addresses
+	// (e.g. joined multicast groups) of queued datagrams instead of returning
+	// them in arrival order. rcvGroups holds the queued datagrams of each
+	// destination address and rcvGroupOrder the order in which the groups are
+	// read from. Groups that were emptied by anything but a read stay in
+	// rcvGroupOrder until they reach its front.
+	rcvFair       bool
+	rcvGroups     map[tcpip.Address]*rcvGroup
+	rcvGroupOrder []*rcvGroup
+	// rcvDropPolicy determines which datagram is dropped when the receive
+	// queue is full.
+	rcvDropPolicy ReceiveQueueDropPolicy
+	// rcvDeadline is the time after which reads from an empty receive queue
+	// fail with ErrTimeout, or zero if there is no deadline. rcvDeadlineTimer
+	// wakes up readers when the deadline passes.
+	rcvDeadline      tcpip.MonotonicTime
+	rcvDeadlineTimer tcpip.Timer `state:"nosave"`
+	// rcvPartial holds the unread remainder of the last datagram that did not
+	// fit in a read with ReadOptions.Continue, for the next such read. It is
+	// counted in rcvBufSize.
+	rcvPartial *udpPacket
+	// rcvReads counts the reads that took a datagram or a remainder off the
+	// receive queue. A read only keeps the remainder of its datagram if no
+	// other read took one in the meantime.
+	rcvReads uint64
+	// rcvPeak is the largest value rcvBufSize has reached.
+	rcvPeak int
+
+	// sndBufUsed is the number of payload bytes held by writes in progress.
+	// UDP doesn't queue outgoing datagrams, so this is the endpoint's send
+	// queue occupancy. sndPeak is the largest value sndBufUsed has reached.
+	sndMu      sync.Mutex `state:"nosave"`
+	sndBufUsed int
+	sndPeak    int
 
 	lastErrorMu sync.Mutex `state:"nosave"`
 	lastError   tcpip.Error
 
+	// lastMulticastSrc is the source address of the last multicast datagram
+	// sent by the endpoint, or empty if none was sent.
+	lastMulticastSrcMu sync.Mutex `state:"nosave"`
+	lastMulticastSrc   tcpip.Address
+
+	// pending holds the payload of a datagram being built by writes with
+	// WriteOptions.More (MSG_MORE), and pendingTo the destination given by
+	// the first of them, if any. The datagram is sent by the first write
+	// without More. hasPending is true while a datagram is being built.
+	//
+	// flushOnClose determines whether Close sends a pending datagram
+	// instead of discarding it.
+	pendingMu    sync.Mutex `state:"nosave"`
+	pending      buffer.View
+	pendingTo    *tcpip.FullAddress
+	hasPending   bool
+	flushOnClose bool
+
+	// linkBlocked is set when the outgoing link endpoint rejected a packet
+	// with ErrWouldBlock and cleared once it reports room again. The
+	// endpoint is not writable while it is set.
+	linkBlockedMu sync.Mutex `state:"nosave"`
+	linkBlocked   bool       `state:"nosave"`
+
 	// The following fields are protected by the mu mutex.
 	mu        sync.RWMutex `state:"nosave"`
 	portFlags ports.Flags
@@ -83,7 +242,8 @@ type endpoint struct {
 	boundBindToDevice tcpip.NICID
 	boundPortFlags    ports.Flags
 
-	readShutdown bool
+	readShutdown  bool
+	writeShutdown bool
 
 	// effectiveNetProtos contains the network protocols actually in use. In
 	// most cases it will only contain "netProto", but in cases like IPv6
@@ -99,19 +259,54 @@ type endpoint struct {
 
 	localPort  uint16
 	remotePort uint16
+
+	// extraPorts is the number of ports following localPort that the endpoint
+	// is also bound to by BindRange.
+	extraPorts uint16
+
+	// prependHeader is prepended to the payload of every datagram written.
+	prependHeader buffer.View
+
+	// name labels the endpoint for diagnostics.
+	name string
+
+	// acceptLocalSource is non-zero if the endpoint accepts datagrams whose
+	// source is one of the stack's own addresses. It is read atomically on the
+	// receive path and written atomically while holding mu.
+	acceptLocalSource uint32
+
+	// closing is non-zero once Close has started. It is set before the
+	// endpoint is unregistered, so that packets the demuxer hashes to it in
+	// the meantime go to another member of its SO_REUSEPORT group instead. It
+	// is accessed atomically.
+	closing uint32
+
+	// requireMembershipToSend is true if the endpoint may only send to
+	// multicast groups it has joined on the outgoing NIC.
+	requireMembershipToSend bool
+
+	// liteCoverage is the number of payload bytes covered by the checksum of
+	// UDP-Lite datagrams sent by the endpoint, or 0 if the checksum covers
+	// the whole datagram.
+	liteCoverage uint16
+
+	// promiscuous is true if the endpoint receives a copy of every datagram
+	// sent to its port without reserving the port.
+	promiscuous bool
 }
 
-func newEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+func newEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
 	e := &endpoint{
 		stack:       s,
 		waiterQueue: waiterQueue,
 		uniqueID:    s.UniqueID(),
+		transProto:  transProto,
 	}
 	e.ops.InitHandler(e, e.stack, tcpip.GetStackSendBufferLimits, tcpip.GetStackReceiveBufferLimits)
 	e.ops.SetMulticastLoop(true)
 	e.ops.SetSendBufferSize(32*1024, false /* notify */)
 	e.ops.SetReceiveBufferSize(32*1024, false /* notify */)
-	e.net.Init(s, netProto, header.UDPProtocolNumber, &e.ops)
+	e.net.Init(s, netProto, transProto, &e.ops)
 
 	// Override with stack defaults.
 	var ss tcpip.SendBufferSizeOption
@@ -124,6 +319,11 @@ func newEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQue
 		e.ops.SetReceiveBufferSize(int64(rs.Default), false /* notify */)
 	}
 
+	if s.DefaultReceiveTOS() {
+		e.ops.SetReceiveTOS(true)
+		e.ops.SetReceiveTClass(true)
+	}
+
 	return e
 }
 
@@ -148,14 +348,94 @@ func (e *endpoint) UpdateLastError(err tcpip.Error) {
 	e.lastErrorMu.Unlock()
 }
 
+// LastMulticastSource returns the source address of the last multicast
+// datagram sent by the endpoint. It returns false if the endpoint hasn't sent
+// a multicast datagram.
+func (e *endpoint) LastMulticastSource() (tcpip.Address, bool) {
+	e.lastMulticastSrcMu.Lock()
+	defer e.lastMulticastSrcMu.Unlock()
+	return e.lastMulticastSrc, len(e.lastMulticastSrc) != 0
+}
+
+// BufferHighWatermarks returns the largest number of bytes the receive queue
+// and the send queue have held over the endpoint's lifetime. They help size
+// buffers after a run.
+func (e *endpoint) BufferHighWatermarks() (rcvPeak, sndPeak int) {
+	e.rcvMu.Lock()
+	rcvPeak = e.rcvPeak
+	e.rcvMu.Unlock()
+
+	e.sndMu.Lock()
+	defer e.sndMu.Unlock()
+	return rcvPeak, e.sndPeak
+}
+
+// acquireSendBytes accounts for n payload bytes held by a write in progress.
+func (e *endpoint) acquireSendBytes(n int) {
+	e.sndMu.Lock()
+	defer e.sndMu.Unlock()
+	e.sndBufUsed += n
+	if e.sndBufUsed > e.sndPeak {
+		e.sndPeak = e.sndBufUsed
+	}
+}
+
+// releaseSendBytes releases n payload bytes accounted for by
+// acquireSendBytes.
+func (e *endpoint) releaseSendBytes(n int) {
+	e.sndMu.Lock()
+	defer e.sndMu.Unlock()
+	e.sndBufUsed -= n
+}
+
 // Abort implements stack.TransportEndpoint.
 func (e *endpoint) Abort() {
 	e.Close()
 }
 
+// DrainReceiveQueue removes all datagrams queued for reading and returns them
+// in the order they were received. It allows queued datagrams to be handed off
+// before the endpoint is closed.
+func (e *endpoint) DrainReceiveQueue() []QueuedDatagram {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	var datagrams []QueuedDatagram
+	for !e.rcvList.Empty() {
+		p := e.rcvList.Front()
+		e.dequeueLocked(p)
+		datagrams = append(datagrams, QueuedDatagram{
+			Payload:     p.data.ToView(),
+			Sender:      p.senderAddress,
+			Destination: p.destinationAddress,
+		})
+	}
+	e.rcvBufSize = 0
+	e.rcvPartial = nil
+	return datagrams
+}
+
+// FlushReceiveQueue implements stack.udpReceiveQueueFlusher.
+func (e *endpoint) FlushReceiveQueue() int {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	n := 0
+	for !e.rcvList.Empty() {
+		e.dequeueLocked(e.rcvList.Front())
+		n++
+	}
+	e.rcvBufSize = 0
+	e.rcvPartial = nil
+	return n
+}
+
 // Close puts the endpoint in a closed state and frees all resources
 // associated with it.
 func (e *endpoint) Close() {
+	atomic.StoreUint32(&e.closing, 1)
+	e.closePending()
+
 	e.mu.Lock()
 
 	switch state := e.net.State(); state {
@@ -164,20 +444,25 @@ func (e *endpoint) Close() {
 		e.mu.Unlock()
 		return
 	case transport.DatagramEndpointStateBound, transport.DatagramEndpointStateConnected:
+		e.releaseExtraPortsLocked()
 		id := e.net.Info().ID
 		id.LocalPort = e.localPort
 		id.RemotePort = e.remotePort
-		e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, ProtocolNumber, id, e, e.boundPortFlags, e.boundBindToDevice)
-		portRes := ports.Reservation{
-			Networks:     e.effectiveNetProtos,
-			Transport:    ProtocolNumber,
-			Addr:         id.LocalAddress,
-			Port:         id.LocalPort,
-			Flags:        e.boundPortFlags,
-			BindToDevice: e.boundBindToDevice,
-			Dest:         tcpip.FullAddress{},
+		if e.promiscuous {
+			e.stack.UnregisterPromiscuousTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e)
+		} else {
+			e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e, e.boundPortFlags, e.boundBindToDevice)
+			portRes := ports.Reservation{
+				Networks:     e.effectiveNetProtos,
+				Transport:    e.transProto,
+				Addr:         id.LocalAddress,
+				Port:         id.LocalPort,
+				Flags:        e.boundPortFlags,
+				BindToDevice: e.boundBindToDevice,
+				Dest:         tcpip.FullAddress{},
+			}
+			e.stack.ReleasePort(portRes)
 		}
-		e.stack.ReleasePort(portRes)
 		e.boundBindToDevice = 0
 		e.boundPortFlags = ports.Flags{}
 	default:
@@ -189,11 +474,19 @@ func (e *endpoint) Close() {
 	e.rcvClosed = true
 	e.rcvBufSize = 0
 	for !e.rcvList.Empty() {
-		p := e.rcvList.Front()
-		e.rcvList.Remove(p)
+		e.dequeueLocked(e.rcvList.Front())
+	}
+	e.rcvPartial = nil
+	if e.rcvDeadlineTimer != nil {
+		e.rcvDeadlineTimer.Stop()
+		e.rcvDeadlineTimer = nil
 	}
 	e.rcvMu.Unlock()
 
+	if atomic.SwapUint32(&e.acceptLocalSource, 0) != 0 {
+		e.stack.RemoveLocalSourceListener()
+	}
+
 	e.net.Shutdown()
 	e.net.Close()
 	e.readShutdown = true
@@ -213,23 +506,67 @@ func (e *endpoint) Read(dst io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult
 
 	e.rcvMu.Lock()
 
-	if e.rcvList.Empty() {
-		var err tcpip.Error = &tcpip.ErrWouldBlock{}
-		if e.rcvClosed {
-			e.stats.ReadErrors.ReadClosed.Increment()
-			err = &tcpip.ErrClosedForReceive{}
+	var p *udpPacket
+	var merged []*udpPacket
+	var read uint64
+	if opts.Continue && e.rcvPartial != nil {
+		p = e.rcvPartial
+		if !opts.Peek {
+			e.rcvPartial = nil
+			e.rcvBufSize -= p.data.Size()
+			e.rcvReads++
+			read = e.rcvReads
+		}
+	} else {
+		if !opts.Peek {
+			// Reading anything but the remainder of a partially read
+			// datagram discards it.
+			e.discardPartialLocked()
+		}
+		if e.rcvList.Empty() {
+			var err tcpip.Error = &tcpip.ErrWouldBlock{}
+			if e.rcvClosed {
+				e.stats.ReadErrors.ReadClosed.Increment()
+				err = &tcpip.ErrClosedForReceive{}
+			} else if e.rcvDeadline != (tcpip.MonotonicTime{}) && !e.stack.Clock().NowMonotonic().Before(e.rcvDeadline) {
+				err = &tcpip.ErrTimeout{}
+			}
+			e.rcvMu.Unlock()
+			return tcpip.ReadResult{}, err
 		}
-		e.rcvMu.Unlock()
-		return tcpip.ReadResult{}, err
-	}
 
-	p := e.rcvList.Front()
-	if !opts.Peek {
-		e.rcvList.Remove(p)
-		e.rcvBufSize -= p.data.Size()
+		p = e.nextPacketLocked()
+		if e.ops.GetUDPGRO() {
+			merged = e.coalesceLocked(p)
+		}
+		if !opts.Peek {
+			e.rcvReads++
+			read = e.rcvReads
+			e.dequeueLocked(p)
+			e.rcvBufSize -= p.data.Size()
+			for _, m := range merged {
+				e.dequeueLocked(m)
+				e.rcvBufSize -= m.data.Size()
+			}
+			if e.rcvFair {
+				e.rotateGroupsLocked()
+			}
+		}
 	}
 	e.rcvMu.Unlock()
 
+	data := p.data
+	if len(merged) != 0 {
+		data = p.data.Clone(nil)
+		for _, m := range merged {
+			data.Append(m.data.Clone(nil))
+		}
+		if !opts.Peek {
+			e.stack.Stats().UDP.Coalesced.IncrementBy(uint64(len(merged) + 1))
+			e.stack.Stats().UDP.CoalesceBatches.Increment()
+		}
+	}
+
 	// Control Messages
 	cm := tcpip.ControlMessages{
 		HasTimestamp: true,
@@ -247,6 +584,11 @@ func (e *endpoint) Read(dst io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult
 			cm.HasIPPacketInfo = true
 			cm.PacketInfo = p.packetInfo
 		}
+
+		if e.ops.GetReceiveIPID() {
+			cm.HasIPID = true
+			cm.IPID = p.ipID
+		}
 	case header.IPv6ProtocolNumber:
 		if e.ops.GetReceiveTClass() {
 			cm.HasTClass = true
@@ -261,6 +603,14 @@ func (e *endpoint) Read(dst io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult
 				Addr: p.packetInfo.DestinationAddr,
 			}
 		}
+
+		if e.ops.GetReceiveIPv6Info() {
+			cm.HasIPv6Info = true
+			cm.IPv6Info = tcpip.IPv6Info{
+				TrafficClass: p.tos,
+				FlowLabel:    p.flowLabel,
+			}
+		}
 	default:
 		panic(fmt.Sprintf("unrecognized network protocol = %d", p.netProto))
 	}
@@ -270,23 +620,278 @@ func (e *endpoint) Read(dst io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult
 		cm.OriginalDstAddress = p.destinationAddress
 	}
 
+	// Only endpoints that opted into steering are told the bucket.
+	if p.incomingCPU >= 0 && e.ops.GetIncomingCPU() >= 0 {
+		cm.HasIncomingCPU = true
+		cm.IncomingCPU = p.incomingCPU
+	}
+
+	if e.ops.GetReceiveDestinationType() {
+		cm.WasBroadcast = p.wasBroadcast
+		cm.WasMulticast = p.wasMulticast
+	}
+
+	if e.ops.GetReceiveInterfaceIndex() {
+		cm.HasIfIndex = true
+		cm.IfIndex = p.destinationAddress.NIC
+	}
+
+	if e.ops.GetReceiveLinkPriority() {
+		cm.HasLinkPriority = true
+		cm.LinkPriority = p.linkPriority
+	}
+
+	if e.ops.GetReceiveLinkSource() && len(p.linkSource) != 0 {
+		cm.HasLinkSource = true
+		cm.LinkSource = p.linkSource
+	}
+
+	if e.ops.GetReceiveWasFragmented() {
+		cm.WasFragmented = p.wasFragmented
+	}
+
+	if len(merged) != 0 {
+		cm.HasGROSegmentSize = true
+		cm.GROSegmentSize = uint16(p.data.Size())
+	}
+
 	// Read Result
 	res := tcpip.ReadResult{
-		Total:           p.data.Size(),
+		Total:           data.Size(),
 		ControlMessages: cm,
 	}
 	if opts.NeedRemoteAddr {
 		res.RemoteAddr = p.senderAddress
 	}
+	if opts.NeedInboundNIC {
+		res.InboundNIC = p.senderAddress.NIC
+	}
 
-	n, err := p.data.ReadTo(dst, opts.Peek)
+	n, err := data.ReadTo(dst, opts.Peek)
 	if n == 0 && err != nil {
 		return res, &tcpip.ErrBadBuffer{}
 	}
 	res.Count = n
+	if opts.Continue && !opts.Peek && data.Size() != 0 {
+		// Keep the remainder of the truncated datagram for the next read with
+		// ReadOptions.Continue. If a concurrent read took another datagram
+		// since, the remainder is discarded instead, as it would have been
+		// had the reads happened one after the other.
+		rest := *p
+		rest.data = data
+		e.rcvMu.Lock()
+		kept := !e.rcvClosed && read == e.rcvReads
+		if kept {
+			e.rcvPartial = &rest
+			e.rcvBufSize += data.Size()
+		}
+		e.rcvMu.Unlock()
+		if kept {
+			e.waiterQueue.Notify(waiter.ReadableEvents)
+		}
+	}
 	return res, nil
 }
 
+// discardPartialLocked discards the remainder of a partially read datagram, if
+// any.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) discardPartialLocked() {
+	if e.rcvPartial != nil {
+		e.rcvBufSize -= e.rcvPartial.data.Size()
+		e.rcvPartial = nil
+	}
+}
+
+// vecWriter is an io.Writer that scatters its input across a list of buffers,
+// filling each one before moving on to the next.
+type vecWriter struct {
+	bufs [][]byte
+}
+
+// Write implements io.Writer.Write.
+func (w *vecWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && len(w.bufs) > 0 {
+		c := copy(w.bufs[0], p)
+		w.bufs[0] = w.bufs[0][c:]
+		if len(w.bufs[0]) == 0 {
+			w.bufs = w.bufs[1:]
+		}
+		p = p[c:]
+		n += c
+	}
+	if len(p) != 0 {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// ReadVec is like Read but scatters the datagram across bufs in order, like
+// readv. If the datagram does not fit, the remainder is discarded and
+// ReadResult.Count is less than ReadResult.Total.
+func (e *endpoint) ReadVec(bufs [][]byte, opts tcpip.ReadOptions) (tcpip.ReadResult, tcpip.Error) {
+	w := vecWriter{bufs: append([][]byte(nil), bufs...)}
+	return e.Read(&w, opts)
+}
+
+// coalesceLocked returns the packets following p in the receive queue that can
+// be returned together with p by a single read. Packets are merged while they
+// belong to the same flow as p and are no larger than p; a shorter packet ends
+// the batch.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) coalesceLocked(p *udpPacket) []*udpPacket {
+	segSize := p.data.Size()
+	if segSize == 0 {
+		return nil
+	}
+	var merged []*udpPacket
+	total := segSize
+	for m := p.Next(); m != nil && len(merged)+1 < maxGROSegments; m = m.Next() {
+		size := m.data.Size()
+		if m.netProto != p.netProto || m.senderAddress != p.senderAddress || m.destinationAddress != p.destinationAddress {
+			break
+		}
+		if size == 0 || size > segSize || total+size > header.UDPMaximumPacketSize-header.UDPMinimumSize {
+			break
+		}
+		merged = append(merged, m)
+		total += size
+		if size < segSize {
+			break
+		}
+	}
+	return merged
+}
+
+// SetFairMulticastQueue sets whether reads round-robin across the destination
+// addresses of queued datagrams, so that a busy multicast group cannot starve
+// the other groups the endpoint joined. Datagrams sent to the same address are
+// still read in the order they were received.
+func (e *endpoint) SetFairMulticastQueue(v bool) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	e.rcvFair = v
+	e.rcvGroups = nil
+	e.rcvGroupOrder = nil
+	if v {
+		e.rcvGroups = make(map[tcpip.Address]*rcvGroup)
+	}
+	for p := e.rcvList.Front(); p != nil; p = p.Next() {
+		p.group, p.groupPrev, p.groupNext = nil, nil, nil
+		if v {
+			e.groupLocked(p)
+		}
+	}
+}
+
+// enqueueLocked appends p to the receive queue.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) enqueueLocked(p *udpPacket) {
+	e.rcvList.PushBack(p)
+	if e.rcvFair {
+		e.groupLocked(p)
+	}
+}
+
+// groupLocked appends p to the fair queuing group of its destination address.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) groupLocked(p *udpPacket) {
+	addr := p.destinationAddress.Addr
+	g, ok := e.rcvGroups[addr]
+	if !ok {
+		g = &rcvGroup{}
+		e.rcvGroups[addr] = g
+	}
+	g.pushBack(p)
+	if !g.ordered {
+		g.ordered = true
+		e.rcvGroupOrder = append(e.rcvGroupOrder, g)
+	}
+}
+
+// dequeueLocked removes p from the receive queue.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) dequeueLocked(p *udpPacket) {
+	e.rcvList.Remove(p)
+	if g := p.group; g != nil {
+		g.remove(p)
+		if g.head == nil {
+			delete(e.rcvGroups, p.destinationAddress.Addr)
+		}
+	}
+}
+
+// popGroupLocked removes the group at the front of rcvGroupOrder.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) popGroupLocked() *rcvGroup {
+	g := e.rcvGroupOrder[0]
+	e.rcvGroupOrder[0] = nil
+	e.rcvGroupOrder = e.rcvGroupOrder[1:]
+	g.ordered = false
+	return g
+}
+
+// rotateGroupsLocked moves the group a datagram was just read from to the back
+// of rcvGroupOrder, or drops it if it has no datagrams left.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) rotateGroupsLocked() {
+	if g := e.popGroupLocked(); g.head != nil {
+		g.ordered = true
+		e.rcvGroupOrder = append(e.rcvGroupOrder, g)
+	}
+}
+
+// SetReceiveQueueDropPolicy sets which datagram is dropped when a datagram
+// arrives while the receive queue is full.
+func (e *endpoint) SetReceiveQueueDropPolicy(policy ReceiveQueueDropPolicy) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	e.rcvDropPolicy = policy
+}
+
+// nextPacketLocked returns the datagram the next read returns. The receive
+// list must not be empty.
+//
+// +checklocks:e.rcvMu
+func (e *endpoint) nextPacketLocked() *udpPacket {
+	if !e.rcvFair {
+		return e.rcvList.Front()
+	}
+	// Skip the groups that were emptied without being read; some group holds
+	// a datagram since the receive list isn't empty.
+	for e.rcvGroupOrder[0].head == nil {
+		e.popGroupLocked()
+	}
+	return e.rcvGroupOrder[0].head
+}
+
+// PeekAll calls fn for each queued datagram, oldest first, without dequeuing
+// it, and stops early if fn returns false. The payload is not copied unless the
+// datagram is stored in several chunks, so fn must not modify or retain it.
+//
+// fn is called with the receive queue locked and must not call into the
+// endpoint.
+func (e *endpoint) PeekAll(fn func(payload buffer.View, src tcpip.FullAddress) bool) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	for p := e.rcvList.Front(); p != nil; p = p.Next() {
+		if !fn(p.data.ToView(), p.senderAddress) {
+			return
+		}
+	}
+}
+
 // prepareForWriteInner prepares the endpoint for sending data. In particular,
 // it binds it if it's still in the initial state. To do so, it must first
 // reacquire the mutex in exclusive mode.
@@ -329,7 +934,135 @@ func (e *endpoint) prepareForWriteInner(to *tcpip.FullAddress) (retry bool, err
 // Write writes data to the endpoint's peer. This method does not block
 // if the data cannot be written.
 func (e *endpoint) Write(p tcpip.Payloader, opts tcpip.WriteOptions) (int64, tcpip.Error) {
-	n, err := e.write(p, opts)
+	e.pendingMu.Lock()
+	if opts.More || e.hasPending {
+		defer e.pendingMu.Unlock()
+		return e.writePendingLocked(p, opts)
+	}
+	e.pendingMu.Unlock()
+
+	n, _, err := e.writeAndCount(p, opts, false /* returnPacket */)
+	return n, err
+}
+
+// writePendingLocked handles a write that is part of a datagram built from
+// several writes with WriteOptions.More. Writes with More append their
+// payload to the pending datagram, and the first write without More appends
+// its payload and sends the datagram to the destination given by the first
+// write.
+//
+// Precondition: e.pendingMu must be locked.
+func (e *endpoint) writePendingLocked(p tcpip.Payloader, opts tcpip.WriteOptions) (int64, tcpip.Error) {
+	// Buffered data must be rejected for the same reasons a datagram would be
+	// rejected by prepareForWrite.
+	e.mu.RLock()
+	state := e.net.State()
+	writeShutdown := e.writeShutdown
+	e.mu.RUnlock()
+	switch {
+	case state == transport.DatagramEndpointStateClosed:
+		return 0, &tcpip.ErrInvalidEndpointState{}
+	case writeShutdown:
+		return 0, &tcpip.ErrClosedForSend{}
+	case !e.hasPending && opts.To == nil && state != transport.DatagramEndpointStateConnected:
+		return 0, &tcpip.ErrDestinationRequired{}
+	}
+
+	n := p.Len()
+	if len(e.pending)+n > header.UDPMaximumPacketSize-header.UDPMinimumSize {
+		e.discardPendingLocked()
+		return 0, &tcpip.ErrMessageTooLong{}
+	}
+	// The pending datagram is held in the send buffer until it is sent, so it
+	// can't grow past the send buffer size.
+	if int64(len(e.pending)+n) > e.ops.GetSendBufferSize() {
+		return 0, &tcpip.ErrNoBufferSpace{}
+	}
+	v := make(buffer.View, n)
+	if err := readPayload(p, v, nil /* xsum */); err != nil {
+		return 0, err
+	}
+	if !e.hasPending {
+		e.hasPending = true
+		if opts.To != nil {
+			to := *opts.To
+			e.pendingTo = &to
+		}
+	}
+	e.pending = append(e.pending, v...)
+	if opts.More {
+		return int64(n), nil
+	}
+
+	pending, to := e.pending, e.pendingTo
+	e.discardPendingLocked()
+	opts.To = to
+	opts.More = false
+	if _, _, err := e.writeAndCount(bytes.NewReader(pending), opts, false /* returnPacket */); err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// discardPendingLocked discards the datagram being built by writes with
+// WriteOptions.More, if any.
+//
+// Precondition: e.pendingMu must be locked.
+func (e *endpoint) discardPendingLocked() {
+	e.pending = nil
+	e.pendingTo = nil
+	e.hasPending = false
+}
+
+// SetFlushOnClose sets whether Close sends a datagram still being built by
+// writes with WriteOptions.More (MSG_MORE). If it is false, the default, the
+// datagram is discarded as in Linux.
+func (e *endpoint) SetFlushOnClose(v bool) {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	e.flushOnClose = v
+}
+
+// closePending sends or discards the datagram being built by writes with
+// WriteOptions.More when the endpoint is closed, as determined by
+// SetFlushOnClose.
+func (e *endpoint) closePending() {
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+
+	if !e.hasPending {
+		return
+	}
+	pending, to := e.pending, e.pendingTo
+	e.discardPendingLocked()
+	if e.flushOnClose {
+		// The endpoint is going away, so there is no one to report an error
+		// to.
+		_, _, _ = e.writeAndCount(bytes.NewReader(pending), tcpip.WriteOptions{To: to}, false /* returnPacket */)
+	}
+}
+
+// WriteAndReturnPacket is like Write but also returns a clone of the emitted
+// packet so tests can inspect it without reading it back from a link endpoint.
+// The clone is taken before the packet is handed to the network layer, so it
+// holds the UDP header and payload but no network header. It shares its
+// payload with the emitted packet and must be treated as read-only.
+//
+// It is a debugging aid and returns ErrNotSupported unless
+// tcpip.UDPWriteAndReturnPacketOption is enabled on the stack.
+func (e *endpoint) WriteAndReturnPacket(p tcpip.Payloader, opts tcpip.WriteOptions) (*stack.PacketBuffer, tcpip.Error) {
+	var enabled tcpip.UDPWriteAndReturnPacketOption
+	if err := e.stack.TransportProtocolOption(e.transProto, &enabled); err != nil || !bool(enabled) {
+		return nil, &tcpip.ErrNotSupported{}
+	}
+	_, pkt, err := e.writeAndCount(p, opts, true /* returnPacket */)
+	return pkt, err
+}
+
+// writeAndCount writes a datagram and updates the endpoint's statistics. If
+// returnPacket is true, a clone of the emitted packet is returned.
+func (e *endpoint) writeAndCount(p tcpip.Payloader, opts tcpip.WriteOptions, returnPacket bool) (int64, *stack.PacketBuffer, tcpip.Error) {
+	n, pkt, err := e.write(p, opts, returnPacket)
 	switch err.(type) {
 	case nil:
 		e.stats.PacketsSent.Increment()
@@ -346,13 +1079,40 @@ func (e *endpoint) Write(p tcpip.Payloader, opts tcpip.WriteOptions) (int64, tcp
 		// For all other errors when writing to the network layer.
 		e.stats.SendErrors.SendToNetworkFailed.Increment()
 	}
-	return n, err
+	return n, pkt, err
+}
+
+// CheckRoute resolves the route a datagram to dst would take without sending
+// anything. It applies the same rules as Write, so it fails with the error a
+// write to dst would fail with during route resolution.
+func (e *endpoint) CheckRoute(dst tcpip.FullAddress) (tcpip.RouteInfo, tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var detail tcpip.WriteResult
+	ctx, err := e.net.AcquireContextForWrite(tcpip.WriteOptions{To: &dst, WantDetail: &detail})
+	if err != nil {
+		return tcpip.RouteInfo{}, err
+	}
+	defer ctx.Release()
+
+	return tcpip.RouteInfo{
+		NIC:           ctx.PacketInfo().NICID,
+		LocalAddress:  detail.LocalAddress,
+		RemoteAddress: detail.RemoteAddress,
+		NextHop:       detail.NextHop,
+	}, nil
 }
 
 func (e *endpoint) prepareForWrite(p tcpip.Payloader, opts tcpip.WriteOptions) (udpPacketInfo, tcpip.Error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	// An IPv4 endpoint can't reach native IPv6 destinations.
+	if to := opts.To; to != nil && e.net.NetProto() == header.IPv4ProtocolNumber && len(to.Addr) == header.IPv6AddressSize && !header.IsV4MappedAddress(to.Addr) {
+		return udpPacketInfo{}, &tcpip.ErrInvalidEndpointState{}
+	}
+
 	// Prepare for write.
 	for {
 		retry, err := e.prepareForWriteInner(opts.To)
@@ -365,6 +1125,12 @@ func (e *endpoint) prepareForWrite(p tcpip.Payloader, opts tcpip.WriteOptions) (
 		}
 	}
 
+	// The only ports an endpoint holds a reservation for are the ones it is
+	// bound to.
+	if opts.SourcePort != 0 && (opts.SourcePort < e.localPort || uint32(opts.SourcePort) > uint32(e.localPort)+uint32(e.extraPorts)) {
+		return udpPacketInfo{}, &tcpip.ErrInvalidOptionValue{}
+	}
+
 	dst, connected := e.net.GetRemoteAddress()
 	dst.Port = e.remotePort
 	if opts.To != nil {
@@ -377,100 +1143,505 @@ func (e *endpoint) prepareForWrite(p tcpip.Payloader, opts tcpip.WriteOptions) (
 	} else if !connected {
 		return udpPacketInfo{}, &tcpip.ErrDestinationRequired{}
 	}
-
-	ctx, err := e.net.AcquireContextForWrite(opts)
-	if err != nil {
-		return udpPacketInfo{}, err
+
+	// Reject payloads that can't possibly fit in a datagram before doing any
+	// route work. Larger IPv6 datagrams may still be sent as jumbograms if the
+	// stack has a link that can carry them; whether the link the route goes
+	// out of can is checked once the route is known.
+	maxSize := maxPayloadSize(dst.Addr, e.net.NetProto()) - len(e.prependHeader)
+	tooLong := p.Len() > maxSize
+	if tooLong && (isIPv4Destination(dst.Addr, e.net.NetProto()) || !carriesJumbograms(e.stack.MaxLinkMTU())) {
+		return udpPacketInfo{}, e.messageTooLong(maxSize, dst)
+	}
+
+	ctx, err := e.net.AcquireContextForWrite(opts)
+	if err != nil {
+		return udpPacketInfo{}, err
+	}
+
+	if e.requireMembershipToSend {
+		pktInfo := ctx.PacketInfo()
+		multicast := header.IsV4MulticastAddress(pktInfo.RemoteAddress) || header.IsV6MulticastAddress(pktInfo.RemoteAddress)
+		if multicast && !e.net.HasMembership(pktInfo.NICID, pktInfo.RemoteAddress) {
+			ctx.Release()
+			return udpPacketInfo{}, &tcpip.ErrNoRoute{}
+		}
+	}
+
+	// Datagrams that do not fit in the UDP Length field can only be sent as
+	// IPv6 jumbograms (RFC 2675) over a link that can carry them.
+	if tooLong {
+		if ctx.PacketInfo().NetProto != header.IPv6ProtocolNumber || !carriesJumbograms(ctx.LinkMTU()) {
+			ctx.Release()
+			return udpPacketInfo{}, e.messageTooLong(maxSize, dst)
+		}
+	}
+
+	localPort := e.localPort
+	if opts.SourcePort != 0 {
+		localPort = opts.SourcePort
+	}
+
+	// TODO(https://gvisor.dev/issue/6538): Avoid this allocation.
+	hdr, data := allocWriteBuffers(header.UDPMinimumSize+int(ctx.PacketInfo().MaxHeaderLength), len(e.prependHeader)+p.Len())
+	info := udpPacketInfo{
+		ctx:           ctx,
+		hdr:           hdr,
+		data:          data,
+		prependLen:    len(e.prependHeader),
+		needsChecksum: e.needsChecksum(ctx.PacketInfo()),
+		localPort:     localPort,
+		remotePort:    dst.Port,
+	}
+	copy(info.data, e.prependHeader)
+	// The UDP-Lite checksum is mandatory and computed in software, since
+	// checksum offload can't be limited to the covered bytes. Only the covered
+	// part of the payload is checksummed, once the payload has been read.
+	if e.transProto == LiteProtocolNumber {
+		info.lite = true
+		info.liteCoverage = e.liteCoverage
+		info.needsChecksum = true
+		if err := readPayload(p, info.data[info.prependLen:], nil /* xsum */); err != nil {
+			ctx.Release()
+			return udpPacketInfo{}, err
+		}
+		return info, nil
+	}
+	var xsum *header.Checksumer
+	if info.needsChecksum {
+		xsum = &info.xsum
+		xsum.Add(e.prependHeader)
+	}
+	if err := readPayload(p, info.data[info.prependLen:], xsum); err != nil {
+		ctx.Release()
+		return udpPacketInfo{}, err
+	}
+	return info, nil
+}
+
+// allocWriteBuffers returns the storage for the reserved header space and the
+// data of a datagram, carved from a single allocation. The allocation is
+// exactly as large as the packet, so a packet that outlives its write (e.g. one
+// held in a receive queue) doesn't keep any other memory alive.
+func allocWriteBuffers(reserve, size int) (hdr, data buffer.View) {
+	b := make([]byte, reserve+size)
+	return b[:reserve:reserve], b[reserve:]
+}
+
+// carriesJumbograms returns true if a link with the given MTU is large enough
+// to carry IPv6 jumbograms, as per RFC 2675 section 1.
+func carriesJumbograms(mtu uint32) bool {
+	return mtu > header.IPv6MinimumSize+header.UDPMaximumPacketSize
+}
+
+// messageTooLong queues a local error reporting maxSize if IP_RECVERR is
+// enabled and returns ErrMessageTooLong.
+//
+// Precondition: e.mu must be read locked.
+func (e *endpoint) messageTooLong(maxSize int, dst tcpip.FullAddress) tcpip.Error {
+	so := e.SocketOptions()
+	if so.GetRecvError() {
+		so.QueueLocalErr(
+			&tcpip.ErrMessageTooLong{},
+			e.net.NetProto(),
+			uint32(maxSize),
+			dst,
+			nil,
+		)
+	}
+	return &tcpip.ErrMessageTooLong{}
+}
+
+// payloadChunkSize is the number of bytes readPayload copies at a time.
+const payloadChunkSize = 4096
+
+// needsChecksum returns true if the UDP checksum of a datagram sent with the
+// given packet info must be computed by the stack.
+func (e *endpoint) needsChecksum(pktInfo network.WritePacketInfo) bool {
+	// The checksum is not needed if TX checksum offload is enabled. On IPv4,
+	// the UDP checksum is optional, and a zero value indicates the transmitter
+	// skipped the checksum generation (RFC768). On IPv6, the UDP checksum is
+	// not optional (RFC2460 Section 8.1).
+	return pktInfo.RequiresTXTransportChecksum &&
+		(!e.ops.GetNoChecksum() || pktInfo.NetProto == header.IPv6ProtocolNumber)
+}
+
+// readPayload fills v from p. If xsum is not nil, the checksum of the payload
+// is accumulated in xsum while each chunk is still hot in the cache, so that
+// the payload doesn't have to be traversed again to compute the datagram's
+// checksum.
+func readPayload(p tcpip.Payloader, v []byte, xsum *header.Checksumer) tcpip.Error {
+	for len(v) != 0 {
+		n := len(v)
+		if n > payloadChunkSize {
+			n = payloadChunkSize
+		}
+		if _, err := io.ReadFull(p, v[:n]); err != nil {
+			return &tcpip.ErrBadBuffer{}
+		}
+		if xsum != nil {
+			xsum.Add(v[:n])
+		}
+		v = v[n:]
+	}
+	return nil
+}
+
+// maxPayloadSize returns the largest UDP payload that can be sent to addr from
+// an endpoint of the given network protocol without fragmenting past the
+// maximum IP datagram size.
+func maxPayloadSize(addr tcpip.Address, netProto tcpip.NetworkProtocolNumber) int {
+	if isIPv4Destination(addr, netProto) {
+		// The IPv4 total length field covers the IP header.
+		return header.UDPMaximumPacketSize - header.IPv4MinimumSize - header.UDPMinimumSize
+	}
+	// The IPv6 payload length field does not cover the fixed header.
+	return header.UDPMaximumPacketSize - header.UDPMinimumSize
+}
+
+// isIPv4Destination returns true if datagrams sent to addr by an endpoint of
+// the given network protocol are sent over IPv4.
+func isIPv4Destination(addr tcpip.Address, netProto tcpip.NetworkProtocolNumber) bool {
+	return len(addr) == header.IPv4AddressSize || header.IsV4MappedAddress(addr) || len(addr) == 0 && netProto == header.IPv4ProtocolNumber
+}
+
+func (e *endpoint) write(p tcpip.Payloader, opts tcpip.WriteOptions, returnPacket bool) (int64, *stack.PacketBuffer, tcpip.Error) {
+	// Do not hold lock when sending as loopback is synchronous and if the UDP
+	// datagram ends up generating an ICMP response then it can result in a
+	// deadlock where the ICMP response handling ends up acquiring this endpoint's
+	// mutex using e.mu.RLock() in endpoint.HandleControlPacket which can cause a
+	// deadlock if another caller is trying to acquire e.mu in exclusive mode w/
+	// e.mu.Lock(). Since e.mu.Lock() prevents any new read locks to ensure the
+	// lock can be eventually acquired.
+	//
+	// See: https://golang.org/pkg/sync/#RWMutex for details on why recursive read
+	// locking is prohibited.
+
+	if d := opts.WantDetail; d != nil {
+		*d = tcpip.WriteResult{}
+	}
+
+	if err := e.LastError(); err != nil {
+		if d := opts.WantDetail; d != nil {
+			d.FailedStage = tcpip.WriteStageSend
+		}
+		return 0, nil, err
+	}
+
+	udpInfo, err := e.prepareForWrite(p, opts)
+	if err != nil {
+		// Route resolution failures are recorded when they happen.
+		if d := opts.WantDetail; d != nil && d.FailedStage == tcpip.WriteStageNone {
+			d.FailedStage = tcpip.WriteStagePrepare
+		}
+		return 0, nil, err
+	}
+	defer udpInfo.ctx.Release()
+
+	e.acquireSendBytes(len(udpInfo.data))
+	defer e.releaseSendBytes(len(udpInfo.data))
+
+	pktInfo := udpInfo.ctx.PacketInfo()
+	reserve := header.UDPMinimumSize + int(pktInfo.MaxHeaderLength)
+	jumbogram := header.UDPMinimumSize+len(udpInfo.data) > header.UDPMaximumPacketSize
+	if jumbogram {
+		// Make room for the Hop-by-Hop Options header carrying the Jumbo Payload
+		// option.
+		reserve += header.IPv6JumboPayloadExtHdrLength
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes:   reserve,
+		ReserveHeaderStorage: udpInfo.hdr,
+		Data:                 udpInfo.data.ToVectorisedView(),
+	})
+
+	// Initialize the UDP header.
+	udp := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
+	pkt.TransportProtocolNumber = e.transProto
+
+	srcPort := udpInfo.localPort
+	if rewrite := e.stack.UDPSourcePortRewriter(); rewrite != nil {
+		if port, ok := rewrite(stack.TransportEndpointID{
+			LocalPort:     udpInfo.localPort,
+			LocalAddress:  pktInfo.LocalAddress,
+			RemotePort:    udpInfo.remotePort,
+			RemoteAddress: pktInfo.RemoteAddress,
+		}); ok {
+			srcPort = port
+		}
+	}
+
+	// As per RFC 2675 section 4, the UDP Length field of a jumbogram is zero
+	// and the length is derived from the Jumbo Payload option instead.
+	size := pkt.Size()
+	var length uint16
+	if !jumbogram {
+		length = uint16(size)
+	}
+	// The Length field of a UDP-Lite datagram holds the checksum coverage,
+	// which counts the header (RFC 3828 section 3.1).
+	covered := len(udpInfo.data)
+	if c := int(udpInfo.liteCoverage); udpInfo.lite && c != 0 && c < covered {
+		covered = c
+		length = uint16(header.UDPMinimumSize + c)
+	}
+	udp.Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: udpInfo.remotePort,
+		Length:  length,
+	})
+
+	// The payload's checksum was accumulated while it was read, so only the
+	// headers are left to checksum. The pseudo-header carries the full 32-bit
+	// length, whose upper half is zero unless this is a jumbogram.
+	if udpInfo.needsChecksum {
+		xsum := header.PseudoHeaderChecksum(e.transProto, pktInfo.LocalAddress, pktInfo.FinalRemoteAddress, uint16(size))
+		xsum = header.ChecksumCombine(xsum, uint16(size>>16))
+		payloadXsum := udpInfo.xsum.Checksum()
+		if udpInfo.lite {
+			payloadXsum = header.Checksum(udpInfo.data[:covered], 0)
+		}
+		udp.SetChecksum(^udp.CalculateChecksum(header.ChecksumCombine(xsum, payloadXsum)))
+	}
+	if tap := e.stack.UDPTap(); tap != nil {
+		tap(stack.UDPTapOutgoing, pkt)
+	}
+	// The clone must be taken before the packet is handed off, as link
+	// endpoints may hold on to and modify it once written.
+	var emitted *stack.PacketBuffer
+	if returnPacket {
+		emitted = pkt.Clone()
+	}
+	if err := udpInfo.ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+		if d := opts.WantDetail; d != nil {
+			d.FailedStage = tcpip.WriteStageSend
+		}
+		e.stack.Stats().UDP.PacketSendErrors.Increment()
+		if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+			e.setLinkBlocked(pktInfo.NICID)
+		}
+		return 0, nil, err
+	}
+
+	// Track count of packets sent.
+	e.stack.Stats().UDP.PacketsSent.Increment()
+
+	if d := opts.WantDetail; d != nil {
+		d.EgressNIC = pktInfo.NICID
+	}
+
+	if header.IsV4MulticastAddress(pktInfo.RemoteAddress) || header.IsV6MulticastAddress(pktInfo.RemoteAddress) {
+		e.lastMulticastSrcMu.Lock()
+		e.lastMulticastSrc = pktInfo.LocalAddress
+		e.lastMulticastSrcMu.Unlock()
+	}
+
+	// The packet may still hold on to the data, so the reported payload is a
+	// copy.
+	if so := e.SocketOptions(); so.GetTxTimestamp() {
+		so.QueueErr(&tcpip.SockError{
+			Err:     &tcpip.ErrNoMessage{},
+			Cause:   &tcpip.TimestampingSockError{},
+			Payload: append([]byte(nil), udpInfo.data...),
+			Dst: tcpip.FullAddress{
+				Addr: pktInfo.RemoteAddress,
+				Port: udpInfo.remotePort,
+			},
+			NetProto:  pktInfo.NetProto,
+			Timestamp: e.stack.Clock().Now(),
+		})
+		e.waiterQueue.Notify(waiter.EventErr)
+	}
+	return int64(len(udpInfo.data) - udpInfo.prependLen), emitted, nil
+}
+
+// SetPromiscuousReceive sets whether the endpoint is a promiscuous listener.
+// A promiscuous listener doesn't reserve the port it is bound to, so it can be
+// bound to a port other endpoints are bound to, and it receives a copy of every
+// datagram sent to the port in addition to the endpoint that would otherwise
+// receive it. It must be bound to a specific port and can't be connected.
+//
+// The endpoint must not be bound yet, and making it a promiscuous listener
+// requires the stack's UDPPromiscuousReceiveCheck to permit it.
+func (e *endpoint) SetPromiscuousReceive(v bool) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.net.State() != transport.DatagramEndpointStateInitial {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+	if v {
+		if check := e.stack.UDPPromiscuousReceiveCheck(); check == nil || !check() {
+			return &tcpip.ErrNotPermitted{}
+		}
+	}
+	e.promiscuous = v
+	return nil
+}
+
+// ReadDeadline sets the time after which reads that find no queued datagram
+// fail with ErrTimeout instead of ErrWouldBlock, as measured by the stack's
+// clock. Readers waiting for the endpoint to become readable are notified when
+// the deadline passes. A zero t removes the deadline.
+//
+// The deadline applies to all subsequent reads until it is changed, matching
+// net.Conn.SetReadDeadline.
+func (e *endpoint) ReadDeadline(t tcpip.MonotonicTime) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if e.rcvDeadlineTimer != nil {
+		e.rcvDeadlineTimer.Stop()
+		e.rcvDeadlineTimer = nil
+	}
+	e.rcvDeadline = t
+	if t == (tcpip.MonotonicTime{}) || e.rcvClosed {
+		return
+	}
+	clock := e.stack.Clock()
+	e.rcvDeadlineTimer = clock.AfterFunc(t.Sub(clock.NowMonotonic()), func() {
+		e.waiterQueue.Notify(waiter.ReadableEvents)
+	})
+}
+
+// CloneConfig returns the endpoint's socket options for use with
+// stack.Stack.NewEndpointFromConfig. Binding and connection state is not
+// included. It returns an error if the endpoint is closed or one of its
+// options can't be read.
+func (e *endpoint) CloneConfig() (stack.EndpointConfig, tcpip.Error) {
+	if e.net.State() == transport.DatagramEndpointStateClosed {
+		return stack.EndpointConfig{}, &tcpip.ErrInvalidEndpointState{}
+	}
+
+	cfg := stack.EndpointConfig{
+		TransProto:   e.transProto,
+		NetProto:     e.net.NetProto(),
+		Broadcast:    e.ops.GetBroadcast(),
+		ReuseAddress: e.ops.GetReuseAddress(),
+		ReusePort:    e.ops.GetReusePort(),
+		V6Only:       e.ops.GetV6Only(),
+	}
+	for _, opt := range []struct {
+		opt tcpip.SockOptInt
+		v   *uint8
+	}{
+		{tcpip.TTLOption, &cfg.TTL},
+		{tcpip.IPv4TOSOption, &cfg.IPv4TOS},
+		{tcpip.IPv6TrafficClassOption, &cfg.IPv6TrafficClass},
+	} {
+		v, err := e.net.GetSockOptInt(opt.opt)
+		if err != nil {
+			return stack.EndpointConfig{}, err
+		}
+		*opt.v = uint8(v)
+	}
+	return cfg, nil
+}
+
+// SetAcceptLocalSource sets whether the endpoint accepts datagrams whose source
+// is one of the stack's own addresses, which are otherwise dropped when the
+// stack handles local traffic itself (see stack.Options.HandleLocal). This is
+// useful for loopback testing tools.
+func (e *endpoint) SetAcceptLocalSource(v bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.net.State() == transport.DatagramEndpointStateClosed {
+		return
+	}
+	var n uint32
+	if v {
+		n = 1
+	}
+	if atomic.SwapUint32(&e.acceptLocalSource, n) == n {
+		return
+	}
+	if v {
+		e.stack.AddLocalSourceListener()
+	} else {
+		e.stack.RemoveLocalSourceListener()
 	}
+}
 
-	// TODO(https://gvisor.dev/issue/6538): Avoid this allocation.
-	v := make([]byte, p.Len())
-	if _, err := io.ReadFull(p, v); err != nil {
-		ctx.Release()
-		return udpPacketInfo{}, &tcpip.ErrBadBuffer{}
-	}
-	if len(v) > header.UDPMaximumPacketSize {
-		// Payload can't possibly fit in a packet.
-		so := e.SocketOptions()
-		if so.GetRecvError() {
-			so.QueueLocalErr(
-				&tcpip.ErrMessageTooLong{},
-				e.net.NetProto(),
-				header.UDPMaximumPacketSize,
-				dst,
-				v,
-			)
+// SetAcceptedSourcePorts restricts the endpoint to datagrams sent from one of
+// the given source ports. Other datagrams are dropped and counted in
+// ReceiveErrors.SourcePortFiltered. An empty list removes the restriction.
+//
+// It is a lightweight alternative to attaching a packet filter.
+func (e *endpoint) SetAcceptedSourcePorts(ports []uint16) {
+	var accepted map[uint16]struct{}
+	if len(ports) != 0 {
+		accepted = make(map[uint16]struct{}, len(ports))
+		for _, p := range ports {
+			accepted[p] = struct{}{}
 		}
-		ctx.Release()
-		return udpPacketInfo{}, &tcpip.ErrMessageTooLong{}
 	}
 
-	return udpPacketInfo{
-		ctx:        ctx,
-		data:       v,
-		localPort:  e.localPort,
-		remotePort: dst.Port,
-	}, nil
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+	e.rcvAcceptedPorts = accepted
 }
 
-func (e *endpoint) write(p tcpip.Payloader, opts tcpip.WriteOptions) (int64, tcpip.Error) {
-	// Do not hold lock when sending as loopback is synchronous and if the UDP
-	// datagram ends up generating an ICMP response then it can result in a
-	// deadlock where the ICMP response handling ends up acquiring this endpoint's
-	// mutex using e.mu.RLock() in endpoint.HandleControlPacket which can cause a
-	// deadlock if another caller is trying to acquire e.mu in exclusive mode w/
-	// e.mu.Lock(). Since e.mu.Lock() prevents any new read locks to ensure the
-	// lock can be eventually acquired.
-	//
-	// See: https://golang.org/pkg/sync/#RWMutex for details on why recursive read
-	// locking is prohibited.
-
-	if err := e.LastError(); err != nil {
-		return 0, err
+// SetUDPLiteCoverage sets the number of payload bytes covered by the checksum
+// of UDP-Lite datagrams sent by the endpoint (RFC 3828 section 3.1). The
+// checksum always covers the header, and a coverage of 0 or one that exceeds a
+// datagram's payload covers the whole datagram. This is similar to Linux's
+// UDPLITE_SEND_CSCOV, except that the header is not included in n.
+//
+// It returns ErrNotSupported for UDP endpoints.
+func (e *endpoint) SetUDPLiteCoverage(n uint16) tcpip.Error {
+	if e.transProto != LiteProtocolNumber {
+		return &tcpip.ErrNotSupported{}
 	}
-
-	udpInfo, err := e.prepareForWrite(p, opts)
-	if err != nil {
-		return 0, err
+	if int(n) > header.UDPMaximumSize-header.UDPMinimumSize {
+		return &tcpip.ErrInvalidOptionValue{}
 	}
-	defer udpInfo.ctx.Release()
 
-	pktInfo := udpInfo.ctx.PacketInfo()
-	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		ReserveHeaderBytes: header.UDPMinimumSize + int(pktInfo.MaxHeaderLength),
-		Data:               udpInfo.data.ToVectorisedView(),
-	})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.liteCoverage = n
+	return nil
+}
 
-	// Initialize the UDP header.
-	udp := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
-	pkt.TransportProtocolNumber = ProtocolNumber
+// SetRequireMulticastMembershipToSend sets whether the endpoint may only send
+// to multicast groups it has joined on the outgoing NIC. Writes to other
+// groups fail with ErrNoRoute. By default, the endpoint may send to any group.
+func (e *endpoint) SetRequireMulticastMembershipToSend(v bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requireMembershipToSend = v
+}
 
-	length := uint16(pkt.Size())
-	udp.Encode(&header.UDPFields{
-		SrcPort: udpInfo.localPort,
-		DstPort: udpInfo.remotePort,
-		Length:  length,
-	})
+// SetName labels the endpoint for diagnostics. The name is reported by
+// stack.Stack.UDPEndpoints.
+func (e *endpoint) SetName(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	// Set the checksum field unless TX checksum offload is enabled.
-	// On IPv4, UDP checksum is optional, and a zero value indicates the
-	// transmitter skipped the checksum generation (RFC768).
-	// On IPv6, UDP checksum is not optional (RFC2460 Section 8.1).
-	if pktInfo.RequiresTXTransportChecksum &&
-		(!e.ops.GetNoChecksum() || pktInfo.NetProto == header.IPv6ProtocolNumber) {
-		udp.SetChecksum(^udp.CalculateChecksum(header.ChecksumCombine(
-			header.PseudoHeaderChecksum(ProtocolNumber, pktInfo.LocalAddress, pktInfo.RemoteAddress, length),
-			pkt.Data().AsRange().Checksum(),
-		)))
-	}
-	if err := udpInfo.ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
-		e.stack.Stats().UDP.PacketSendErrors.Increment()
-		return 0, err
+	e.name = name
+}
+
+// Name returns the label set by SetName.
+func (e *endpoint) Name() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.name
+}
+
+// SetPrependHeader sets the bytes prepended to the payload of every datagram
+// subsequently written by the endpoint. The bytes are copied, so the caller
+// may reuse hdr. An empty hdr stops prepending.
+func (e *endpoint) SetPrependHeader(hdr []byte) {
+	var v buffer.View
+	if len(hdr) != 0 {
+		v = append(buffer.View(nil), hdr...)
 	}
 
-	// Track count of packets sent.
-	e.stack.Stats().UDP.PacketsSent.Increment()
-	return int64(len(udpInfo.data)), nil
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.prependHeader = v
 }
 
 // OnReuseAddressSet implements tcpip.SocketOptionsHandler.
@@ -487,6 +1658,34 @@ func (e *endpoint) OnReusePortSet(v bool) {
 	e.mu.Unlock()
 }
 
+// OnIncomingCPUSet implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnIncomingCPUSet(int) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	switch e.net.State() {
+	case transport.DatagramEndpointStateBound, transport.DatagramEndpointStateConnected:
+	default:
+		return
+	}
+	if e.promiscuous {
+		return
+	}
+	// The endpoint is already registered, so the groups it belongs to must
+	// pick up the new hint now rather than on the next bind.
+	id := e.net.Info().ID
+	id.LocalPort = e.localPort
+	id.RemotePort = e.remotePort
+	e.stack.UpdateTransportEndpointSteering(e.effectiveNetProtos, e.transProto, id, e.boundBindToDevice)
+	for i := uint16(1); i <= e.extraPorts; i++ {
+		extraID := stack.TransportEndpointID{
+			LocalPort:    e.localPort + i,
+			LocalAddress: id.LocalAddress,
+		}
+		e.stack.UpdateTransportEndpointSteering(e.effectiveNetProtos, e.transProto, extraID, e.boundBindToDevice)
+	}
+}
+
 // SetSockOptInt implements tcpip.Endpoint.
 func (e *endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 	return e.net.SetSockOptInt(opt, v)
@@ -504,18 +1703,32 @@ func (e *endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 	return e.net.SetSockOpt(opt)
 }
 
+// QueuedBytes returns the size of the datagram the next read returns, or 0 if
+// the receive queue is empty. Like FIONREAD on a Linux UDP socket, only the
+// first datagram is counted.
+func (e *endpoint) QueuedBytes() int {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if e.rcvList.Empty() {
+		return 0
+	}
+	return e.nextPacketLocked().data.Size()
+}
+
+// QueuedDatagrams returns the number of datagrams in the receive queue.
+func (e *endpoint) QueuedDatagrams() int {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	return e.rcvList.Len()
+}
+
 // GetSockOptInt implements tcpip.Endpoint.
 func (e *endpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
 	switch opt {
 	case tcpip.ReceiveQueueSizeOption:
-		v := 0
-		e.rcvMu.Lock()
-		if !e.rcvList.Empty() {
-			p := e.rcvList.Front()
-			v = p.data.Size()
-		}
-		e.rcvMu.Unlock()
-		return v, nil
+		return e.QueuedBytes(), nil
 
 	default:
 		return e.net.GetSockOptInt(opt)
@@ -529,10 +1742,24 @@ func (e *endpoint) GetSockOpt(opt tcpip.GettableSocketOption) tcpip.Error {
 
 // udpPacketInfo holds information needed to send a UDP packet.
 type udpPacketInfo struct {
-	ctx        network.WriteContext
-	data       buffer.View
-	localPort  uint16
-	remotePort uint16
+	ctx network.WriteContext
+	// hdr is the storage for the datagram's reserved header space.
+	hdr  buffer.View
+	data buffer.View
+	// prependLen is the length of the endpoint's prepend header at the start
+	// of data.
+	prependLen int
+	// needsChecksum is true if the stack computes the datagram's checksum,
+	// in which case xsum holds the checksum of data.
+	needsChecksum bool
+	xsum          header.Checksumer
+	localPort     uint16
+	remotePort    uint16
+	// lite is true if the datagram is a UDP-Lite datagram, whose checksum
+	// covers liteCoverage bytes of data, or all of it if liteCoverage is 0.
+	// xsum is not used for UDP-Lite datagrams.
+	lite         bool
+	liteCoverage uint16
 }
 
 // Disconnect implements tcpip.Endpoint.
@@ -572,7 +1799,7 @@ func (e *endpoint) Disconnect() tcpip.Error {
 			// Release the ephemeral port.
 			portRes := ports.Reservation{
 				Networks:     e.effectiveNetProtos,
-				Transport:    ProtocolNumber,
+				Transport:    e.transProto,
 				Addr:         info.ID.LocalAddress,
 				Port:         info.ID.LocalPort,
 				Flags:        boundPortFlags,
@@ -584,7 +1811,7 @@ func (e *endpoint) Disconnect() tcpip.Error {
 		}
 	}
 
-	e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, ProtocolNumber, info.ID, e, boundPortFlags, e.boundBindToDevice)
+	e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, e.transProto, info.ID, e, boundPortFlags, e.boundBindToDevice)
 	e.boundBindToDevice = btd
 	e.localPort = id.LocalPort
 	e.remotePort = id.RemotePort
@@ -599,6 +1826,18 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	return e.connectLocked(addr)
+}
+
+// +checklocks:e.mu
+func (e *endpoint) connectLocked(addr tcpip.FullAddress) tcpip.Error {
+	// Connecting only one port of a range bound by BindRange would leave the
+	// other ports accepting datagrams from any peer. Promiscuous listeners
+	// receive datagrams from any peer by definition.
+	if e.extraPorts != 0 || e.promiscuous {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+
 	err := e.net.ConnectAndThen(addr, func(netProto tcpip.NetworkProtocolNumber, previousID, nextID stack.TransportEndpointID) tcpip.Error {
 		nextID.LocalPort = e.localPort
 		nextID.RemotePort = addr.Port
@@ -625,7 +1864,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
 		if e.localPort != 0 {
 			previousID.LocalPort = e.localPort
 			previousID.RemotePort = e.remotePort
-			e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, ProtocolNumber, previousID, e, oldPortFlags, e.boundBindToDevice)
+			e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, e.transProto, previousID, e, oldPortFlags, e.boundBindToDevice)
 		}
 
 		e.localPort = nextID.LocalPort
@@ -650,7 +1889,9 @@ func (*endpoint) ConnectEndpoint(tcpip.Endpoint) tcpip.Error {
 }
 
 // Shutdown closes the read and/or write end of the endpoint connection
-// to its peer.
+// to its peer. Both directions may be shut down in a single call, and shutting
+// down a direction that is already shut down is a no-op. Once both directions
+// are shut down, the endpoint reports EventHUp.
 func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -667,21 +1908,29 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) tcpip.Error {
 		if err := e.net.Shutdown(); err != nil {
 			return err
 		}
+		e.writeShutdown = true
 	}
-
 	if flags&tcpip.ShutdownRead != 0 {
 		e.readShutdown = true
+	}
 
-		e.rcvMu.Lock()
-		wasClosed := e.rcvClosed
+	// Waiters are only notified of the events this call caused, so repeating
+	// a shutdown is a no-op.
+	var events waiter.EventMask
+	e.rcvMu.Lock()
+	if e.readShutdown && !e.rcvClosed {
 		e.rcvClosed = true
-		e.rcvMu.Unlock()
-
-		if !wasClosed {
-			e.waiterQueue.Notify(waiter.ReadableEvents)
-		}
+		events |= waiter.ReadableEvents
+	}
+	if e.readShutdown && e.writeShutdown && !e.rcvHUp {
+		e.rcvHUp = true
+		events |= waiter.EventHUp
 	}
+	e.rcvMu.Unlock()
 
+	if events != 0 {
+		e.waiterQueue.Notify(events)
+	}
 	return nil
 }
 
@@ -697,10 +1946,18 @@ func (*endpoint) Accept(*tcpip.FullAddress) (tcpip.Endpoint, *waiter.Queue, tcpi
 
 func (e *endpoint) registerWithStack(netProtos []tcpip.NetworkProtocolNumber, id stack.TransportEndpointID) (stack.TransportEndpointID, tcpip.NICID, tcpip.Error) {
 	bindToDevice := tcpip.NICID(e.ops.GetBindToDevice())
+	if e.promiscuous {
+		// Promiscuous listeners don't reserve a port, so they can't be given
+		// an ephemeral one.
+		if id.LocalPort == 0 {
+			return id, bindToDevice, &tcpip.ErrInvalidOptionValue{}
+		}
+		return id, bindToDevice, e.stack.RegisterPromiscuousTransportEndpoint(netProtos, e.transProto, id, e)
+	}
 	if e.localPort == 0 {
 		portRes := ports.Reservation{
 			Networks:     netProtos,
-			Transport:    ProtocolNumber,
+			Transport:    e.transProto,
 			Addr:         id.LocalAddress,
 			Port:         id.LocalPort,
 			Flags:        e.portFlags,
@@ -715,11 +1972,11 @@ func (e *endpoint) registerWithStack(netProtos []tcpip.NetworkProtocolNumber, id
 	}
 	e.boundPortFlags = e.portFlags
 
-	err := e.stack.RegisterTransportEndpoint(netProtos, ProtocolNumber, id, e, e.boundPortFlags, bindToDevice)
+	err := e.stack.RegisterTransportEndpoint(netProtos, e.transProto, id, e, e.boundPortFlags, bindToDevice)
 	if err != nil {
 		portRes := ports.Reservation{
 			Networks:     netProtos,
-			Transport:    ProtocolNumber,
+			Transport:    e.transProto,
 			Addr:         id.LocalAddress,
 			Port:         id.LocalPort,
 			Flags:        e.boundPortFlags,
@@ -776,7 +2033,8 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress) tcpip.Error {
 }
 
 // Bind binds the endpoint to a specific local address and port.
-// Specifying a NIC is optional.
+// Specifying a NIC is optional. A zero port selects an ephemeral port, which is
+// reserved only for the given address.
 func (e *endpoint) Bind(addr tcpip.FullAddress) tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -789,6 +2047,143 @@ func (e *endpoint) Bind(addr tcpip.FullAddress) tcpip.Error {
 	return nil
 }
 
+// BindRange binds the endpoint to count consecutive ports starting at start on
+// addr, e.g. for media servers that need a contiguous block of ports. The
+// endpoint receives datagrams sent to any port in the block and may send from
+// any of them using WriteOptions.SourcePort; by default it sends from start.
+// If any port in the block is unavailable, no port is reserved.
+//
+// An endpoint bound to more than one port can't be connected.
+func (e *endpoint) BindRange(addr tcpip.Address, start, count uint16) tcpip.Error {
+	if start == 0 || count == 0 || uint32(start)+uint32(count)-1 > math.MaxUint16 {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.promiscuous && count > 1 {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+	if err := e.bindLocked(tcpip.FullAddress{Addr: addr, Port: start}); err != nil {
+		return err
+	}
+	for i := uint16(1); i < count; i++ {
+		if err := e.bindExtraPortLocked(start + i); err != nil {
+			e.unbindLocked()
+			return err
+		}
+		e.extraPorts++
+	}
+	return nil
+}
+
+// bindExtraPortLocked reserves port on the address the endpoint is bound to
+// and registers the endpoint to receive datagrams sent to it.
+//
+// +checklocks:e.mu
+func (e *endpoint) bindExtraPortLocked(port uint16) tcpip.Error {
+	id := stack.TransportEndpointID{
+		LocalPort:    port,
+		LocalAddress: e.net.Info().ID.LocalAddress,
+	}
+	portRes := ports.Reservation{
+		Networks:     e.effectiveNetProtos,
+		Transport:    e.transProto,
+		Addr:         id.LocalAddress,
+		Port:         port,
+		Flags:        e.boundPortFlags,
+		BindToDevice: e.boundBindToDevice,
+		Dest:         tcpip.FullAddress{},
+	}
+	if _, err := e.stack.ReservePort(e.stack.Rand(), portRes, nil /* testPort */); err != nil {
+		return err
+	}
+	if err := e.stack.RegisterTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e, e.boundPortFlags, e.boundBindToDevice); err != nil {
+		e.stack.ReleasePort(portRes)
+		return err
+	}
+	return nil
+}
+
+// releaseExtraPortsLocked releases the ports acquired by BindRange beyond the
+// first one.
+//
+// +checklocks:e.mu
+func (e *endpoint) releaseExtraPortsLocked() {
+	for ; e.extraPorts != 0; e.extraPorts-- {
+		id := stack.TransportEndpointID{
+			LocalPort:    e.localPort + e.extraPorts,
+			LocalAddress: e.net.Info().ID.LocalAddress,
+		}
+		e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e, e.boundPortFlags, e.boundBindToDevice)
+		e.stack.ReleasePort(ports.Reservation{
+			Networks:     e.effectiveNetProtos,
+			Transport:    e.transProto,
+			Addr:         id.LocalAddress,
+			Port:         id.LocalPort,
+			Flags:        e.boundPortFlags,
+			BindToDevice: e.boundBindToDevice,
+			Dest:         tcpip.FullAddress{},
+		})
+	}
+}
+
+// BindConnect binds the endpoint to local and connects it to remote as a
+// single operation. No other caller can observe the endpoint in the bound but
+// not yet connected state. If the endpoint fails to connect, the bind is
+// rolled back and the endpoint is left in its initial state.
+func (e *endpoint) BindConnect(local, remote tcpip.FullAddress) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.bindLocked(local); err != nil {
+		return err
+	}
+
+	if err := e.connectLocked(remote); err != nil {
+		e.unbindLocked()
+		return err
+	}
+
+	return nil
+}
+
+// unbindLocked releases the resources acquired by bindLocked and returns the
+// endpoint to the initial state.
+//
+// +checklocks:e.mu
+func (e *endpoint) unbindLocked() {
+	e.releaseExtraPortsLocked()
+	id := e.net.Info().ID
+	id.LocalPort = e.localPort
+	if e.promiscuous {
+		e.stack.UnregisterPromiscuousTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e)
+	} else {
+		e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, e.transProto, id, e, e.boundPortFlags, e.boundBindToDevice)
+		portRes := ports.Reservation{
+			Networks:     e.effectiveNetProtos,
+			Transport:    e.transProto,
+			Addr:         id.LocalAddress,
+			Port:         id.LocalPort,
+			Flags:        e.boundPortFlags,
+			BindToDevice: e.boundBindToDevice,
+			Dest:         tcpip.FullAddress{},
+		}
+		e.stack.ReleasePort(portRes)
+	}
+	e.boundBindToDevice = 0
+	e.boundPortFlags = ports.Flags{}
+	e.effectiveNetProtos = nil
+	e.localPort = 0
+
+	e.net.Unbind()
+
+	e.rcvMu.Lock()
+	e.rcvReady = false
+	e.rcvMu.Unlock()
+}
+
 // GetLocalAddress returns the address to which the endpoint is bound.
 func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, tcpip.Error) {
 	e.mu.RLock()
@@ -813,30 +2208,92 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, tcpip.Error) {
 	return addr, nil
 }
 
+// SetMemberships leaves the multicast groups in remove and joins the groups in
+// add as a single change: if any of them fails, the endpoint's memberships are
+// left unchanged.
+func (e *endpoint) SetMemberships(add, remove []tcpip.MembershipInfo) tcpip.Error {
+	return e.net.SetMemberships(add, remove)
+}
+
+// MulticastMemberships returns the multicast groups the endpoint has joined.
+func (e *endpoint) MulticastMemberships() []tcpip.MembershipInfo {
+	return e.net.MulticastMemberships()
+}
+
 // Readiness returns the current readiness of the endpoint. For example, if
 // waiter.EventIn is set, the endpoint is immediately readable.
 func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
-	// The endpoint is always writable.
-	result := waiter.WritableEvents & mask
+	// The endpoint is writable unless the outgoing link is full.
+	var result waiter.EventMask
+	e.linkBlockedMu.Lock()
+	if !e.linkBlocked {
+		result |= waiter.WritableEvents & mask
+	}
+	e.linkBlockedMu.Unlock()
 
 	// Determine if the endpoint is readable if requested.
-	if mask&waiter.ReadableEvents != 0 {
-		e.rcvMu.Lock()
-		if !e.rcvList.Empty() || e.rcvClosed {
-			result |= waiter.ReadableEvents
-		}
-		e.rcvMu.Unlock()
+	e.rcvMu.Lock()
+	if mask&waiter.ReadableEvents != 0 && (!e.rcvList.Empty() || e.rcvPartial != nil || e.rcvClosed) {
+		result |= waiter.ReadableEvents
+	}
+	if e.rcvHUp {
+		result |= waiter.EventHUp
 	}
+	e.rcvMu.Unlock()
 
 	e.lastErrorMu.Lock()
 	hasError := e.lastError != nil
 	e.lastErrorMu.Unlock()
-	if hasError {
+	if hasError || e.ops.PeekErr() != nil {
 		result |= waiter.EventErr
 	}
 	return result
 }
 
+// setLinkBlocked marks the endpoint as not writable until the link endpoint of
+// the given NIC can accept packets again.
+func (e *endpoint) setLinkBlocked(nicID tcpip.NICID) {
+	e.linkBlockedMu.Lock()
+	if e.linkBlocked {
+		e.linkBlockedMu.Unlock()
+		return
+	}
+	e.linkBlocked = true
+	e.linkBlockedMu.Unlock()
+
+	// The callback may run synchronously if the link already has room, so
+	// linkBlockedMu must not be held here.
+	if err := e.stack.NotifyWhenLinkWritable(nicID, e.onLinkWritable); err != nil {
+		e.onLinkWritable()
+	}
+}
+
+// onLinkWritable is called when the link endpoint that blocked a write can
+// accept packets again.
+func (e *endpoint) onLinkWritable() {
+	e.linkBlockedMu.Lock()
+	e.linkBlocked = false
+	e.linkBlockedMu.Unlock()
+	e.waiterQueue.Notify(waiter.WritableEvents)
+}
+
+// WaitWritable blocks until the endpoint is writable or ctx is done, in which
+// case ctx.Err() is returned.
+func (e *endpoint) WaitWritable(ctx context.Context) error {
+	we, ch := waiter.NewChannelEntry(nil)
+	e.waiterQueue.EventRegister(&we, waiter.WritableEvents)
+	defer e.waiterQueue.EventUnregister(&we)
+
+	for e.Readiness(waiter.WritableEvents) == 0 {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // verifyChecksum verifies the checksum unless RX checksum offload is enabled.
 func verifyChecksum(hdr header.UDP, pkt *stack.PacketBuffer) bool {
 	if pkt.RXTransportChecksumValidated {
@@ -863,26 +2320,103 @@ func verifyChecksum(hdr header.UDP, pkt *stack.PacketBuffer) bool {
 	return hdr.IsChecksumValid(netHdr.SourceAddress(), netHdr.DestinationAddress(), payloadChecksum)
 }
 
+// verifyLiteChecksum is like verifyChecksum for UDP-Lite datagrams. It also
+// returns false if the datagram's checksum coverage is invalid, which RFC 3828
+// section 3.1 requires to be treated like a checksum failure.
+func verifyLiteChecksum(hdr header.UDP, pkt *stack.PacketBuffer) bool {
+	size := header.UDPMinimumSize + pkt.Data().Size()
+	coverage := int(hdr.Length())
+	switch {
+	case coverage == 0:
+		// A coverage of zero covers the whole datagram.
+		coverage = size
+	case coverage < header.UDPMinimumSize || coverage > size:
+		return false
+	}
+
+	// The UDP-Lite checksum is mandatory, even on IPv4. Checksum offload
+	// validates UDP checksums, which cover the whole datagram, so it can't be
+	// relied on.
+	if hdr.Checksum() == 0 {
+		return false
+	}
+
+	// Unlike the Length field, the pseudo-header's length covers the whole
+	// datagram (RFC 3828 section 3.2).
+	netHdr := pkt.Network()
+	xsum := header.PseudoHeaderChecksum(header.UDPLiteProtocolNumber, netHdr.SourceAddress(), netHdr.DestinationAddress(), uint16(size))
+	xsum = header.ChecksumCombine(xsum, pkt.Data().AsRange().Capped(coverage-header.UDPMinimumSize).Checksum())
+	return hdr.CalculateChecksum(xsum) == 0xffff
+}
+
+// IsClosing implements stack.closingTransportEndpoint.
+func (e *endpoint) IsClosing() bool {
+	return atomic.LoadUint32(&e.closing) != 0
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
 func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
 	// Get the header then trim it from the view.
 	hdr := header.UDP(pkt.TransportHeader().View())
-	if int(hdr.Length()) > pkt.Data().Size()+header.UDPMinimumSize {
-		// Malformed packet.
-		e.stack.Stats().UDP.MalformedPacketsReceived.Increment()
-		e.stats.ReceiveErrors.MalformedPacketsReceived.Increment()
-		return
+	if e.transProto == LiteProtocolNumber {
+		if !verifyLiteChecksum(hdr, pkt) {
+			e.stack.Stats().UDP.ChecksumErrors.Increment()
+			e.stats.ReceiveErrors.ChecksumErrors.Increment()
+			return
+		}
+	} else {
+		if int(hdr.Length()) > pkt.Data().Size()+header.UDPMinimumSize {
+			// Malformed packet.
+			e.stack.Stats().UDP.MalformedPacketsReceived.Increment()
+			e.stats.ReceiveErrors.MalformedPacketsReceived.Increment()
+			captureBadLength(e.stack, hdr, pkt)
+			return
+		}
+
+		if !verifyChecksum(hdr, pkt) {
+			if countChecksumError(e.stack, hdr, pkt) {
+				e.stats.ReceiveErrors.ChecksumErrors.Increment()
+			}
+			return
+		}
 	}
 
-	if !verifyChecksum(hdr, pkt) {
-		e.stack.Stats().UDP.ChecksumErrors.Increment()
-		e.stats.ReceiveErrors.ChecksumErrors.Increment()
+	if pkt.NetworkPacketInfo.LocalSource && atomic.LoadUint32(&e.acceptLocalSource) == 0 {
+		e.stack.Stats().IP.InvalidSourceAddressesReceived.Increment()
 		return
 	}
+	e.rcvMu.Lock()
+	acceptedPorts := e.rcvAcceptedPorts
+	e.rcvMu.Unlock()
+	if acceptedPorts != nil {
+		if _, ok := acceptedPorts[hdr.SourcePort()]; !ok {
+			e.stats.ReceiveErrors.SourcePortFiltered.Increment()
+			return
+		}
+	}
 
 	e.stack.Stats().UDP.PacketsReceived.Increment()
 	e.stats.PacketsReceived.Increment()
+	switch {
+	case header.IsV4MulticastAddress(id.LocalAddress) || header.IsV6MulticastAddress(id.LocalAddress):
+		e.stats.ReceivedMulticast.Increment()
+	case pkt.NetworkPacketInfo.LocalAddressBroadcast:
+		e.stats.ReceivedBroadcast.Increment()
+	default:
+		e.stats.ReceivedUnicast.Increment()
+	}
+	if pkt.ReusePortMiss {
+		e.stats.ReceiveErrors.ReusePortMiss.Increment()
+	}
+
+	// Classifying the destination requires looking up the NIC's subnets, so
+	// only do it when the destination type is going to be reported.
+	var wasBroadcast, wasMulticast bool
+	if e.ops.GetReceiveDestinationType() {
+		wasMulticast = header.IsV4MulticastAddress(id.LocalAddress) || header.IsV6MulticastAddress(id.LocalAddress)
+		wasBroadcast = id.LocalAddress == header.IPv4Broadcast || e.stack.IsSubnetBroadcast(pkt.NICID, pkt.NetworkProtocolNumber, id.LocalAddress)
+	}
 
 	e.rcvMu.Lock()
 	// Drop the packet if our buffer is currently full.
@@ -893,7 +2427,20 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketB
 		return
 	}
 
+	// The limit may change at any time, including to below the current
+	// occupancy. It is only consulted when a datagram arrives, so lowering it
+	// never drops datagrams that are already queued under DropTail.
 	rcvBufSize := e.ops.GetReceiveBufferSize()
+	if !e.frozen && e.rcvDropPolicy == DropHead {
+		// Evict the oldest datagrams until the new one fits.
+		for e.rcvBufSize >= int(rcvBufSize) && !e.rcvList.Empty() {
+			p := e.rcvList.Front()
+			e.dequeueLocked(p)
+			e.rcvBufSize -= p.data.Size()
+			e.stack.Stats().UDP.ReceiveBufferErrors.Increment()
+			e.stats.ReceiveErrors.ReceiveBufferOverflow.Increment()
+		}
+	}
 	if e.frozen || e.rcvBufSize >= int(rcvBufSize) {
 		e.rcvMu.Unlock()
 		e.stack.Stats().UDP.ReceiveBufferErrors.Increment()
@@ -901,7 +2448,9 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketB
 		return
 	}
 
-	wasEmpty := e.rcvBufSize == 0
+	// Zero-length datagrams don't contribute to rcvBufSize, so check the list
+	// itself to determine whether waiters need to be notified.
+	wasEmpty := e.rcvList.Empty()
 
 	// Push new packet into receive list and increment the buffer size.
 	packet := &udpPacket{
@@ -916,17 +2465,28 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketB
 			Addr: id.LocalAddress,
 			Port: hdr.DestinationPort(),
 		},
-		data: pkt.Data().ExtractVV(),
+		data:          pkt.Data().ExtractVV(),
+		incomingCPU:   pkt.IncomingCPU,
+		wasBroadcast:  wasBroadcast,
+		wasMulticast:  wasMulticast,
+		linkPriority:  pkt.LinkPriority,
+		linkSource:    pkt.LinkSource,
+		wasFragmented: pkt.NetworkPacketInfo.Reassembled,
 	}
-	e.rcvList.PushBack(packet)
+	e.enqueueLocked(packet)
 	e.rcvBufSize += packet.data.Size()
+	if e.rcvBufSize > e.rcvPeak {
+		e.rcvPeak = e.rcvBufSize
+	}
 
 	// Save any useful information from the network header to the packet.
 	switch pkt.NetworkProtocolNumber {
 	case header.IPv4ProtocolNumber:
-		packet.tos, _ = header.IPv4(pkt.NetworkHeader().View()).TOS()
+		ipv4Hdr := header.IPv4(pkt.NetworkHeader().View())
+		packet.tos, _ = ipv4Hdr.TOS()
+		packet.ipID = ipv4Hdr.ID()
 	case header.IPv6ProtocolNumber:
-		packet.tos, _ = header.IPv6(pkt.NetworkHeader().View()).TOS()
+		packet.tos, packet.flowLabel = header.IPv6(pkt.NetworkHeader().View()).TOS()
 	}
 
 	// TODO(gvisor.dev/issue/3556): r.LocalAddress may be a multicast or broadcast
@@ -946,11 +2506,14 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt *stack.PacketB
 	}
 }
 
-func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, pkt *stack.PacketBuffer) {
-	// Update last error first.
-	e.lastErrorMu.Lock()
-	e.lastError = err
-	e.lastErrorMu.Unlock()
+func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, pkt *stack.PacketBuffer, soft bool) {
+	// Like Linux, soft errors don't fail the socket and are only reported
+	// through the error queue.
+	if !soft {
+		e.lastErrorMu.Lock()
+		e.lastError = err
+		e.lastErrorMu.Unlock()
+	}
 
 	// Update the error queue if IP_RECVERR is enabled.
 	if e.SocketOptions().GetRecvError() {
@@ -977,7 +2540,10 @@ func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, p
 				Port: e.localPort,
 			},
 			NetProto: pkt.NetworkProtocolNumber,
+			Soft:     soft,
 		})
+	} else if soft {
+		return
 	}
 
 	// Notify of the error.
@@ -987,11 +2553,34 @@ func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, p
 // HandleError implements stack.TransportEndpoint.
 func (e *endpoint) HandleError(transErr stack.TransportError, pkt *stack.PacketBuffer) {
 	// TODO(gvisor.dev/issues/5270): Handle all transport errors.
-	switch transErr.Kind() {
+	if e.net.State() != transport.DatagramEndpointStateConnected {
+		return
+	}
+
+	if err, soft := classifyTransportError(transErr.Kind()); err != nil {
+		e.onICMPError(err, transErr, pkt, soft)
+	}
+}
+
+// classifyTransportError returns the error a connected endpoint reports for a
+// transport error of the given kind, and whether it is a soft error, or nil if
+// the endpoint ignores such errors.
+//
+// As in Linux, only a refused connection is a hard error. Expired TTLs,
+// unreachable hosts and networks and failed source routes may be transient,
+// so they are soft errors.
+func classifyTransportError(kind stack.TransportErrorKind) (tcpip.Error, bool) {
+	switch kind {
 	case stack.DestinationPortUnreachableTransportError:
-		if e.net.State() == transport.DatagramEndpointStateConnected {
-			e.onICMPError(&tcpip.ErrConnectionRefused{}, transErr, pkt)
-		}
+		return &tcpip.ErrConnectionRefused{}, false
+	case stack.TimeExceededTransportError, stack.DestinationHostUnreachableTransportError:
+		return &tcpip.ErrNoRoute{}, true
+	case stack.DestinationNetworkUnreachableTransportError:
+		return &tcpip.ErrNetworkUnreachable{}, true
+	case stack.SourceRouteFailedTransportError:
+		return &tcpip.ErrNotSupported{}, true
+	default:
+		return nil, false
 	}
 }
 
@@ -1015,6 +2604,12 @@ func (e *endpoint) Stats() tcpip.EndpointStats {
 	return &e.stats
 }
 
+// ResetStats zeroes the endpoint stats and returns a snapshot of their values
+// before the reset, so that callers can sample deltas.
+func (e *endpoint) ResetStats() tcpip.TransportEndpointStats {
+	return e.stats.Reset()
+}
+
 // Wait implements tcpip.Endpoint.
 func (*endpoint) Wait() {}
 
@@ -82,6 +82,11 @@ func (e *endpoint) Resume(s *stack.Stack) {
 		}
 		e.localPort = id.LocalPort
 		e.remotePort = id.RemotePort
+		for i := uint16(1); i <= e.extraPorts; i++ {
+			if err := e.bindExtraPortLocked(e.localPort + i); err != nil {
+				panic(err)
+			}
+		}
 	default:
 		panic(fmt.Sprintf("unhandled state = %s", state))
 	}
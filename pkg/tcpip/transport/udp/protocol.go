@@ -16,6 +16,8 @@
 package udp
 
 import (
+	"sync/atomic"
+
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -29,6 +31,9 @@ const (
 	// ProtocolNumber is the udp protocol number.
 	ProtocolNumber = header.UDPProtocolNumber
 
+	// LiteProtocolNumber is the UDP-Lite protocol number.
+	LiteProtocolNumber = header.UDPLiteProtocolNumber
+
 	// MinBufferSize is the smallest size of a receive or send buffer.
 	MinBufferSize = 4 << 10 // 4KiB bytes.
 
@@ -42,26 +47,42 @@ const (
 
 	// MaxBufferSize is the largest size a receive/send buffer can grow to.
 	MaxBufferSize = 4 << 20 // 4MiB
+
+	// maxGROSegments is the maximum number of datagrams returned by a single
+	// coalesced read. It matches Linux's UDP_GRO_CNT_MAX.
+	maxGROSegments = 64
 )
 
 type protocol struct {
 	stack *stack.Stack
+
+	// number is ProtocolNumber, or LiteProtocolNumber if the protocol
+	// implements UDP-Lite.
+	number tcpip.TransportProtocolNumber
+
+	// separateZeroChecksumStats is non-zero if IPv6 datagrams with a zero
+	// checksum are not counted as checksum errors. Accessed atomically.
+	separateZeroChecksumStats uint32
+
+	// writeAndReturnPacket is non-zero if endpoints allow
+	// WriteAndReturnPacket. Accessed atomically.
+	writeAndReturnPacket uint32
 }
 
 // Number returns the udp protocol number.
-func (*protocol) Number() tcpip.TransportProtocolNumber {
-	return ProtocolNumber
+func (p *protocol) Number() tcpip.TransportProtocolNumber {
+	return p.number
 }
 
 // NewEndpoint creates a new udp endpoint.
 func (p *protocol) NewEndpoint(netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, tcpip.Error) {
-	return newEndpoint(p.stack, netProto, waiterQueue), nil
+	return newEndpoint(p.stack, netProto, p.number, waiterQueue), nil
 }
 
 // NewRawEndpoint creates a new raw UDP endpoint. It implements
 // stack.TransportProtocol.NewRawEndpoint.
 func (p *protocol) NewRawEndpoint(netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, tcpip.Error) {
-	return raw.NewEndpoint(p.stack, netProto, header.UDPProtocolNumber, waiterQueue)
+	return raw.NewEndpoint(p.stack, netProto, p.number, waiterQueue)
 }
 
 // MinimumPacketSize returns the minimum valid udp packet size.
@@ -80,27 +101,88 @@ func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err tcpip.Error) {
 // protocol but don't match any existing endpoint.
 func (p *protocol) HandleUnknownDestinationPacket(id stack.TransportEndpointID, pkt *stack.PacketBuffer) stack.UnknownDestinationPacketDisposition {
 	hdr := header.UDP(pkt.TransportHeader().View())
+	if p.number == LiteProtocolNumber {
+		if !verifyLiteChecksum(hdr, pkt) {
+			p.stack.Stats().UDP.ChecksumErrors.Increment()
+			return stack.UnknownDestinationPacketMalformed
+		}
+		return stack.UnknownDestinationPacketUnhandled
+	}
+
 	if int(hdr.Length()) > pkt.Data().Size()+header.UDPMinimumSize {
 		p.stack.Stats().UDP.MalformedPacketsReceived.Increment()
+		captureBadLength(p.stack, hdr, pkt)
 		return stack.UnknownDestinationPacketMalformed
 	}
 
 	if !verifyChecksum(hdr, pkt) {
-		p.stack.Stats().UDP.ChecksumErrors.Increment()
+		countChecksumError(p.stack, hdr, pkt)
 		return stack.UnknownDestinationPacketMalformed
 	}
 
 	return stack.UnknownDestinationPacketUnhandled
 }
 
+// captureBadLength reports a datagram whose Length field exceeds its size to
+// the stack's malformed packet capture.
+func captureBadLength(s *stack.Stack, hdr header.UDP, pkt *stack.PacketBuffer) {
+	s.CaptureMalformedPacket(pkt, "UDP length %d exceeds datagram size %d", hdr.Length(), pkt.Data().Size()+header.UDPMinimumSize)
+}
+
+// countChecksumError records a datagram that failed checksum verification in
+// the stack's statistics. It returns true if the datagram was counted as a
+// checksum error rather than only as an illegal zero checksum on IPv6.
+func countChecksumError(s *stack.Stack, hdr header.UDP, pkt *stack.PacketBuffer) bool {
+	stats := s.Stats().UDP
+	if pkt.NetworkProtocolNumber == header.IPv6ProtocolNumber && hdr.Checksum() == 0 {
+		stats.ZeroChecksumIPv6.Increment()
+		var separate tcpip.UDPSeparateZeroChecksumStatsOption
+		if err := s.TransportProtocolOption(ProtocolNumber, &separate); err == nil && bool(separate) {
+			return false
+		}
+	}
+	stats.ChecksumErrors.Increment()
+	return true
+}
+
 // SetOption implements stack.TransportProtocol.SetOption.
-func (*protocol) SetOption(tcpip.SettableTransportProtocolOption) tcpip.Error {
-	return &tcpip.ErrUnknownProtocolOption{}
+func (p *protocol) SetOption(option tcpip.SettableTransportProtocolOption) tcpip.Error {
+	switch v := option.(type) {
+	case *tcpip.UDPSeparateZeroChecksumStatsOption:
+		var b uint32
+		if *v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.separateZeroChecksumStats, b)
+		return nil
+
+	case *tcpip.UDPWriteAndReturnPacketOption:
+		var b uint32
+		if *v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.writeAndReturnPacket, b)
+		return nil
+
+	default:
+		return &tcpip.ErrUnknownProtocolOption{}
+	}
 }
 
 // Option implements stack.TransportProtocol.Option.
-func (*protocol) Option(tcpip.GettableTransportProtocolOption) tcpip.Error {
-	return &tcpip.ErrUnknownProtocolOption{}
+func (p *protocol) Option(option tcpip.GettableTransportProtocolOption) tcpip.Error {
+	switch v := option.(type) {
+	case *tcpip.UDPSeparateZeroChecksumStatsOption:
+		*v = atomic.LoadUint32(&p.separateZeroChecksumStats) != 0
+		return nil
+
+	case *tcpip.UDPWriteAndReturnPacketOption:
+		*v = atomic.LoadUint32(&p.writeAndReturnPacket) != 0
+		return nil
+
+	default:
+		return &tcpip.ErrUnknownProtocolOption{}
+	}
 }
 
 // Close implements stack.TransportProtocol.Close.
@@ -110,11 +192,23 @@ func (*protocol) Close() {}
 func (*protocol) Wait() {}
 
 // Parse implements stack.TransportProtocol.Parse.
-func (*protocol) Parse(pkt *stack.PacketBuffer) bool {
-	return parse.UDP(pkt)
+func (p *protocol) Parse(pkt *stack.PacketBuffer) bool {
+	if !parse.UDP(pkt) {
+		return false
+	}
+	pkt.TransportProtocolNumber = p.number
+	return true
 }
 
 // NewProtocol returns a UDP transport protocol.
 func NewProtocol(s *stack.Stack) stack.TransportProtocol {
-	return &protocol{stack: s}
+	return &protocol{stack: s, number: ProtocolNumber}
+}
+
+// NewLiteProtocol returns a UDP-Lite transport protocol (RFC 3828). Its
+// endpoints behave like UDP endpoints, except that the checksum of the
+// datagrams they send and receive may cover only part of the payload (see
+// SetUDPLiteCoverage).
+func NewLiteProtocol(s *stack.Stack) stack.TransportProtocol {
+	return &protocol{stack: s, number: LiteProtocolNumber}
 }
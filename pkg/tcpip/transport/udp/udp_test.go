@@ -16,10 +16,17 @@ package udp_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/time/rate"
@@ -33,9 +40,12 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/ports"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/testutil"
+	"gvisor.dev/gvisor/pkg/tcpip/transport"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
 )
@@ -303,19 +313,30 @@ func newDualTestContext(t *testing.T, mtu uint32) *testContext {
 }
 
 func newDualTestContextWithHandleLocal(t *testing.T, mtu uint32, handleLocal bool) *testContext {
+	t.Helper()
+	return newDualTestContextWithClock(t, mtu, handleLocal, &faketime.NullClock{})
+}
+
+func newDualTestContextWithClock(t *testing.T, mtu uint32, handleLocal bool, clock tcpip.Clock) *testContext {
+	t.Helper()
+	return newDualTestContextWithOptions(t, mtu, stack.Options{
+		HandleLocal: handleLocal,
+		Clock:       clock,
+	})
+}
+
+// newDualTestContextWithOptions is like newDualTestContext, but creates the
+// stack with options. The network and transport protocols are always set.
+func newDualTestContextWithOptions(t *testing.T, mtu uint32, options stack.Options) *testContext {
 	const nicID = 1
 
 	t.Helper()
 
-	options := stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
-		HandleLocal:        handleLocal,
-		Clock:              &faketime.NullClock{},
-	}
+	options.NetworkProtocols = []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol}
+	options.TransportProtocols = []stack.TransportProtocolFactory{udp.NewProtocol, udp.NewLiteProtocol, icmp.NewProtocol6, icmp.NewProtocol4}
 	s := stack.New(options)
-	// Disable ICMP rate limiter because we're using Null clock, which never advances time and thus
-	// never allows ICMP messages.
+	// Disable ICMP rate limiter because test clocks may never advance time and
+	// thus never allow ICMP messages.
 	s.SetICMPLimit(rate.Inf)
 	ep := channel.New(256, mtu, "")
 	wep := stack.LinkEndpoint(ep)
@@ -442,9 +463,7 @@ func (c *testContext) injectPacket(flow testFlow, payload []byte, badChecksum bo
 				}
 			}
 		}
-		c.linkEP.InjectInbound(ipv4.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Data: buf.ToVectorisedView(),
-		}))
+		c.injectRaw(ipv4.ProtocolNumber, buf)
 	} else {
 		buf := c.buildV6Packet(payload, &h)
 		if badChecksum {
@@ -453,12 +472,20 @@ func (c *testContext) injectPacket(flow testFlow, payload []byte, badChecksum bo
 			u := header.UDP(buf[header.IPv6MinimumSize:])
 			u.SetChecksum(u.Checksum() + 1)
 		}
-		c.linkEP.InjectInbound(ipv6.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Data: buf.ToVectorisedView(),
-		}))
+		c.injectRaw(ipv6.ProtocolNumber, buf)
 	}
 }
 
+// injectRaw injects the given bytes into the link endpoint as a packet of the
+// given network protocol, without any validation.
+func (c *testContext) injectRaw(netProto tcpip.NetworkProtocolNumber, b []byte) {
+	c.t.Helper()
+
+	c.linkEP.InjectInbound(netProto, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(b).ToVectorisedView(),
+	}))
+}
+
 // buildV6Packet creates a V6 test packet with the given payload and header
 // values in a buffer.
 func (c *testContext) buildV6Packet(payload []byte, h *header4Tuple) buffer.View {
@@ -597,6 +624,146 @@ func TestBindToDeviceOption(t *testing.T) {
 	}
 }
 
+func TestCloneConfig(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+	for _, opt := range []struct {
+		opt tcpip.SockOptInt
+		v   int
+	}{
+		{tcpip.TTLOption, 7},
+		{tcpip.IPv4TOSOption, 0x10},
+		{tcpip.IPv6TrafficClassOption, 0x20},
+	} {
+		if err := c.ep.SetSockOptInt(opt.opt, opt.v); err != nil {
+			t.Fatalf("SetSockOptInt(%d, %d) failed: %s", opt.opt, opt.v, err)
+		}
+	}
+	ops := c.ep.SocketOptions()
+	ops.SetBroadcast(true)
+	ops.SetReuseAddress(true)
+	ops.SetReusePort(true)
+	ops.SetV6Only(true)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	cfg, err := c.ep.(interface {
+		CloneConfig() (stack.EndpointConfig, tcpip.Error)
+	}).CloneConfig()
+	if err != nil {
+		t.Fatalf("CloneConfig() failed: %s", err)
+	}
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpointFromConfig(cfg, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpointFromConfig(%+v, _) failed: %s", cfg, err)
+	}
+	defer ep.Close()
+
+	for _, opt := range []tcpip.SockOptInt{tcpip.TTLOption, tcpip.IPv4TOSOption, tcpip.IPv6TrafficClassOption} {
+		want, err := c.ep.GetSockOptInt(opt)
+		if err != nil {
+			t.Fatalf("c.ep.GetSockOptInt(%d) failed: %s", opt, err)
+		}
+		if got, err := ep.GetSockOptInt(opt); err != nil {
+			t.Errorf("ep.GetSockOptInt(%d) failed: %s", opt, err)
+		} else if got != want {
+			t.Errorf("got ep.GetSockOptInt(%d) = %d, want = %d", opt, got, want)
+		}
+	}
+	clonedOps := ep.SocketOptions()
+	for _, tc := range []struct {
+		name string
+		get  func(*tcpip.SocketOptions) bool
+	}{
+		{"Broadcast", (*tcpip.SocketOptions).GetBroadcast},
+		{"ReuseAddress", (*tcpip.SocketOptions).GetReuseAddress},
+		{"ReusePort", (*tcpip.SocketOptions).GetReusePort},
+		{"V6Only", (*tcpip.SocketOptions).GetV6Only},
+	} {
+		if got := tc.get(clonedOps); !got {
+			t.Errorf("got %s = false on the cloned endpoint, want = true", tc.name)
+		}
+	}
+
+	// The binding isn't cloned, and sharing the port is allowed by the cloned
+	// reuse options.
+	if got, err := ep.GetLocalAddress(); err != nil {
+		t.Fatalf("GetLocalAddress failed: %s", err)
+	} else if got.Port != 0 {
+		t.Errorf("got cloned endpoint local port = %d, want = 0", got.Port)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Errorf("Bind of the cloned endpoint to the same port failed: %s", err)
+	}
+
+	// A closed endpoint has no configuration to clone.
+	c.ep.Close()
+	{
+		_, err := c.ep.(interface {
+			CloneConfig() (stack.EndpointConfig, tcpip.Error)
+		}).CloneConfig()
+		if _, ok := err.(*tcpip.ErrInvalidEndpointState); !ok {
+			t.Errorf("got CloneConfig() after Close = %v, want = %s", err, &tcpip.ErrInvalidEndpointState{})
+		}
+	}
+}
+
+func TestBindToNICOption(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              &faketime.NullClock{},
+	})
+
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if err != nil {
+		t.Fatalf("NewEndpoint failed; %s", err)
+	}
+	defer ep.Close()
+
+	if err := s.CreateNIC(321, loopback.New()); err != nil {
+		t.Errorf("CreateNIC(321, _) failed: %s", err)
+	}
+
+	// nicIDPtr is used instead of taking the address of NICID literals, which is
+	// a compiler error.
+	nicIDPtr := func(s tcpip.NICID) *tcpip.NICID {
+		return &s
+	}
+
+	testActions := []struct {
+		name              string
+		setBindToNIC      *tcpip.NICID
+		setBindToNICError tcpip.Error
+		getBindToNIC      tcpip.NICID
+	}{
+		{"GetDefaultValue", nil, nil, 0},
+		{"BindToNonExistent", nicIDPtr(999), &tcpip.ErrUnknownDevice{}, 0},
+		{"BindToExistent", nicIDPtr(321), nil, 321},
+		{"UnbindToNIC", nicIDPtr(0), nil, 0},
+	}
+	for _, testAction := range testActions {
+		t.Run(testAction.name, func(t *testing.T) {
+			if testAction.setBindToNIC != nil {
+				nicID := *testAction.setBindToNIC
+				if gotErr, wantErr := ep.SocketOptions().SetBindToNIC(nicID), testAction.setBindToNICError; gotErr != wantErr {
+					t.Errorf("got SetBindToNIC(%d) = %s, want = %s", nicID, gotErr, wantErr)
+				}
+			}
+			if got := ep.SocketOptions().GetBindToNIC(); got != testAction.getBindToNIC {
+				t.Errorf("got GetBindToNIC() = %d, want = %d", got, testAction.getBindToNIC)
+			}
+			if got, want := ep.SocketOptions().GetBindToDevice(), int32(testAction.getBindToNIC); got != want {
+				t.Errorf("got GetBindToDevice() = %d, want = %d", got, want)
+			}
+		})
+	}
+}
+
 // testReadInternal sends a packet of the given test flow into the stack by
 // injecting it into the link endpoint. It then attempts to read it from the
 // UDP endpoint and depending on if this was expected to succeed verifies its
@@ -699,6 +866,299 @@ func TestBindEphemeralPort(t *testing.T) {
 	}
 }
 
+func TestBindRange(t *testing.T) {
+	const (
+		start = 5000
+		count = 10
+	)
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	type rangeBinder interface {
+		BindRange(tcpip.Address, uint16, uint16) tcpip.Error
+	}
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.(rangeBinder).BindRange(stackAddr, start, count); err != nil {
+		t.Fatalf("BindRange(%s, %d, %d): %s", stackAddr, start, count, err)
+	}
+
+	// Datagrams sent to any port in the range are delivered.
+	c.ep.SocketOptions().SetReceiveOriginalDstAddress(true)
+	payload := newPayload()
+	h := header4Tuple{
+		srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+		dstAddr: tcpip.FullAddress{Addr: stackAddr, Port: start + 5},
+	}
+	c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(payload, &h))
+	var buf bytes.Buffer
+	res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if got, want := res.ControlMessages.OriginalDstAddress.Port, uint16(start+5); got != want {
+		t.Errorf("got OriginalDstAddress.Port = %d, want = %d", got, want)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Errorf("got payload = %x, want = %x", buf.Bytes(), payload)
+	}
+
+	// Any port in the range can be used as the source port.
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	var r bytes.Reader
+	r.Reset(newPayload())
+	if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, SourcePort: start + count - 1}); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	c.getPacketAndVerify(unicastV4, checker.UDP(checker.SrcPort(start+count-1)))
+
+	newEndpoint := func() tcpip.Endpoint {
+		t.Helper()
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		return ep
+	}
+
+	// The whole range is unavailable to other endpoints.
+	for port := uint16(start); port < start+count; port++ {
+		ep := newEndpoint()
+		{
+			err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: port})
+			if _, ok := err.(*tcpip.ErrPortInUse); !ok {
+				t.Errorf("got Bind to port %d = %v, want = %s", port, err, &tcpip.ErrPortInUse{})
+			}
+		}
+		ep.Close()
+	}
+
+	// A conflicting range reserves none of its ports.
+	other := newEndpoint()
+	defer other.Close()
+	{
+		err := other.(rangeBinder).BindRange(stackAddr, start-5, count)
+		if _, ok := err.(*tcpip.ErrPortInUse); !ok {
+			t.Fatalf("got overlapping BindRange = %v, want = %s", err, &tcpip.ErrPortInUse{})
+		}
+	}
+	for port := uint16(start - 5); port < start; port++ {
+		ep := newEndpoint()
+		if err := ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: port}); err != nil {
+			t.Errorf("Bind to port %d after failed BindRange: %s", port, err)
+		}
+		ep.Close()
+	}
+
+	// Range bound endpoints can't be connected.
+	{
+		err := c.ep.Connect(to)
+		if _, ok := err.(*tcpip.ErrInvalidEndpointState); !ok {
+			t.Errorf("got Connect = %v, want = %s", err, &tcpip.ErrInvalidEndpointState{})
+		}
+	}
+
+	// Closing the endpoint releases the whole range.
+	c.ep.Close()
+	c.ep = nil
+	if err := other.(rangeBinder).BindRange(stackAddr, start, count); err != nil {
+		t.Errorf("BindRange(%s, %d, %d) after close: %s", stackAddr, start, count, err)
+	}
+}
+
+func TestPromiscuousReceive(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+
+	type promiscuousReceiver interface {
+		SetPromiscuousReceive(bool) tcpip.Error
+	}
+	pep, ok := ep.(promiscuousReceiver)
+	if !ok {
+		t.Fatalf("%T does not implement SetPromiscuousReceive", ep)
+	}
+
+	// Promiscuous listeners must be permitted by the stack.
+	{
+		err := pep.SetPromiscuousReceive(true)
+		if _, ok := err.(*tcpip.ErrNotPermitted); !ok {
+			t.Fatalf("got SetPromiscuousReceive(true) = %v without a check, want = %s", err, &tcpip.ErrNotPermitted{})
+		}
+	}
+	{
+		err := ep.Bind(tcpip.FullAddress{Port: stackPort})
+		if _, ok := err.(*tcpip.ErrPortInUse); !ok {
+			t.Fatalf("got Bind(...) = %v, want = %s", err, &tcpip.ErrPortInUse{})
+		}
+	}
+
+	c.s.SetUDPPromiscuousReceiveCheck(func() bool { return true })
+	if err := pep.SetPromiscuousReceive(true); err != nil {
+		t.Fatalf("SetPromiscuousReceive(true): %s", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	// Both listeners get a copy of the datagram.
+	payload := newPayload()
+	c.injectPacket(unicastV4, payload, false /* badChecksum */)
+	for _, ep := range []tcpip.Endpoint{c.ep, ep} {
+		var buf bytes.Buffer
+		if _, err := ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if diff := cmp.Diff(payload, buf.Bytes()); diff != "" {
+			t.Errorf("payload mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// The normal listener keeps the port once the promiscuous listener is
+	// closed.
+	ep.Close()
+	testRead(c, unicastV4)
+}
+
+func TestBindAddressEphemeralPort(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackAddr}); err != nil {
+		t.Fatalf("ep.Bind(...) failed: %s", err)
+	}
+	addr, err := c.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %s", err)
+	}
+	if addr.Addr != stackAddr || addr.Port == 0 {
+		t.Fatalf("got GetLocalAddress() = %+v, want address %s with an ephemeral port", addr, stackAddr)
+	}
+
+	if got := testWrite(c, unicastV4, checker.SrcAddr(stackAddr)); got != addr.Port {
+		t.Errorf("got source port = %d, want = %d", got, addr.Port)
+	}
+
+	// The reservation only covers the bound address.
+	const otherAddr = tcpip.Address("\x0a\x00\x00\x03")
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: otherAddr.WithPrefix(),
+	}
+	if err := c.s.AddProtocolAddress(1, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(1, %+v, {}): %s", protocolAddr, err)
+	}
+	for _, tc := range []struct {
+		addr    tcpip.FullAddress
+		wantErr tcpip.Error
+	}{
+		{addr: tcpip.FullAddress{Addr: stackAddr, Port: addr.Port}, wantErr: &tcpip.ErrPortInUse{}},
+		{addr: tcpip.FullAddress{Port: addr.Port}, wantErr: &tcpip.ErrPortInUse{}},
+		{addr: tcpip.FullAddress{Addr: otherAddr, Port: addr.Port}},
+	} {
+		func() {
+			ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %s", err)
+			}
+			defer ep.Close()
+			if diff := cmp.Diff(tc.wantErr, ep.Bind(tc.addr)); diff != "" {
+				t.Errorf("ep.Bind(%+v) mismatch (-want +got):\n%s", tc.addr, diff)
+			}
+		}()
+	}
+}
+
+func TestEphemeralPortRandomization(t *testing.T) {
+	const numBinds = 64
+
+	bindPorts := func(c *testContext) []uint16 {
+		var got []uint16
+		for i := 0; i < numBinds; i++ {
+			ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %s", err)
+			}
+			t.Cleanup(ep.Close)
+			if err := ep.Bind(tcpip.FullAddress{}); err != nil {
+				t.Fatalf("ep.Bind(...) failed: %s", err)
+			}
+			addr, err := ep.GetLocalAddress()
+			if err != nil {
+				t.Fatalf("GetLocalAddress failed: %s", err)
+			}
+			got = append(got, addr.Port)
+		}
+		return got
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		if err := c.s.SetEphemeralPortRandomization(0); err != nil {
+			t.Fatalf("SetEphemeralPortRandomization(0): %s", err)
+		}
+		// Ports for the same flow are allocated sequentially from a secret
+		// per-flow offset, wrapping around at the end of the range.
+		first, last := c.s.PortRange()
+		got := bindPorts(c)
+		for i, port := range got {
+			if want := first + uint16((int(got[0]-first)+i)%(int(last-first)+1)); port != want {
+				t.Fatalf("got port #%d = %d, want = %d", i, port, want)
+			}
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		if err := c.s.SetEphemeralPortRandomization(ports.MaxRandomizedBits); err != nil {
+			t.Fatalf("SetEphemeralPortRandomization(%d): %s", ports.MaxRandomizedBits, err)
+		}
+		first, last := c.s.PortRange()
+		lo, hi := last, first
+		for _, port := range bindPorts(c) {
+			if port < lo {
+				lo = port
+			}
+			if port > hi {
+				hi = port
+			}
+		}
+		if spread, window := hi-lo, last-first; spread < window/2 {
+			t.Errorf("got ports spread over [%d, %d], want a spread of at least %d in [%d, %d]", lo, hi, window/2, first, last)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		for _, bits := range []int{-1, ports.MaxRandomizedBits + 1} {
+			err := c.s.SetEphemeralPortRandomization(bits)
+			if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+				t.Errorf("got SetEphemeralPortRandomization(%d) = %v, want = %s", bits, err, &tcpip.ErrInvalidOptionValue{})
+			}
+		}
+	})
+}
+
 func TestBindReservedPort(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -764,26 +1224,489 @@ func TestBindReservedPort(t *testing.T) {
 	}()
 }
 
-func TestV4ReadOnV6(t *testing.T) {
+func TestDumpPortReservations(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpointForFlow(unicastV4in6)
-
-	// Bind to wildcard.
-	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
-		c.t.Fatalf("Bind failed: %s", err)
+	// A dual-stack endpoint connected to an IPv6 peer.
+	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+	connected, err := c.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %s", err)
 	}
 
-	// Test acceptance.
-	testRead(c, unicastV4in6)
-}
+	// An IPv4 endpoint bound to a specific address.
+	v4, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer v4.Close()
+	if err := v4.Bind(tcpip.FullAddress{Addr: stackAddr, Port: stackPort}); err != nil {
+		t.Fatalf("v4.Bind(...) failed: %s", err)
+	}
 
-func TestV4ReadOnBoundToV4MappedWildcard(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+	// A dual-stack endpoint bound to the wildcard address with SO_REUSEPORT.
+	dual, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer dual.Close()
+	dual.SocketOptions().SetReusePort(true)
+	if err := dual.Bind(tcpip.FullAddress{Port: stackPort + 1}); err != nil {
+		t.Fatalf("dual.Bind(...) failed: %s", err)
+	}
 
-	c.createEndpointForFlow(unicastV4in6)
+	// The connected dual-stack endpoint holds its port for both network
+	// protocols, which is why binding the IPv4 wildcard address to that port
+	// fails. UDP does not include the destination in its reservations.
+	want := []ports.PortReservation{
+		{Network: ipv4.ProtocolNumber, Addr: stackAddr, Port: stackPort, Refs: 1},
+		{Network: ipv4.ProtocolNumber, Port: stackPort + 1, Flags: ports.Flags{LoadBalanced: true}, Refs: 1},
+		{Network: ipv4.ProtocolNumber, Addr: stackV6Addr, Port: connected.Port, Refs: 1},
+		{Network: ipv6.ProtocolNumber, Port: stackPort + 1, Flags: ports.Flags{LoadBalanced: true}, Refs: 1},
+		{Network: ipv6.ProtocolNumber, Addr: stackV6Addr, Port: connected.Port, Refs: 1},
+	}
+	if diff := cmp.Diff(want, c.s.DumpPortReservations(udp.ProtocolNumber)); diff != "" {
+		t.Errorf("DumpPortReservations(%d) mismatch (-want +got):\n%s", udp.ProtocolNumber, diff)
+	}
+
+	// Reservations go away with their endpoints.
+	c.ep.Close()
+	v4.Close()
+	dual.Close()
+	if got := c.s.DumpPortReservations(udp.ProtocolNumber); len(got) != 0 {
+		t.Errorf("got DumpPortReservations(%d) = %+v after closing all endpoints, want = []", udp.ProtocolNumber, got)
+	}
+}
+
+func TestConnectPinsSourceAddress(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			h := flow.header4Tuple(outgoing)
+			if err := c.ep.Connect(h.dstAddr); err != nil {
+				c.t.Fatalf("Connect(%#v): %s", h.dstAddr, err)
+			}
+
+			addr, err := c.ep.GetLocalAddress()
+			if err != nil {
+				t.Fatalf("GetLocalAddress failed: %s", err)
+			}
+			if addr.Addr != h.srcAddr.Addr || addr.Port == 0 {
+				t.Fatalf("got GetLocalAddress() = %+v, want address %s with an ephemeral port", addr, h.srcAddr.Addr)
+			}
+
+			if got := testWriteWithoutDestination(c, flow, checker.SrcAddr(h.srcAddr.Addr)); got != addr.Port {
+				t.Errorf("got source port = %d, want = %d", got, addr.Port)
+			}
+		})
+	}
+}
+
+func TestBindConnect(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	type bindConnecter interface {
+		BindConnect(local, remote tcpip.FullAddress) tcpip.Error
+	}
+	ep, ok := c.ep.(bindConnecter)
+	if !ok {
+		t.Fatalf("%T does not implement BindConnect", c.ep)
+	}
+
+	local := tcpip.FullAddress{Addr: stackV6Addr, Port: stackPort}
+	remote := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+	if err := ep.BindConnect(local, remote); err != nil {
+		t.Fatalf("BindConnect(%#v, %#v): %s", local, remote, err)
+	}
+
+	if got, err := c.ep.GetLocalAddress(); err != nil {
+		t.Fatalf("GetLocalAddress failed: %s", err)
+	} else if diff := cmp.Diff(local, got, checker.IgnoreCmpPath("NIC")); diff != "" {
+		t.Errorf("GetLocalAddress() mismatch (-want +got):\n%s", diff)
+	}
+	if got, err := c.ep.GetRemoteAddress(); err != nil {
+		t.Fatalf("GetRemoteAddress failed: %s", err)
+	} else if diff := cmp.Diff(remote, got, checker.IgnoreCmpPath("NIC")); diff != "" {
+		t.Errorf("GetRemoteAddress() mismatch (-want +got):\n%s", diff)
+	}
+
+	testWriteWithoutDestination(c, unicastV6)
+}
+
+func TestBindConnectRollback(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV6Only)
+
+	type bindConnecter interface {
+		BindConnect(local, remote tcpip.FullAddress) tcpip.Error
+	}
+	ep, ok := c.ep.(bindConnecter)
+	if !ok {
+		t.Fatalf("%T does not implement BindConnect", c.ep)
+	}
+
+	// A V6-only endpoint can't connect to a V4-mapped address, so the bind must
+	// be rolled back.
+	local := tcpip.FullAddress{Port: stackPort}
+	remote := tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}
+	{
+		err := ep.BindConnect(local, remote)
+		if _, ok := err.(*tcpip.ErrNoRoute); !ok {
+			t.Fatalf("got BindConnect(%#v, %#v) = %v, want = %s", local, remote, err, &tcpip.ErrNoRoute{})
+		}
+	}
+
+	if got, want := transport.DatagramEndpointState(c.ep.State()), transport.DatagramEndpointStateInitial; got != want {
+		t.Errorf("got c.ep.State() = %s, want = %s", got, want)
+	}
+
+	// The port reservation must have been released.
+	func() {
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &c.wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		defer ep.Close()
+		if err := ep.Bind(local); err != nil {
+			t.Fatalf("ep.Bind(%#v): %s", local, err)
+		}
+	}()
+
+	// The endpoint can still be bound after the failed attempt.
+	if err := c.ep.Bind(local); err != nil {
+		t.Fatalf("c.ep.Bind(%#v): %s", local, err)
+	}
+}
+
+func TestGetRemoteAddress(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	checkNotConnected := func(desc string) {
+		t.Helper()
+		addr, err := c.ep.GetRemoteAddress()
+		if _, ok := err.(*tcpip.ErrNotConnected); !ok {
+			t.Fatalf("%s: got c.ep.GetRemoteAddress() = (%#v, %v), want = (_, %s)", desc, addr, err, &tcpip.ErrNotConnected{})
+		}
+	}
+
+	checkNotConnected("new endpoint")
+
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackV6Addr, Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+	checkNotConnected("bound endpoint")
+
+	remote := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+	if err := c.ep.Connect(remote); err != nil {
+		t.Fatalf("Connect(%#v): %s", remote, err)
+	}
+	if got, err := c.ep.GetRemoteAddress(); err != nil {
+		t.Fatalf("GetRemoteAddress failed: %s", err)
+	} else if diff := cmp.Diff(remote, got, checker.IgnoreCmpPath("NIC")); diff != "" {
+		t.Errorf("GetRemoteAddress() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := c.ep.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %s", err)
+	}
+	checkNotConnected("disconnected endpoint")
+}
+
+func TestReadInboundNIC(t *testing.T) {
+	for _, needInboundNIC := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NeedInboundNIC=%t", needInboundNIC), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(unicastV4)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				t.Fatalf("Bind failed: %s", err)
+			}
+
+			c.injectPacket(unicastV4, newPayload(), false)
+
+			res, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{NeedInboundNIC: needInboundNIC})
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+			var want tcpip.NICID
+			if needInboundNIC {
+				want = 1
+			}
+			if res.InboundNIC != want {
+				t.Errorf("got res.InboundNIC = %d, want = %d", res.InboundNIC, want)
+			}
+			if res.ControlMessages.HasIPPacketInfo {
+				t.Error("got res.ControlMessages.HasIPPacketInfo = true, want = false")
+			}
+		})
+	}
+}
+
+func TestReceiveIPID(t *testing.T) {
+	const ipID = 0x1234
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+	c.ep.SocketOptions().SetReceiveIPID(true)
+
+	h := unicastV4.header4Tuple(incoming)
+	buf := c.buildV4Packet(newPayload(), &h)
+	ip := header.IPv4(buf)
+	ip.SetID(ipID)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	c.linkEP.InjectInbound(ipv4.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buf.ToVectorisedView(),
+	}))
+
+	res, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if !res.ControlMessages.HasIPID {
+		t.Fatal("got res.ControlMessages.HasIPID = false, want = true")
+	}
+	if got := res.ControlMessages.IPID; got != ipID {
+		t.Errorf("got res.ControlMessages.IPID = %#x, want = %#x", got, ipID)
+	}
+
+	// IPv6 packets have no identification field.
+	c.ep.Close()
+	c.createEndpointForFlow(unicastV6Only)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+	c.ep.SocketOptions().SetReceiveIPID(true)
+	c.injectPacket(unicastV6Only, newPayload(), false)
+	res, err = c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if res.ControlMessages.HasIPID {
+		t.Errorf("got res.ControlMessages.HasIPID = true for an IPv6 packet, want = false")
+	}
+}
+
+func TestDrainReceiveQueue(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	type receiveQueueDrainer interface {
+		DrainReceiveQueue() []udp.QueuedDatagram
+	}
+	ep, ok := c.ep.(receiveQueueDrainer)
+	if !ok {
+		t.Fatalf("%T does not implement DrainReceiveQueue", c.ep)
+	}
+
+	h := unicastV4.header4Tuple(incoming)
+	var want []udp.QueuedDatagram
+	for i := 0; i < 3; i++ {
+		payload := newPayload()
+		c.injectPacket(unicastV4, payload, false)
+		want = append(want, udp.QueuedDatagram{
+			Payload:     payload,
+			Sender:      tcpip.FullAddress{NIC: 1, Addr: h.srcAddr.Addr, Port: h.srcAddr.Port},
+			Destination: tcpip.FullAddress{NIC: 1, Addr: h.dstAddr.Addr, Port: h.dstAddr.Port},
+		})
+	}
+
+	if diff := cmp.Diff(want, ep.DrainReceiveQueue()); diff != "" {
+		t.Errorf("DrainReceiveQueue() mismatch (-want +got):\n%s", diff)
+	}
+
+	// The queue is empty after draining.
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got Read() = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	if got, err := c.ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption); err != nil {
+		t.Fatalf("GetSockOptInt(ReceiveQueueSizeOption): %s", err)
+	} else if got != 0 {
+		t.Errorf("got GetSockOptInt(ReceiveQueueSizeOption) = %d, want = 0", got)
+	}
+}
+
+func TestFlushUDPReceiveQueues(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var eps []tcpip.Endpoint
+	injected := 0
+	for i := 0; i < 3; i++ {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
+		}
+		defer ep.Close()
+		port := uint16(stackPort + i)
+		if err := ep.Bind(tcpip.FullAddress{Port: port}); err != nil {
+			t.Fatalf("ep.Bind(...) on endpoint %d failed: %s", i, err)
+		}
+		eps = append(eps, ep)
+
+		// Inject a different number of datagrams into each endpoint, over both
+		// network protocols.
+		for j := 0; j <= i; j++ {
+			flow := unicastV6
+			if j%2 == 1 {
+				flow = unicastV4in6
+			}
+			h := flow.header4Tuple(incoming)
+			h.dstAddr.Port = port
+			var buf buffer.View
+			var proto tcpip.NetworkProtocolNumber
+			if flow.isV4() {
+				buf, proto = c.buildV4Packet(newPayload(), &h), ipv4.ProtocolNumber
+			} else {
+				buf, proto = c.buildV6Packet(newPayload(), &h), ipv6.ProtocolNumber
+			}
+			c.linkEP.InjectInbound(proto, stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Data: buf.ToVectorisedView(),
+			}))
+			injected++
+		}
+	}
+
+	if got := c.s.FlushUDPReceiveQueues(); got != injected {
+		t.Errorf("got c.s.FlushUDPReceiveQueues() = %d, want = %d", got, injected)
+	}
+
+	for i, ep := range eps {
+		_, err := ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got Read() on endpoint %d = %v, want = %s", i, err, &tcpip.ErrWouldBlock{})
+		}
+	}
+
+	if got := c.s.FlushUDPReceiveQueues(); got != 0 {
+		t.Errorf("got c.s.FlushUDPReceiveQueues() = %d after flushing, want = 0", got)
+	}
+}
+
+func TestUDPEndpointsReportsName(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	const name = "dns-resolver"
+	c.createEndpoint(ipv6.ProtocolNumber)
+	c.ep.(interface{ SetName(string) }).SetName(name)
+	if got := c.ep.(interface{ Name() string }).Name(); got != name {
+		t.Errorf("got Name() = %q, want = %q", got, name)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	// An unnamed endpoint is reported without a name.
+	var wq waiter.Queue
+	other, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer other.Close()
+	if err := other.Bind(tcpip.FullAddress{Port: stackPort + 1}); err != nil {
+		t.Fatalf("other.Bind(...) failed: %s", err)
+	}
+
+	got := make(map[uint16]stack.UDPEndpointInfo)
+	for _, info := range c.s.UDPEndpoints() {
+		got[info.ID.LocalPort] = info
+	}
+	want := map[uint16]stack.UDPEndpointInfo{
+		stackPort: {
+			ID:       stack.TransportEndpointID{LocalPort: stackPort},
+			NetProto: ipv6.ProtocolNumber,
+			Name:     name,
+		},
+		stackPort + 1: {
+			ID:       stack.TransportEndpointID{LocalPort: stackPort + 1},
+			NetProto: ipv4.ProtocolNumber,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("c.s.UDPEndpoints() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUDPEndpointsConcurrentConnect(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	// Enumerating endpoints must not hold stack locks while calling into
+	// endpoints that are concurrently connecting.
+	const iterations = 1000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			c.s.UDPEndpoints()
+		}
+	}()
+	for i := 0; i < iterations; i++ {
+		if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort + uint16(i%2)}); err != nil {
+			t.Fatalf("Connect failed: %s", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestV4ReadOnV6(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4in6)
+
+	// Bind to wildcard.
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	// Test acceptance.
+	testRead(c, unicastV4in6)
+}
+
+func TestV4ReadOnBoundToV4MappedWildcard(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4in6)
 
 	// Bind to v4 mapped wildcard.
 	if err := c.ep.Bind(tcpip.FullAddress{Addr: v4MappedWildcardAddr, Port: stackPort}); err != nil {
@@ -809,6 +1732,24 @@ func TestV4ReadOnBoundToV4Mapped(t *testing.T) {
 	testRead(c, unicastV4in6)
 }
 
+// TestV6ReadOnBoundToV4Mapped checks that an endpoint bound to a v4-mapped
+// address only receives v4 traffic.
+func TestV6ReadOnBoundToV4Mapped(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4in6)
+
+	// Bind to local address.
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackV4MappedAddr, Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	// Test acceptance of v4 traffic and rejection of native v6 traffic.
+	testRead(c, unicastV4in6)
+	testFailingRead(c, unicastV6, false /* expectReadError */)
+}
+
 func TestV6ReadOnV6(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -866,1023 +1807,5875 @@ func TestV4ReadSelfSource(t *testing.T) {
 	}
 }
 
-func TestV4ReadOnV4(t *testing.T) {
+func TestAcceptedSourcePorts(t *testing.T) {
+	const otherPort = testPort + 1
+
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpointForFlow(unicastV4)
-
-	// Bind to wildcard.
+	c.createEndpoint(ipv4.ProtocolNumber)
 	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
 		c.t.Fatalf("Bind failed: %s", err)
 	}
+	setAcceptedSourcePorts := c.ep.(interface{ SetAcceptedSourcePorts([]uint16) }).SetAcceptedSourcePorts
+	setAcceptedSourcePorts([]uint16{testPort})
 
-	// Test acceptance.
-	testRead(c, unicastV4)
-}
+	inject := func(srcPort uint16) {
+		t.Helper()
+		h := unicastV4.header4Tuple(incoming)
+		h.srcAddr.Port = srcPort
+		c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(newPayload(), &h))
+	}
+	read := func() tcpip.Error {
+		t.Helper()
+		var buf bytes.Buffer
+		_, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+		return err
+	}
 
-// TestReadOnBoundToMulticast checks that an endpoint can bind to a multicast
-// address and receive data sent to that address.
-func TestReadOnBoundToMulticast(t *testing.T) {
-	// FIXME(b/128189410): multicastV4in6 currently doesn't work as
-	// AddMembershipOption doesn't handle V4in6 addresses.
-	for _, flow := range []testFlow{multicastV4, multicastV6, multicastV6Only} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
-
-			c.createEndpointForFlow(flow)
-
-			// Bind to multicast address.
-			mcastAddr := flow.mapAddrIfApplicable(flow.getMcastAddr())
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: mcastAddr, Port: stackPort}); err != nil {
-				c.t.Fatal("Bind failed:", err)
-			}
-
-			// Join multicast group.
-			ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: mcastAddr}
-			if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
-				c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
-			}
+	inject(otherPort)
+	inject(testPort)
+	if err := read(); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	{
+		err := read()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got second Read() = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	stats := c.ep.Stats().(*tcpip.TransportEndpointStats)
+	if got := stats.ReceiveErrors.SourcePortFiltered.Value(); got != 1 {
+		t.Errorf("got SourcePortFiltered = %d, want = 1", got)
+	}
+	if got := stats.PacketsReceived.Value(); got != 1 {
+		t.Errorf("got PacketsReceived = %d, want = 1", got)
+	}
 
-			// Check that we receive multicast packets but not unicast or broadcast
-			// ones.
-			testRead(c, flow)
-			testFailingRead(c, broadcast, false /* expectReadError */)
-			testFailingRead(c, unicastV4, false /* expectReadError */)
-		})
+	// Removing the allow-list accepts all source ports again.
+	setAcceptedSourcePorts(nil)
+	inject(otherPort)
+	if err := read(); err != nil {
+		t.Fatalf("Read after removing the allow-list failed: %s", err)
 	}
 }
 
-// TestV4ReadOnBoundToBroadcast checks that an endpoint can bind to a broadcast
-// address and can receive only broadcast data.
-func TestV4ReadOnBoundToBroadcast(t *testing.T) {
-	for _, flow := range []testFlow{broadcast, broadcastIn6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
-
-			c.createEndpointForFlow(flow)
+func TestAcceptedSourcePortsConcurrentConnect(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
 
-			// Bind to broadcast address.
-			bcastAddr := flow.mapAddrIfApplicable(broadcastAddr)
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: bcastAddr, Port: stackPort}); err != nil {
-				c.t.Fatalf("Bind failed: %s", err)
-			}
+	c.createEndpoint(ipv4.ProtocolNumber)
+	c.ep.(interface{ SetAcceptedSourcePorts([]uint16) }).SetAcceptedSourcePorts([]uint16{testPort})
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
 
-			// Check that we receive broadcast packets but not unicast ones.
-			testRead(c, flow)
-			testFailingRead(c, unicastV4, false /* expectReadError */)
-		})
+	// Filtering datagrams must not take locks that are held while the
+	// endpoint re-registers with the stack on Connect.
+	const iterations = 1000
+	h := unicastV4.header4Tuple(incoming)
+	b := c.buildV4Packet(newPayload(), &h)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			c.injectRaw(ipv4.ProtocolNumber, b)
+		}
+	}()
+	for i := 0; i < iterations; i++ {
+		if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort + uint16(i%2)}); err != nil {
+			t.Fatalf("Connect failed: %s", err)
+		}
 	}
+	wg.Wait()
 }
 
-// TestReadFromMulticast checks that an endpoint will NOT receive a packet
-// that was sent with multicast SOURCE address.
-func TestReadFromMulticast(t *testing.T) {
-	for _, flow := range []testFlow{reverseMulticast4, reverseMulticast6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
+func TestAcceptLocalSource(t *testing.T) {
+	c := newDualTestContextWithOptions(t, defaultMTU, stack.Options{
+		HandleLocal: true,
+		Clock:       &faketime.NullClock{},
+		RawFactory:  raw.EndpointFactory{},
+	})
+	defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
+	c.createEndpointForFlow(unicastV4)
+	c.ep.(interface{ SetAcceptLocalSource(bool) }).SetAcceptLocalSource(true)
 
-			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
-				t.Fatalf("Bind failed: %s", err)
-			}
-			testFailingRead(c, flow, false /* expectReadError */)
-		})
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
 	}
-}
-
-// TestV4ReadBroadcastOnBoundToWildcard checks that an endpoint can bind to ANY
-// and receive broadcast and unicast data.
-func TestV4ReadBroadcastOnBoundToWildcard(t *testing.T) {
-	for _, flow := range []testFlow{broadcast, broadcastIn6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
-
-			c.createEndpointForFlow(flow)
 
-			// Bind to wildcard.
-			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
-				c.t.Fatalf("Bind failed: %s (", err)
-			}
+	// Only the UDP endpoint opted in, so raw endpoints don't see self-sourced
+	// datagrams.
+	var rawWQ waiter.Queue
+	rawEP, err := c.s.NewRawEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &rawWQ, true /* associated */)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint(%d, %d, _, true): %s", udp.ProtocolNumber, ipv4.ProtocolNumber, err)
+	}
+	defer rawEP.Close()
 
-			// Check that we receive both broadcast and unicast packets.
-			testRead(c, flow)
-			testRead(c, unicastV4)
-		})
+	inject := func() []byte {
+		payload := newPayload()
+		h := unicastV4.header4Tuple(incoming)
+		h.srcAddr = h.dstAddr
+		buf := c.buildV4Packet(payload, &h)
+		c.linkEP.InjectInbound(ipv4.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buf.ToVectorisedView(),
+		}))
+		return payload
 	}
-}
 
-// testFailingWrite sends a packet of the given test flow into the UDP endpoint
-// and verifies it fails with the provided error code.
-func testFailingWrite(c *testContext, flow testFlow, wantErr tcpip.Error) {
-	c.t.Helper()
-	// Take a snapshot of the stats to validate them at the end of the test.
-	epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
-	h := flow.header4Tuple(outgoing)
-	writeDstAddr := flow.mapAddrIfApplicable(h.dstAddr.Addr)
+	payload := inject()
+	if got := c.s.Stats().IP.InvalidSourceAddressesReceived.Value(); got != 0 {
+		t.Errorf("got c.s.Stats().IP.InvalidSourceAddressesReceived = %d, want = 0", got)
+	}
+	var buf bytes.Buffer
+	res, err := c.ep.Read(&buf, tcpip.ReadOptions{NeedRemoteAddr: true})
+	if err != nil {
+		t.Fatalf("c.ep.Read: %s", err)
+	}
+	if diff := cmp.Diff(payload, buf.Bytes()); diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := res.RemoteAddr.Addr, tcpip.Address(stackAddr); got != want {
+		t.Errorf("got res.RemoteAddr.Addr = %s, want = %s", got, want)
+	}
+	{
+		_, err := rawEP.Read(ioutil.Discard, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got rawEP.Read = %s, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
 
-	var r bytes.Reader
-	r.Reset(newPayload())
-	_, gotErr := c.ep.Write(&r, tcpip.WriteOptions{
-		To: &tcpip.FullAddress{Addr: writeDstAddr, Port: h.dstAddr.Port},
-	})
-	c.checkEndpointWriteStats(1, epstats, gotErr)
-	if gotErr != wantErr {
-		c.t.Fatalf("Write returned unexpected error: got %v, want %v", gotErr, wantErr)
+	// Once the option is cleared, self-sourced datagrams are dropped again.
+	c.ep.(interface{ SetAcceptLocalSource(bool) }).SetAcceptLocalSource(false)
+	inject()
+	if got := c.s.Stats().IP.InvalidSourceAddressesReceived.Value(); got != 1 {
+		t.Errorf("got c.s.Stats().IP.InvalidSourceAddressesReceived = %d, want = 1", got)
+	}
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got c.ep.Read = %s, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
 	}
 }
 
-// testWrite sends a packet of the given test flow from the UDP endpoint to the
-// flow's destination address:port. It then receives it from the link endpoint
-// and verifies its correctness including any additional checker functions
-// provided.
-func testWrite(c *testContext, flow testFlow, checkers ...checker.NetworkChecker) uint16 {
-	c.t.Helper()
-	return testWriteAndVerifyInternal(c, flow, true, checkers...)
-}
+func TestReservedEphemeralPorts(t *testing.T) {
+	const (
+		firstPort = 16000
+		lastPort  = 16015
+	)
+	reserved := []uint16{firstPort, 16003, 16007, 16008, lastPort}
 
-// testWriteWithoutDestination sends a packet of the given test flow from the
-// UDP endpoint without giving a destination address:port. It then receives it
-// from the link endpoint and verifies its correctness including any additional
-// checker functions provided.
-func testWriteWithoutDestination(c *testContext, flow testFlow, checkers ...checker.NetworkChecker) uint16 {
-	c.t.Helper()
-	return testWriteAndVerifyInternal(c, flow, false, checkers...)
-}
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
 
-func testWriteNoVerify(c *testContext, flow testFlow, setDest bool) buffer.View {
-	c.t.Helper()
-	// Take a snapshot of the stats to validate them at the end of the test.
-	epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+	if err := c.s.SetPortRange(firstPort, lastPort); err != nil {
+		t.Fatalf("SetPortRange(%d, %d): %s", firstPort, lastPort, err)
+	}
+	c.s.SetReservedEphemeralPorts(reserved)
+	if diff := cmp.Diff(reserved, c.s.ReservedEphemeralPorts()); diff != "" {
+		t.Errorf("ReservedEphemeralPorts() mismatch (-want +got):\n%s", diff)
+	}
 
-	writeOpts := tcpip.WriteOptions{}
-	if setDest {
-		h := flow.header4Tuple(outgoing)
-		writeDstAddr := flow.mapAddrIfApplicable(h.dstAddr.Addr)
-		writeOpts = tcpip.WriteOptions{
-			To: &tcpip.FullAddress{Addr: writeDstAddr, Port: h.dstAddr.Port},
+	isReserved := make(map[uint16]bool)
+	for _, p := range reserved {
+		isReserved[p] = true
+	}
+
+	// Keep every endpoint bound so that the allocator eventually runs out of
+	// unreserved ports.
+	var eps []tcpip.Endpoint
+	defer func() {
+		for _, ep := range eps {
+			ep.Close()
+		}
+	}()
+	bind := func() (uint16, tcpip.Error) {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %s", err)
 		}
+		eps = append(eps, ep)
+		if err := ep.Bind(tcpip.FullAddress{}); err != nil {
+			return 0, err
+		}
+		addr, err := ep.GetLocalAddress()
+		if err != nil {
+			t.Fatalf("GetLocalAddress failed: %s", err)
+		}
+		return addr.Port, nil
 	}
-	var r bytes.Reader
-	payload := newPayload()
-	r.Reset(payload)
-	n, err := c.ep.Write(&r, writeOpts)
-	if err != nil {
-		c.t.Fatalf("Write failed: %s", err)
+
+	for i := 0; i < lastPort-firstPort+1-len(reserved); i++ {
+		port, err := bind()
+		if err != nil {
+			t.Fatalf("bind #%d: %s", i, err)
+		}
+		if isReserved[port] {
+			t.Errorf("bind #%d picked reserved port %d", i, port)
+		}
 	}
-	if n != int64(len(payload)) {
-		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	{
+		_, err := bind()
+		if _, ok := err.(*tcpip.ErrNoPortAvailable); !ok {
+			t.Errorf("got bind() with all unreserved ports in use = %v, want = %s", err, &tcpip.ErrNoPortAvailable{})
+		}
 	}
-	c.checkEndpointWriteStats(1, epstats, err)
-	return payload
-}
 
-func testWriteAndVerifyInternal(c *testContext, flow testFlow, setDest bool, checkers ...checker.NetworkChecker) uint16 {
-	c.t.Helper()
-	payload := testWriteNoVerify(c, flow, setDest)
-	// Received the packet and check the payload.
-	b := c.getPacketAndVerify(flow, checkers...)
-	var udpH header.UDP
-	if flow.isV4() {
-		udpH = header.IPv4(b).Payload()
-	} else {
-		udpH = header.IPv6(b).Payload()
+	// Reserved ports may still be bound explicitly.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
 	}
-	if !bytes.Equal(payload, udpH.Payload()) {
-		c.t.Fatalf("Bad payload: got %x, want %x", udpH.Payload(), payload)
+	eps = append(eps, ep)
+	if err := ep.Bind(tcpip.FullAddress{Port: reserved[0]}); err != nil {
+		t.Errorf("Bind(%d): %s", reserved[0], err)
 	}
-
-	return udpH.SourcePort()
 }
 
-func testDualWrite(c *testContext) uint16 {
-	c.t.Helper()
+func TestPortEventHandler(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
 
-	v4Port := testWrite(c, unicastV4in6)
-	v6Port := testWrite(c, unicastV6)
-	if v4Port != v6Port {
-		c.t.Fatalf("expected v4 and v6 ports to be equal: got v4Port = %d, v6Port = %d", v4Port, v6Port)
+	var events []stack.PortEvent
+	c.s.SetPortEventHandler(func(ev stack.PortEvent) {
+		events = append(events, ev)
+	})
+	defer c.s.SetPortEventHandler(nil)
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
 	}
+	c.ep.Close()
 
-	return v4Port
+	want := []stack.PortEvent{
+		{Kind: stack.PortReserved, Addr: stackAddr, Port: stackPort},
+		{Kind: stack.PortReleased, Addr: stackAddr, Port: stackPort},
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("port events mismatch (-want +got):\n%s", diff)
+	}
 }
 
-func TestDualWriteUnbound(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
+func TestForwardedFragmentationNeeded(t *testing.T) {
+	const (
+		mtu        = 1280
+		offLinkDst = "\x0b\x00\x00\x01"
+	)
+
+	c := newDualTestContext(t, mtu)
 	defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.s.SetForwardingDefaultAndAllNICs(ipv4.ProtocolNumber, true); err != nil {
+		t.Fatalf("SetForwardingDefaultAndAllNICs(%d, true): %s", ipv4.ProtocolNumber, err)
+	}
 
-	testDualWrite(c)
+	// Inject a datagram with DF set that is too large for the link it has to
+	// be forwarded on.
+	h := header4Tuple{
+		srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+		dstAddr: tcpip.FullAddress{Addr: offLinkDst, Port: stackPort},
+	}
+	buf := c.buildV4Packet(make([]byte, mtu), &h)
+	ip := header.IPv4(buf)
+	ip.SetFlagsFragmentOffset(header.IPv4FlagDontFragment, 0)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	c.injectRaw(ipv4.ProtocolNumber, buf)
+
+	p, ok := c.linkEP.Read()
+	if !ok {
+		t.Fatal("expected an ICMP error to be sent")
+	}
+	vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+	checker.IPv4(t, vv.ToView(),
+		checker.SrcAddr(stackAddr),
+		checker.DstAddr(testAddr),
+		checker.ICMPv4(
+			checker.ICMPv4Type(header.ICMPv4DstUnreachable),
+			checker.ICMPv4Code(header.ICMPv4FragmentationNeeded),
+			checker.ICMPv4MTU(mtu),
+		),
+	)
+	if got := c.s.Stats().IP.Forwarding.PacketTooBig.Value(); got != 1 {
+		t.Errorf("got c.s.Stats().IP.Forwarding.PacketTooBig = %d, want = 1", got)
+	}
 }
 
-func TestDualWriteBoundToWildcard(t *testing.T) {
+func TestV4ReadOnV4(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+	c.createEndpointForFlow(unicastV4)
 
 	// Bind to wildcard.
 	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
 		c.t.Fatalf("Bind failed: %s", err)
 	}
 
-	p := testDualWrite(c)
-	if p != stackPort {
-		c.t.Fatalf("Bad port: got %v, want %v", p, stackPort)
-	}
+	// Test acceptance.
+	testRead(c, unicastV4)
 }
 
-func TestDualWriteConnectedToV6(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+func TestConnectedRejectsMismatchedDestinationPort(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(flow.String(), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+			h := flow.header4Tuple(outgoing)
+			if err := c.ep.Connect(h.dstAddr); err != nil {
+				c.t.Fatalf("Connect(%+v) failed: %s", h.dstAddr, err)
+			}
 
-	// Connect to v6 address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
-		c.t.Fatalf("Bind failed: %s", err)
-	}
-
-	testWrite(c, unicastV6)
+			// A datagram from the peer to another local port is not delivered.
+			h = flow.header4Tuple(incoming)
+			h.dstAddr.Port = stackPort + 1
+			var buf buffer.View
+			var proto tcpip.NetworkProtocolNumber
+			if flow.isV4() {
+				buf, proto = c.buildV4Packet(newPayload(), &h), ipv4.ProtocolNumber
+			} else {
+				buf, proto = c.buildV6Packet(newPayload(), &h), ipv6.ProtocolNumber
+			}
+			unknownPort := c.s.Stats().UDP.UnknownPortErrors.Value()
+			c.injectRaw(proto, buf)
+			{
+				_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+				if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+					t.Errorf("got Read() = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+				}
+			}
+			if got, want := c.s.Stats().UDP.UnknownPortErrors.Value(), unknownPort+1; got != want {
+				t.Errorf("got UnknownPortErrors = %d, want = %d", got, want)
+			}
 
-	// Write to V4 mapped address.
-	testFailingWrite(c, unicastV4in6, &tcpip.ErrNetworkUnreachable{})
-	const want = 1
-	if got := c.ep.Stats().(*tcpip.TransportEndpointStats).SendErrors.NoRoute.Value(); got != want {
-		c.t.Fatalf("Endpoint stat not updated. got %d want %d", got, want)
+			// Datagrams to the bound port are still delivered.
+			testRead(c, flow)
+		})
 	}
 }
 
-func TestDualWriteConnectedToV4Mapped(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+// TestReadOnBoundToMulticast checks that an endpoint can bind to a multicast
+// address and receive data sent to that address.
+func TestReadOnBoundToMulticast(t *testing.T) {
+	// FIXME(b/128189410): multicastV4in6 currently doesn't work as
+	// AddMembershipOption doesn't handle V4in6 addresses.
+	for _, flow := range []testFlow{multicastV4, multicastV6, multicastV6Only} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+			c.createEndpointForFlow(flow)
 
-	// Connect to v4 mapped address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
-		c.t.Fatalf("Bind failed: %s", err)
-	}
+			// Bind to multicast address.
+			mcastAddr := flow.mapAddrIfApplicable(flow.getMcastAddr())
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: mcastAddr, Port: stackPort}); err != nil {
+				c.t.Fatal("Bind failed:", err)
+			}
 
-	testWrite(c, unicastV4in6)
+			// Join multicast group.
+			ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: mcastAddr}
+			if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+				c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
+			}
 
-	// Write to v6 address.
-	testFailingWrite(c, unicastV6, &tcpip.ErrInvalidEndpointState{})
+			// Check that we receive multicast packets but not unicast or broadcast
+			// ones.
+			testRead(c, flow)
+			testFailingRead(c, broadcast, false /* expectReadError */)
+			testFailingRead(c, unicastV4, false /* expectReadError */)
+		})
+	}
 }
 
-func TestV4WriteOnV6Only(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+func TestJoinMulticastBeforeBind(t *testing.T) {
+	for _, flow := range []testFlow{multicastV4, multicastV6, multicastV6Only} {
+		for _, bindToGroup := range []bool{true, false} {
+			t.Run(fmt.Sprintf("flow:%s/bindToGroup:%t", flow, bindToGroup), func(t *testing.T) {
+				c := newDualTestContext(t, defaultMTU)
+				defer c.cleanup()
 
-	c.createEndpointForFlow(unicastV6Only)
+				c.createEndpointForFlow(flow)
 
-	// Write to V4 mapped address.
-	testFailingWrite(c, unicastV4in6, &tcpip.ErrNoRoute{})
+				// Join multicast group while still unbound.
+				mcastAddr := flow.mapAddrIfApplicable(flow.getMcastAddr())
+				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: mcastAddr}
+				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+					c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
+				}
+
+				bindAddr := tcpip.FullAddress{Port: stackPort}
+				if bindToGroup {
+					bindAddr.Addr = mcastAddr
+				}
+				if err := c.ep.Bind(bindAddr); err != nil {
+					c.t.Fatalf("Bind(%#v): %s", bindAddr, err)
+				}
+
+				// The membership survives the bind.
+				testRead(c, flow)
+			})
+		}
+	}
 }
 
-func TestV6WriteOnBoundToV4Mapped(t *testing.T) {
+func TestMulticastMemberships(t *testing.T) {
+	const otherMulticastAddr = "\xe8\x2b\xd3\xeb"
+
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+	c.createEndpoint(ipv4.ProtocolNumber)
 
-	// Bind to v4 mapped address.
-	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackV4MappedAddr, Port: stackPort}); err != nil {
-		c.t.Fatalf("Bind failed: %s", err)
+	type multicastMembershipLister interface {
+		MulticastMemberships() []tcpip.MembershipInfo
+	}
+	ep, ok := c.ep.(multicastMembershipLister)
+	if !ok {
+		t.Fatalf("%T does not implement MulticastMemberships", c.ep)
 	}
 
-	// Write to v6 address.
-	testFailingWrite(c, unicastV6, &tcpip.ErrInvalidEndpointState{})
+	if diff := cmp.Diff([]tcpip.MembershipInfo{}, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, addr := range []tcpip.Address{multicastAddr, otherMulticastAddr} {
+		opt := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: addr}
+		if err := c.ep.SetSockOpt(&opt); err != nil {
+			t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
+		}
+	}
+	want := []tcpip.MembershipInfo{
+		{NIC: 1, MulticastAddr: multicastAddr},
+		{NIC: 1, MulticastAddr: otherMulticastAddr},
+	}
+	if diff := cmp.Diff(want, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch (-want +got):\n%s", diff)
+	}
+
+	opt := tcpip.RemoveMembershipOption{NIC: 1, MulticastAddr: multicastAddr}
+	if err := c.ep.SetSockOpt(&opt); err != nil {
+		t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
+	}
+	want = []tcpip.MembershipInfo{
+		{NIC: 1, MulticastAddr: otherMulticastAddr},
+	}
+	if diff := cmp.Diff(want, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch (-want +got):\n%s", diff)
+	}
 }
 
-func TestV6WriteOnConnected(t *testing.T) {
+func TestSetMemberships(t *testing.T) {
+	const (
+		groupA = "\xe8\x2b\xd3\xea"
+		groupB = "\xe8\x2b\xd3\xeb"
+		groupC = "\xe8\x2b\xd3\xec"
+		groupD = "\xe8\x2b\xd3\xed"
+	)
+
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+	c.createEndpoint(ipv4.ProtocolNumber)
+	ep := c.ep.(interface {
+		SetMemberships(add, remove []tcpip.MembershipInfo) tcpip.Error
+		MulticastMemberships() []tcpip.MembershipInfo
+	})
 
-	// Connect to v6 address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
-		c.t.Fatalf("Connect failed: %s", err)
+	opt := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: groupA}
+	if err := c.ep.SetSockOpt(&opt); err != nil {
+		t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
 	}
 
-	testWriteWithoutDestination(c, unicastV6)
+	add := []tcpip.MembershipInfo{
+		{NIC: 1, MulticastAddr: groupB},
+		{NIC: 1, MulticastAddr: groupC},
+		{NIC: 1, MulticastAddr: groupD},
+	}
+	remove := []tcpip.MembershipInfo{{NIC: 1, MulticastAddr: groupA}}
+	if err := ep.SetMemberships(add, remove); err != nil {
+		t.Fatalf("SetMemberships(%v, %v): %s", add, remove, err)
+	}
+	if diff := cmp.Diff(add, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch (-want +got):\n%s", diff)
+	}
+	for _, group := range []tcpip.Address{groupA, groupB} {
+		joined, err := c.s.IsInGroup(1, group)
+		if err != nil {
+			t.Fatalf("IsInGroup(1, %s): %s", group, err)
+		}
+		if want := group != groupA; joined != want {
+			t.Errorf("got IsInGroup(1, %s) = %t, want = %t", group, joined, want)
+		}
+	}
+
+	// Joining a group the endpoint is already a member of fails the whole
+	// change, including the removal.
+	{
+		add := []tcpip.MembershipInfo{
+			{NIC: 1, MulticastAddr: groupA},
+			{NIC: 1, MulticastAddr: groupB},
+		}
+		remove := []tcpip.MembershipInfo{{NIC: 1, MulticastAddr: groupC}}
+		err := ep.SetMemberships(add, remove)
+		if _, ok := err.(*tcpip.ErrDuplicateMembership); !ok {
+			t.Errorf("got SetMemberships(%v, %v) = %s, want = %s", add, remove, err, &tcpip.ErrDuplicateMembership{})
+		}
+	}
+	if diff := cmp.Diff(add, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch after failed change (-want +got):\n%s", diff)
+	}
+
+	// A group that can't be joined rolls back the groups already joined and
+	// left by the change.
+	{
+		const unknownNICID = 99
+		add := []tcpip.MembershipInfo{
+			{NIC: 1, MulticastAddr: groupA},
+			{NIC: unknownNICID, MulticastAddr: groupA},
+		}
+		remove := []tcpip.MembershipInfo{{NIC: 1, MulticastAddr: groupC}}
+		err := ep.SetMemberships(add, remove)
+		if _, ok := err.(*tcpip.ErrUnknownNICID); !ok {
+			t.Errorf("got SetMemberships(%v, %v) = %s, want = %s", add, remove, err, &tcpip.ErrUnknownNICID{})
+		}
+	}
+	if diff := cmp.Diff(add, ep.MulticastMemberships()); diff != "" {
+		t.Errorf("MulticastMemberships() mismatch after rolled back change (-want +got):\n%s", diff)
+	}
+	for _, group := range []tcpip.Address{groupA, groupC} {
+		joined, err := c.s.IsInGroup(1, group)
+		if err != nil {
+			t.Fatalf("IsInGroup(1, %s): %s", group, err)
+		}
+		if want := group == groupC; joined != want {
+			t.Errorf("got IsInGroup(1, %s) = %t after rolled back change, want = %t", group, joined, want)
+		}
+	}
 }
 
-func TestV4WriteOnConnected(t *testing.T) {
-	c := newDualTestContext(t, defaultMTU)
-	defer c.cleanup()
+func TestMembershipReports(t *testing.T) {
+	const nicID = 1
 
-	c.createEndpoint(ipv6.ProtocolNumber)
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocolWithOptions(ipv4.Options{
+			IGMP: ipv4.IGMPOptions{Enabled: true},
+		})},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		// A manual clock that is never advanced keeps the delayed unsolicited
+		// reports from being sent.
+		Clock: faketime.NewManualClock(),
+	})
+	defer s.Close()
 
-	// Connect to v4 mapped address.
-	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
-		c.t.Fatalf("Connect failed: %s", err)
+	linkEP := channel.New(4, defaultMTU, "")
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
 	}
 
-	testWriteWithoutDestination(c, unicastV4)
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+
+	// checkIGMP reads the next packet written out and checks that it is an
+	// IGMP message of the given type for the multicast group.
+	checkIGMP := func(igmpType header.IGMPType, dstAddr tcpip.Address) {
+		t.Helper()
+		p, ok := linkEP.Read()
+		if !ok {
+			t.Fatalf("no IGMP message of type %d written out", igmpType)
+		}
+		checker.IPv4(t, stack.PayloadSince(p.Pkt.NetworkHeader()),
+			checker.SrcAddr(stackAddr),
+			checker.DstAddr(dstAddr),
+			// TTL for an IGMP message must be 1 as per RFC 2236 section 2.
+			checker.TTL(1),
+			checker.IPv4RouterAlert(),
+			checker.IGMP(
+				checker.IGMPType(igmpType),
+				checker.IGMPGroupAddress(multicastAddr),
+			),
+		)
+	}
+
+	addOpt := tcpip.AddMembershipOption{NIC: nicID, MulticastAddr: multicastAddr}
+	if err := ep.SetSockOpt(&addOpt); err != nil {
+		t.Fatalf("SetSockOpt(&%#v): %s", addOpt, err)
+	}
+	checkIGMP(header.IGMPv2MembershipReport, multicastAddr)
+	if n := linkEP.Drain(); n != 0 {
+		t.Errorf("got %d extra packets written out after joining, want = 0", n)
+	}
+
+	removeOpt := tcpip.RemoveMembershipOption{NIC: nicID, MulticastAddr: multicastAddr}
+	if err := ep.SetSockOpt(&removeOpt); err != nil {
+		t.Fatalf("SetSockOpt(&%#v): %s", removeOpt, err)
+	}
+	checkIGMP(header.IGMPLeaveGroup, header.IPv4AllRoutersGroup)
 }
 
-func TestWriteOnConnectedInvalidPort(t *testing.T) {
-	protocols := map[string]tcpip.NetworkProtocolNumber{
-		"ipv4": ipv4.ProtocolNumber,
-		"ipv6": ipv6.ProtocolNumber,
+func TestFairMulticastQueue(t *testing.T) {
+	const otherMulticastAddr = "\xe8\x2b\xd3\xeb"
+
+	tests := []struct {
+		name string
+		fair bool
+		// enableLate enables fair queuing after the datagrams are queued.
+		enableLate bool
+		wantAddrs  []tcpip.Address
+	}{
+		{
+			name:      "FIFO",
+			wantAddrs: []tcpip.Address{multicastAddr, multicastAddr, multicastAddr, otherMulticastAddr},
+		},
+		{
+			name:      "fair",
+			fair:      true,
+			wantAddrs: []tcpip.Address{multicastAddr, otherMulticastAddr, multicastAddr, multicastAddr},
+		},
+		{
+			name:       "fair enabled with a backlog",
+			fair:       true,
+			enableLate: true,
+			wantAddrs:  []tcpip.Address{multicastAddr, otherMulticastAddr, multicastAddr, multicastAddr},
+		},
 	}
-	for name, pn := range protocols {
-		t.Run(name, func(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpoint(pn)
-			if err := c.ep.Connect(tcpip.FullAddress{Addr: stackAddr, Port: invalidPort}); err != nil {
-				c.t.Fatalf("Connect failed: %s", err)
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
 			}
-			writeOpts := tcpip.WriteOptions{
-				To: &tcpip.FullAddress{Addr: stackAddr, Port: invalidPort},
+			for _, addr := range []tcpip.Address{multicastAddr, otherMulticastAddr} {
+				opt := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: addr}
+				if err := c.ep.SetSockOpt(&opt); err != nil {
+					t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
+				}
 			}
-			var r bytes.Reader
-			payload := newPayload()
-			r.Reset(payload)
-			n, err := c.ep.Write(&r, writeOpts)
-			if err != nil {
-				c.t.Fatalf("c.ep.Write(...) = %s, want nil", err)
+
+			type fairQueuer interface {
+				SetFairMulticastQueue(bool)
 			}
-			if got, want := n, int64(len(payload)); got != want {
-				c.t.Fatalf("c.ep.Write(...) wrote %d bytes, want %d bytes", got, want)
+			ep, ok := c.ep.(fairQueuer)
+			if !ok {
+				t.Fatalf("%T does not implement SetFairMulticastQueue", c.ep)
+			}
+			if !test.enableLate {
+				ep.SetFairMulticastQueue(test.fair)
 			}
 
-			{
-				err := c.ep.LastError()
-				if _, ok := err.(*tcpip.ErrConnectionRefused); !ok {
-					c.t.Fatalf("expected c.ep.LastError() == ErrConnectionRefused, got: %+v", err)
+			// A burst to the first group is followed by a single datagram to
+			// the second group.
+			inject := func(addr tcpip.Address) {
+				h := header4Tuple{
+					srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+					dstAddr: tcpip.FullAddress{Addr: addr, Port: stackPort},
+				}
+				c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(newPayload(), &h))
+			}
+			for i := 0; i < 3; i++ {
+				inject(multicastAddr)
+			}
+			inject(otherMulticastAddr)
+			if test.enableLate {
+				ep.SetFairMulticastQueue(test.fair)
+			}
+
+			c.ep.SocketOptions().SetReceiveOriginalDstAddress(true)
+			var got []tcpip.Address
+			for range test.wantAddrs {
+				res, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
 				}
+				got = append(got, res.ControlMessages.OriginalDstAddress.Addr)
+			}
+			if diff := cmp.Diff(test.wantAddrs, got); diff != "" {
+				t.Errorf("read order mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-// TestWriteOnBoundToV4Multicast checks that we can send packets out of a socket
-// that is bound to a V4 multicast address.
-func TestWriteOnBoundToV4Multicast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4, multicastV4, broadcast} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
+func TestQueuedBytes(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
 
-			// Bind to V4 mcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastAddr, Port: stackPort}); err != nil {
-				c.t.Fatal("Bind failed:", err)
-			}
+	type queueReader interface {
+		QueuedBytes() int
+		QueuedDatagrams() int
+	}
+	ep, ok := c.ep.(queueReader)
+	if !ok {
+		t.Fatalf("%T does not implement QueuedBytes and QueuedDatagrams", c.ep)
+	}
+	check := func(wantBytes, wantDatagrams int) {
+		t.Helper()
+		if got := ep.QueuedBytes(); got != wantBytes {
+			t.Errorf("got QueuedBytes() = %d, want = %d", got, wantBytes)
+		}
+		if got := ep.QueuedDatagrams(); got != wantDatagrams {
+			t.Errorf("got QueuedDatagrams() = %d, want = %d", got, wantDatagrams)
+		}
+	}
 
-			testWrite(c, flow)
-		})
+	check(0, 0)
+
+	sizes := []int{10, 30, 0, 20}
+	h := header4Tuple{
+		srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+		dstAddr: tcpip.FullAddress{Addr: stackAddr, Port: stackPort},
 	}
+	for _, size := range sizes {
+		c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(make([]byte, size), &h))
+	}
+
+	for i, size := range sizes {
+		check(size, len(sizes)-i)
+		if _, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{}); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}
+	check(0, 0)
 }
 
-// TestWriteOnBoundToV4MappedMulticast checks that we can send packets out of a
-// socket that is bound to a V4-mapped multicast address.
-func TestWriteOnBoundToV4MappedMulticast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4in6, multicastV4in6, broadcastIn6} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+func TestReceiveQueueDropPolicy(t *testing.T) {
+	const (
+		payloadSize = 40
+		rcvBufSize  = 100
+		// The receive queue holds as many datagrams as fit before the queue
+		// size reaches rcvBufSize, plus one more.
+		queued = rcvBufSize/payloadSize + 1
+	)
+
+	tests := []struct {
+		name     string
+		policy   udp.ReceiveQueueDropPolicy
+		wantRead []byte
+	}{
+		{
+			name:     "tail-drop",
+			policy:   udp.DropTail,
+			wantRead: []byte{0, 1, 2},
+		},
+		{
+			name:     "head-drop",
+			policy:   udp.DropHead,
+			wantRead: []byte{1, 2, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+			c.ep.SocketOptions().SetReceiveBufferSize(rcvBufSize, false /* notify */)
 
-			// Bind to V4Mapped mcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV4MappedAddr, Port: stackPort}); err != nil {
-				c.t.Fatalf("Bind failed: %s", err)
+			type dropPolicySetter interface {
+				SetReceiveQueueDropPolicy(udp.ReceiveQueueDropPolicy)
+			}
+			ep, ok := c.ep.(dropPolicySetter)
+			if !ok {
+				t.Fatalf("%T does not implement SetReceiveQueueDropPolicy", c.ep)
 			}
+			ep.SetReceiveQueueDropPolicy(test.policy)
 
-			testWrite(c, flow)
+			// Fill the queue, then inject one more datagram. Each datagram's
+			// payload is filled with its index.
+			h := header4Tuple{
+				srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+				dstAddr: tcpip.FullAddress{Addr: stackAddr, Port: stackPort},
+			}
+			for i := 0; i <= queued; i++ {
+				c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(bytes.Repeat([]byte{byte(i)}, payloadSize), &h))
+			}
+
+			if got, want := c.ep.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ReceiveBufferOverflow.Value(), uint64(1); got != want {
+				t.Errorf("got EP Stats.ReceiveErrors.ReceiveBufferOverflow = %d, want = %d", got, want)
+			}
+
+			var got []byte
+			for {
+				var buf bytes.Buffer
+				if _, err := c.ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+					if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+						t.Fatalf("Read failed: %s", err)
+					}
+					break
+				}
+				got = append(got, buf.Bytes()[0])
+			}
+			if diff := cmp.Diff(test.wantRead, got); diff != "" {
+				t.Errorf("read datagrams mismatch (-want +got):\n%s", diff)
+			}
 		})
 	}
 }
 
-// TestWriteOnBoundToV6Multicast checks that we can send packets out of a
-// socket that is bound to a V6 multicast address.
-func TestWriteOnBoundToV6Multicast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV6, multicastV6} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+func TestLowerReceiveBufferBelowOccupancy(t *testing.T) {
+	const payloadSize = 40
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	h := header4Tuple{
+		srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort},
+		dstAddr: tcpip.FullAddress{Addr: stackAddr, Port: stackPort},
+	}
+	inject := func(i int) {
+		c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(bytes.Repeat([]byte{byte(i)}, payloadSize), &h))
+	}
+	overflows := func() uint64 {
+		return c.ep.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ReceiveBufferOverflow.Value()
+	}
+	read := func() byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := c.ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		return buf.Bytes()[0]
+	}
+
+	// Queue four datagrams, then lower the limit to below the occupancy.
+	for i := 0; i < 4; i++ {
+		inject(i)
+	}
+	c.ep.SocketOptions().SetReceiveBufferSize(2*payloadSize, false /* notify */)
+
+	// The queued datagrams are kept but new ones are dropped.
+	inject(4)
+	if got := overflows(); got != 1 {
+		t.Errorf("got ReceiveBufferOverflow = %d, want = 1", got)
+	}
+
+	// Read down to below the new limit; new datagrams are accepted again.
+	for _, want := range []byte{0, 1, 2} {
+		if got := read(); got != want {
+			t.Errorf("got datagram %d, want %d", got, want)
+		}
+	}
+	inject(5)
+	if got := overflows(); got != 1 {
+		t.Errorf("got ReceiveBufferOverflow = %d, want = 1", got)
+	}
+	for _, want := range []byte{3, 5} {
+		if got := read(); got != want {
+			t.Errorf("got datagram %d, want %d", got, want)
+		}
+	}
+}
+
+func TestPeekAll(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	type datagram struct {
+		size int
+		src  tcpip.FullAddress
+	}
+	var want []datagram
+	for i := 0; i < 3; i++ {
+		h := header4Tuple{
+			srcAddr: tcpip.FullAddress{Addr: testAddr, Port: testPort + uint16(i)},
+			dstAddr: tcpip.FullAddress{Addr: stackAddr, Port: stackPort},
+		}
+		size := 10 * (i + 1)
+		c.injectRaw(ipv4.ProtocolNumber, c.buildV4Packet(make([]byte, size), &h))
+		want = append(want, datagram{size: size, src: tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort + uint16(i)}})
+	}
+
+	peekAll := c.ep.(interface {
+		PeekAll(func(buffer.View, tcpip.FullAddress) bool)
+	}).PeekAll
+
+	var got []datagram
+	peekAll(func(payload buffer.View, src tcpip.FullAddress) bool {
+		got = append(got, datagram{size: len(payload), src: src})
+		return true
+	})
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(datagram{})); diff != "" {
+		t.Errorf("PeekAll mismatch (-want +got):\n%s", diff)
+	}
+
+	// Returning false stops the iteration.
+	calls := 0
+	peekAll(func(buffer.View, tcpip.FullAddress) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("got %d PeekAll callbacks, want 1", calls)
+	}
+
+	// The datagrams are still queued.
+	for _, w := range want {
+		var buf bytes.Buffer
+		res, err := c.ep.Read(&buf, tcpip.ReadOptions{NeedRemoteAddr: true})
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if got := (datagram{size: res.Count, src: res.RemoteAddr}); got != w {
+			t.Errorf("got Read = %+v, want = %+v", got, w)
+		}
+	}
+}
+
+func TestDuplicateMembership(t *testing.T) {
+	const otherNICID = 2
+
+	for _, flow := range []testFlow{multicastV4, multicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
+			if err := c.s.CreateNIC(otherNICID, channel.New(0, defaultMTU, "")); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", otherNICID, err)
+			}
+
 			c.createEndpointForFlow(flow)
 
-			// Bind to V6 mcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV6Addr, Port: stackPort}); err != nil {
-				c.t.Fatalf("Bind failed: %s", err)
+			mcastAddr := flow.getMcastAddr()
+			opt := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: mcastAddr}
+			if err := c.ep.SetSockOpt(&opt); err != nil {
+				t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
+			}
+			{
+				err := c.ep.SetSockOpt(&opt)
+				if _, ok := err.(*tcpip.ErrDuplicateMembership); !ok {
+					t.Fatalf("got second SetSockOpt(&%#v) = %v, want = %s", opt, err, &tcpip.ErrDuplicateMembership{})
+				}
 			}
 
-			testWrite(c, flow)
+			// Joining the same group on another NIC is a new membership.
+			opt.NIC = otherNICID
+			if err := c.ep.SetSockOpt(&opt); err != nil {
+				t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
+			}
 		})
 	}
 }
 
-// TestWriteOnBoundToV6Multicast checks that we can send packets out of a
-// V6-only socket that is bound to a V6 multicast address.
-func TestWriteOnBoundToV6OnlyMulticast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV6Only, multicastV6Only} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+func TestWriteOptionsNIC(t *testing.T) {
+	const (
+		otherNICID = 2
+		otherAddr  = tcpip.Address("\xc0\xa8\x00\x01")
+	)
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	otherLinkEP := channel.New(1, defaultMTU, "")
+	if err := c.s.CreateNIC(otherNICID, otherLinkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", otherNICID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: otherAddr.WithPrefix(),
+	}
+	if err := c.s.AddProtocolAddress(otherNICID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", otherNICID, protocolAddr, err)
+	}
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	payload := newPayload()
+	write := func(nicID tcpip.NICID, to tcpip.Address) tcpip.Error {
+		var r bytes.Reader
+		r.Reset(payload)
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{
+			To:  &tcpip.FullAddress{Addr: to, Port: testPort},
+			NIC: nicID,
+		})
+		return err
+	}
+
+	for _, test := range []struct {
+		nicID   tcpip.NICID
+		linkEP  *channel.Endpoint
+		srcAddr tcpip.Address
+	}{
+		{nicID: 1, linkEP: c.linkEP, srcAddr: stackAddr},
+		{nicID: otherNICID, linkEP: otherLinkEP, srcAddr: otherAddr},
+	} {
+		if err := write(test.nicID, multicastAddr); err != nil {
+			t.Fatalf("write(%d, %s): %s", test.nicID, tcpip.Address(multicastAddr), err)
+		}
+
+		for _, linkEP := range []*channel.Endpoint{c.linkEP, otherLinkEP} {
+			p, ok := linkEP.Read()
+			if want := linkEP == test.linkEP; ok != want {
+				t.Fatalf("write out NIC %d: got packet = %t on link endpoint, want = %t", test.nicID, ok, want)
+			}
+			if !ok {
+				continue
+			}
+			vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+			checker.IPv4(t, vv.ToView(),
+				checker.SrcAddr(test.srcAddr),
+				checker.DstAddr(multicastAddr),
+				checker.UDP(checker.Payload(payload)),
+			)
+		}
+	}
+
+	// NIC 2 has no route to the unicast peer.
+	{
+		err := write(otherNICID, testAddr)
+		if _, ok := err.(*tcpip.ErrNoRoute); !ok {
+			t.Errorf("got write(%d, %s) = %v, want = %s", otherNICID, tcpip.Address(testAddr), err, &tcpip.ErrNoRoute{})
+		}
+	}
+	{
+		const unknownNICID = 3
+		err := write(unknownNICID, multicastAddr)
+		if _, ok := err.(*tcpip.ErrNoRoute); !ok {
+			t.Errorf("got write(%d, %s) = %v, want = %s", unknownNICID, tcpip.Address(multicastAddr), err, &tcpip.ErrNoRoute{})
+		}
+	}
+}
+
+// TestV4ReadOnBoundToBroadcast checks that an endpoint can bind to a broadcast
+// address and can receive only broadcast data.
+func TestV4ReadOnBoundToBroadcast(t *testing.T) {
+	for _, flow := range []testFlow{broadcast, broadcastIn6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
 			c.createEndpointForFlow(flow)
 
-			// Bind to V6 mcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV6Addr, Port: stackPort}); err != nil {
+			// Bind to broadcast address.
+			bcastAddr := flow.mapAddrIfApplicable(broadcastAddr)
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: bcastAddr, Port: stackPort}); err != nil {
 				c.t.Fatalf("Bind failed: %s", err)
 			}
 
-			testWrite(c, flow)
+			// Check that we receive broadcast packets but not unicast ones.
+			testRead(c, flow)
+			testFailingRead(c, unicastV4, false /* expectReadError */)
 		})
 	}
 }
 
-// TestWriteOnBoundToBroadcast checks that we can send packets out of a
-// socket that is bound to the broadcast address.
-func TestWriteOnBoundToBroadcast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4, multicastV4, broadcast} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+// TestReadFromMulticast checks that an endpoint will NOT receive a packet
+// that was sent with multicast SOURCE address.
+func TestReadFromMulticast(t *testing.T) {
+	for _, flow := range []testFlow{reverseMulticast4, reverseMulticast6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
 			c.createEndpointForFlow(flow)
 
-			// Bind to V4 broadcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: broadcastAddr, Port: stackPort}); err != nil {
-				c.t.Fatal("Bind failed:", err)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				t.Fatalf("Bind failed: %s", err)
 			}
-
-			testWrite(c, flow)
+			testFailingRead(c, flow, false /* expectReadError */)
 		})
 	}
 }
 
-// TestWriteOnBoundToV4MappedBroadcast checks that we can send packets out of a
-// socket that is bound to the V4-mapped broadcast address.
-func TestWriteOnBoundToV4MappedBroadcast(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4in6, multicastV4in6, broadcastIn6} {
-		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+// TestV4ReadBroadcastOnBoundToWildcard checks that an endpoint can bind to ANY
+// and receive broadcast and unicast data.
+func TestV4ReadBroadcastOnBoundToWildcard(t *testing.T) {
+	for _, flow := range []testFlow{broadcast, broadcastIn6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
 			c.createEndpointForFlow(flow)
 
-			// Bind to V4Mapped mcast address.
-			if err := c.ep.Bind(tcpip.FullAddress{Addr: broadcastV4MappedAddr, Port: stackPort}); err != nil {
-				c.t.Fatalf("Bind failed: %s", err)
+			// Bind to wildcard.
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s (", err)
 			}
 
-			testWrite(c, flow)
+			// Check that we receive both broadcast and unicast packets.
+			testRead(c, flow)
+			testRead(c, unicastV4)
 		})
 	}
 }
 
-func TestReadIncrementsPacketsReceived(t *testing.T) {
+func TestReceivedDestinationTypeStats(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	// Create IPv4 UDP endpoint
-	c.createEndpoint(ipv6.ProtocolNumber)
-
-	// Bind to wildcard.
+	c.createEndpointForFlow(broadcast)
 	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
 		c.t.Fatalf("Bind failed: %s", err)
 	}
 
+	testRead(c, broadcast)
 	testRead(c, unicastV4)
 
-	var want uint64 = 1
-	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != want {
-		c.t.Fatalf("Read did not increment PacketsReceived: got %v, want %v", got, want)
+	stats := c.ep.Stats().(*tcpip.TransportEndpointStats)
+	for _, s := range []struct {
+		name string
+		stat *tcpip.StatCounter
+		want uint64
+	}{
+		{"ReceivedUnicast", &stats.ReceivedUnicast, 1},
+		{"ReceivedMulticast", &stats.ReceivedMulticast, 0},
+		{"ReceivedBroadcast", &stats.ReceivedBroadcast, 1},
+	} {
+		if got := s.stat.Value(); got != s.want {
+			t.Errorf("got EP Stats.%s = %d, want = %d", s.name, got, s.want)
+		}
 	}
 }
 
-func TestReadIPPacketInfo(t *testing.T) {
-	tests := []struct {
-		name    string
-		proto   tcpip.NetworkProtocolNumber
-		flow    testFlow
-		checker func(tcpip.NICID) checker.ControlMessagesChecker
+func TestReadDestinationType(t *testing.T) {
+	for _, tc := range []struct {
+		flow          testFlow
+		wantBroadcast bool
+		wantMulticast bool
 	}{
-		{
-			name:  "IPv4 unicast",
-			proto: header.IPv4ProtocolNumber,
-			flow:  unicastV4,
-			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
-				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
-					NIC:             id,
-					LocalAddr:       stackAddr,
-					DestinationAddr: stackAddr,
-				})
-			},
-		},
-		{
-			name:  "IPv4 multicast",
-			proto: header.IPv4ProtocolNumber,
-			flow:  multicastV4,
-			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
-				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
-					NIC: id,
-					// TODO(gvisor.dev/issue/3556): Check for a unicast address.
-					LocalAddr:       multicastAddr,
-					DestinationAddr: multicastAddr,
-				})
-			},
-		},
-		{
-			name:  "IPv4 broadcast",
-			proto: header.IPv4ProtocolNumber,
-			flow:  broadcast,
-			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
-				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
-					NIC: id,
-					// TODO(gvisor.dev/issue/3556): Check for a unicast address.
-					LocalAddr:       broadcastAddr,
-					DestinationAddr: broadcastAddr,
-				})
-			},
-		},
-		{
-			name:  "IPv6 unicast",
-			proto: header.IPv6ProtocolNumber,
-			flow:  unicastV6,
-			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
-				return checker.ReceiveIPv6PacketInfo(tcpip.IPv6PacketInfo{
-					NIC:  id,
-					Addr: stackV6Addr,
-				})
-			},
-		},
-		{
-			name:  "IPv6 multicast",
-			proto: header.IPv6ProtocolNumber,
-			flow:  multicastV6,
-			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
-				return checker.ReceiveIPv6PacketInfo(tcpip.IPv6PacketInfo{
-					NIC:  id,
-					Addr: multicastV6Addr,
-				})
-			},
+		{flow: unicastV4},
+		{flow: broadcast, wantBroadcast: true},
+		{flow: multicastV4, wantMulticast: true},
+		{flow: unicastV6},
+		{flow: multicastV6, wantMulticast: true},
+	} {
+		t.Run(fmt.Sprintf("flow:%s", tc.flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(tc.flow)
+
+			// Bind to wildcard.
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+			if tc.flow.isMulticast() {
+				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: tc.flow.getMcastAddr()}
+				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+					c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
+				}
+			}
+
+			// Destination type is not reported while the option is disabled.
+			testRead(c, tc.flow, checker.ReceiveDestinationType(false, false))
+
+			c.ep.SocketOptions().SetReceiveDestinationType(true)
+			testRead(c, tc.flow, checker.ReceiveDestinationType(tc.wantBroadcast, tc.wantMulticast))
+
+			// A unicast packet on the same socket reports neither.
+			unicast := unicastV6
+			if tc.flow.isV4() {
+				unicast = unicastV4
+			}
+			testRead(c, unicast, checker.ReceiveDestinationType(false, false))
+		})
+	}
+}
+
+func TestReadCoalesced(t *testing.T) {
+	const numDatagrams = 4
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+	c.ep.SocketOptions().SetUDPGRO(true)
+
+	var want []byte
+	for i := 0; i < numDatagrams; i++ {
+		payload := make([]byte, 100)
+		for j := range payload {
+			payload[j] = byte(i)
+		}
+		want = append(want, payload...)
+		c.injectPacket(unicastV4, payload, false)
+	}
+
+	var buf bytes.Buffer
+	res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+	if err != nil {
+		c.t.Fatalf("Read failed: %s", err)
+	}
+	if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+		c.t.Errorf("read payload mismatch (-want +got):\n%s", diff)
+	}
+	if !res.ControlMessages.HasGROSegmentSize || res.ControlMessages.GROSegmentSize != 100 {
+		c.t.Errorf("got GRO segment size = (%t, %d), want = (true, 100)", res.ControlMessages.HasGROSegmentSize, res.ControlMessages.GROSegmentSize)
+	}
+	if got := c.s.Stats().UDP.Coalesced.Value(); got != numDatagrams {
+		c.t.Errorf("got Coalesced = %d, want = %d", got, numDatagrams)
+	}
+	if got := c.s.Stats().UDP.CoalesceBatches.Value(); got != 1 {
+		c.t.Errorf("got CoalesceBatches = %d, want = 1", got)
+	}
+	{
+		_, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			c.t.Fatalf("got second Read = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+func TestReadVec(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+	ep := c.ep.(interface {
+		ReadVec([][]byte, tcpip.ReadOptions) (tcpip.ReadResult, tcpip.Error)
+	})
+
+	read := func(bufs [][]byte) tcpip.ReadResult {
+		t.Helper()
+		res, err := ep.ReadVec(bufs, tcpip.ReadOptions{})
+		if err != nil {
+			t.Fatalf("ReadVec failed: %s", err)
+		}
+		return res
+	}
+
+	payload := make([]byte, 50)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// The datagram fills the buffers in order.
+	c.injectPacket(unicastV4, payload, false)
+	bufs := [][]byte{make([]byte, 20), make([]byte, 20), make([]byte, 20)}
+	res := read(bufs)
+	if res.Total != len(payload) || res.Count != len(payload) {
+		t.Errorf("got (Total, Count) = (%d, %d), want = (%d, %d)", res.Total, res.Count, len(payload), len(payload))
+	}
+	want := [][]byte{payload[:20], payload[20:40], append(append([]byte(nil), payload[40:]...), make([]byte, 10)...)}
+	if diff := cmp.Diff(want, bufs); diff != "" {
+		t.Errorf("buffers mismatch (-want +got):\n%s", diff)
+	}
+
+	// A datagram larger than the buffers is truncated.
+	c.injectPacket(unicastV4, payload, false)
+	bufs = [][]byte{make([]byte, 20), make([]byte, 10)}
+	res = read(bufs)
+	if res.Total != len(payload) || res.Count != 30 {
+		t.Errorf("got (Total, Count) = (%d, %d), want = (%d, 30)", res.Total, res.Count, len(payload))
+	}
+	if diff := cmp.Diff([][]byte{payload[:20], payload[20:30]}, bufs); diff != "" {
+		t.Errorf("truncated buffers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadContinue(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	// read reads up to n bytes and returns them.
+	read := func(n int64, opts tcpip.ReadOptions) ([]byte, tcpip.ReadResult) {
+		t.Helper()
+		var buf bytes.Buffer
+		res, err := c.ep.Read(&tcpip.LimitedWriter{W: &buf, N: n}, opts)
+		if err != nil {
+			t.Fatalf("Read(_, %+v) failed: %s", opts, err)
+		}
+		return buf.Bytes(), res
+	}
+
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	c.injectPacket(unicastV4, payload, false)
+
+	// The remainder is still readable, and counted against the receive
+	// buffer, after the truncated read.
+	got, res := read(40, tcpip.ReadOptions{Continue: true})
+	if res.Count != 40 || res.Total != len(payload) {
+		t.Errorf("got first Read() Count = %d, Total = %d, want = 40, %d", res.Count, res.Total, len(payload))
+	}
+	if !bytes.Equal(got, payload[:40]) {
+		t.Errorf("got first Read() = %x, want = %x", got, payload[:40])
+	}
+	if got := c.ep.Readiness(waiter.ReadableEvents); got != waiter.ReadableEvents {
+		t.Errorf("got Readiness() after a truncated read = %v, want = %v", got, waiter.ReadableEvents)
+	}
+	rcvBufSize := c.ep.SocketOptions().GetReceiveBufferSize()
+	c.ep.SocketOptions().SetReceiveBufferSize(int64(len(payload)-40), false /* notify */)
+	overflows := c.ep.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ReceiveBufferOverflow.Value()
+	c.injectPacket(unicastV4, payload[:10], false)
+	if got, want := c.ep.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ReceiveBufferOverflow.Value(), overflows+1; got != want {
+		t.Errorf("got ReceiveBufferOverflow with a full remainder = %d, want = %d", got, want)
+	}
+	c.ep.SocketOptions().SetReceiveBufferSize(rcvBufSize, false /* notify */)
+
+	// Peeking leaves the remainder for the next read.
+	if got, _ := read(100, tcpip.ReadOptions{Continue: true, Peek: true}); !bytes.Equal(got, payload[40:]) {
+		t.Errorf("got peeking Read() = %x, want = %x", got, payload[40:])
+	}
+	got, res = read(100, tcpip.ReadOptions{Continue: true, NeedRemoteAddr: true})
+	if res.Count != 60 || res.Total != 60 {
+		t.Errorf("got continued Read() Count = %d, Total = %d, want = 60, 60", res.Count, res.Total)
+	}
+	if !bytes.Equal(got, payload[40:]) {
+		t.Errorf("got continued Read() = %x, want = %x", got, payload[40:])
+	}
+	if got := res.RemoteAddr; got.Addr != testAddr || got.Port != testPort {
+		t.Errorf("got continued Read() RemoteAddr = %+v, want = %s:%d", got, testAddr, testPort)
+	}
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{Continue: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got Read() after the datagram was consumed = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+
+	// Without Continue, the remainder of a truncated datagram is discarded.
+	c.injectPacket(unicastV4, payload, false)
+	read(40, tcpip.ReadOptions{})
+	if got := c.ep.Readiness(waiter.ReadableEvents); got != 0 {
+		t.Errorf("got Readiness() after a truncated read without Continue = %v, want = 0", got)
+	}
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{Continue: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got continued Read() after a discarded remainder = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+
+	// Reading the next datagram discards the remainder of the previous one.
+	c.injectPacket(unicastV4, payload, false)
+	c.injectPacket(unicastV4, payload[:10], false)
+	read(40, tcpip.ReadOptions{Continue: true})
+	if got, _ := read(100, tcpip.ReadOptions{}); !bytes.Equal(got, payload[:10]) {
+		t.Errorf("got Read() after a truncated read = %x, want = %x", got, payload[:10])
+	}
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{Continue: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got continued Read() after a discarded remainder = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+// blockingWriter is an io.Writer that blocks its first write until release is
+// closed.
+type blockingWriter struct {
+	w       io.Writer
+	started chan struct{}
+	release chan struct{}
+}
+
+// Write implements io.Writer.Write.
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.started:
+	default:
+		close(w.started)
+		<-w.release
+	}
+	return w.w.Write(p)
+}
+
+func TestReadContinueConcurrentReads(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	first := bytes.Repeat([]byte{1}, 100)
+	second := bytes.Repeat([]byte{2}, 100)
+	c.injectPacket(unicastV4, first, false)
+	c.injectPacket(unicastV4, second, false)
+
+	// Truncate the first datagram in a read that is still copying it out
+	// while a second read truncates the second datagram. Only the remainder
+	// of the datagram read last is kept.
+	w := blockingWriter{
+		w:       &tcpip.LimitedWriter{W: ioutil.Discard, N: 40},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan tcpip.Error)
+	go func() {
+		_, err := c.ep.Read(&w, tcpip.ReadOptions{Continue: true})
+		done <- err
+	}()
+	<-w.started
+	if _, err := c.ep.Read(&tcpip.LimitedWriter{W: ioutil.Discard, N: 40}, tcpip.ReadOptions{Continue: true}); err != nil {
+		t.Fatalf("second Read failed: %s", err)
+	}
+	close(w.release)
+	if err := <-done; err != nil {
+		t.Fatalf("first Read failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.ep.Read(&buf, tcpip.ReadOptions{Continue: true}); err != nil {
+		t.Fatalf("continued Read failed: %s", err)
+	}
+	if diff := cmp.Diff(second[40:], buf.Bytes()); diff != "" {
+		t.Errorf("continued Read() mismatch (-want +got):\n%s", diff)
+	}
+	{
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{Continue: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got Read() after the remainder was consumed = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+// testFailingWrite sends a packet of the given test flow into the UDP endpoint
+// and verifies it fails with the provided error code.
+func testFailingWrite(c *testContext, flow testFlow, wantErr tcpip.Error) {
+	c.t.Helper()
+	// Take a snapshot of the stats to validate them at the end of the test.
+	epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+	h := flow.header4Tuple(outgoing)
+	writeDstAddr := flow.mapAddrIfApplicable(h.dstAddr.Addr)
+
+	var r bytes.Reader
+	r.Reset(newPayload())
+	_, gotErr := c.ep.Write(&r, tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: writeDstAddr, Port: h.dstAddr.Port},
+	})
+	c.checkEndpointWriteStats(1, epstats, gotErr)
+	if gotErr != wantErr {
+		c.t.Fatalf("Write returned unexpected error: got %v, want %v", gotErr, wantErr)
+	}
+}
+
+// testWrite sends a packet of the given test flow from the UDP endpoint to the
+// flow's destination address:port. It then receives it from the link endpoint
+// and verifies its correctness including any additional checker functions
+// provided.
+func testWrite(c *testContext, flow testFlow, checkers ...checker.NetworkChecker) uint16 {
+	c.t.Helper()
+	return testWriteAndVerifyInternal(c, flow, true, checkers...)
+}
+
+// testWriteWithoutDestination sends a packet of the given test flow from the
+// UDP endpoint without giving a destination address:port. It then receives it
+// from the link endpoint and verifies its correctness including any additional
+// checker functions provided.
+func testWriteWithoutDestination(c *testContext, flow testFlow, checkers ...checker.NetworkChecker) uint16 {
+	c.t.Helper()
+	return testWriteAndVerifyInternal(c, flow, false, checkers...)
+}
+
+func testWriteNoVerify(c *testContext, flow testFlow, setDest bool) buffer.View {
+	c.t.Helper()
+	// Take a snapshot of the stats to validate them at the end of the test.
+	epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+
+	writeOpts := tcpip.WriteOptions{}
+	if setDest {
+		h := flow.header4Tuple(outgoing)
+		writeDstAddr := flow.mapAddrIfApplicable(h.dstAddr.Addr)
+		writeOpts = tcpip.WriteOptions{
+			To: &tcpip.FullAddress{Addr: writeDstAddr, Port: h.dstAddr.Port},
+		}
+	}
+	var r bytes.Reader
+	payload := newPayload()
+	r.Reset(payload)
+	n, err := c.ep.Write(&r, writeOpts)
+	if err != nil {
+		c.t.Fatalf("Write failed: %s", err)
+	}
+	if n != int64(len(payload)) {
+		c.t.Fatalf("Bad number of bytes written: got %v, want %v", n, len(payload))
+	}
+	c.checkEndpointWriteStats(1, epstats, err)
+	return payload
+}
+
+func testWriteAndVerifyInternal(c *testContext, flow testFlow, setDest bool, checkers ...checker.NetworkChecker) uint16 {
+	c.t.Helper()
+	payload := testWriteNoVerify(c, flow, setDest)
+	// Received the packet and check the payload.
+	checkers = append(checkers, checker.UDP(checker.Payload(payload)))
+	b := c.getPacketAndVerify(flow, checkers...)
+	var udpH header.UDP
+	if flow.isV4() {
+		udpH = header.IPv4(b).Payload()
+	} else {
+		udpH = header.IPv6(b).Payload()
+	}
+
+	return udpH.SourcePort()
+}
+
+func testDualWrite(c *testContext) uint16 {
+	c.t.Helper()
+
+	v4Port := testWrite(c, unicastV4in6)
+	v6Port := testWrite(c, unicastV6)
+	if v4Port != v6Port {
+		c.t.Fatalf("expected v4 and v6 ports to be equal: got v4Port = %d, v6Port = %d", v4Port, v6Port)
+	}
+
+	return v4Port
+}
+
+func TestDualWriteUnbound(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	testDualWrite(c)
+}
+
+func TestDualWriteBoundToWildcard(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Bind to wildcard.
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	p := testDualWrite(c)
+	if p != stackPort {
+		c.t.Fatalf("Bad port: got %v, want %v", p, stackPort)
+	}
+}
+
+func TestDualWriteConnectedToV6(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Connect to v6 address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	testWrite(c, unicastV6)
+
+	// Write to V4 mapped address.
+	testFailingWrite(c, unicastV4in6, &tcpip.ErrNetworkUnreachable{})
+	const want = 1
+	if got := c.ep.Stats().(*tcpip.TransportEndpointStats).SendErrors.NoRoute.Value(); got != want {
+		c.t.Fatalf("Endpoint stat not updated. got %d want %d", got, want)
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+	checkRoute := c.ep.(interface {
+		CheckRoute(tcpip.FullAddress) (tcpip.RouteInfo, tcpip.Error)
+	}).CheckRoute
+
+	got, err := checkRoute(tcpip.FullAddress{Addr: testV6Addr, Port: testPort})
+	if err != nil {
+		t.Fatalf("CheckRoute(%s): %s", testV6Addr, err)
+	}
+	want := tcpip.RouteInfo{
+		NIC:           1,
+		LocalAddress:  stackV6Addr,
+		RemoteAddress: testV6Addr,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CheckRoute(%s) mismatch (-want +got):\n%s", testV6Addr, diff)
+	}
+
+	{
+		_, err := checkRoute(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort})
+		if _, ok := err.(*tcpip.ErrNetworkUnreachable); !ok {
+			t.Errorf("got CheckRoute(%s) = %s, want = %s", testV4MappedAddr, err, &tcpip.ErrNetworkUnreachable{})
+		}
+	}
+
+	// Probing a route must not emit a packet or count as a send.
+	if pkt, ok := c.linkEP.Read(); ok {
+		t.Errorf("unexpected packet written: %+v", pkt)
+	}
+	if got := c.ep.Stats().(*tcpip.TransportEndpointStats).PacketsSent.Value(); got != 0 {
+		t.Errorf("got PacketsSent = %d, want = 0", got)
+	}
+}
+
+func TestWriteDetail(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	write := func(to *tcpip.FullAddress) (tcpip.WriteResult, tcpip.Error) {
+		var detail tcpip.WriteResult
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{To: to, WantDetail: &detail})
+		return detail, err
+	}
+
+	// A v4-mapped destination can't be routed from a v6-connected endpoint.
+	detail, err := write(&tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort})
+	if _, ok := err.(*tcpip.ErrNetworkUnreachable); !ok {
+		t.Fatalf("got Write(...) = %v, want = %s", err, &tcpip.ErrNetworkUnreachable{})
+	}
+	if got, want := detail.FailedStage.String(), "route resolution"; got != want {
+		t.Errorf("got detail.FailedStage = %q, want = %q", got, want)
+	}
+	if diff := cmp.Diff(tcpip.WriteResult{FailedStage: tcpip.WriteStageRoute}, detail); diff != "" {
+		t.Errorf("write detail mismatch (-want +got):\n%s", diff)
+	}
+
+	// A successful write reports the route it used.
+	detail, err = write(nil)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	want := tcpip.WriteResult{
+		LocalAddress:  stackV6Addr,
+		RemoteAddress: testV6Addr,
+		EgressNIC:     1,
+	}
+	if diff := cmp.Diff(want, detail); diff != "" {
+		t.Errorf("write detail mismatch (-want +got):\n%s", diff)
+	}
+	c.getPacketAndVerify(unicastV6)
+}
+
+func TestWriteDetailEgressNIC(t *testing.T) {
+	const (
+		otherNICID    = 2
+		otherPeerAddr = tcpip.Address("\xc0\xa8\x00\x02")
+	)
+	otherAddr := tcpip.AddressWithPrefix{Address: "\xc0\xa8\x00\x01", PrefixLen: 24}
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	otherLinkEP := channel.New(1, defaultMTU, "")
+	if err := c.s.CreateNIC(otherNICID, otherLinkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", otherNICID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: otherAddr,
+	}
+	if err := c.s.AddProtocolAddress(otherNICID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", otherNICID, protocolAddr, err)
+	}
+	// The route through the other NIC must precede the default route.
+	c.s.SetRouteTable(append([]tcpip.Route{{Destination: otherAddr.Subnet(), NIC: otherNICID}}, c.s.GetRouteTable()...))
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	for _, test := range []struct {
+		dst     tcpip.Address
+		wantNIC tcpip.NICID
+		linkEP  *channel.Endpoint
+	}{
+		{dst: testAddr, wantNIC: 1, linkEP: c.linkEP},
+		{dst: otherPeerAddr, wantNIC: otherNICID, linkEP: otherLinkEP},
+	} {
+		var detail tcpip.WriteResult
+		var r bytes.Reader
+		r.Reset(newPayload())
+		if _, err := c.ep.Write(&r, tcpip.WriteOptions{
+			To:         &tcpip.FullAddress{Addr: test.dst, Port: testPort},
+			WantDetail: &detail,
+		}); err != nil {
+			t.Fatalf("Write to %s failed: %s", test.dst, err)
+		}
+		if got := detail.EgressNIC; got != test.wantNIC {
+			t.Errorf("got detail.EgressNIC = %d for write to %s, want = %d", got, test.dst, test.wantNIC)
+		}
+		if _, ok := test.linkEP.Read(); !ok {
+			t.Errorf("write to %s: no packet on NIC %d", test.dst, test.wantNIC)
+		}
+	}
+
+	// A failed write reports no egress NIC.
+	var detail tcpip.WriteResult
+	var r bytes.Reader
+	r.Reset(newPayload())
+	if _, err := c.ep.Write(&r, tcpip.WriteOptions{
+		To:         &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
+		WantDetail: &detail,
+	}); err == nil {
+		t.Fatalf("Write to %s succeeded, want error", tcpip.Address(testV6Addr))
+	}
+	if got := detail.EgressNIC; got != 0 {
+		t.Errorf("got detail.EgressNIC = %d for failed write, want = 0", got)
+	}
+}
+
+func TestDualWriteConnectedToV4Mapped(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Connect to v4 mapped address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	testWrite(c, unicastV4in6)
+
+	// Write to v6 address.
+	testFailingWrite(c, unicastV6, &tcpip.ErrInvalidEndpointState{})
+}
+
+func TestConnectedWriteAfterRouteRemoved(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+	testWriteWithoutDestination(c, unicastV4)
+
+	// Removing the route makes the cached route stale.
+	routes := c.s.GetRouteTable()
+	c.s.SetRouteTable(nil)
+	{
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{})
+		if _, ok := err.(*tcpip.ErrNoRoute); !ok {
+			c.t.Fatalf("got Write(_, _) = %v, want = %s", err, &tcpip.ErrNoRoute{})
+		}
+	}
+	if got := c.ep.Stats().(*tcpip.TransportEndpointStats).SendErrors.NoRoute.Value(); got != 1 {
+		c.t.Fatalf("got SendErrors.NoRoute = %d, want = 1", got)
+	}
+	if c.linkEP.Drain() != 0 {
+		c.t.Fatal("packet was sent without a route")
+	}
+
+	// Writes succeed again once a route is available.
+	c.s.SetRouteTable(routes)
+	testWriteWithoutDestination(c, unicastV4)
+}
+
+func TestV4WriteOnV6Only(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV6Only)
+
+	// Write to V4 mapped address.
+	testFailingWrite(c, unicastV4in6, &tcpip.ErrNoRoute{})
+}
+
+func TestV6WriteOnV4Endpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(*testContext)
+	}{
+		{
+			name:  "unbound",
+			setup: func(*testContext) {},
+		},
+		{
+			name: "bound",
+			setup: func(c *testContext) {
+				if err := c.ep.Bind(tcpip.FullAddress{Addr: stackAddr, Port: stackPort}); err != nil {
+					c.t.Fatalf("Bind failed: %s", err)
+				}
+			},
+		},
+		{
+			name: "connected",
+			setup: func(c *testContext) {
+				if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+					c.t.Fatalf("Connect failed: %s", err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv4.ProtocolNumber)
+			tc.setup(c)
+
+			// Write to v6 address.
+			testFailingWrite(c, unicastV6, &tcpip.ErrInvalidEndpointState{})
+		})
+	}
+}
+
+func TestV6WriteOnBoundToV4Mapped(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Bind to v4 mapped address.
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: stackV4MappedAddr, Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	// Write to v6 address.
+	testFailingWrite(c, unicastV6, &tcpip.ErrInvalidEndpointState{})
+}
+
+func TestV6WriteOnConnected(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Connect to v6 address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	testWriteWithoutDestination(c, unicastV6)
+}
+
+func TestV4WriteOnConnected(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Connect to v4 mapped address.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	testWriteWithoutDestination(c, unicastV4)
+}
+
+func TestWriteOnConnectedInvalidPort(t *testing.T) {
+	protocols := map[string]tcpip.NetworkProtocolNumber{
+		"ipv4": ipv4.ProtocolNumber,
+		"ipv6": ipv6.ProtocolNumber,
+	}
+	for name, pn := range protocols {
+		t.Run(name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(pn)
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: stackAddr, Port: invalidPort}); err != nil {
+				c.t.Fatalf("Connect failed: %s", err)
+			}
+			writeOpts := tcpip.WriteOptions{
+				To: &tcpip.FullAddress{Addr: stackAddr, Port: invalidPort},
+			}
+			var r bytes.Reader
+			payload := newPayload()
+			r.Reset(payload)
+			n, err := c.ep.Write(&r, writeOpts)
+			if err != nil {
+				c.t.Fatalf("c.ep.Write(...) = %s, want nil", err)
+			}
+			if got, want := n, int64(len(payload)); got != want {
+				c.t.Fatalf("c.ep.Write(...) wrote %d bytes, want %d bytes", got, want)
+			}
+
+			{
+				err := c.ep.LastError()
+				if _, ok := err.(*tcpip.ErrConnectionRefused); !ok {
+					c.t.Fatalf("expected c.ep.LastError() == ErrConnectionRefused, got: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestICMPTimeExceeded(t *testing.T) {
+	const routerAddr = tcpip.Address("\x0a\x00\x00\x03")
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+	c.ep.SocketOptions().SetRecvError(true)
+
+	testWriteNoVerify(c, unicastV4, false /* setDest */)
+	orig := c.getPacketAndVerify(unicastV4)
+
+	// A router on the path reports that the datagram's TTL expired, quoting
+	// the IP header and the first 8 bytes of the datagram.
+	orig = orig[:header.IPv4MinimumSize+header.UDPMinimumSize]
+	buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(orig))
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     routerAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4TimeExceeded)
+	icmp.SetCode(header.ICMPv4TTLExceeded)
+	copy(icmp[header.ICMPv4MinimumSize:], orig)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	c.injectRaw(ipv4.ProtocolNumber, buf)
+
+	sockErr := c.ep.SocketOptions().DequeueErr()
+	if sockErr == nil {
+		t.Fatal("got DequeueErr() = nil, want Time Exceeded error")
+	}
+	if _, ok := sockErr.Err.(*tcpip.ErrNoRoute); !ok {
+		t.Errorf("got sockErr.Err = %s, want = %s", sockErr.Err, &tcpip.ErrNoRoute{})
+	}
+	if got, want := sockErr.Cause.Origin(), tcpip.SockExtErrorOriginICMP; got != want {
+		t.Errorf("got sockErr.Cause.Origin() = %d, want = %d", got, want)
+	}
+	if got, want := header.ICMPv4Type(sockErr.Cause.Type()), header.ICMPv4TimeExceeded; got != want {
+		t.Errorf("got sockErr.Cause.Type() = %d, want = %d", got, want)
+	}
+	if got, want := header.ICMPv4Code(sockErr.Cause.Code()), header.ICMPv4TTLExceeded; got != want {
+		t.Errorf("got sockErr.Cause.Code() = %d, want = %d", got, want)
+	}
+	if !sockErr.Soft {
+		t.Error("got sockErr.Soft = false, want = true")
+	}
+
+	// Like Linux, an expired TTL is a soft error that doesn't fail the socket.
+	if err := c.ep.LastError(); err != nil {
+		t.Errorf("got c.ep.LastError() = %s, want = nil", err)
+	}
+}
+
+// TestErrQueueLastErrorSkipsSoftErrors checks that dequeuing an error queue
+// entry only makes the next entry the last error if that entry is a hard
+// error.
+func TestErrQueueLastErrorSkipsSoftErrors(t *testing.T) {
+	const routerAddr = tcpip.Address("\x0a\x00\x00\x03")
+
+	type icmpError struct {
+		typ  header.ICMPv4Type
+		code header.ICMPv4Code
+	}
+	var (
+		hard = icmpError{typ: header.ICMPv4DstUnreachable, code: header.ICMPv4PortUnreachable}
+		soft = icmpError{typ: header.ICMPv4TimeExceeded, code: header.ICMPv4TTLExceeded}
+	)
+
+	for _, test := range []struct {
+		name   string
+		errors []icmpError
+		// wantLastErrors holds the last error after each entry is dequeued.
+		wantLastErrors []tcpip.Error
+	}{
+		{
+			name:           "hard then soft",
+			errors:         []icmpError{hard, soft},
+			wantLastErrors: []tcpip.Error{nil, nil},
+		},
+		{
+			name:           "soft then hard",
+			errors:         []icmpError{soft, hard},
+			wantLastErrors: []tcpip.Error{&tcpip.ErrConnectionRefused{}, nil},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				c.t.Fatalf("Connect failed: %s", err)
+			}
+			c.ep.SocketOptions().SetRecvError(true)
+
+			testWriteNoVerify(c, unicastV4, false /* setDest */)
+			orig := c.getPacketAndVerify(unicastV4)
+			orig = orig[:header.IPv4MinimumSize+header.UDPMinimumSize]
+
+			for _, icmpErr := range test.errors {
+				buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(orig))
+				ip := header.IPv4(buf)
+				ip.Encode(&header.IPv4Fields{
+					TotalLength: uint16(len(buf)),
+					TTL:         65,
+					Protocol:    uint8(header.ICMPv4ProtocolNumber),
+					SrcAddr:     routerAddr,
+					DstAddr:     stackAddr,
+				})
+				ip.SetChecksum(^ip.CalculateChecksum())
+				icmp := header.ICMPv4(ip.Payload())
+				icmp.SetType(icmpErr.typ)
+				icmp.SetCode(icmpErr.code)
+				copy(icmp[header.ICMPv4MinimumSize:], orig)
+				icmp.SetChecksum(^header.Checksum(icmp, 0))
+				c.injectRaw(ipv4.ProtocolNumber, buf)
+			}
+
+			for i, want := range test.wantLastErrors {
+				if sockErr := c.ep.SocketOptions().DequeueErrAndUpdateLastError(); sockErr == nil {
+					t.Fatalf("got DequeueErrAndUpdateLastError() #%d = nil, want error", i)
+				}
+				if diff := cmp.Diff(want, c.ep.LastError()); diff != "" {
+					t.Errorf("last error after dequeuing entry #%d mismatch (-want +got):\n%s", i, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorQueueLimit(t *testing.T) {
+	const (
+		limit      = 2
+		routerAddr = tcpip.Address("\x0a\x00\x00\x03")
+	)
+	type icmpError struct {
+		typ  header.ICMPv4Type
+		code header.ICMPv4Code
+	}
+	icmpErrors := []icmpError{
+		{typ: header.ICMPv4DstUnreachable, code: header.ICMPv4PortUnreachable},
+		{typ: header.ICMPv4TimeExceeded, code: header.ICMPv4TTLExceeded},
+		{typ: header.ICMPv4DstUnreachable, code: header.ICMPv4PortUnreachable},
+	}
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+	c.ep.SocketOptions().SetRecvError(true)
+	c.ep.SocketOptions().SetErrorQueueLimit(limit)
+
+	testWriteNoVerify(c, unicastV4, false /* setDest */)
+	orig := c.getPacketAndVerify(unicastV4)
+	orig = orig[:header.IPv4MinimumSize+header.UDPMinimumSize]
+
+	for _, icmpErr := range icmpErrors {
+		buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(orig))
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(buf)),
+			TTL:         65,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     routerAddr,
+			DstAddr:     stackAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		icmp := header.ICMPv4(ip.Payload())
+		icmp.SetType(icmpErr.typ)
+		icmp.SetCode(icmpErr.code)
+		copy(icmp[header.ICMPv4MinimumSize:], orig)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		c.injectRaw(ipv4.ProtocolNumber, buf)
+	}
+
+	// Only the most recent errors remain queued.
+	for _, want := range icmpErrors[len(icmpErrors)-limit:] {
+		sockErr := c.ep.SocketOptions().DequeueErr()
+		if sockErr == nil {
+			t.Fatalf("got DequeueErr() = nil, want error with type %d code %d", want.typ, want.code)
+		}
+		if got := header.ICMPv4Type(sockErr.Cause.Type()); got != want.typ {
+			t.Errorf("got sockErr.Cause.Type() = %d, want = %d", got, want.typ)
+		}
+		if got := header.ICMPv4Code(sockErr.Cause.Code()); got != want.code {
+			t.Errorf("got sockErr.Cause.Code() = %d, want = %d", got, want.code)
+		}
+	}
+	if sockErr := c.ep.SocketOptions().DequeueErr(); sockErr != nil {
+		t.Errorf("got DequeueErr() = %+v, want = nil", sockErr)
+	}
+	if got, want := c.ep.SocketOptions().ErrorQueueDropped(), uint64(len(icmpErrors)-limit); got != want {
+		t.Errorf("got ErrorQueueDropped() = %d, want = %d", got, want)
+	}
+}
+
+func TestICMPSoftErrors(t *testing.T) {
+	const routerAddr = tcpip.Address("\x0a\x00\x00\x03")
+
+	for _, test := range []struct {
+		name     string
+		typ      header.ICMPv4Type
+		code     header.ICMPv4Code
+		wantErr  tcpip.Error
+		wantSoft bool
+	}{
+		{
+			name:     "source route failed",
+			typ:      header.ICMPv4DstUnreachable,
+			code:     header.ICMPv4SourceRouteFailed,
+			wantErr:  &tcpip.ErrNotSupported{},
+			wantSoft: true,
+		},
+		{
+			name:     "host unreachable",
+			typ:      header.ICMPv4DstUnreachable,
+			code:     header.ICMPv4HostUnreachable,
+			wantErr:  &tcpip.ErrNoRoute{},
+			wantSoft: true,
+		},
+		{
+			name:     "time exceeded",
+			typ:      header.ICMPv4TimeExceeded,
+			code:     header.ICMPv4TTLExceeded,
+			wantErr:  &tcpip.ErrNoRoute{},
+			wantSoft: true,
+		},
+		{
+			name:     "port unreachable",
+			typ:      header.ICMPv4DstUnreachable,
+			code:     header.ICMPv4PortUnreachable,
+			wantErr:  &tcpip.ErrConnectionRefused{},
+			wantSoft: false,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				c.t.Fatalf("Connect failed: %s", err)
+			}
+			c.ep.SocketOptions().SetRecvError(true)
+
+			testWriteNoVerify(c, unicastV4, false /* setDest */)
+			orig := c.getPacketAndVerify(unicastV4)
+			orig = orig[:header.IPv4MinimumSize+header.UDPMinimumSize]
+			buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(orig))
+			ip := header.IPv4(buf)
+			ip.Encode(&header.IPv4Fields{
+				TotalLength: uint16(len(buf)),
+				TTL:         65,
+				Protocol:    uint8(header.ICMPv4ProtocolNumber),
+				SrcAddr:     routerAddr,
+				DstAddr:     stackAddr,
+			})
+			ip.SetChecksum(^ip.CalculateChecksum())
+			icmp := header.ICMPv4(ip.Payload())
+			icmp.SetType(test.typ)
+			icmp.SetCode(test.code)
+			copy(icmp[header.ICMPv4MinimumSize:], orig)
+			icmp.SetChecksum(^header.Checksum(icmp, 0))
+			c.injectRaw(ipv4.ProtocolNumber, buf)
+
+			sockErr := c.ep.SocketOptions().DequeueErr()
+			if sockErr == nil {
+				t.Fatal("got DequeueErr() = nil, want error")
+			}
+			if diff := cmp.Diff(test.wantErr, sockErr.Err); diff != "" {
+				t.Errorf("sockErr.Err mismatch (-want +got):\n%s", diff)
+			}
+			if got := sockErr.Soft; got != test.wantSoft {
+				t.Errorf("got sockErr.Soft = %t, want = %t", got, test.wantSoft)
+			}
+			if got, want := header.ICMPv4Type(sockErr.Cause.Type()), test.typ; got != want {
+				t.Errorf("got sockErr.Cause.Type() = %d, want = %d", got, want)
+			}
+			if got, want := header.ICMPv4Code(sockErr.Cause.Code()), test.code; got != want {
+				t.Errorf("got sockErr.Cause.Code() = %d, want = %d", got, want)
+			}
+
+			// Soft errors don't fail the next write.
+			var r bytes.Reader
+			r.Reset(newPayload())
+			_, err := c.ep.Write(&r, tcpip.WriteOptions{})
+			var wantWriteErr tcpip.Error
+			if !test.wantSoft {
+				wantWriteErr = test.wantErr
+			}
+			if diff := cmp.Diff(wantWriteErr, err); diff != "" {
+				t.Errorf("Write(...) error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestWriteOnBoundToV4Multicast checks that we can send packets out of a socket
+// that is bound to a V4 multicast address.
+func TestWriteOnBoundToV4Multicast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, multicastV4, broadcast} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V4 mcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastAddr, Port: stackPort}); err != nil {
+				c.t.Fatal("Bind failed:", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+func TestRequireMulticastMembershipToSend(t *testing.T) {
+	for _, flow := range []testFlow{multicastV4, multicastV6Only} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			c.ep.(interface{ SetRequireMulticastMembershipToSend(bool) }).SetRequireMulticastMembershipToSend(true)
+
+			testFailingWrite(c, flow, &tcpip.ErrNoRoute{})
+
+			group := flow.header4Tuple(outgoing).dstAddr.Addr
+			if err := c.ep.SetSockOpt(&tcpip.AddMembershipOption{NIC: 1, MulticastAddr: group}); err != nil {
+				c.t.Fatalf("SetSockOpt(&AddMembershipOption{NIC: 1, MulticastAddr: %s}): %s", group, err)
+			}
+			testWrite(c, flow)
+		})
+	}
+}
+
+// TestWriteOnBoundToV4MappedMulticast checks that we can send packets out of a
+// socket that is bound to a V4-mapped multicast address.
+func TestWriteOnBoundToV4MappedMulticast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4in6, multicastV4in6, broadcastIn6} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V4Mapped mcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV4MappedAddr, Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+// TestWriteOnBoundToV6Multicast checks that we can send packets out of a
+// socket that is bound to a V6 multicast address.
+func TestWriteOnBoundToV6Multicast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV6, multicastV6} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V6 mcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV6Addr, Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+// TestWriteOnBoundToV6Multicast checks that we can send packets out of a
+// V6-only socket that is bound to a V6 multicast address.
+func TestWriteOnBoundToV6OnlyMulticast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV6Only, multicastV6Only} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V6 mcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: multicastV6Addr, Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+// TestWriteOnBoundToBroadcast checks that we can send packets out of a
+// socket that is bound to the broadcast address.
+func TestWriteOnBoundToBroadcast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, multicastV4, broadcast} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V4 broadcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: broadcastAddr, Port: stackPort}); err != nil {
+				c.t.Fatal("Bind failed:", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+// TestConnectToBroadcast checks that connecting to a broadcast address requires
+// SO_BROADCAST and that writes on the connected endpoint honor it.
+func TestConnectToBroadcast(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	to := tcpip.FullAddress{Addr: broadcastAddr, Port: testPort}
+	{
+		err := c.ep.Connect(to)
+		if _, ok := err.(*tcpip.ErrBroadcastDisabled); !ok {
+			c.t.Fatalf("got Connect(%#v) = %v without SO_BROADCAST, want = %s", to, err, &tcpip.ErrBroadcastDisabled{})
+		}
+	}
+
+	c.ep.SocketOptions().SetBroadcast(true)
+	if err := c.ep.Connect(to); err != nil {
+		c.t.Fatalf("Connect(%#v): %s", to, err)
+	}
+	testWriteWithoutDestination(c, broadcast)
+
+	// Writes fail once broadcasts are disabled again.
+	c.ep.SocketOptions().SetBroadcast(false)
+	var r bytes.Reader
+	r.Reset(newPayload())
+	if _, err := c.ep.Write(&r, tcpip.WriteOptions{}); err == nil {
+		c.t.Fatal("Write succeeded after disabling SO_BROADCAST")
+	} else if _, ok := err.(*tcpip.ErrBroadcastDisabled); !ok {
+		c.t.Fatalf("got Write(_, _) = %s, want = %s", err, &tcpip.ErrBroadcastDisabled{})
+	}
+}
+
+// TestWriteOnBoundToV4MappedBroadcast checks that we can send packets out of a
+// socket that is bound to the V4-mapped broadcast address.
+func TestWriteOnBoundToV4MappedBroadcast(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4in6, multicastV4in6, broadcastIn6} {
+		t.Run(fmt.Sprintf("%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Bind to V4Mapped mcast address.
+			if err := c.ep.Bind(tcpip.FullAddress{Addr: broadcastV4MappedAddr, Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			testWrite(c, flow)
+		})
+	}
+}
+
+func TestReadIncrementsPacketsReceived(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Create IPv4 UDP endpoint
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	// Bind to wildcard.
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	testRead(c, unicastV4)
+
+	var want uint64 = 1
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != want {
+		c.t.Fatalf("Read did not increment PacketsReceived: got %v, want %v", got, want)
+	}
+}
+
+func TestReadIPPacketInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		proto   tcpip.NetworkProtocolNumber
+		flow    testFlow
+		checker func(tcpip.NICID) checker.ControlMessagesChecker
+	}{
+		{
+			name:  "IPv4 unicast",
+			proto: header.IPv4ProtocolNumber,
+			flow:  unicastV4,
+			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
+				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
+					NIC:             id,
+					LocalAddr:       stackAddr,
+					DestinationAddr: stackAddr,
+				})
+			},
+		},
+		{
+			name:  "IPv4 multicast",
+			proto: header.IPv4ProtocolNumber,
+			flow:  multicastV4,
+			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
+				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
+					NIC: id,
+					// TODO(gvisor.dev/issue/3556): Check for a unicast address.
+					LocalAddr:       multicastAddr,
+					DestinationAddr: multicastAddr,
+				})
+			},
+		},
+		{
+			name:  "IPv4 broadcast",
+			proto: header.IPv4ProtocolNumber,
+			flow:  broadcast,
+			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
+				return checker.ReceiveIPPacketInfo(tcpip.IPPacketInfo{
+					NIC: id,
+					// TODO(gvisor.dev/issue/3556): Check for a unicast address.
+					LocalAddr:       broadcastAddr,
+					DestinationAddr: broadcastAddr,
+				})
+			},
+		},
+		{
+			name:  "IPv6 unicast",
+			proto: header.IPv6ProtocolNumber,
+			flow:  unicastV6,
+			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
+				return checker.ReceiveIPv6PacketInfo(tcpip.IPv6PacketInfo{
+					NIC:  id,
+					Addr: stackV6Addr,
+				})
+			},
+		},
+		{
+			name:  "IPv6 multicast",
+			proto: header.IPv6ProtocolNumber,
+			flow:  multicastV6,
+			checker: func(id tcpip.NICID) checker.ControlMessagesChecker {
+				return checker.ReceiveIPv6PacketInfo(tcpip.IPv6PacketInfo{
+					NIC:  id,
+					Addr: multicastV6Addr,
+				})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(test.proto)
+
+			bindAddr := tcpip.FullAddress{Port: stackPort}
+			if err := c.ep.Bind(bindAddr); err != nil {
+				t.Fatalf("Bind(%+v): %s", bindAddr, err)
+			}
+
+			if test.flow.isMulticast() {
+				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: test.flow.getMcastAddr()}
+				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+					c.t.Fatalf("SetSockOpt(&%#v): %s:", ifoptSet, err)
+				}
+			}
+
+			switch f := test.flow.netProto(); f {
+			case header.IPv4ProtocolNumber:
+				c.ep.SocketOptions().SetReceivePacketInfo(true)
+			case header.IPv6ProtocolNumber:
+				c.ep.SocketOptions().SetIPv6ReceivePacketInfo(true)
+			default:
+				t.Fatalf("unhandled protocol number = %d", f)
+			}
+
+			testRead(c, test.flow, test.checker(c.nicID))
+
+			if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 1 {
+				t.Fatalf("Read did not increment PacketsReceived: got = %d, want = 1", got)
+			}
+		})
+	}
+}
+
+func TestReadInterfaceIndex(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, multicastV4, multicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			bindAddr := tcpip.FullAddress{Port: stackPort}
+			if err := c.ep.Bind(bindAddr); err != nil {
+				t.Fatalf("Bind(%+v): %s", bindAddr, err)
+			}
+			if flow.isMulticast() {
+				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: flow.getMcastAddr()}
+				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+					c.t.Fatalf("SetSockOpt(&%#v): %s:", ifoptSet, err)
+				}
+			}
+
+			// The interface index is not reported by default.
+			testRead(c, flow, func(t *testing.T, cm tcpip.ControlMessages) {
+				t.Helper()
+				if cm.HasIfIndex {
+					t.Errorf("got cm.HasIfIndex = true with the option disabled, want = false")
+				}
+			})
+
+			c.ep.SocketOptions().SetReceiveInterfaceIndex(true)
+			testRead(c, flow, checker.ReceiveIfIndex(c.nicID))
+		})
+	}
+}
+
+func TestReadRecvOriginalDstAddr(t *testing.T) {
+	tests := []struct {
+		name                    string
+		proto                   tcpip.NetworkProtocolNumber
+		flow                    testFlow
+		expectedOriginalDstAddr tcpip.FullAddress
+	}{
+		{
+			name:                    "IPv4 unicast",
+			proto:                   header.IPv4ProtocolNumber,
+			flow:                    unicastV4,
+			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: stackAddr, Port: stackPort},
+		},
+		{
+			name:  "IPv4 multicast",
+			proto: header.IPv4ProtocolNumber,
+			flow:  multicastV4,
+			// This should actually be a unicast address assigned to the interface.
+			//
+			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
+			// behaviour. We still include the test so that once the bug is
+			// resolved, this test will start to fail and the individual tasked
+			// with fixing this bug knows to also fix this test :).
+			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: multicastAddr, Port: stackPort},
+		},
+		{
+			name:  "IPv4 broadcast",
+			proto: header.IPv4ProtocolNumber,
+			flow:  broadcast,
+			// This should actually be a unicast address assigned to the interface.
+			//
+			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
+			// behaviour. We still include the test so that once the bug is
+			// resolved, this test will start to fail and the individual tasked
+			// with fixing this bug knows to also fix this test :).
+			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: broadcastAddr, Port: stackPort},
+		},
+		{
+			name:                    "IPv6 unicast",
+			proto:                   header.IPv6ProtocolNumber,
+			flow:                    unicastV6,
+			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: stackV6Addr, Port: stackPort},
+		},
+		{
+			name:  "IPv6 multicast",
+			proto: header.IPv6ProtocolNumber,
+			flow:  multicastV6,
+			// This should actually be a unicast address assigned to the interface.
+			//
+			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
+			// behaviour. We still include the test so that once the bug is
+			// resolved, this test will start to fail and the individual tasked
+			// with fixing this bug knows to also fix this test :).
+			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: multicastV6Addr, Port: stackPort},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(test.proto)
+
+			bindAddr := tcpip.FullAddress{Port: stackPort}
+			if err := c.ep.Bind(bindAddr); err != nil {
+				t.Fatalf("Bind(%#v): %s", bindAddr, err)
+			}
+
+			if test.flow.isMulticast() {
+				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: test.flow.getMcastAddr()}
+				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+					c.t.Fatalf("SetSockOpt(&%#v): %s:", ifoptSet, err)
+				}
+			}
+
+			c.ep.SocketOptions().SetReceiveOriginalDstAddress(true)
+
+			testRead(c, test.flow, checker.ReceiveOriginalDstAddr(test.expectedOriginalDstAddr))
+
+			if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 1 {
+				t.Fatalf("Read did not increment PacketsReceived: got = %d, want = 1", got)
+			}
+		})
+	}
+}
+
+func TestWriteIncrementsPacketsSent(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	testDualWrite(c)
+
+	var want uint64 = 2
+	if got := c.s.Stats().UDP.PacketsSent.Value(); got != want {
+		c.t.Fatalf("Write did not increment PacketsSent: got %v, want %v", got, want)
+	}
+}
+
+// TestZeroLengthWrite verifies that writing an empty payload emits a valid
+// datagram consisting of only the UDP header.
+func TestZeroLengthWrite(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(flow.String(), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			h := flow.header4Tuple(outgoing)
+			writeOpts := tcpip.WriteOptions{
+				To: &tcpip.FullAddress{Addr: flow.mapAddrIfApplicable(h.dstAddr.Addr), Port: h.dstAddr.Port},
+			}
+			var r bytes.Reader
+			if n, err := c.ep.Write(&r, writeOpts); err != nil || n != 0 {
+				t.Fatalf("got c.ep.Write(_, %#v) = (%d, %s), want = (0, nil)", writeOpts, n, err)
+			}
+
+			b := c.getPacketAndVerify(flow)
+			var udpH header.UDP
+			if flow.isV4() {
+				udpH = header.IPv4(b).Payload()
+			} else {
+				udpH = header.IPv6(b).Payload()
+			}
+			if got, want := udpH.Length(), uint16(header.UDPMinimumSize); got != want {
+				t.Errorf("got udpH.Length() = %d, want = %d", got, want)
+			}
+			if got := len(udpH.Payload()); got != 0 {
+				t.Errorf("got len(udpH.Payload()) = %d, want = 0", got)
+			}
+		})
+	}
+}
+
+// TestZeroLengthRead verifies that a received datagram with an empty payload
+// is delivered to the endpoint and is not mistaken for EOF.
+func TestZeroLengthRead(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(flow.String(), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				t.Fatalf("Bind failed: %s", err)
+			}
+
+			we, ch := waiter.NewChannelEntry(nil)
+			c.wq.EventRegister(&we, waiter.ReadableEvents)
+			defer c.wq.EventUnregister(&we)
+
+			c.injectPacket(flow, nil, false)
+
+			select {
+			case <-ch:
+			default:
+				t.Fatal("endpoint not notified of zero-length datagram")
+			}
+
+			var buf bytes.Buffer
+			res, err := c.ep.Read(&buf, tcpip.ReadOptions{NeedRemoteAddr: true})
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+			h := flow.header4Tuple(incoming)
+			if diff := cmp.Diff(tcpip.ReadResult{
+				Count:      0,
+				Total:      0,
+				RemoteAddr: tcpip.FullAddress{Addr: h.srcAddr.Addr, Port: h.srcAddr.Port},
+			}, res, checker.IgnoreCmpPath("ControlMessages", "RemoteAddr.NIC")); diff != "" {
+				t.Fatalf("Read: unexpected result (-want +got):\n%s", diff)
+			}
+
+			// The datagram was consumed; nothing else is queued.
+			{
+				_, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+				if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+					t.Fatalf("got c.ep.Read(...) = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+				}
+			}
+		})
+	}
+}
+
+func TestResetUDPStats(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	const firstBatch = 3
+	for i := 0; i < firstBatch; i++ {
+		testRead(c, unicastV4)
+	}
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != firstBatch {
+		t.Fatalf("got PacketsReceived = %d, want = %d", got, firstBatch)
+	}
+
+	prev := c.s.ResetUDPStats()
+	if got := prev.PacketsReceived.Value(); got != firstBatch {
+		t.Errorf("got ResetUDPStats().PacketsReceived = %d, want = %d", got, firstBatch)
+	}
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 0 {
+		t.Errorf("got PacketsReceived = %d after reset, want = 0", got)
+	}
+
+	const secondBatch = 2
+	for i := 0; i < secondBatch; i++ {
+		testRead(c, unicastV4)
+	}
+	if got := c.s.Stats().UDP.PacketsReceived.Value(); got != secondBatch {
+		t.Errorf("got PacketsReceived = %d after reset, want = %d", got, secondBatch)
+	}
+	// The snapshot returned by the reset is not affected by later packets.
+	if got := prev.PacketsReceived.Value(); got != firstBatch {
+		t.Errorf("got snapshot PacketsReceived = %d, want = %d", got, firstBatch)
+	}
+}
+
+func TestUDPTap(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var got []stack.UDPTapDirection
+	c.s.SetUDPTap(func(dir stack.UDPTapDirection, pkt *stack.PacketBuffer) {
+		if pkt.TransportProtocolNumber != udp.ProtocolNumber {
+			t.Errorf("got pkt.TransportProtocolNumber = %d, want = %d", pkt.TransportProtocolNumber, udp.ProtocolNumber)
+		}
+		got = append(got, dir)
+	})
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	testRead(c, unicastV4)
+	testWrite(c, unicastV4)
+
+	want := []stack.UDPTapDirection{stack.UDPTapIncoming, stack.UDPTapOutgoing}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tapped directions mismatch (-want +got):\n%s", diff)
+	}
+
+	// Removing the tap stops further observations.
+	c.s.SetUDPTap(nil)
+	testWrite(c, unicastV4)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tapped directions mismatch after removing tap (-want +got):\n%s", diff)
+	}
+}
+
+func TestUDPSourcePortRewriter(t *testing.T) {
+	const rewrittenPort = 5555
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var gotID stack.TransportEndpointID
+	c.s.SetUDPSourcePortRewriter(func(id stack.TransportEndpointID) (uint16, bool) {
+		gotID = id
+		return rewrittenPort, true
+	})
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	payload := testWriteNoVerify(c, unicastV4, true /* setDest */)
+	b := c.getPacketAndVerify(unicastV4, checker.UDP(
+		checker.SrcPort(rewrittenPort),
+		checker.DstPort(testPort),
+		checker.Payload(payload),
+	))
+	ip := header.IPv4(b)
+	udpHdr := header.UDP(ip.Payload())
+	if !udpHdr.IsChecksumValid(ip.SourceAddress(), ip.DestinationAddress(), header.Checksum(udpHdr.Payload(), 0)) {
+		t.Error("got udpHdr.IsChecksumValid() = false, want = true")
+	}
+
+	wantID := stack.TransportEndpointID{
+		LocalPort:     stackPort,
+		LocalAddress:  stackAddr,
+		RemotePort:    testPort,
+		RemoteAddress: testAddr,
+	}
+	if diff := cmp.Diff(wantID, gotID); diff != "" {
+		t.Errorf("rewriter ID mismatch (-want +got):\n%s", diff)
+	}
+
+	// Removing the rewriter restores the bound port.
+	c.s.SetUDPSourcePortRewriter(nil)
+	testWrite(c, unicastV4, checker.UDP(checker.SrcPort(stackPort)))
+}
+
+func TestResetStats(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	resetStats := c.ep.(interface {
+		ResetStats() tcpip.TransportEndpointStats
+	}).ResetStats
+	stats := c.ep.Stats().(*tcpip.TransportEndpointStats)
+
+	for i := 0; i < 2; i++ {
+		testWrite(c, unicastV4)
+	}
+	prev := resetStats()
+	if got := prev.PacketsSent.Value(); got != 2 {
+		t.Errorf("got PacketsSent before the reset = %d, want = 2", got)
+	}
+	if got := stats.PacketsSent.Value(); got != 0 {
+		t.Errorf("got PacketsSent after the reset = %d, want = 0", got)
+	}
+
+	testWrite(c, unicastV4)
+	if got := stats.PacketsSent.Value(); got != 1 {
+		t.Errorf("got PacketsSent after a write following the reset = %d, want = 1", got)
+	}
+}
+
+// TestChecksumFunc checks that a checksum implementation installed with
+// header.SetChecksumFunc is used on both the write and receive paths. The hook
+// is global, so the test must not run in parallel with others.
+func TestChecksumFunc(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	var mu sync.Mutex
+	var calls [][]byte
+	header.SetChecksumFunc(func(buf []byte, initial uint16) uint16 {
+		mu.Lock()
+		calls = append(calls, append([]byte(nil), buf...))
+		mu.Unlock()
+		return header.ChecksumOld(buf, initial)
+	})
+	t.Cleanup(func() { header.SetChecksumFunc(nil) })
+
+	// called returns true if the checksum func was called with b since the
+	// last call to called.
+	called := func(b []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { calls = nil }()
+		for _, buf := range calls {
+			if bytes.Equal(buf, b) {
+				return true
+			}
+		}
+		return false
+	}
+
+	payload := testWriteNoVerify(c, unicastV4, true /* setDest */)
+	b := c.getPacketAndVerify(unicastV4)
+	if !called(payload) {
+		t.Errorf("checksum func not called with the %d-byte payload written", len(payload))
+	}
+
+	// Received datagrams are verified with the checksum func too.
+	rcvPayload := newPayload()
+	c.injectPacket(unicastV4, rcvPayload, false /* badChecksum */)
+	if !called(rcvPayload) {
+		t.Errorf("checksum func not called with the %d-byte payload received", len(rcvPayload))
+	}
+	{
+		var buf bytes.Buffer
+		if _, err := c.ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if diff := cmp.Diff(rcvPayload, buf.Bytes()); diff != "" {
+			t.Errorf("received payload mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// The datagram's checksum is still valid.
+	ip := header.IPv4(b)
+	udpHdr := header.UDP(ip.Payload())
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(udpHdr)))
+	if got := header.ChecksumOld(udpHdr, xsum); got != 0xffff {
+		t.Errorf("got checksum sum = %#x, want = 0xffff", got)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	clock := faketime.NewManualClock()
+	c := newDualTestContextWithClock(t, defaultMTU, true /* handleLocal */, clock)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.ReadableEvents)
+	defer c.wq.EventUnregister(&we)
+
+	readDeadline := c.ep.(interface{ ReadDeadline(tcpip.MonotonicTime) }).ReadDeadline
+	readDeadline(clock.NowMonotonic().Add(time.Second))
+
+	read := func() tcpip.Error {
+		_, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+		return err
+	}
+	{
+		err := read()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got Read() before the deadline = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+
+	// Readers are woken up once the deadline passes.
+	clock.Advance(time.Second)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("readers not notified when the read deadline passed")
+	}
+	{
+		err := read()
+		if _, ok := err.(*tcpip.ErrTimeout); !ok {
+			t.Fatalf("got Read() after the deadline = %v, want = %s", err, &tcpip.ErrTimeout{})
+		}
+	}
+
+	// Queued datagrams are still read after the deadline.
+	testRead(c, unicastV4)
+
+	// Clearing the deadline restores non-blocking semantics.
+	readDeadline(tcpip.MonotonicTime{})
+	{
+		err := read()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got Read() with no deadline = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+func TestUDPConntrackEntries(t *testing.T) {
+	clock := faketime.NewManualClock()
+	c := newDualTestContextWithClock(t, defaultMTU, true /* handleLocal */, clock)
+	defer c.cleanup()
+
+	c.s.SetUDPConntrack(true)
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	clock.Advance(time.Second)
+	testWriteWithoutDestination(c, unicastV4)
+	testWriteWithoutDestination(c, unicastV4)
+	clock.Advance(time.Second)
+	lastSeen := clock.NowMonotonic()
+	testRead(c, unicastV4)
+
+	original := stack.UDPConntrackTuple{
+		NetProto: ipv4.ProtocolNumber,
+		SrcAddr:  stackAddr,
+		SrcPort:  stackPort,
+		DstAddr:  testAddr,
+		DstPort:  testPort,
+	}
+	want := []stack.UDPConntrackEntry{{
+		Original: original,
+		Reply: stack.UDPConntrackTuple{
+			NetProto: ipv4.ProtocolNumber,
+			SrcAddr:  testAddr,
+			SrcPort:  testPort,
+			DstAddr:  stackAddr,
+			DstPort:  stackPort,
+		},
+		LastSeen:        lastSeen,
+		OriginalPackets: 2,
+		ReplyPackets:    1,
+	}}
+	if diff := cmp.Diff(want, c.s.UDPConntrackEntries(), cmp.AllowUnexported(tcpip.MonotonicTime{})); diff != "" {
+		t.Errorf("conntrack entries mismatch (-want +got):\n%s", diff)
+	}
+
+	// Flows that saw replies are kept for 120 seconds after the last packet.
+	clock.Advance(120 * time.Second)
+	if got := len(c.s.UDPConntrackEntries()); got != 1 {
+		t.Errorf("got len(UDPConntrackEntries()) = %d before the timeout, want = 1", got)
+	}
+	clock.Advance(time.Second)
+	if got := c.s.UDPConntrackEntries(); len(got) != 0 {
+		t.Errorf("got UDPConntrackEntries() = %#v after the timeout, want = []", got)
+	}
+
+	// Disabling tracking discards flows and stops tracking new packets.
+	testWriteWithoutDestination(c, unicastV4)
+	if got := len(c.s.UDPConntrackEntries()); got != 1 {
+		t.Fatalf("got len(UDPConntrackEntries()) = %d after a write, want = 1", got)
+	}
+	c.s.SetUDPConntrack(false)
+	testWriteWithoutDestination(c, unicastV4)
+	if got := c.s.UDPConntrackEntries(); len(got) != 0 {
+		t.Errorf("got UDPConntrackEntries() = %#v after disabling tracking, want = []", got)
+	}
+
+	// Closing the stack discards flows as well.
+	c.s.SetUDPConntrack(true)
+	testWriteWithoutDestination(c, unicastV4)
+	c.s.Close()
+	if got := c.s.UDPConntrackEntries(); len(got) != 0 {
+		t.Errorf("got UDPConntrackEntries() = %#v after closing the stack, want = []", got)
+	}
+}
+
+func TestWriteAndReturnPacket(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	type packetWriter interface {
+		WriteAndReturnPacket(tcpip.Payloader, tcpip.WriteOptions) (*stack.PacketBuffer, tcpip.Error)
+	}
+	w, ok := c.ep.(packetWriter)
+	if !ok {
+		t.Fatalf("%T does not implement WriteAndReturnPacket", c.ep)
+	}
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	payload := newPayload()
+	var r bytes.Reader
+	r.Reset(payload)
+	{
+		_, err := w.WriteAndReturnPacket(&r, tcpip.WriteOptions{To: &to})
+		if _, ok := err.(*tcpip.ErrNotSupported); !ok {
+			t.Fatalf("got WriteAndReturnPacket(...) = %v without the option, want = %s", err, &tcpip.ErrNotSupported{})
+		}
+	}
+
+	opt := tcpip.UDPWriteAndReturnPacketOption(true)
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, &opt); err != nil {
+		t.Fatalf("SetTransportProtocolOption(%d, &%T(%t)): %s", udp.ProtocolNumber, opt, opt, err)
+	}
+	r.Reset(payload)
+	pkt, err := w.WriteAndReturnPacket(&r, tcpip.WriteOptions{To: &to})
+	if err != nil {
+		t.Fatalf("WriteAndReturnPacket failed: %s", err)
+	}
+	// The clone is taken before the network layer adds its header.
+	if got := len(pkt.NetworkHeader().View()); got != 0 {
+		t.Errorf("got len(pkt.NetworkHeader().View()) = %d, want = 0", got)
+	}
+	udpHdr := header.UDP(stack.PayloadSince(pkt.TransportHeader()))
+	if got := udpHdr.SourcePort(); got != stackPort {
+		t.Errorf("got udpHdr.SourcePort() = %d, want = %d", got, stackPort)
+	}
+	if got := udpHdr.DestinationPort(); got != testPort {
+		t.Errorf("got udpHdr.DestinationPort() = %d, want = %d", got, testPort)
+	}
+	if !bytes.Equal(udpHdr.Payload(), payload) {
+		t.Errorf("got UDP payload = %x, want = %x", udpHdr.Payload(), payload)
+	}
+
+	// The packet is still emitted on the link.
+	c.getPacketAndVerify(unicastV4, checker.UDP(
+		checker.SrcPort(stackPort),
+		checker.DstPort(testPort),
+		checker.Payload(payload),
+	))
+}
+
+func TestPrependHeader(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			type headerPrepender interface {
+				SetPrependHeader([]byte)
+			}
+			ep, ok := c.ep.(headerPrepender)
+			if !ok {
+				t.Fatalf("%T does not implement SetPrependHeader", c.ep)
+			}
+
+			hdr := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+			ep.SetPrependHeader(hdr)
+			// The endpoint keeps its own copy of the header.
+			hdr[0] = 0xff
+
+			payload := testWriteNoVerify(c, flow, true /* setDest */)
+			want := append([]byte{1, 2, 3, 4, 5, 6, 7, 8}, payload...)
+			c.getPacketAndVerify(flow, checker.UDP(checker.Payload(want)))
+
+			// Clearing the header only affects subsequent writes.
+			ep.SetPrependHeader(nil)
+			payload = testWriteNoVerify(c, flow, true /* setDest */)
+			c.getPacketAndVerify(flow, checker.UDP(checker.Payload(payload)))
+		})
+	}
+}
+
+func TestReceiveLinkPriority(t *testing.T) {
+	const linkPriority = 5
+
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			read := func(enabled bool) tcpip.ControlMessages {
+				t.Helper()
+
+				c.ep.SocketOptions().SetReceiveLinkPriority(enabled)
+				h := flow.header4Tuple(incoming)
+				var b buffer.View
+				if flow.isV4() {
+					b = c.buildV4Packet(newPayload(), &h)
+				} else {
+					b = c.buildV6Packet(newPayload(), &h)
+				}
+				c.linkEP.InjectInbound(flow.netProto(), stack.NewPacketBuffer(stack.PacketBufferOptions{
+					Data:         b.ToVectorisedView(),
+					LinkPriority: linkPriority,
+				}))
+
+				var buf bytes.Buffer
+				res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
+				}
+				return res.ControlMessages
+			}
+
+			if cm := read(false); cm.HasLinkPriority {
+				t.Errorf("got cm.HasLinkPriority = true with the option disabled, want = false")
+			}
+			checker.ReceiveLinkPriority(linkPriority)(t, read(true))
+		})
+	}
+}
+
+func TestReceiveLinkSource(t *testing.T) {
+	const linkSource = tcpip.LinkAddress("\x02\x03\x04\x05\x06\x07")
+
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			read := func(enabled bool) tcpip.ControlMessages {
+				t.Helper()
+
+				c.ep.SocketOptions().SetReceiveLinkSource(enabled)
+				h := flow.header4Tuple(incoming)
+				var b buffer.View
+				if flow.isV4() {
+					b = c.buildV4Packet(newPayload(), &h)
+				} else {
+					b = c.buildV6Packet(newPayload(), &h)
+				}
+				c.linkEP.InjectInbound(flow.netProto(), stack.NewPacketBuffer(stack.PacketBufferOptions{
+					Data:       b.ToVectorisedView(),
+					LinkSource: linkSource,
+				}))
+
+				var buf bytes.Buffer
+				res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
+				}
+				return res.ControlMessages
+			}
+
+			if cm := read(false); cm.HasLinkSource {
+				t.Errorf("got cm.HasLinkSource = true with the option disabled, want = false")
+			}
+			checker.ReceiveLinkSource(linkSource)(t, read(true))
+		})
+	}
+}
+
+func TestReceiveWasFragmented(t *testing.T) {
+	// firstFragmentSize is the number of IP payload bytes carried by the first
+	// fragment. It must be a multiple of 8.
+	const firstFragmentSize = 16
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+	c.ep.SocketOptions().SetReceiveWasFragmented(true)
+
+	// fragment returns a fragment of the IPv4 packet b carrying the IP payload
+	// bytes in [start, end).
+	fragment := func(b buffer.View, start, end int, more bool) buffer.View {
+		ip := header.IPv4(b)
+		payload := ip.Payload()
+		frag := buffer.NewView(header.IPv4MinimumSize + end - start)
+		copy(frag, ip[:header.IPv4MinimumSize])
+		copy(frag[header.IPv4MinimumSize:], payload[start:end])
+
+		fragIP := header.IPv4(frag)
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		fragIP.SetFlagsFragmentOffset(flags, uint16(start))
+		fragIP.SetTotalLength(uint16(len(frag)))
+		fragIP.SetChecksum(0)
+		fragIP.SetChecksum(^fragIP.CalculateChecksum())
+		return frag
+	}
+
+	read := func(fragmented bool) {
+		t.Helper()
+
+		payload := newPayload()
+		h := unicastV4.header4Tuple(incoming)
+		b := c.buildV4Packet(payload, &h)
+		if fragmented {
+			header.IPv4(b).SetID(1)
+			payloadSize := len(b) - header.IPv4MinimumSize
+			c.injectRaw(ipv4.ProtocolNumber, fragment(b, 0, firstFragmentSize, true /* more */))
+			c.injectRaw(ipv4.ProtocolNumber, fragment(b, firstFragmentSize, payloadSize, false /* more */))
+		} else {
+			c.injectRaw(ipv4.ProtocolNumber, b)
+		}
+
+		var buf bytes.Buffer
+		res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if diff := cmp.Diff(payload, buf.Bytes()); diff != "" {
+			t.Errorf("payload mismatch (-want +got):\n%s", diff)
+		}
+		checker.ReceiveWasFragmented(fragmented)(t, res.ControlMessages)
+	}
+
+	read(false /* fragmented */)
+	read(true /* fragmented */)
+}
+
+func TestUseMinMTU(t *testing.T) {
+	const payloadSize = 2 * header.IPv6MinimumMTU
+
+	tests := []struct {
+		name          string
+		useMinMTU     int
+		dst           tcpip.Address
+		wantFragments bool
+	}{
+		{
+			name:          "default unicast",
+			useMinMTU:     tcpip.UseMinMTUMulticast,
+			dst:           testV6Addr,
+			wantFragments: false,
+		},
+		{
+			name:          "default multicast",
+			useMinMTU:     tcpip.UseMinMTUMulticast,
+			dst:           multicastV6Addr,
+			wantFragments: true,
+		},
+		{
+			name:          "never multicast",
+			useMinMTU:     tcpip.UseMinMTUNever,
+			dst:           multicastV6Addr,
+			wantFragments: false,
+		},
+		{
+			name:          "always unicast",
+			useMinMTU:     tcpip.UseMinMTUAlways,
+			dst:           testV6Addr,
+			wantFragments: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv6.ProtocolNumber)
+
+			if got, want := c.ep.SocketOptions().GetUseMinMTU(), tcpip.UseMinMTUMulticast; got != want {
+				t.Fatalf("got GetUseMinMTU() = %d, want = %d", got, want)
+			}
+			if err := c.ep.SocketOptions().SetUseMinMTU(test.useMinMTU); err != nil {
+				t.Fatalf("SetUseMinMTU(%d): %s", test.useMinMTU, err)
+			}
+
+			payload := buffer.NewView(payloadSize)
+			var r bytes.Reader
+			r.Reset(payload)
+			to := tcpip.FullAddress{Addr: test.dst, Port: testPort}
+			n, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to})
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			if n != int64(len(payload)) {
+				t.Fatalf("got Write(...) = %d, want = %d", n, len(payload))
+			}
+
+			var fragments int
+			for {
+				p, ok := c.linkEP.Read()
+				if !ok {
+					break
+				}
+				fragments++
+				vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+				b := vv.ToView()
+				if test.wantFragments {
+					if len(b) > header.IPv6MinimumMTU {
+						t.Errorf("got packet size = %d, want <= %d", len(b), header.IPv6MinimumMTU)
+					}
+					checker.IPv6(t, b, checker.DstAddr(test.dst), checker.IPv6Fragment())
+				} else {
+					checker.IPv6(t, b, checker.DstAddr(test.dst), checker.UDP(checker.DstPort(testPort)))
+				}
+			}
+
+			if test.wantFragments {
+				if fragments < 2 {
+					t.Errorf("got %d packets, want at least 2 fragments", fragments)
+				}
+			} else if fragments != 1 {
+				t.Errorf("got %d packets, want = 1", fragments)
+			}
+		})
+	}
+
+	t.Run("invalid value", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		c.createEndpoint(ipv6.ProtocolNumber)
+
+		if err := c.ep.SocketOptions().SetUseMinMTU(2); err == nil {
+			t.Fatal("SetUseMinMTU(2) succeeded, want error")
+		} else if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Fatalf("got SetUseMinMTU(2) = %s, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+		}
+	})
+}
+
+func TestIPv4ChecksumOffload(t *testing.T) {
+	for _, offload := range []bool{false, true} {
+		t.Run(fmt.Sprintf("offload=%t", offload), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				t.Fatalf("Bind failed: %s", err)
+			}
+			c.s.SetIPv4ChecksumOffload(offload)
+
+			write := func(to tcpip.FullAddress) {
+				t.Helper()
+				var r bytes.Reader
+				r.Reset(newPayload())
+				if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+					t.Fatalf("Write failed: %s", err)
+				}
+			}
+
+			write(tcpip.FullAddress{Addr: testAddr, Port: testPort})
+			p, ok := c.linkEP.Read()
+			if !ok {
+				t.Fatal("packet wasn't written out")
+			}
+			ip := header.IPv4(stack.PayloadSince(p.Pkt.NetworkHeader()))
+			if offload {
+				if got := ip.Checksum(); got != 0 {
+					t.Errorf("got ip.Checksum() = %#x, want = 0", got)
+				}
+			} else if !ip.IsChecksumValid() {
+				t.Errorf("got ip.IsChecksumValid() = false, want = true")
+			}
+
+			// Packets delivered locally are still received.
+			write(tcpip.FullAddress{Addr: stackAddr, Port: stackPort})
+			if _, err := c.ep.Read(ioutil.Discard, tcpip.ReadOptions{}); err != nil {
+				t.Errorf("Read of locally delivered packet failed: %s", err)
+			}
+
+			// Packets received from the link are still validated.
+			h := unicastV4.header4Tuple(incoming)
+			buf := c.buildV4Packet(newPayload(), &h)
+			header.IPv4(buf).SetChecksum(0)
+			malformed := c.s.Stats().IP.MalformedPacketsReceived.Value()
+			c.linkEP.InjectInbound(ipv4.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Data: buf.ToVectorisedView(),
+			}))
+			if got, want := c.s.Stats().IP.MalformedPacketsReceived.Value(), malformed+1; got != want {
+				t.Errorf("got MalformedPacketsReceived = %d, want = %d", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteFullLinkQueue(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              &faketime.NullClock{},
+	})
+	defer s.Close()
+
+	linkEP := channel.New(1, defaultMTU, "")
+	linkEP.ReportFullQueue = true
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	write := func() tcpip.Error {
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := ep.Write(&r, tcpip.WriteOptions{To: &to})
+		return err
+	}
+
+	if err := write(); err != nil {
+		t.Fatalf("first Write failed: %s", err)
+	}
+	if linkEP.Writable() {
+		t.Fatal("got linkEP.Writable() = true after filling the queue, want = false")
+	}
+	{
+		err := write()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got second Write() = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	if got := s.Stats().UDP.PacketsSent.Value(); got != 1 {
+		t.Errorf("got PacketsSent = %d, want = 1", got)
+	}
+	if got := ep.Readiness(waiter.WritableEvents); got != 0 {
+		t.Errorf("got ep.Readiness(WritableEvents) = %#x while the link is full, want = 0", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.WritableEvents)
+	defer wq.EventUnregister(&we)
+
+	// Draining the queue makes room for another write, and waiters are told
+	// that the endpoint is writable again.
+	if got := linkEP.Drain(); got != 1 {
+		t.Fatalf("got linkEP.Drain() = %d, want = 1", got)
+	}
+	if !linkEP.Writable() {
+		t.Fatal("got linkEP.Writable() = false after draining the queue, want = true")
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("waiter not notified after draining the queue")
+	}
+	if got, want := ep.Readiness(waiter.WritableEvents), waiter.WritableEvents; got != want {
+		t.Errorf("got ep.Readiness(WritableEvents) = %#x after draining the queue, want = %#x", got, want)
+	}
+	if err := write(); err != nil {
+		t.Fatalf("Write after drain failed: %s", err)
+	}
+}
+
+func TestWaitWritable(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              &faketime.NullClock{},
+	})
+	defer s.Close()
+
+	linkEP := channel.New(1, defaultMTU, "")
+	linkEP.ReportFullQueue = true
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+	waitEP := ep.(interface {
+		WaitWritable(context.Context) error
+	})
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	write := func() tcpip.Error {
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := ep.Write(&r, tcpip.WriteOptions{To: &to})
+		return err
+	}
+
+	if err := waitEP.WaitWritable(context.Background()); err != nil {
+		t.Fatalf("WaitWritable on an idle endpoint: %s", err)
+	}
+	if err := write(); err != nil {
+		t.Fatalf("first Write failed: %s", err)
+	}
+	{
+		err := write()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got second Write() = %v, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	if got := ep.Readiness(waiter.WritableEvents); got != 0 {
+		t.Fatalf("got Readiness(WritableEvents) = %x with a full link queue, want = 0", got)
+	}
+
+	// Cancelling the context while the queue is still full ends the wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- waitEP.WaitWritable(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got WaitWritable(_) = %v, want = %s", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for WaitWritable to return after cancellation")
+	}
+
+	// Reading a packet off the link makes the endpoint writable again.
+	if _, ok := linkEP.Read(); !ok {
+		t.Fatal("expected a packet on the link endpoint")
+	}
+	if err := waitEP.WaitWritable(context.Background()); err != nil {
+		t.Fatalf("WaitWritable after draining the link: %s", err)
+	}
+	if got := ep.Readiness(waiter.WritableEvents); got != waiter.WritableEvents {
+		t.Fatalf("got Readiness(WritableEvents) = %x, want = %x", got, waiter.WritableEvents)
+	}
+	if err := write(); err != nil {
+		t.Fatalf("Write after drain failed: %s", err)
+	}
+}
+
+func TestWritableEvents(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              &faketime.NullClock{},
+	})
+	defer s.Close()
+
+	linkEP := channel.New(2, defaultMTU, "")
+	linkEP.ReportFullQueue = true
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.WritableEvents)
+	defer wq.EventUnregister(&we)
+	notified := func() bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	write := func() tcpip.Error {
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := ep.Write(&r, tcpip.WriteOptions{To: &to})
+		return err
+	}
+
+	// Fill the link queue until writes block.
+	for i := 0; i < 2; i++ {
+		if err := write(); err != nil {
+			t.Fatalf("Write #%d failed: %s", i, err)
+		}
+	}
+	{
+		err := write()
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got Write() = %v with a full link queue, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	if notified() {
+		t.Fatal("got a writable event while the link queue is full")
+	}
+	if got := ep.Readiness(waiter.WritableEvents); got != 0 {
+		t.Fatalf("got Readiness(WritableEvents) = %x with a full link queue, want = 0", got)
+	}
+
+	// Draining a single packet wakes the waiter.
+	if _, ok := linkEP.Read(); !ok {
+		t.Fatal("expected a packet on the link endpoint")
+	}
+	if !notified() {
+		t.Fatal("got no writable event after draining a packet")
+	}
+	if got := ep.Readiness(waiter.WritableEvents); got != waiter.WritableEvents {
+		t.Fatalf("got Readiness(WritableEvents) = %x, want = %x", got, waiter.WritableEvents)
+	}
+
+	// Draining more packets doesn't notify again until writes block again.
+	if _, ok := linkEP.Read(); !ok {
+		t.Fatal("expected a packet on the link endpoint")
+	}
+	if notified() {
+		t.Fatal("got a writable event while the endpoint was not blocked")
+	}
+}
+
+func TestLinkReordering(t *testing.T) {
+	const numPackets = 10
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	c.linkEP.SetReorderProbability(0.5, 1 /* seed */)
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	var want []byte
+	for i := 0; i < numPackets; i++ {
+		var r bytes.Reader
+		r.Reset([]byte{byte(i)})
+		if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+			t.Fatalf("Write #%d failed: %s", i, err)
+		}
+		want = append(want, byte(i))
+	}
+
+	var got []byte
+	for {
+		p, ok := c.linkEP.Read()
+		if !ok {
+			break
+		}
+		v := stack.PayloadSince(p.Pkt.NetworkHeader())
+		got = append(got, header.UDP(header.IPv4(v).Payload()).Payload()...)
+	}
+
+	if bytes.Equal(got, want) {
+		t.Errorf("got datagrams in write order %v with reordering enabled", got)
+	}
+	sorted := append([]byte(nil), got...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if diff := cmp.Diff(want, sorted); diff != "" {
+		t.Errorf("delivered datagrams mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLinkReorderingReadContext(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	// Every packet written while none is delayed is delayed.
+	c.linkEP.SetReorderProbability(1, 1 /* seed */)
+
+	// A blocked reader is handed a delayed packet even if no other packet
+	// follows it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch := make(chan bool)
+	go func() {
+		_, ok := c.linkEP.ReadContext(ctx)
+		ch <- ok
+	}()
+	testWriteNoVerify(c, unicastV4, true /* setDest */)
+	if ok := <-ch; !ok {
+		t.Error("got ReadContext(...) = false, want the delayed packet")
+	}
+}
+
+func TestLinkReorderingFullQueue(t *testing.T) {
+	const queueSize = 2
+
+	ep := channel.New(queueSize, defaultMTU, "")
+	ep.ReportFullQueue = true
+	ep.SetReorderProbability(1, 1 /* seed */)
+
+	write := func(i byte) tcpip.Error {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buffer.View([]byte{i}).ToVectorisedView(),
+		})
+		return ep.WritePacket(stack.RouteInfo{}, ipv4.ProtocolNumber, pkt)
+	}
+	// read reads n packets. Reading from an empty queue releases the delayed
+	// packet.
+	read := func(n int) []byte {
+		var got []byte
+		for i := 0; i < n; i++ {
+			p, ok := ep.Read()
+			if !ok {
+				break
+			}
+			got = append(got, p.Pkt.Data().AsRange().ToOwnedView()...)
+		}
+		return got
+	}
+
+	for i := byte(0); i < 3; i++ {
+		if err := write(i); err != nil {
+			t.Fatalf("write(%d): %s", i, err)
+		}
+	}
+	// Packet 2 is delayed and the queue only has room for packet 3, so the
+	// write must fail rather than drop packet 2 once packet 3 is queued.
+	{
+		err := write(3)
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Fatalf("got write(3) = %v with a full queue, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+	if diff := cmp.Diff([]byte{1, 0}, read(2)); diff != "" {
+		t.Errorf("packets mismatch (-want +got):\n%s", diff)
+	}
+	if err := write(3); err != nil {
+		t.Fatalf("write(3): %s", err)
+	}
+	if diff := cmp.Diff([]byte{3, 2}, read(3)); diff != "" {
+		t.Errorf("packets mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLinkLoss(t *testing.T) {
+	const numPackets = 100
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	c.linkEP.SetLossProbability(0.5, 1 /* seed */)
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	for i := 0; i < numPackets; i++ {
+		var r bytes.Reader
+		r.Reset(newPayload())
+		if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+			t.Fatalf("Write #%d failed: %s", i, err)
+		}
+	}
+
+	delivered := c.linkEP.Drain()
+	if delivered < numPackets/4 || delivered > numPackets*3/4 {
+		t.Errorf("got %d of %d packets delivered with 50%% loss, want roughly half", delivered, numPackets)
+	}
+	if got, want := c.linkEP.Lost(), uint64(numPackets-delivered); got != want {
+		t.Errorf("got linkEP.Lost() = %d, want = %d", got, want)
+	}
+}
+
+func TestIPv6Jumbogram(t *testing.T) {
+	const (
+		jumboMTU    = 80000
+		payloadSize = 70000
+	)
+
+	c := newDualTestContext(t, jumboMTU)
+	defer c.cleanup()
+
+	// The network MTU stays capped to what the Payload Length field can hold
+	// so that other protocols, e.g. TCP's MSS, never exceed it.
+	route, err := c.s.FindRoute(1, "", testV6Addr, ipv6.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(...): %s", err)
+	}
+	if got, want := route.MTU(), uint32(math.MaxUint16); got != want {
+		t.Errorf("got route.MTU() = %d, want = %d", got, want)
+	}
+	route.Release()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	payload := bytes.Repeat([]byte{0xAB}, payloadSize)
+	to := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+	var r bytes.Reader
+	r.Reset(payload)
+	if n, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	} else if n != payloadSize {
+		t.Fatalf("got c.ep.Write(...) = %d, want = %d", n, payloadSize)
+	}
+
+	p, ok := c.linkEP.Read()
+	if !ok {
+		t.Fatal("Packet wasn't written out")
+	}
+	vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+	b := vv.ToView()
+	if _, ok := c.linkEP.Read(); ok {
+		t.Fatal("got more than one packet, want a single jumbogram")
+	}
+
+	ip := header.IPv6(b)
+	if got := ip.PayloadLength(); got != 0 {
+		t.Errorf("got PayloadLength() = %d, want = 0", got)
+	}
+	if got, want := ip.NextHeader(), uint8(header.IPv6HopByHopOptionsExtHdrIdentifier); got != want {
+		t.Fatalf("got NextHeader() = %d, want = %d", got, want)
+	}
+
+	// The Hop-by-Hop Options header only carries the Jumbo Payload option.
+	hbh := b[header.IPv6MinimumSize:][:header.IPv6JumboPayloadExtHdrLength]
+	if got, want := hbh[0], uint8(header.UDPProtocolNumber); got != want {
+		t.Errorf("got Hop-by-Hop next header = %d, want = %d", got, want)
+	}
+	if got := hbh[1]; got != 0 {
+		t.Errorf("got Hop-by-Hop length = %d, want = 0", got)
+	}
+	if got, want := hbh[2:4], []byte{0xC2, 4}; !bytes.Equal(got, want) {
+		t.Errorf("got Jumbo Payload option type and length = %x, want = %x", got, want)
+	}
+	if got, want := binary.BigEndian.Uint32(hbh[4:]), uint32(len(b)-header.IPv6MinimumSize); got != want {
+		t.Errorf("got Jumbo Payload Length = %d, want = %d", got, want)
+	}
+
+	udpBytes := b[header.IPv6MinimumSize+header.IPv6JumboPayloadExtHdrLength:]
+	udpHdr := header.UDP(udpBytes)
+	if got := udpHdr.Length(); got != 0 {
+		t.Errorf("got UDP Length() = %d, want = 0", got)
+	}
+	if got, want := udpHdr.DestinationPort(), uint16(testPort); got != want {
+		t.Errorf("got DestinationPort() = %d, want = %d", got, want)
+	}
+	if !bytes.Equal(udpHdr.Payload(), payload) {
+		t.Errorf("got payload of %d bytes, want the %d bytes written", len(udpHdr.Payload()), payloadSize)
+	}
+	// The pseudo-header carries the full 32-bit upper-layer length.
+	udpLen := len(udpBytes)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(udpLen))
+	xsum = header.ChecksumCombine(xsum, uint16(udpLen>>16))
+	if got := header.Checksum(udpBytes, xsum); got != 0xffff {
+		t.Errorf("got checksum sum = %#x, want = 0xffff", got)
+	}
+
+}
+
+func TestIPv6JumbogramNeedsJumboLink(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	to := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+	var r bytes.Reader
+	r.Reset(make([]byte, 70000))
+	{
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to})
+		if _, ok := err.(*tcpip.ErrMessageTooLong); !ok {
+			t.Errorf("got c.ep.Write(...) = %s, want = %s", err, &tcpip.ErrMessageTooLong{})
+		}
+	}
+	if got := c.linkEP.Drain(); got != 0 {
+		t.Errorf("got %d packets written, want = 0", got)
+	}
+}
+
+// TestJumboLinkOnlyExemptsIPv6Routes checks that a link that can carry
+// jumbograms only lifts the payload size limit of IPv6 datagrams sent over
+// it.
+func TestJumboLinkOnlyExemptsIPv6Routes(t *testing.T) {
+	const (
+		jumboMTU = 80000
+		maxV4    = 65507
+	)
+
+	for _, test := range []struct {
+		name     string
+		mtu      uint32
+		netProto tcpip.NetworkProtocolNumber
+		// connect is the address the endpoint is connected to. If it is
+		// empty, the endpoint writes to to instead.
+		connect tcpip.Address
+		to      tcpip.Address
+		size    int
+		// jumboNIC adds a second NIC that can carry jumbograms, which the
+		// route doesn't go out of.
+		jumboNIC bool
+	}{
+		{
+			name:     "IPv4 over a jumbo link",
+			mtu:      jumboMTU,
+			netProto: ipv4.ProtocolNumber,
+			to:       testAddr,
+			size:     maxV4 + 1,
+		},
+		{
+			name:     "v4-mapped peer over a jumbo link",
+			mtu:      jumboMTU,
+			netProto: ipv6.ProtocolNumber,
+			to:       testV4MappedAddr,
+			size:     maxV4 + 1,
+		},
+		{
+			name:     "connected v4-mapped peer over a jumbo link",
+			mtu:      jumboMTU,
+			netProto: ipv6.ProtocolNumber,
+			connect:  testV4MappedAddr,
+			size:     maxV4 + 1,
+		},
+		{
+			name:     "IPv6 with a jumbo link on another NIC",
+			mtu:      defaultMTU,
+			netProto: ipv6.ProtocolNumber,
+			to:       testV6Addr,
+			size:     70000,
+			jumboNIC: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, test.mtu)
+			defer c.cleanup()
+
+			if test.jumboNIC {
+				if err := c.s.CreateNIC(2, channel.New(1, jumboMTU, "")); err != nil {
+					t.Fatalf("CreateNIC(2, _): %s", err)
+				}
+			}
+
+			c.createEndpoint(test.netProto)
+			var opts tcpip.WriteOptions
+			if test.connect != "" {
+				if err := c.ep.Connect(tcpip.FullAddress{Addr: test.connect, Port: testPort}); err != nil {
+					t.Fatalf("Connect failed: %s", err)
+				}
+			} else {
+				opts.To = &tcpip.FullAddress{Addr: test.to, Port: testPort}
+				if !test.jumboNIC {
+					// Payloads that can't be sent over any route must be
+					// rejected before the route is resolved.
+					c.s.SetRouteTable(nil)
+				}
+			}
+
+			// The payload must be rejected by the endpoint, not by the
+			// network layer once the datagram was built.
+			var detail tcpip.WriteResult
+			opts.WantDetail = &detail
+			epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+			var r bytes.Reader
+			r.Reset(make([]byte, test.size))
+			_, err := c.ep.Write(&r, opts)
+			c.checkEndpointWriteStats(1, epstats, err)
+			if _, ok := err.(*tcpip.ErrMessageTooLong); !ok {
+				t.Errorf("got c.ep.Write(...) = %v, want = %s", err, &tcpip.ErrMessageTooLong{})
+			}
+			if got, want := detail.FailedStage, tcpip.WriteStagePrepare; got != want {
+				t.Errorf("got FailedStage = %d, want = %d", got, want)
+			}
+			if got := c.linkEP.Drain(); got != 0 {
+				t.Errorf("got %d packets written, want = 0", got)
+			}
+		})
+	}
+}
+
+func TestDeterministicRandSource(t *testing.T) {
+	const (
+		nicID    = 1
+		seed     = 42
+		numPorts = 5
+	)
+
+	// run returns the ephemeral ports picked for numPorts endpoints and the
+	// IPv4 identification of the first packet sent by a stack seeded with
+	// seed.
+	run := func(t *testing.T) ([]uint16, uint16) {
+		t.Helper()
+
+		s := stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+			Clock:              &faketime.NullClock{},
+			RandSource:         rand.NewSource(seed),
+		})
+		defer s.Close()
+
+		linkEP := channel.New(1, defaultMTU, "")
+		if err := s.CreateNIC(nicID, linkEP); err != nil {
+			t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+		}
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+		}
+		if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+			t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+		var ports []uint16
+		for i := 0; i < numPorts; i++ {
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %s", err)
+			}
+			defer ep.Close()
+
+			if i == 0 {
+				// Sending binds the endpoint to an ephemeral port.
+				var r bytes.Reader
+				r.Reset(newPayload())
+				if _, err := ep.Write(&r, tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: testAddr, Port: testPort}}); err != nil {
+					t.Fatalf("Write failed: %s", err)
+				}
+			} else if err := ep.Bind(tcpip.FullAddress{}); err != nil {
+				t.Fatalf("Bind failed: %s", err)
+			}
+			addr, err := ep.GetLocalAddress()
+			if err != nil {
+				t.Fatalf("GetLocalAddress failed: %s", err)
+			}
+			ports = append(ports, addr.Port)
+		}
+
+		p, ok := linkEP.Read()
+		if !ok {
+			t.Fatal("packet wasn't written out")
+		}
+		return ports, header.IPv4(stack.PayloadSince(p.Pkt.NetworkHeader())).ID()
+	}
+
+	ports1, id1 := run(t)
+	ports2, id2 := run(t)
+	if diff := cmp.Diff(ports1, ports2); diff != "" {
+		t.Errorf("ephemeral ports mismatch between identically seeded stacks (-first +second):\n%s", diff)
+	}
+	if id1 != id2 {
+		t.Errorf("got IPv4 IDs %d and %d from identically seeded stacks, want equal", id1, id2)
+	}
+}
+
+func TestTxTimestamp(t *testing.T) {
+	const nicID = 1
+
+	clock := faketime.NewManualClock()
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              clock,
+	})
+	defer s.Close()
+
+	linkEP := channel.New(256, defaultMTU, "")
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %s", err)
+	}
+	defer ep.Close()
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	write := func(payload []byte) {
+		t.Helper()
+		var r bytes.Reader
+		r.Reset(payload)
+		if _, err := ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	// No timestamp is reported while the option is disabled.
+	write(newPayload())
+	if sockErr := ep.SocketOptions().DequeueErr(); sockErr != nil {
+		t.Fatalf("got DequeueErr() = %#v with TX timestamping disabled, want = nil", sockErr)
+	}
+
+	if got := linkEP.Drain(); got != 1 {
+		t.Fatalf("got linkEP.Drain() = %d, want = 1", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventErr)
+	defer wq.EventUnregister(&we)
+
+	ep.SocketOptions().SetTxTimestamp(true)
+	clock.Advance(5 * time.Second)
+	wantTimestamp := clock.Now()
+	payload := newPayload()
+	write(payload)
+
+	// Waiters are told that the error queue has an entry.
+	select {
+	case <-ch:
+	default:
+		t.Fatal("waiter not notified of the TX timestamp")
+	}
+	if got := ep.Readiness(waiter.EventErr); got != waiter.EventErr {
+		t.Errorf("got ep.Readiness(EventErr) = %#x, want = %#x", got, waiter.EventErr)
+	}
+
+	// The reported payload doesn't share memory with the packet sent.
+	pkt, ok := linkEP.Read()
+	if !ok {
+		t.Fatal("packet wasn't written out")
+	}
+	for _, v := range pkt.Pkt.Data().Views() {
+		for i := range v {
+			v[i] = ^v[i]
+		}
+	}
+
+	// Time passing after the write must not affect the reported timestamp.
+	clock.Advance(time.Second)
+
+	// The timestamp is read the way recvmsg(MSG_ERRQUEUE) reads it.
+	sockErr := ep.SocketOptions().DequeueErrAndUpdateLastError()
+	if sockErr == nil {
+		t.Fatal("got DequeueErrAndUpdateLastError() = nil, want TX timestamp")
+	}
+	if _, ok := sockErr.Err.(*tcpip.ErrNoMessage); !ok {
+		t.Errorf("got sockErr.Err = %v, want = %s", sockErr.Err, &tcpip.ErrNoMessage{})
+	}
+	if got, want := sockErr.Cause.Origin(), tcpip.SockExtErrorOriginTimestamping; got != want {
+		t.Errorf("got sockErr.Cause.Origin() = %d, want = %d", got, want)
+	}
+	if !sockErr.Timestamp.Equal(wantTimestamp) {
+		t.Errorf("got sockErr.Timestamp = %s, want = %s", sockErr.Timestamp, wantTimestamp)
+	}
+	if !bytes.Equal(sockErr.Payload, payload) {
+		t.Errorf("got sockErr.Payload = %x, want = %x", sockErr.Payload, payload)
+	}
+	if diff := cmp.Diff(to, sockErr.Dst); diff != "" {
+		t.Errorf("sockErr.Dst mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := sockErr.NetProto, ipv4.ProtocolNumber; got != want {
+		t.Errorf("got sockErr.NetProto = %d, want = %d", got, want)
+	}
+	if err := ep.LastError(); err != nil {
+		t.Errorf("got ep.LastError() = %s after dequeuing a TX timestamp, want = nil", err)
+	}
+	if sockErr := ep.SocketOptions().DequeueErrAndUpdateLastError(); sockErr != nil {
+		t.Errorf("got DequeueErrAndUpdateLastError() = %#v after dequeuing the only timestamp, want = nil", sockErr)
+	}
+}
+
+func TestPayloadChecker(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+
+	payload := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	var r bytes.Reader
+	r.Reset(payload)
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	b := c.getPacketAndVerify(unicastV4, checker.UDP(checker.Payload(payload)))
+	udpH := header.UDP(header.IPv4(b).Payload())
+
+	// A payload differing by a single byte must be reported. The checker is
+	// run against a separate testing.T so that the expected failure doesn't
+	// fail this test.
+	want := append([]byte(nil), payload...)
+	want[len(want)-1]++
+	var mismatchT testing.T
+	checker.Payload(want)(&mismatchT, udpH)
+	if !mismatchT.Failed() {
+		t.Errorf("checker.Payload(%v) accepted payload %v", want, []byte(udpH.Payload()))
+	}
+}
+
+func TestWriteOversizedPayload(t *testing.T) {
+	for _, tc := range []struct {
+		flow    testFlow
+		maxSize int
+	}{
+		{flow: unicastV4, maxSize: 65507},
+		{flow: unicastV4in6, maxSize: 65507},
+		{flow: unicastV6, maxSize: 65527},
+	} {
+		t.Run(tc.flow.String(), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(tc.flow)
+			h := tc.flow.header4Tuple(outgoing)
+			to := tcpip.FullAddress{Addr: tc.flow.mapAddrIfApplicable(h.dstAddr.Addr), Port: h.dstAddr.Port}
+			write := func(size int) tcpip.Error {
+				var r bytes.Reader
+				r.Reset(make([]byte, size))
+				_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to})
+				return err
+			}
+
+			// The largest payload that fits in a datagram is sent.
+			if err := write(tc.maxSize); err != nil {
+				t.Fatalf("Write of %d bytes failed: %s", tc.maxSize, err)
+			}
+			if got := c.linkEP.Drain(); got == 0 {
+				t.Fatalf("got c.linkEP.Drain() = 0 after writing %d bytes, want > 0", tc.maxSize)
+			}
+
+			// Remove all routes so that any route lookup fails; oversized
+			// payloads must be rejected before the route is resolved.
+			c.s.SetRouteTable(nil)
+			for _, size := range []int{tc.maxSize + 1, 70000} {
+				epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+				err := write(size)
+				c.checkEndpointWriteStats(1, epstats, err)
+				if _, ok := err.(*tcpip.ErrMessageTooLong); !ok {
+					t.Errorf("got Write of %d bytes = %v, want = %s", size, err, &tcpip.ErrMessageTooLong{})
+				}
+			}
+			if got := c.linkEP.Drain(); got != 0 {
+				t.Errorf("got c.linkEP.Drain() = %d after oversized writes, want = 0", got)
+			}
+		})
+	}
+}
+
+func TestWriteIPv6RoutingHeader(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	write := func(flow testFlow, rh tcpip.IPv6RoutingHeader) ([]byte, tcpip.Error) {
+		h := flow.header4Tuple(outgoing)
+		to := tcpip.FullAddress{Addr: flow.mapAddrIfApplicable(h.dstAddr.Addr), Port: h.dstAddr.Port}
+		payload := newPayload()
+		var r bytes.Reader
+		r.Reset(payload)
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, IPv6RoutingHeader: &rh})
+		return payload, err
+	}
+
+	// Type 0 routing headers are deprecated.
+	{
+		epstats := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
+		_, err := write(unicastV6, tcpip.IPv6RoutingHeader{RoutingType: 0})
+		c.checkEndpointWriteStats(1, epstats, err)
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got Write with type 0 routing header = %v, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+		}
+	}
+
+	// Routing headers can't be sent over IPv4.
+	{
+		_, err := write(unicastV4in6, tcpip.IPv6RoutingHeader{RoutingType: 4})
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got Write with routing header to v4 mapped address = %v, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+		}
+	}
+	if got := c.linkEP.Drain(); got != 0 {
+		t.Fatalf("got c.linkEP.Drain() = %d after rejected writes, want = 0", got)
+	}
+
+	rh := tcpip.IPv6RoutingHeader{
+		RoutingType:  4,
+		SegmentsLeft: 0,
+		Data:         []byte{1, 2, 3, 4, 5, 6},
+	}
+	payload, err := write(unicastV6, rh)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	p, ok := c.linkEP.Read()
+	if !ok {
+		t.Fatal("packet wasn't written out")
+	}
+	ip := header.IPv6(stack.PayloadSince(p.Pkt.NetworkHeader()))
+	if got, want := ip.NextHeader(), uint8(header.IPv6RoutingExtHdrIdentifier); got != want {
+		t.Fatalf("got ip.NextHeader() = %d, want = %d", got, want)
+	}
+
+	// The 4 fixed bytes and 6 data bytes are padded to 16 bytes.
+	const routingHdrLen = 16
+	ext := ip.Payload()
+	if got, want := int(ip.PayloadLength()), routingHdrLen+header.UDPMinimumSize+len(payload); got != want {
+		t.Errorf("got ip.PayloadLength() = %d, want = %d", got, want)
+	}
+	wantExt := []byte{
+		uint8(header.UDPProtocolNumber), 1, rh.RoutingType, rh.SegmentsLeft,
+		1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0,
+	}
+	if diff := cmp.Diff(wantExt, []byte(ext[:routingHdrLen])); diff != "" {
+		t.Errorf("routing header mismatch (-want +got):\n%s", diff)
+	}
+
+	udpHdr := header.UDP(ext[routingHdrLen:])
+	if got, want := int(udpHdr.Length()), header.UDPMinimumSize+len(payload); got != want {
+		t.Errorf("got udpHdr.Length() = %d, want = %d", got, want)
+	}
+	if !bytes.Equal(udpHdr.Payload(), payload) {
+		t.Errorf("got UDP payload = %x, want = %x", udpHdr.Payload(), payload)
+	}
+	if !udpHdr.IsChecksumValid(ip.SourceAddress(), ip.DestinationAddress(), header.Checksum(udpHdr.Payload(), 0)) {
+		t.Error("got udpHdr.IsChecksumValid() = false, want = true")
+	}
+}
+
+func TestWriteIPv6RoutingHeaderSegmentsLeft(t *testing.T) {
+	const finalDst = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x99")
+
+	// A Segment Routing header whose Segment List[0], the final segment,
+	// follows the Last Entry, Flags and Tag fields.
+	rh := tcpip.IPv6RoutingHeader{
+		RoutingType:  4,
+		SegmentsLeft: 1,
+		Data:         append([]byte{1, 0, 0, 0}, append([]byte(finalDst), []byte(testV6Addr)...)...),
+	}
+	routingHdrLen := 4 + len(rh.Data)
+
+	tests := []struct {
+		name      string
+		useMinMTU int
+		// payloadSize is the size of the UDP payload to write.
+		payloadSize   int
+		wantFragments bool
+	}{
+		{
+			name:          "unfragmented",
+			useMinMTU:     tcpip.UseMinMTUNever,
+			payloadSize:   100,
+			wantFragments: false,
+		},
+		{
+			name:          "fragmented",
+			useMinMTU:     tcpip.UseMinMTUAlways,
+			payloadSize:   2 * header.IPv6MinimumMTU,
+			wantFragments: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv6.ProtocolNumber)
+			if err := c.ep.SocketOptions().SetUseMinMTU(test.useMinMTU); err != nil {
+				t.Fatalf("SetUseMinMTU(%d): %s", test.useMinMTU, err)
+			}
+
+			payload := newMinPayload(test.payloadSize)
+			var r bytes.Reader
+			r.Reset(payload)
+			to := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+			if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, IPv6RoutingHeader: &rh}); err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			// Reassemble the UDP datagram while checking that the routing
+			// header precedes any Fragment header in every packet.
+			var (
+				src       tcpip.Address
+				datagram  []byte
+				fragments int
+			)
+			for {
+				p, ok := c.linkEP.Read()
+				if !ok {
+					break
+				}
+				fragments++
+				ip := header.IPv6(stack.PayloadSince(p.Pkt.NetworkHeader()))
+				if got, want := ip.DestinationAddress(), tcpip.Address(testV6Addr); got != want {
+					t.Errorf("got ip.DestinationAddress() = %s, want = %s", got, want)
+				}
+				if got, want := ip.NextHeader(), uint8(header.IPv6RoutingExtHdrIdentifier); got != want {
+					t.Fatalf("got ip.NextHeader() = %d, want = %d", got, want)
+				}
+				src = ip.SourceAddress()
+				ext := ip.Payload()
+				if !test.wantFragments {
+					if got, want := ext[0], uint8(header.UDPProtocolNumber); got != want {
+						t.Fatalf("got routing header Next Header = %d, want = %d", got, want)
+					}
+					datagram = append(datagram, ext[routingHdrLen:]...)
+					continue
+				}
+				if got, want := ext[0], uint8(header.IPv6FragmentExtHdrIdentifier); got != want {
+					t.Fatalf("got routing header Next Header = %d, want = %d", got, want)
+				}
+				frag := ext[routingHdrLen:]
+				if got, want := frag[0], uint8(header.UDPProtocolNumber); got != want {
+					t.Fatalf("got fragment header Next Header = %d, want = %d", got, want)
+				}
+				var fragHdr header.IPv6FragmentExtHdr
+				copy(fragHdr[:], frag[2:header.IPv6FragmentExtHdrLength])
+				if got, want := int(fragHdr.FragmentOffset())*header.IPv6FragmentExtHdrFragmentOffsetBytesPerUnit, len(datagram); got != want {
+					t.Fatalf("got fragment offset = %d, want = %d", got, want)
+				}
+				datagram = append(datagram, frag[header.IPv6FragmentExtHdrLength:]...)
+			}
+
+			if test.wantFragments {
+				if fragments < 2 {
+					t.Errorf("got %d packets, want at least 2 fragments", fragments)
+				}
+			} else if fragments != 1 {
+				t.Errorf("got %d packets, want = 1", fragments)
+			}
+
+			udpHdr := header.UDP(datagram)
+			if !bytes.Equal(udpHdr.Payload(), payload) {
+				t.Fatalf("got UDP payload = %x, want = %x", udpHdr.Payload(), payload)
+			}
+			xsum := header.Checksum(udpHdr.Payload(), 0)
+			if !udpHdr.IsChecksumValid(src, finalDst, xsum) {
+				t.Error("got udpHdr.IsChecksumValid(_, finalDst, _) = false, want = true")
+			}
+		})
+	}
+
+	t.Run("no final destination", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		c.createEndpoint(ipv6.ProtocolNumber)
+
+		var r bytes.Reader
+		r.Reset(newPayload())
+		to := tcpip.FullAddress{Addr: testV6Addr, Port: testPort}
+		short := tcpip.IPv6RoutingHeader{RoutingType: 4, SegmentsLeft: 1, Data: []byte{1, 2, 3, 4}}
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, IPv6RoutingHeader: &short})
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got Write with truncated routing header = %v, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+		}
+	})
+}
+
+func TestWriteIPv4Options(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        tcpip.IPv4WriteOptions
+		wantOptions header.IPv4Options
+	}{
+		{
+			name: "record route",
+			opts: tcpip.IPv4WriteOptions{RecordRouteSlots: 2},
+			wantOptions: header.IPv4Options{
+				uint8(header.IPv4OptionRecordRouteType), 11, 4,
+				0, 0, 0, 0,
+				0, 0, 0, 0,
+				// Padding.
+				0,
+			},
+		},
+		{
+			name: "timestamp",
+			opts: tcpip.IPv4WriteOptions{TimestampSlots: 2},
+			wantOptions: header.IPv4Options{
+				uint8(header.IPv4OptionTimestampType), 12, 5, uint8(header.IPv4OptionTimestampOnlyFlag),
+				0, 0, 0, 0,
+				0, 0, 0, 0,
+			},
+		},
+		{
+			name: "record route and timestamp",
+			opts: tcpip.IPv4WriteOptions{RecordRouteSlots: 1, TimestampSlots: 1},
+			wantOptions: header.IPv4Options{
+				uint8(header.IPv4OptionRecordRouteType), 7, 4,
+				0, 0, 0, 0,
+				uint8(header.IPv4OptionTimestampType), 8, 5, uint8(header.IPv4OptionTimestampOnlyFlag),
+				0, 0, 0, 0,
+				// Padding.
+				0,
+			},
 		},
 	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv6.ProtocolNumber)
+
+			write := func(flow testFlow, opts tcpip.IPv4WriteOptions) ([]byte, tcpip.Error) {
+				h := flow.header4Tuple(outgoing)
+				to := tcpip.FullAddress{Addr: flow.mapAddrIfApplicable(h.dstAddr.Addr), Port: h.dstAddr.Port}
+				payload := newPayload()
+				var r bytes.Reader
+				r.Reset(payload)
+				_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, IPv4Options: &opts})
+				return payload, err
+			}
+
+			// IPv4 options can't be sent over IPv6.
+			{
+				_, err := write(unicastV6, test.opts)
+				if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+					t.Errorf("got Write with IPv4 options to IPv6 address = %v, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+				}
+			}
+			if got := c.linkEP.Drain(); got != 0 {
+				t.Fatalf("got c.linkEP.Drain() = %d after rejected writes, want = 0", got)
+			}
+
+			payload, err := write(unicastV4in6, test.opts)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			c.getPacketAndVerify(unicastV4in6,
+				checker.IPv4HeaderLength(header.IPv4MinimumSize+len(test.wantOptions)),
+				checker.IPv4Options(test.wantOptions),
+				checker.UDP(checker.Payload(payload)),
+			)
+		})
+	}
+}
+
+func TestWriteIPv4OptionsTooLarge(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+
+	// 3 bytes of header and 40 bytes of addresses exceed the 40 bytes
+	// available for options.
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	var r bytes.Reader
+	r.Reset(newPayload())
+	_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, IPv4Options: &tcpip.IPv4WriteOptions{RecordRouteSlots: 10}})
+	if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+		t.Errorf("got Write with oversized IPv4 options = %v, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+	}
+	if got := c.linkEP.Drain(); got != 0 {
+		t.Fatalf("got c.linkEP.Drain() = %d after rejected write, want = 0", got)
+	}
+}
+
+func TestWriteSourcePort(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpointForFlow(unicastV4)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+	write := func(srcPort uint16) tcpip.Error {
+		var r bytes.Reader
+		r.Reset(newPayload())
+		_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to, SourcePort: srcPort})
+		return err
+	}
+
+	if err := write(stackPort); err != nil {
+		t.Fatalf("Write with SourcePort = %d failed: %s", stackPort, err)
+	}
+	c.getPacketAndVerify(unicastV4, checker.UDP(checker.SrcPort(stackPort)))
+
+	// Ports not reserved by the endpoint are rejected.
+	{
+		err := write(stackPort + 1)
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Fatalf("got Write with SourcePort = %d = %v, want = %s", stackPort+1, err, &tcpip.ErrInvalidOptionValue{})
+		}
+	}
+	if p, ok := c.linkEP.Read(); ok {
+		t.Fatalf("got unexpected packet = %#v", p)
+	}
+}
+
+func TestNoChecksum(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			// Disable the checksum generation.
+			c.ep.SocketOptions().SetNoChecksum(true)
+			// This option is effective on IPv4 only.
+			testWrite(c, flow, checker.UDP(checker.NoChecksum(flow.isV4())))
+
+			// Enable the checksum generation.
+			c.ep.SocketOptions().SetNoChecksum(false)
+			testWrite(c, flow, checker.UDP(checker.NoChecksum(false)))
+		})
+	}
+}
+
+var _ stack.NetworkInterface = (*testInterface)(nil)
+
+type testInterface struct {
+	stack.NetworkInterface
+}
+
+func (*testInterface) ID() tcpip.NICID {
+	return 0
+}
+
+func (*testInterface) Enabled() bool {
+	return true
+}
+
+func TestTTL(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, unicastV6Only, multicastV4, multicastV4in6, multicastV6, broadcast, broadcastIn6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			const multicastTTL = 42
+			if err := c.ep.SetSockOptInt(tcpip.MulticastTTLOption, multicastTTL); err != nil {
+				c.t.Fatalf("SetSockOptInt failed: %s", err)
+			}
+
+			var wantTTL uint8
+			if flow.isMulticast() {
+				wantTTL = multicastTTL
+			} else {
+				var p stack.NetworkProtocolFactory
+				var n tcpip.NetworkProtocolNumber
+				if flow.isV4() {
+					p = ipv4.NewProtocol
+					n = ipv4.ProtocolNumber
+				} else {
+					p = ipv6.NewProtocol
+					n = ipv6.ProtocolNumber
+				}
+				s := stack.New(stack.Options{
+					NetworkProtocols: []stack.NetworkProtocolFactory{p},
+					Clock:            &faketime.NullClock{},
+				})
+				ep := s.NetworkProtocolInstance(n).NewEndpoint(&testInterface{}, nil)
+				wantTTL = ep.DefaultTTL()
+				ep.Close()
+			}
+
+			testWrite(c, flow, checker.TTL(wantTTL))
+		})
+	}
+}
+
+func TestNICMulticastTTL(t *testing.T) {
+	const (
+		nicTTL      = 5
+		endpointTTL = 42
+	)
+
+	tests := []struct {
+		name        string
+		setNIC      bool
+		setEndpoint bool
+		wantTTL     uint8
+	}{
+		{name: "protocol default", wantTTL: 1},
+		{name: "NIC default", setNIC: true, wantTTL: nicTTL},
+		{name: "endpoint", setEndpoint: true, wantTTL: endpointTTL},
+		{name: "endpoint overrides NIC default", setNIC: true, setEndpoint: true, wantTTL: endpointTTL},
+	}
+	for _, test := range tests {
+		for _, flow := range []testFlow{multicastV4, multicastV4in6, multicastV6} {
+			t.Run(fmt.Sprintf("%s/flow:%s", test.name, flow), func(t *testing.T) {
+				c := newDualTestContext(t, defaultMTU)
+				defer c.cleanup()
+
+				if test.setNIC {
+					if err := c.s.SetNICMulticastTTL(c.nicID, nicTTL); err != nil {
+						c.t.Fatalf("SetNICMulticastTTL(%d, %d): %s", c.nicID, nicTTL, err)
+					}
+				}
+
+				c.createEndpointForFlow(flow)
+				if test.setEndpoint {
+					if err := c.ep.SetSockOptInt(tcpip.MulticastTTLOption, endpointTTL); err != nil {
+						c.t.Fatalf("SetSockOptInt(MulticastTTLOption, %d): %s", endpointTTL, err)
+					}
+				}
+
+				testWrite(c, flow, checker.TTL(test.wantTTL))
+			})
+		}
+	}
+}
+
+func TestStackDefaultTTL(t *testing.T) {
+	const (
+		defaultTTL  = 42
+		endpointTTL = 7
+	)
+
+	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, unicastV6Only} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			if err := c.s.SetDefaultTTL(flow.netProto(), defaultTTL); err != nil {
+				c.t.Fatalf("SetDefaultTTL(%d, %d): %s", flow.netProto(), defaultTTL, err)
+			}
+			c.createEndpointForFlow(flow)
+			testWrite(c, flow, checker.TTL(defaultTTL))
+
+			// An explicit TTL on the endpoint takes precedence.
+			if err := c.ep.SetSockOptInt(tcpip.TTLOption, endpointTTL); err != nil {
+				c.t.Fatalf("SetSockOptInt(TTLOption, %d): %s", endpointTTL, err)
+			}
+			testWrite(c, flow, checker.TTL(endpointTTL))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newDualTestContext(t, defaultMTU)
+		defer c.cleanup()
+
+		err := c.s.SetDefaultTTL(ipv4.ProtocolNumber, 0)
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got SetDefaultTTL(%d, 0) = %v, want = %s", ipv4.ProtocolNumber, err, &tcpip.ErrInvalidOptionValue{})
+		}
+	})
+}
+
+func TestMTUDiscoverInterface(t *testing.T) {
+	const mtu = 1280
+
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, mtu)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			if err := c.ep.SetSockOptInt(tcpip.MTUDiscoverOption, tcpip.PMTUDiscoveryInterface); err != nil {
+				c.t.Fatalf("SetSockOptInt(MTUDiscoverOption, PMTUDiscoveryInterface): %s", err)
+			}
+			if v, err := c.ep.GetSockOptInt(tcpip.MTUDiscoverOption); err != nil || v != tcpip.PMTUDiscoveryInterface {
+				c.t.Fatalf("got GetSockOptInt(MTUDiscoverOption) = (%d, %v), want = (%d, nil)", v, err, tcpip.PMTUDiscoveryInterface)
+			}
+
+			ipHdrSize := header.IPv6MinimumSize
+			if flow.isV4() {
+				ipHdrSize = header.IPv4MinimumSize
+			}
+			maxPayload := mtu - ipHdrSize - header.UDPMinimumSize
+
+			h := flow.header4Tuple(outgoing)
+			to := tcpip.FullAddress{Addr: flow.mapAddrIfApplicable(h.dstAddr.Addr), Port: h.dstAddr.Port}
+			write := func(size int) tcpip.Error {
+				var r bytes.Reader
+				r.Reset(make([]byte, size))
+				_, err := c.ep.Write(&r, tcpip.WriteOptions{To: &to})
+				return err
+			}
+
+			if err := write(maxPayload); err != nil {
+				c.t.Fatalf("Write of %d bytes: %s", maxPayload, err)
+			}
+			if got := c.linkEP.Drain(); got != 1 {
+				c.t.Fatalf("got %d packets sent, want = 1", got)
+			}
+
+			// Oversized writes are rejected instead of being fragmented.
+			{
+				err := write(maxPayload + 1)
+				if _, ok := err.(*tcpip.ErrMessageTooLong); !ok {
+					c.t.Fatalf("got Write of %d bytes = %v, want = %s", maxPayload+1, err, &tcpip.ErrMessageTooLong{})
+				}
+			}
+			if got := c.linkEP.Drain(); got != 0 {
+				c.t.Fatalf("got %d packets sent for a rejected write, want = 0", got)
+			}
+
+			// Without the option the datagram is fragmented.
+			if err := c.ep.SetSockOptInt(tcpip.MTUDiscoverOption, tcpip.PMTUDiscoveryDont); err != nil {
+				c.t.Fatalf("SetSockOptInt(MTUDiscoverOption, PMTUDiscoveryDont): %s", err)
+			}
+			if err := write(maxPayload + 1); err != nil {
+				c.t.Fatalf("Write of %d bytes: %s", maxPayload+1, err)
+			}
+			if got := c.linkEP.Drain(); got != 2 {
+				c.t.Fatalf("got %d packets sent, want = 2 fragments", got)
+			}
+		})
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, unicastV6Only, broadcast, broadcastIn6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			for _, wantTTL := range []uint8{1, 2, 50, 64, 128, 254, 255} {
+				t.Run(fmt.Sprintf("TTL:%d", wantTTL), func(t *testing.T) {
+					c := newDualTestContext(t, defaultMTU)
+					defer c.cleanup()
+
+					c.createEndpointForFlow(flow)
+
+					if err := c.ep.SetSockOptInt(tcpip.TTLOption, int(wantTTL)); err != nil {
+						c.t.Fatalf("SetSockOptInt(TTLOption, %d) failed: %s", wantTTL, err)
+					}
+
+					ttlChecker := checker.TTL(wantTTL)
+					if !flow.isV4() {
+						ttlChecker = checker.HopLimit(wantTTL)
+					}
+					testWrite(c, flow, ttlChecker)
+				})
+			}
+		})
+	}
+}
+
+var v4PacketFlows = [...]testFlow{unicastV4, multicastV4, broadcast, unicastV4in6, multicastV4in6, broadcastIn6}
+
+func TestSetTOS(t *testing.T) {
+	for _, flow := range v4PacketFlows {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			const tos = testTOS
+			v, err := c.ep.GetSockOptInt(tcpip.IPv4TOSOption)
+			if err != nil {
+				c.t.Errorf("GetSockOptInt(IPv4TOSOption) failed: %s", err)
+			}
+			// Test for expected default value.
+			if v != 0 {
+				c.t.Errorf("got GetSockOptInt(IPv4TOSOption) = 0x%x, want = 0x%x", v, 0)
+			}
+
+			if err := c.ep.SetSockOptInt(tcpip.IPv4TOSOption, tos); err != nil {
+				c.t.Errorf("SetSockOptInt(IPv4TOSOption, 0x%x) failed: %s", tos, err)
+			}
+
+			v, err = c.ep.GetSockOptInt(tcpip.IPv4TOSOption)
+			if err != nil {
+				c.t.Errorf("GetSockOptInt(IPv4TOSOption) failed: %s", err)
+			}
+
+			if v != tos {
+				c.t.Errorf("got GetSockOptInt(IPv4TOSOption) = 0x%x, want = 0x%x", v, tos)
+			}
+
+			testWrite(c, flow, checker.TOS(tos, 0))
+		})
+	}
+}
+
+var v6PacketFlows = [...]testFlow{unicastV6, unicastV6Only, multicastV6}
+
+func TestSetTClass(t *testing.T) {
+	for _, flow := range v6PacketFlows {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			const tClass = testTOS
+			v, err := c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
+			if err != nil {
+				c.t.Errorf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
+			}
+			// Test for expected default value.
+			if v != 0 {
+				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, 0)
+			}
+
+			if err := c.ep.SetSockOptInt(tcpip.IPv6TrafficClassOption, tClass); err != nil {
+				c.t.Errorf("SetSockOptInt(IPv6TrafficClassOption, 0x%x) failed: %s", tClass, err)
+			}
+
+			v, err = c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
+			if err != nil {
+				c.t.Errorf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
+			}
+
+			if v != tClass {
+				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, tClass)
+			}
+
+			// The header getter for TClass is called TOS, so use that checker.
+			testWrite(c, flow, checker.TOS(tClass, 0))
+		})
+	}
+}
+
+func TestUDPLiteCoverage(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	type coverageSetter interface {
+		SetUDPLiteCoverage(uint16) tcpip.Error
+	}
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	{
+		err := c.ep.(coverageSetter).SetUDPLiteCoverage(8)
+		if _, ok := err.(*tcpip.ErrNotSupported); !ok {
+			t.Errorf("got SetUDPLiteCoverage(8) on a UDP endpoint = %s, want = %s", err, &tcpip.ErrNotSupported{})
+		}
+	}
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.LiteProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint(%d, %d, _): %s", udp.LiteProtocolNumber, ipv4.ProtocolNumber, err)
+	}
+	defer ep.Close()
+
+	const coverage = 8
+	if err := ep.(coverageSetter).SetUDPLiteCoverage(coverage); err != nil {
+		t.Fatalf("SetUDPLiteCoverage(%d): %s", coverage, err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+
+	payload := newPayload()
+	var r bytes.Reader
+	r.Reset(payload)
+	if _, err := ep.Write(&r, tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	p, ok := c.linkEP.Read()
+	if !ok {
+		t.Fatal("Packet wasn't written out")
+	}
+	vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+	b := vv.ToView()
+	ip := header.IPv4(b)
+	if got, want := ip.TransportProtocol(), header.UDPLiteProtocolNumber; got != want {
+		t.Errorf("got TransportProtocol() = %d, want = %d", got, want)
+	}
+	udpHdr := header.UDP(ip.Payload())
+	if got, want := udpHdr.Length(), uint16(header.UDPMinimumSize+coverage); got != want {
+		t.Errorf("got Length() = %d, want = %d", got, want)
+	}
+	if diff := cmp.Diff(payload, []byte(udpHdr.Payload())); diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
+	}
+
+	// The checksum covers the pseudo-header, which carries the full length,
+	// the header and only the first coverage bytes of the payload.
+	xsum := header.PseudoHeaderChecksum(header.UDPLiteProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(udpHdr)))
+	hdr := append([]byte(nil), udpHdr[:header.UDPMinimumSize]...)
+	header.UDP(hdr).SetChecksum(0)
+	xsum = header.Checksum(hdr, xsum)
+	xsum = header.Checksum(payload[:coverage], xsum)
+	if got, want := udpHdr.Checksum(), ^xsum; got != want {
+		t.Errorf("got Checksum() = %#04x, want = %#04x", got, want)
+	}
+}
+
+func TestUDPLiteReceive(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.LiteProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint(%d, %d, _): %s", udp.LiteProtocolNumber, ipv4.ProtocolNumber, err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %s", err)
+	}
+
+	// inject injects a UDP-Lite datagram whose checksum covers the header
+	// and the first n bytes of payload, with its Length field set to
+	// coverage.
+	inject := func(payload []byte, n int, coverage uint16) {
+		h := unicastV4.header4Tuple(incoming)
+		buf := c.buildV4Packet(payload, &h)
+		ip := header.IPv4(buf)
+		ip.SetChecksum(0)
+		ip.Encode(&header.IPv4Fields{
+			TOS:         testTOS,
+			TotalLength: uint16(len(buf)),
+			TTL:         65,
+			Protocol:    uint8(udp.LiteProtocolNumber),
+			SrcAddr:     h.srcAddr.Addr,
+			DstAddr:     h.dstAddr.Addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		u := header.UDP(ip.Payload())
+		u.SetLength(coverage)
+		u.SetChecksum(0)
+		xsum := header.PseudoHeaderChecksum(udp.LiteProtocolNumber, h.srcAddr.Addr, h.dstAddr.Addr, uint16(len(u)))
+		xsum = header.Checksum(payload[:n], xsum)
+		u.SetChecksum(^u.CalculateChecksum(xsum))
+		c.injectRaw(ipv4.ProtocolNumber, buf)
+	}
+	checksumErrors := func() uint64 {
+		return ep.Stats().(*tcpip.TransportEndpointStats).ReceiveErrors.ChecksumErrors.Value()
+	}
+
+	// Only the first 8 bytes of payload are covered, so the rest are
+	// delivered as is.
+	const n = 8
+	payload := newPayload()
+	inject(payload, n, header.UDPMinimumSize+n)
+	if got := checksumErrors(); got != 0 {
+		t.Errorf("got ChecksumErrors = %d, want = 0", got)
+	}
+	var buf bytes.Buffer
+	if _, err := ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if diff := cmp.Diff(payload, buf.Bytes()); diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
+	}
+
+	// A coverage that exceeds the datagram is dropped as a checksum error.
+	inject(payload, len(payload), uint16(header.UDPMinimumSize+len(payload)+1))
+	if got := checksumErrors(); got != 1 {
+		t.Errorf("got ChecksumErrors = %d, want = 1", got)
+	}
+	if got := c.s.Stats().UDP.ChecksumErrors.Value(); got != 1 {
+		t.Errorf("got c.s.Stats().UDP.ChecksumErrors = %d, want = 1", got)
+	}
+	{
+		_, err := ep.Read(ioutil.Discard, tcpip.ReadOptions{})
+		if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got Read = %s, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+func TestTClassFromPriority(t *testing.T) {
+	for _, flow := range v6PacketFlows {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+
+			const (
+				priority = 5
+				// The class selector code point for priority 5, CS5.
+				priorityTClass = 0xa0
+				tClass         = testTOS
+			)
+			if err := c.ep.SetSockOptInt(tcpip.PriorityOption, priority); err != nil {
+				c.t.Fatalf("SetSockOptInt(PriorityOption, %d) failed: %s", priority, err)
+			}
+			v, err := c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
+			if err != nil {
+				c.t.Fatalf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
+			}
+			if v != priorityTClass {
+				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, priorityTClass)
+			}
+			testWrite(c, flow, checker.TOS(priorityTClass, 0))
+
+			// An explicit traffic class overrides the one derived from priority.
+			if err := c.ep.SetSockOptInt(tcpip.IPv6TrafficClassOption, tClass); err != nil {
+				c.t.Fatalf("SetSockOptInt(IPv6TrafficClassOption, 0x%x) failed: %s", tClass, err)
+			}
+			v, err = c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
+			if err != nil {
+				c.t.Fatalf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
+			}
+			if v != tClass {
+				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, tClass)
+			}
+			testWrite(c, flow, checker.TOS(tClass, 0))
+
+			{
+				err := c.ep.SetSockOptInt(tcpip.PriorityOption, 8)
+				if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+					c.t.Errorf("got SetSockOptInt(PriorityOption, 8) = %s, want = %s", err, &tcpip.ErrInvalidOptionValue{})
+				}
+			}
+		})
+	}
+}
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+func TestReceiveIPv6Info(t *testing.T) {
+	const (
+		trafficClass = 0xb8
+		flowLabel    = 0x12345
+	)
+
+	for _, flow := range []testFlow{unicastV6, unicastV6Only} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpoint(test.proto)
-
-			bindAddr := tcpip.FullAddress{Port: stackPort}
-			if err := c.ep.Bind(bindAddr); err != nil {
-				t.Fatalf("Bind(%+v): %s", bindAddr, err)
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
 			}
 
-			if test.flow.isMulticast() {
-				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: test.flow.getMcastAddr()}
-				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
-					c.t.Fatalf("SetSockOpt(&%#v): %s:", ifoptSet, err)
+			read := func(enabled bool) tcpip.ControlMessages {
+				t.Helper()
+
+				c.ep.SocketOptions().SetReceiveIPv6Info(enabled)
+				h := flow.header4Tuple(incoming)
+				b := c.buildV6Packet(newPayload(), &h)
+				header.IPv6(b).SetTOS(trafficClass, flowLabel)
+				c.injectRaw(ipv6.ProtocolNumber, b)
+
+				var buf bytes.Buffer
+				res, err := c.ep.Read(&buf, tcpip.ReadOptions{})
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
 				}
+				return res.ControlMessages
 			}
 
-			switch f := test.flow.netProto(); f {
-			case header.IPv4ProtocolNumber:
-				c.ep.SocketOptions().SetReceivePacketInfo(true)
-			case header.IPv6ProtocolNumber:
-				c.ep.SocketOptions().SetIPv6ReceivePacketInfo(true)
-			default:
-				t.Fatalf("unhandled protocol number = %d", f)
+			if cm := read(false); cm.HasIPv6Info {
+				t.Errorf("got cm.HasIPv6Info = true with the option disabled, want = false")
 			}
-
-			testRead(c, test.flow, test.checker(c.nicID))
-
-			if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 1 {
-				t.Fatalf("Read did not increment PacketsReceived: got = %d, want = 1", got)
+			cm := read(true)
+			checker.ReceiveIPv6Info(tcpip.IPv6Info{
+				TrafficClass: trafficClass,
+				FlowLabel:    flowLabel,
+			})(t, cm)
+			// The combined option does not need the separate traffic class option.
+			if cm.HasTClass {
+				t.Errorf("got cm.HasTClass = true without IPV6_RECVTCLASS, want = false")
 			}
 		})
 	}
 }
 
-func TestReadRecvOriginalDstAddr(t *testing.T) {
-	tests := []struct {
-		name                    string
-		proto                   tcpip.NetworkProtocolNumber
-		flow                    testFlow
-		expectedOriginalDstAddr tcpip.FullAddress
+func TestReceiveTosTClass(t *testing.T) {
+	const RcvTOSOpt = "ReceiveTosOption"
+	const RcvTClassOpt = "ReceiveTClassOption"
+
+	testCases := []struct {
+		name  string
+		tests []testFlow
 	}{
 		{
-			name:                    "IPv4 unicast",
-			proto:                   header.IPv4ProtocolNumber,
-			flow:                    unicastV4,
-			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: stackAddr, Port: stackPort},
-		},
-		{
-			name:  "IPv4 multicast",
-			proto: header.IPv4ProtocolNumber,
-			flow:  multicastV4,
-			// This should actually be a unicast address assigned to the interface.
-			//
-			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
-			// behaviour. We still include the test so that once the bug is
-			// resolved, this test will start to fail and the individual tasked
-			// with fixing this bug knows to also fix this test :).
-			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: multicastAddr, Port: stackPort},
-		},
-		{
-			name:  "IPv4 broadcast",
-			proto: header.IPv4ProtocolNumber,
-			flow:  broadcast,
-			// This should actually be a unicast address assigned to the interface.
-			//
-			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
-			// behaviour. We still include the test so that once the bug is
-			// resolved, this test will start to fail and the individual tasked
-			// with fixing this bug knows to also fix this test :).
-			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: broadcastAddr, Port: stackPort},
-		},
-		{
-			name:                    "IPv6 unicast",
-			proto:                   header.IPv6ProtocolNumber,
-			flow:                    unicastV6,
-			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: stackV6Addr, Port: stackPort},
+			name:  RcvTOSOpt,
+			tests: v4PacketFlows[:],
 		},
 		{
-			name:  "IPv6 multicast",
-			proto: header.IPv6ProtocolNumber,
-			flow:  multicastV6,
-			// This should actually be a unicast address assigned to the interface.
-			//
-			// TODO(gvisor.dev/issue/3556): This check is validating incorrect
-			// behaviour. We still include the test so that once the bug is
-			// resolved, this test will start to fail and the individual tasked
-			// with fixing this bug knows to also fix this test :).
-			expectedOriginalDstAddr: tcpip.FullAddress{NIC: 1, Addr: multicastV6Addr, Port: stackPort},
+			name:  RcvTClassOpt,
+			tests: v6PacketFlows[:],
 		},
 	}
+	for _, testCase := range testCases {
+		for _, flow := range testCase.tests {
+			t.Run(fmt.Sprintf("%s:flow:%s", testCase.name, flow), func(t *testing.T) {
+				c := newDualTestContext(t, defaultMTU)
+				defer c.cleanup()
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+				c.createEndpointForFlow(flow)
+				name := testCase.name
+
+				if flow.isMulticast() {
+					netProto := flow.netProto()
+					addr := flow.getMcastAddr()
+					if err := c.s.JoinGroup(netProto, c.nicID, addr); err != nil {
+						c.t.Fatalf("JoinGroup(%d, %d, %s): %s", netProto, c.nicID, addr, err)
+					}
+				}
+
+				var optionGetter func() bool
+				var optionSetter func(bool)
+				switch name {
+				case RcvTOSOpt:
+					optionGetter = c.ep.SocketOptions().GetReceiveTOS
+					optionSetter = c.ep.SocketOptions().SetReceiveTOS
+				case RcvTClassOpt:
+					optionGetter = c.ep.SocketOptions().GetReceiveTClass
+					optionSetter = c.ep.SocketOptions().SetReceiveTClass
+				default:
+					t.Fatalf("unkown test variant: %s", name)
+				}
+
+				// Verify that setting and reading the option works.
+				v := optionGetter()
+				// Test for expected default value.
+				if v != false {
+					c.t.Errorf("got GetSockOptBool(%s) = %t, want = %t", name, v, false)
+				}
+
+				const want = true
+				optionSetter(want)
+
+				got := optionGetter()
+				if got != want {
+					c.t.Errorf("got GetSockOptBool(%s) = %t, want = %t", name, got, want)
+				}
+
+				// Verify that the correct received TOS or TClass is handed through as
+				// ancillary data to the ControlMessages struct.
+				if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+					c.t.Fatalf("Bind failed: %s", err)
+				}
+				switch name {
+				case RcvTClassOpt:
+					testRead(c, flow, checker.ReceiveTClass(testTOS))
+				case RcvTOSOpt:
+					testRead(c, flow, checker.ReceiveTOS(testTOS))
+				default:
+					t.Fatalf("unknown test variant: %s", name)
+				}
+			})
+		}
+	}
+}
+
+func TestDefaultReceiveTOS(t *testing.T) {
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpoint(test.proto)
+			c.s.SetDefaultReceiveTOS(true)
+			c.createEndpointForFlow(flow)
 
-			bindAddr := tcpip.FullAddress{Port: stackPort}
-			if err := c.ep.Bind(bindAddr); err != nil {
-				t.Fatalf("Bind(%#v): %s", bindAddr, err)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
 			}
-
-			if test.flow.isMulticast() {
-				ifoptSet := tcpip.AddMembershipOption{NIC: 1, MulticastAddr: test.flow.getMcastAddr()}
-				if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
-					c.t.Fatalf("SetSockOpt(&%#v): %s:", ifoptSet, err)
+			// The endpoint can still opt out.
+			noTOS := func(t *testing.T, cm tcpip.ControlMessages) {
+				t.Helper()
+				if cm.HasTOS || cm.HasTClass {
+					t.Errorf("got cm.HasTOS = %t, cm.HasTClass = %t, want both = false", cm.HasTOS, cm.HasTClass)
 				}
 			}
+			if flow.isV4() {
+				testRead(c, flow, checker.ReceiveTOS(testTOS))
+				c.ep.SocketOptions().SetReceiveTOS(false)
+			} else {
+				testRead(c, flow, checker.ReceiveTClass(testTOS))
+				c.ep.SocketOptions().SetReceiveTClass(false)
+			}
+			testRead(c, flow, noTOS)
+		})
+	}
+}
 
-			c.ep.SocketOptions().SetReceiveOriginalDstAddress(true)
+func TestMulticastInterfaceOption(t *testing.T) {
+	for _, flow := range []testFlow{multicastV4, multicastV4in6, multicastV6, multicastV6Only} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			for _, bindTyp := range []string{"bound", "unbound"} {
+				t.Run(bindTyp, func(t *testing.T) {
+					for _, optTyp := range []string{"use local-addr", "use NICID", "use local-addr and NIC"} {
+						t.Run(optTyp, func(t *testing.T) {
+							h := flow.header4Tuple(outgoing)
+							mcastAddr := h.dstAddr.Addr
+							localIfAddr := h.srcAddr.Addr
 
-			testRead(c, test.flow, checker.ReceiveOriginalDstAddr(test.expectedOriginalDstAddr))
+							var ifoptSet tcpip.MulticastInterfaceOption
+							switch optTyp {
+							case "use local-addr":
+								ifoptSet.InterfaceAddr = localIfAddr
+							case "use NICID":
+								ifoptSet.NIC = 1
+							case "use local-addr and NIC":
+								ifoptSet.InterfaceAddr = localIfAddr
+								ifoptSet.NIC = 1
+							default:
+								t.Fatal("unknown test variant")
+							}
 
-			if got := c.s.Stats().UDP.PacketsReceived.Value(); got != 1 {
-				t.Fatalf("Read did not increment PacketsReceived: got = %d, want = 1", got)
+							c := newDualTestContext(t, defaultMTU)
+							defer c.cleanup()
+
+							c.createEndpoint(flow.sockProto())
+
+							if bindTyp == "bound" {
+								// Bind the socket by connecting to the multicast address.
+								// This may have an influence on how the multicast interface
+								// is set.
+								addr := tcpip.FullAddress{
+									Addr: flow.mapAddrIfApplicable(mcastAddr),
+									Port: stackPort,
+								}
+								if err := c.ep.Connect(addr); err != nil {
+									c.t.Fatalf("Connect failed: %s", err)
+								}
+							}
+
+							if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
+								c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
+							}
+
+							// Verify multicast interface addr and NIC were set correctly.
+							// Note that NIC must be 1 since this is our outgoing interface.
+							var ifoptGot tcpip.MulticastInterfaceOption
+							if err := c.ep.GetSockOpt(&ifoptGot); err != nil {
+								c.t.Fatalf("GetSockOpt(&%T): %s", ifoptGot, err)
+							} else if ifoptWant := (tcpip.MulticastInterfaceOption{NIC: 1, InterfaceAddr: ifoptSet.InterfaceAddr}); ifoptGot != ifoptWant {
+								c.t.Errorf("got multicast interface option = %#v, want = %#v", ifoptGot, ifoptWant)
+							}
+						})
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestWriteMore(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	// Writes with More are coalesced into a single datagram sent by the first
+	// write without More.
+	payload := newPayload()
+	half := len(payload) / 2
+	for _, write := range []struct {
+		data []byte
+		more bool
+	}{
+		{data: payload[:half], more: true},
+		{data: payload[half:], more: false},
+	} {
+		var r bytes.Reader
+		r.Reset(write.data)
+		n, err := c.ep.Write(&r, tcpip.WriteOptions{More: write.more})
+		if err != nil {
+			t.Fatalf("Write(_, {More: %t}): %s", write.more, err)
+		}
+		if got, want := n, int64(len(write.data)); got != want {
+			t.Errorf("got Write(_, {More: %t}) = %d, want = %d", write.more, got, want)
+		}
+		if write.more {
+			if pkt, ok := c.linkEP.Read(); ok {
+				t.Fatalf("unexpected packet written before the datagram was complete: %+v", pkt)
 			}
-		})
+		}
+	}
+	b := c.getPacketAndVerify(unicastV4)
+	udp := header.UDP(header.IPv4(b).Payload())
+	if diff := cmp.Diff(payload, []byte(udp.Payload())); diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
 	}
 }
 
-func TestWriteIncrementsPacketsSent(t *testing.T) {
+func TestSmallWrites(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
 
-	c.createEndpoint(ipv6.ProtocolNumber)
-
-	testDualWrite(c)
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
 
-	var want uint64 = 2
-	if got := c.s.Stats().UDP.PacketsSent.Value(); got != want {
-		c.t.Fatalf("Write did not increment PacketsSent: got %v, want %v", got, want)
+	// Hold on to every packet written and check them all once the writes are
+	// done, so that storage handed out to one packet and reused by another is
+	// caught.
+	const writes = 1000
+	payloads := make([][]byte, writes)
+	sent := make([]header.UDP, writes)
+	for i := range payloads {
+		payloads[i] = bytes.Repeat([]byte{byte(i)}, i%600)
+		var r bytes.Reader
+		r.Reset(payloads[i])
+		n, err := c.ep.Write(&r, tcpip.WriteOptions{})
+		if err != nil {
+			t.Fatalf("Write(_, _) #%d: %s", i, err)
+		}
+		if got, want := n, int64(len(payloads[i])); got != want {
+			t.Fatalf("got Write(_, _) #%d = %d, want = %d", i, got, want)
+		}
+		b := c.getPacketAndVerify(unicastV4, checker.PayloadLen(len(payloads[i])+header.UDPMinimumSize))
+		sent[i] = header.IPv4(b).Payload()
+	}
+	for i, udp := range sent {
+		if diff := cmp.Diff(payloads[i], []byte(udp.Payload())); diff != "" {
+			t.Errorf("payload #%d mismatch (-want +got):\n%s", i, diff)
+		}
 	}
 }
 
-func TestNoChecksum(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4, unicastV6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+func TestFlushOnClose(t *testing.T) {
+	for _, flush := range []bool{true, false} {
+		t.Run(fmt.Sprintf("flush:%t", flush), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				c.t.Fatalf("Connect failed: %s", err)
+			}
+			c.ep.(interface{ SetFlushOnClose(bool) }).SetFlushOnClose(flush)
 
-			// Disable the checksum generation.
-			c.ep.SocketOptions().SetNoChecksum(true)
-			// This option is effective on IPv4 only.
-			testWrite(c, flow, checker.UDP(checker.NoChecksum(flow.isV4())))
+			payload := newPayload()
+			var r bytes.Reader
+			r.Reset(payload)
+			if _, err := c.ep.Write(&r, tcpip.WriteOptions{More: true}); err != nil {
+				t.Fatalf("Write(_, {More: true}): %s", err)
+			}
+			if pkt, ok := c.linkEP.Read(); ok {
+				t.Fatalf("unexpected packet written before close: %+v", pkt)
+			}
 
-			// Enable the checksum generation.
-			c.ep.SocketOptions().SetNoChecksum(false)
-			testWrite(c, flow, checker.UDP(checker.NoChecksum(false)))
+			c.ep.Close()
+			c.ep = nil
+
+			p, ok := c.linkEP.Read()
+			if ok != flush {
+				t.Fatalf("got packet written on close = %t, want = %t", ok, flush)
+			}
+			if !ok {
+				return
+			}
+			vv := buffer.NewVectorisedView(p.Pkt.Size(), p.Pkt.Views())
+			checker.IPv4(t, vv.ToView(),
+				checker.DstAddr(testAddr),
+				checker.UDP(
+					checker.DstPort(testPort),
+					checker.Payload(payload),
+				),
+			)
 		})
 	}
 }
 
-var _ stack.NetworkInterface = (*testInterface)(nil)
-
-type testInterface struct {
-	stack.NetworkInterface
-}
-
-func (*testInterface) ID() tcpip.NICID {
-	return 0
-}
-
-func (*testInterface) Enabled() bool {
-	return true
-}
-
-func TestTTL(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, unicastV6Only, multicastV4, multicastV4in6, multicastV6, broadcast, broadcastIn6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+func TestWriteMoreChecks(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		prepare func(*testContext) int
+		wantErr tcpip.Error
+	}{
+		{
+			name: "closed",
+			prepare: func(c *testContext) int {
+				c.ep.Close()
+				return len(newPayload())
+			},
+			wantErr: &tcpip.ErrInvalidEndpointState{},
+		},
+		{
+			name: "write shutdown",
+			prepare: func(c *testContext) int {
+				if err := c.ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+					c.t.Fatalf("Shutdown(tcpip.ShutdownWrite): %s", err)
+				}
+				return len(newPayload())
+			},
+			wantErr: &tcpip.ErrClosedForSend{},
+		},
+		{
+			name: "send buffer full",
+			prepare: func(c *testContext) int {
+				c.ep.SocketOptions().SetSendBufferSize(1, true /* notify */)
+				return int(c.ep.SocketOptions().GetSendBufferSize()) + 1
+			},
+			wantErr: &tcpip.ErrNoBufferSpace{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
-
-			const multicastTTL = 42
-			if err := c.ep.SetSockOptInt(tcpip.MulticastTTLOption, multicastTTL); err != nil {
-				c.t.Fatalf("SetSockOptInt failed: %s", err)
+			c.createEndpoint(ipv4.ProtocolNumber)
+			if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				c.t.Fatalf("Connect failed: %s", err)
 			}
+			size := test.prepare(c)
 
-			var wantTTL uint8
-			if flow.isMulticast() {
-				wantTTL = multicastTTL
-			} else {
-				var p stack.NetworkProtocolFactory
-				var n tcpip.NetworkProtocolNumber
-				if flow.isV4() {
-					p = ipv4.NewProtocol
-					n = ipv4.ProtocolNumber
-				} else {
-					p = ipv6.NewProtocol
-					n = ipv6.ProtocolNumber
-				}
-				s := stack.New(stack.Options{
-					NetworkProtocols: []stack.NetworkProtocolFactory{p},
-					Clock:            &faketime.NullClock{},
-				})
-				ep := s.NetworkProtocolInstance(n).NewEndpoint(&testInterface{}, nil)
-				wantTTL = ep.DefaultTTL()
-				ep.Close()
+			var r bytes.Reader
+			r.Reset(make([]byte, size))
+			_, err := c.ep.Write(&r, tcpip.WriteOptions{More: true})
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Errorf("Write(_, {More: true}) error mismatch (-want +got):\n%s", diff)
 			}
-
-			testWrite(c, flow, checker.TTL(wantTTL))
 		})
 	}
 }
 
-func TestSetTTL(t *testing.T) {
-	for _, flow := range []testFlow{unicastV4, unicastV4in6, unicastV6, unicastV6Only, broadcast, broadcastIn6} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			for _, wantTTL := range []uint8{1, 2, 50, 64, 128, 254, 255} {
-				t.Run(fmt.Sprintf("TTL:%d", wantTTL), func(t *testing.T) {
-					c := newDualTestContext(t, defaultMTU)
-					defer c.cleanup()
-
-					c.createEndpointForFlow(flow)
+func TestBufferHighWatermarks(t *testing.T) {
+	const payloadSize = 100
 
-					if err := c.ep.SetSockOptInt(tcpip.TTLOption, int(wantTTL)); err != nil {
-						c.t.Fatalf("SetSockOptInt(TTLOption, %d) failed: %s", wantTTL, err)
-					}
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
 
-					testWrite(c, flow, checker.TTL(wantTTL))
-				})
-			}
-		})
+	c.createEndpoint(ipv4.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
 	}
-}
-
-var v4PacketFlows = [...]testFlow{unicastV4, multicastV4, broadcast, unicastV4in6, multicastV4in6, broadcastIn6}
-
-func TestSetTOS(t *testing.T) {
-	for _, flow := range v4PacketFlows {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			c := newDualTestContext(t, defaultMTU)
-			defer c.cleanup()
-
-			c.createEndpointForFlow(flow)
-
-			const tos = testTOS
-			v, err := c.ep.GetSockOptInt(tcpip.IPv4TOSOption)
-			if err != nil {
-				c.t.Errorf("GetSockOptInt(IPv4TOSOption) failed: %s", err)
-			}
-			// Test for expected default value.
-			if v != 0 {
-				c.t.Errorf("got GetSockOptInt(IPv4TOSOption) = 0x%x, want = 0x%x", v, 0)
-			}
-
-			if err := c.ep.SetSockOptInt(tcpip.IPv4TOSOption, tos); err != nil {
-				c.t.Errorf("SetSockOptInt(IPv4TOSOption, 0x%x) failed: %s", tos, err)
-			}
+	highWatermarks := c.ep.(interface{ BufferHighWatermarks() (int, int) }).BufferHighWatermarks
 
-			v, err = c.ep.GetSockOptInt(tcpip.IPv4TOSOption)
-			if err != nil {
-				c.t.Errorf("GetSockOptInt(IPv4TOSOption) failed: %s", err)
+	inject := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			c.injectPacket(unicastV4, make([]byte, payloadSize), false /* badChecksum */)
+		}
+	}
+	read := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			var buf bytes.Buffer
+			if _, err := c.ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+				t.Fatalf("Read failed: %s", err)
 			}
+		}
+	}
 
-			if v != tos {
-				c.t.Errorf("got GetSockOptInt(IPv4TOSOption) = 0x%x, want = 0x%x", v, tos)
-			}
+	// Push the receive queue to 3 datagrams, drain it to 1 and then refill it
+	// to 2. The peak remains at 3 datagrams.
+	inject(3)
+	read(2)
+	inject(1)
+	if got, want := c.ep.(interface{ QueuedDatagrams() int }).QueuedDatagrams(), 2; got != want {
+		t.Fatalf("got QueuedDatagrams() = %d, want = %d", got, want)
+	}
+	if rcvPeak, _ := highWatermarks(); rcvPeak != 3*payloadSize {
+		t.Errorf("got rcvPeak = %d, want = %d", rcvPeak, 3*payloadSize)
+	}
 
-			testWrite(c, flow, checker.TOS(tos, 0))
-		})
+	if _, sndPeak := highWatermarks(); sndPeak != 0 {
+		t.Errorf("got sndPeak = %d before writing, want = 0", sndPeak)
+	}
+	var r bytes.Reader
+	r.Reset(make([]byte, payloadSize))
+	if _, err := c.ep.Write(&r, tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: testAddr, Port: testPort}}); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if _, sndPeak := highWatermarks(); sndPeak != payloadSize {
+		t.Errorf("got sndPeak = %d, want = %d", sndPeak, payloadSize)
 	}
 }
 
-var v6PacketFlows = [...]testFlow{unicastV6, unicastV6Only, multicastV6}
-
-func TestSetTClass(t *testing.T) {
-	for _, flow := range v6PacketFlows {
+func TestLastMulticastSource(t *testing.T) {
+	for _, flow := range []testFlow{multicastV4, multicastV6Only} {
 		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
 			c := newDualTestContext(t, defaultMTU)
 			defer c.cleanup()
 
-			c.createEndpointForFlow(flow)
+			c.createEndpoint(flow.sockProto())
+			lastMulticastSource := c.ep.(interface {
+				LastMulticastSource() (tcpip.Address, bool)
+			}).LastMulticastSource
 
-			const tClass = testTOS
-			v, err := c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
-			if err != nil {
-				c.t.Errorf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
-			}
-			// Test for expected default value.
-			if v != 0 {
-				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, 0)
+			if addr, ok := lastMulticastSource(); ok {
+				t.Errorf("got LastMulticastSource() = (%s, true) before any write, want = (_, false)", addr)
 			}
 
-			if err := c.ep.SetSockOptInt(tcpip.IPv6TrafficClassOption, tClass); err != nil {
-				c.t.Errorf("SetSockOptInt(IPv6TrafficClassOption, 0x%x) failed: %s", tClass, err)
+			localIfAddr := flow.header4Tuple(outgoing).srcAddr.Addr
+			opt := tcpip.MulticastInterfaceOption{InterfaceAddr: localIfAddr}
+			if err := c.ep.SetSockOpt(&opt); err != nil {
+				c.t.Fatalf("SetSockOpt(&%#v): %s", opt, err)
 			}
 
-			v, err = c.ep.GetSockOptInt(tcpip.IPv6TrafficClassOption)
-			if err != nil {
-				c.t.Errorf("GetSockOptInt(IPv6TrafficClassOption) failed: %s", err)
-			}
+			testWrite(c, flow)
 
-			if v != tClass {
-				c.t.Errorf("got GetSockOptInt(IPv6TrafficClassOption) = 0x%x, want = 0x%x", v, tClass)
+			if addr, ok := lastMulticastSource(); !ok || addr != localIfAddr {
+				t.Errorf("got LastMulticastSource() = (%s, %t), want = (%s, true)", addr, ok, localIfAddr)
 			}
-
-			// The header getter for TClass is called TOS, so use that checker.
-			testWrite(c, flow, checker.TOS(tClass, 0))
 		})
 	}
 }
 
-func TestReceiveTosTClass(t *testing.T) {
-	const RcvTOSOpt = "ReceiveTosOption"
-	const RcvTClassOpt = "ReceiveTClassOption"
+func TestMulticastInterfaceOptionFamily(t *testing.T) {
+	const v4OnlyNICID = 2
 
-	testCases := []struct {
-		name  string
-		tests []testFlow
+	for _, tc := range []struct {
+		name    string
+		flow    testFlow
+		opt     tcpip.MulticastInterfaceOption
+		wantErr tcpip.Error
 	}{
 		{
-			name:  RcvTOSOpt,
-			tests: v4PacketFlows[:],
+			name: "v4 addr for v4 group",
+			flow: multicastV4,
+			opt:  tcpip.MulticastInterfaceOption{InterfaceAddr: stackAddr},
 		},
 		{
-			name:  RcvTClassOpt,
-			tests: v6PacketFlows[:],
+			name:    "v6 addr for v4 group",
+			flow:    multicastV4,
+			opt:     tcpip.MulticastInterfaceOption{InterfaceAddr: stackV6Addr},
+			wantErr: &tcpip.ErrInvalidOptionValue{},
 		},
-	}
-	for _, testCase := range testCases {
-		for _, flow := range testCase.tests {
-			t.Run(fmt.Sprintf("%s:flow:%s", testCase.name, flow), func(t *testing.T) {
-				c := newDualTestContext(t, defaultMTU)
-				defer c.cleanup()
-
-				c.createEndpointForFlow(flow)
-				name := testCase.name
-
-				if flow.isMulticast() {
-					netProto := flow.netProto()
-					addr := flow.getMcastAddr()
-					if err := c.s.JoinGroup(netProto, c.nicID, addr); err != nil {
-						c.t.Fatalf("JoinGroup(%d, %d, %s): %s", netProto, c.nicID, addr, err)
-					}
-				}
-
-				var optionGetter func() bool
-				var optionSetter func(bool)
-				switch name {
-				case RcvTOSOpt:
-					optionGetter = c.ep.SocketOptions().GetReceiveTOS
-					optionSetter = c.ep.SocketOptions().SetReceiveTOS
-				case RcvTClassOpt:
-					optionGetter = c.ep.SocketOptions().GetReceiveTClass
-					optionSetter = c.ep.SocketOptions().SetReceiveTClass
-				default:
-					t.Fatalf("unkown test variant: %s", name)
-				}
-
-				// Verify that setting and reading the option works.
-				v := optionGetter()
-				// Test for expected default value.
-				if v != false {
-					c.t.Errorf("got GetSockOptBool(%s) = %t, want = %t", name, v, false)
-				}
+		{
+			name: "v6 addr for v6 group",
+			flow: multicastV6Only,
+			opt:  tcpip.MulticastInterfaceOption{InterfaceAddr: stackV6Addr},
+		},
+		{
+			name:    "v4 addr for v6 group",
+			flow:    multicastV6Only,
+			opt:     tcpip.MulticastInterfaceOption{InterfaceAddr: stackAddr},
+			wantErr: &tcpip.ErrInvalidOptionValue{},
+		},
+		{
+			name:    "v4 mapped addr for v6 group",
+			flow:    multicastV6Only,
+			opt:     tcpip.MulticastInterfaceOption{InterfaceAddr: stackV4MappedAddr},
+			wantErr: &tcpip.ErrInvalidOptionValue{},
+		},
+		{
+			name: "v4 only NIC for v4 group",
+			flow: multicastV4,
+			opt:  tcpip.MulticastInterfaceOption{NIC: v4OnlyNICID},
+		},
+		{
+			name: "v4 only NIC for dual-stack endpoint",
+			flow: multicastV4in6,
+			opt:  tcpip.MulticastInterfaceOption{NIC: v4OnlyNICID},
+		},
+		{
+			name:    "v4 only NIC for v6 group",
+			flow:    multicastV6Only,
+			opt:     tcpip.MulticastInterfaceOption{NIC: v4OnlyNICID},
+			wantErr: &tcpip.ErrInvalidOptionValue{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
 
-				const want = true
-				optionSetter(want)
+			if err := c.s.CreateNIC(v4OnlyNICID, channel.New(0, defaultMTU, "")); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", v4OnlyNICID, err)
+			}
+			protocolAddr := tcpip.ProtocolAddress{
+				Protocol:          ipv4.ProtocolNumber,
+				AddressWithPrefix: tcpip.AddressWithPrefix{Address: "\x0a\x00\x01\x01", PrefixLen: 24},
+			}
+			if err := c.s.AddProtocolAddress(v4OnlyNICID, protocolAddr, stack.AddressProperties{}); err != nil {
+				t.Fatalf("AddProtocolAddress(%d, %+v, {}): %s", v4OnlyNICID, protocolAddr, err)
+			}
 
-				got := optionGetter()
-				if got != want {
-					c.t.Errorf("got GetSockOptBool(%s) = %t, want = %t", name, got, want)
-				}
+			c.createEndpointForFlow(tc.flow)
 
-				// Verify that the correct received TOS or TClass is handed through as
-				// ancillary data to the ControlMessages struct.
-				if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
-					c.t.Fatalf("Bind failed: %s", err)
-				}
-				switch name {
-				case RcvTClassOpt:
-					testRead(c, flow, checker.ReceiveTClass(testTOS))
-				case RcvTOSOpt:
-					testRead(c, flow, checker.ReceiveTOS(testTOS))
-				default:
-					t.Fatalf("unknown test variant: %s", name)
+			if err := c.ep.SetSockOpt(&tc.opt); err != tc.wantErr {
+				t.Fatalf("got SetSockOpt(&%#v) = %v, want = %v", tc.opt, err, tc.wantErr)
+			}
+
+			var got tcpip.MulticastInterfaceOption
+			if err := c.ep.GetSockOpt(&got); err != nil {
+				t.Fatalf("GetSockOpt(&%T): %s", got, err)
+			}
+			var want tcpip.MulticastInterfaceOption
+			if tc.wantErr == nil {
+				want = tc.opt
+				if want.NIC == 0 {
+					want.NIC = 1
 				}
-			})
-		}
+			}
+			if got != want {
+				t.Errorf("got multicast interface option = %#v, want = %#v", got, want)
+			}
+		})
 	}
 }
 
-func TestMulticastInterfaceOption(t *testing.T) {
-	for _, flow := range []testFlow{multicastV4, multicastV4in6, multicastV6, multicastV6Only} {
-		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
-			for _, bindTyp := range []string{"bound", "unbound"} {
-				t.Run(bindTyp, func(t *testing.T) {
-					for _, optTyp := range []string{"use local-addr", "use NICID", "use local-addr and NIC"} {
-						t.Run(optTyp, func(t *testing.T) {
-							h := flow.header4Tuple(outgoing)
-							mcastAddr := h.dstAddr.Addr
-							localIfAddr := h.srcAddr.Addr
-
-							var ifoptSet tcpip.MulticastInterfaceOption
-							switch optTyp {
-							case "use local-addr":
-								ifoptSet.InterfaceAddr = localIfAddr
-							case "use NICID":
-								ifoptSet.NIC = 1
-							case "use local-addr and NIC":
-								ifoptSet.InterfaceAddr = localIfAddr
-								ifoptSet.NIC = 1
-							default:
-								t.Fatal("unknown test variant")
-							}
-
-							c := newDualTestContext(t, defaultMTU)
-							defer c.cleanup()
-
-							c.createEndpoint(flow.sockProto())
-
-							if bindTyp == "bound" {
-								// Bind the socket by connecting to the multicast address.
-								// This may have an influence on how the multicast interface
-								// is set.
-								addr := tcpip.FullAddress{
-									Addr: flow.mapAddrIfApplicable(mcastAddr),
-									Port: stackPort,
-								}
-								if err := c.ep.Connect(addr); err != nil {
-									c.t.Fatalf("Connect failed: %s", err)
-								}
-							}
+func TestAddMembershipInterfaceFamily(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		flow          testFlow
+		interfaceAddr tcpip.Address
+		wantErr       tcpip.Error
+	}{
+		{
+			name:          "v4 addr for v4 group",
+			flow:          multicastV4,
+			interfaceAddr: stackAddr,
+		},
+		{
+			name:          "v6 addr for v4 group",
+			flow:          multicastV4,
+			interfaceAddr: stackV6Addr,
+			wantErr:       &tcpip.ErrInvalidOptionValue{},
+		},
+		{
+			name:          "v6 addr for v6 group",
+			flow:          multicastV6Only,
+			interfaceAddr: stackV6Addr,
+		},
+		{
+			name:          "v4 addr for v6 group",
+			flow:          multicastV6Only,
+			interfaceAddr: stackAddr,
+			wantErr:       &tcpip.ErrInvalidOptionValue{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
 
-							if err := c.ep.SetSockOpt(&ifoptSet); err != nil {
-								c.t.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
-							}
+			c.createEndpointForFlow(tc.flow)
 
-							// Verify multicast interface addr and NIC were set correctly.
-							// Note that NIC must be 1 since this is our outgoing interface.
-							var ifoptGot tcpip.MulticastInterfaceOption
-							if err := c.ep.GetSockOpt(&ifoptGot); err != nil {
-								c.t.Fatalf("GetSockOpt(&%T): %s", ifoptGot, err)
-							} else if ifoptWant := (tcpip.MulticastInterfaceOption{NIC: 1, InterfaceAddr: ifoptSet.InterfaceAddr}); ifoptGot != ifoptWant {
-								c.t.Errorf("got multicast interface option = %#v, want = %#v", ifoptGot, ifoptWant)
-							}
-						})
-					}
-				})
+			mcastAddr := tc.flow.header4Tuple(outgoing).dstAddr.Addr
+			addOpt := tcpip.AddMembershipOption{InterfaceAddr: tc.interfaceAddr, MulticastAddr: mcastAddr}
+			if err := c.ep.SetSockOpt(&addOpt); err != tc.wantErr {
+				t.Fatalf("got SetSockOpt(&%#v) = %v, want = %v", addOpt, err, tc.wantErr)
+			}
+			removeOpt := tcpip.RemoveMembershipOption{InterfaceAddr: tc.interfaceAddr, MulticastAddr: mcastAddr}
+			if err := c.ep.SetSockOpt(&removeOpt); err != tc.wantErr {
+				t.Fatalf("got SetSockOpt(&%#v) = %v, want = %v", removeOpt, err, tc.wantErr)
 			}
 		})
 	}
@@ -1949,37 +7742,25 @@ func TestV4UnknownDestination(t *testing.T) {
 				t.Fatalf("got an ICMP packet of size: %d, want: sz <= %d", got, want)
 			}
 
-			hdr := header.IPv4(pkt)
-			checker.IPv4(t, hdr, checker.ICMPv4(
-				checker.ICMPv4Type(header.ICMPv4DstUnreachable),
-				checker.ICMPv4Code(header.ICMPv4PortUnreachable)))
-
-			// We need to compare the included data part of the UDP packet that is in
-			// the ICMP packet with the matching original data.
-			icmpPkt := header.ICMPv4(hdr.Payload())
-			payloadIPHeader := header.IPv4(icmpPkt.Payload())
-			incomingHeaderLength := header.IPv4MinimumSize + header.UDPMinimumSize
-			wantLen := len(payload)
+			// The ICMP packet must hold as much of the original datagram as fits.
+			h := tc.flow.header4Tuple(incoming)
+			origPkt := c.buildV4Packet(payload, &h)
+			wantLen := len(origPkt)
 			if tc.largePayload {
-				// To work out the data size we need to simulate what the sender would
-				// have done. The wanted size is the total available minus the sum of
-				// the headers in the UDP AND ICMP packets, given that we know the test
-				// had only a minimal IP header but the ICMP sender will have allowed
-				// for a maximally sized packet header.
-				wantLen = header.IPv4MinimumProcessableDatagramSize - header.IPv4MaximumHeaderSize - header.ICMPv4MinimumSize - incomingHeaderLength
+				// The ICMP packet is limited to the minimum processable datagram size,
+				// so the embedded packet gets whatever is left after the ICMP packet's
+				// own headers.
+				wantLen = header.IPv4MinimumProcessableDatagramSize - header.IPv4MinimumSize - header.ICMPv4MinimumSize
 			}
 
-			// In the case of large payloads the IP packet may be truncated. Update
-			// the length field before retrieving the udp datagram payload.
-			// Add back the two headers within the payload.
-			payloadIPHeader.SetTotalLength(uint16(wantLen + incomingHeaderLength))
+			hdr := header.IPv4(pkt)
+			checker.IPv4(t, hdr, checker.ICMPv4(
+				checker.ICMPv4Type(header.ICMPv4DstUnreachable),
+				checker.ICMPv4Code(header.ICMPv4PortUnreachable),
+				checker.ICMPv4PayloadPrefix(origPkt)))
 
-			origDgram := header.UDP(payloadIPHeader.Payload())
-			if got, want := len(origDgram.Payload()), wantLen; got != want {
-				t.Fatalf("unexpected payload length got: %d, want: %d", got, want)
-			}
-			if got, want := origDgram.Payload(), payload[:wantLen]; !bytes.Equal(got, want) {
-				t.Fatalf("unexpected payload got: %d, want: %d", got, want)
+			if got := len(header.ICMPv4(hdr.Payload()).Payload()); got != wantLen {
+				t.Fatalf("got embedded packet length = %d, want = %d", got, wantLen)
 			}
 		})
 	}
@@ -2043,27 +7824,22 @@ func TestV6UnknownDestination(t *testing.T) {
 				t.Fatalf("got an ICMP packet of size: %d, want: sz <= %d", got, want)
 			}
 
+			// The ICMP packet must hold as much of the original datagram as fits.
+			h := tc.flow.header4Tuple(incoming)
+			origPkt := c.buildV6Packet(payload, &h)
+			wantLen := len(origPkt)
+			if tc.largePayload {
+				wantLen = header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6MinimumSize
+			}
+
 			hdr := header.IPv6(pkt)
 			checker.IPv6(t, hdr, checker.ICMPv6(
 				checker.ICMPv6Type(header.ICMPv6DstUnreachable),
-				checker.ICMPv6Code(header.ICMPv6PortUnreachable)))
-
-			icmpPkt := header.ICMPv6(hdr.Payload())
-			payloadIPHeader := header.IPv6(icmpPkt.Payload())
-			wantLen := len(payload)
-			if tc.largePayload {
-				wantLen = header.IPv6MinimumMTU - header.IPv6MinimumSize*2 - header.ICMPv6MinimumSize - header.UDPMinimumSize
-			}
-			// In case of large payloads the IP packet may be truncated. Update
-			// the length field before retrieving the udp datagram payload.
-			payloadIPHeader.SetPayloadLength(uint16(wantLen + header.UDPMinimumSize))
+				checker.ICMPv6Code(header.ICMPv6PortUnreachable),
+				checker.ICMPv6PayloadPrefix(origPkt)))
 
-			origDgram := header.UDP(payloadIPHeader.Payload())
-			if got, want := len(origDgram.Payload()), wantLen; got != want {
-				t.Fatalf("unexpected payload length got: %d, want: %d", got, want)
-			}
-			if got, want := origDgram.Payload(), payload[:wantLen]; !bytes.Equal(got, want) {
-				t.Fatalf("unexpected payload got: %v, want: %v", got, want)
+			if got := len(header.ICMPv6(hdr.Payload()).Payload()); got != wantLen {
+				t.Fatalf("got embedded packet length = %d, want = %d", got, wantLen)
 			}
 		})
 	}
@@ -2102,6 +7878,69 @@ func TestIncrementMalformedPacketsReceived(t *testing.T) {
 	}
 }
 
+func TestMalformedPacketCapture(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		bound       bool
+		payloadSize int
+	}{
+		{name: "bound", bound: true, payloadSize: 30},
+		{name: "unbound", bound: false, payloadSize: 30},
+		{name: "truncated", bound: true, payloadSize: stack.MaxMalformedPacketCaptureSize},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpoint(ipv6.ProtocolNumber)
+			if test.bound {
+				if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+					c.t.Fatalf("Bind failed: %s", err)
+				}
+			}
+
+			type capture struct {
+				reason string
+				raw    []byte
+			}
+			var captures []capture
+			c.s.SetMalformedPacketCapture(func(reason string, raw []byte) {
+				captures = append(captures, capture{reason: reason, raw: raw})
+			})
+
+			h := unicastV6.header4Tuple(incoming)
+			buf := c.buildV6Packet(make([]byte, test.payloadSize), &h)
+
+			// Invalidate the UDP header length field.
+			u := header.UDP(buf[header.IPv6MinimumSize:])
+			u.SetLength(u.Length() + 1)
+			c.injectRaw(ipv6.ProtocolNumber, buf)
+
+			if len(captures) != 1 {
+				t.Fatalf("got %d captures, want = 1", len(captures))
+			}
+			wantReason := fmt.Sprintf("UDP length %d exceeds datagram size %d", u.Length(), len(u))
+			if got := captures[0].reason; got != wantReason {
+				t.Errorf("got reason = %q, want = %q", got, wantReason)
+			}
+			wantRaw := []byte(buf)
+			if len(wantRaw) > stack.MaxMalformedPacketCaptureSize {
+				wantRaw = wantRaw[:stack.MaxMalformedPacketCaptureSize]
+			}
+			if diff := cmp.Diff(wantRaw, captures[0].raw); diff != "" {
+				t.Errorf("raw mismatch (-want +got):\n%s", diff)
+			}
+
+			// Removing the capture function stops capturing.
+			c.s.SetMalformedPacketCapture(nil)
+			c.injectRaw(ipv6.ProtocolNumber, buf)
+			if len(captures) != 1 {
+				t.Errorf("got %d captures after removing the capture function, want = 1", len(captures))
+			}
+		})
+	}
+}
+
 // TestShortHeader verifies that when a packet with a too-short UDP header is
 // received, the malformed received global stat gets incremented.
 func TestShortHeader(t *testing.T) {
@@ -2143,16 +7982,86 @@ func TestShortHeader(t *testing.T) {
 	// Copy all but the last byte of the UDP header into the packet.
 	copy(buf[header.IPv6MinimumSize:], udpHdr)
 
+	if netProto, transProto, valid := stack.ClassifyInbound(buf); netProto != ipv6.ProtocolNumber || transProto != udp.ProtocolNumber || valid {
+		t.Errorf("got ClassifyInbound(_) = (%d, %d, %t), want = (%d, %d, false)", netProto, transProto, valid, ipv6.ProtocolNumber, udp.ProtocolNumber)
+	}
+
 	// Inject packet.
-	c.linkEP.InjectInbound(ipv6.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Data: buf.ToVectorisedView(),
-	}))
+	c.injectRaw(ipv6.ProtocolNumber, buf)
 
 	if got, want := c.s.Stats().NICs.MalformedL4RcvdPackets.Value(), uint64(1); got != want {
 		t.Errorf("got c.s.Stats().NIC.MalformedL4RcvdPackets.Value() = %d, want = %d", got, want)
 	}
 }
 
+func TestClassifyInbound(t *testing.T) {
+	const unknownTransProto = 253
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	h := unicastV6.header4Tuple(incoming)
+	validUDP := c.buildV6Packet(newPayload(), &h)
+	nonUDP := append(buffer.View(nil), validUDP...)
+	header.IPv6(nonUDP).SetNextHeader(unknownTransProto)
+
+	tests := []struct {
+		name           string
+		buf            []byte
+		wantTransProto tcpip.TransportProtocolNumber
+		wantValid      bool
+		check          func(*testing.T)
+	}{
+		{
+			name: "truncated IPv6 header",
+			buf:  validUDP[:header.IPv6MinimumSize-1],
+			check: func(t *testing.T) {
+				if got := c.s.Stats().IP.MalformedPacketsReceived.Value(); got != 1 {
+					t.Errorf("got IP.MalformedPacketsReceived = %d, want = 1", got)
+				}
+			},
+		},
+		{
+			name:           "non-UDP next header",
+			buf:            nonUDP,
+			wantTransProto: unknownTransProto,
+			wantValid:      true,
+			check: func(t *testing.T) {
+				if got, ok := c.s.Stats().NICs.UnknownL4ProtocolRcvdPacketCounts.Get(unknownTransProto); !ok || got.Value() != 1 {
+					t.Errorf("got UnknownL4ProtocolRcvdPacketCounts[%d] = (%v, %t), want = 1", unknownTransProto, got, ok)
+				}
+			},
+		},
+		{
+			name:           "valid UDP",
+			buf:            validUDP,
+			wantTransProto: udp.ProtocolNumber,
+			wantValid:      true,
+			check: func(t *testing.T) {
+				var buf bytes.Buffer
+				if _, err := c.ep.Read(&buf, tcpip.ReadOptions{}); err != nil {
+					t.Errorf("Read failed: %s", err)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			netProto, transProto, valid := stack.ClassifyInbound(test.buf)
+			if netProto != ipv6.ProtocolNumber || transProto != test.wantTransProto || valid != test.wantValid {
+				t.Errorf("got ClassifyInbound(_) = (%d, %d, %t), want = (%d, %d, %t)", netProto, transProto, valid, ipv6.ProtocolNumber, test.wantTransProto, test.wantValid)
+			}
+			c.injectRaw(ipv6.ProtocolNumber, test.buf)
+			test.check(t)
+		})
+	}
+}
+
 // TestBadChecksumErrors verifies if a checksum error is detected,
 // global and endpoint stats are incremented.
 func TestBadChecksumErrors(t *testing.T) {
@@ -2305,6 +8214,52 @@ func TestChecksumZeroV6(t *testing.T) {
 	}
 }
 
+func TestZeroChecksumV6Stats(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	injectZeroChecksum := func() {
+		h := unicastV6.header4Tuple(incoming)
+		buf := c.buildV6Packet(newPayload(), &h)
+		header.UDP(buf[header.IPv6MinimumSize:]).SetChecksum(0)
+		c.linkEP.InjectInbound(ipv6.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buf.ToVectorisedView(),
+		}))
+	}
+	checkStats := func(wantZero, wantChecksum uint64) {
+		t.Helper()
+		stats := c.s.Stats().UDP
+		if got := stats.ZeroChecksumIPv6.Value(); got != wantZero {
+			t.Errorf("got stats.UDP.ZeroChecksumIPv6.Value() = %d, want = %d", got, wantZero)
+		}
+		if got := stats.ChecksumErrors.Value(); got != wantChecksum {
+			t.Errorf("got stats.UDP.ChecksumErrors.Value() = %d, want = %d", got, wantChecksum)
+		}
+	}
+
+	// By default a zero checksum counts in both stats.
+	injectZeroChecksum()
+	checkStats(1, 1)
+
+	// A wrong checksum is only a checksum error.
+	c.injectPacket(unicastV6, newPayload(), true /* badChecksum */)
+	checkStats(1, 2)
+
+	opt := tcpip.UDPSeparateZeroChecksumStatsOption(true)
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, &opt); err != nil {
+		t.Fatalf("SetTransportProtocolOption(%d, &%T(%t)): %s", udp.ProtocolNumber, opt, opt, err)
+	}
+	injectZeroChecksum()
+	checkStats(2, 2)
+	c.injectPacket(unicastV6, newPayload(), true /* badChecksum */)
+	checkStats(2, 3)
+}
+
 // TestShutdownRead verifies endpoint read shutdown and error
 // stats increment on packet receive.
 func TestShutdownRead(t *testing.T) {
@@ -2325,6 +8280,10 @@ func TestShutdownRead(t *testing.T) {
 	if err := c.ep.Shutdown(tcpip.ShutdownRead); err != nil {
 		t.Fatalf("Shutdown failed: %s", err)
 	}
+	// The endpoint only hangs up once both directions are shut down.
+	if got := c.ep.Readiness(waiter.ReadableEvents); got&waiter.EventHUp != 0 {
+		t.Errorf("got c.ep.Readiness(%#x) = %#x, want EventHUp unset", waiter.ReadableEvents, got)
+	}
 
 	testFailingRead(c, unicastV6, true /* expectReadError */)
 
@@ -2356,6 +8315,67 @@ func TestShutdownWrite(t *testing.T) {
 	testFailingWrite(c, unicastV6, &tcpip.ErrClosedForSend{})
 }
 
+// TestShutdownReadWrite verifies that both directions can be shut down in a
+// single call, that this hangs up the endpoint, and that repeating the shutdown
+// neither notifies waiters again nor affects error stats.
+func TestShutdownReadWrite(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createEndpoint(ipv6.ProtocolNumber)
+
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+		c.t.Fatalf("Bind failed: %s", err)
+	}
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %s", err)
+	}
+
+	// Leave room for a second notification so that one would be observed.
+	we, ch := waiter.NewChannelEntry(make(chan struct{}, 2))
+	c.wq.EventRegister(&we, waiter.EventHUp)
+	defer c.wq.EventUnregister(&we)
+
+	for i := 0; i < 2; i++ {
+		if err := c.ep.Shutdown(tcpip.ShutdownRead | tcpip.ShutdownWrite); err != nil {
+			t.Fatalf("Shutdown #%d failed: %s", i, err)
+		}
+	}
+	if got := len(ch); got != 1 {
+		t.Errorf("got %d EventHUp notifications, want = 1", got)
+	}
+	if got := c.ep.Readiness(waiter.ReadableEvents); got&waiter.EventHUp == 0 {
+		t.Errorf("got c.ep.Readiness(%#x) = %#x, want EventHUp set", waiter.ReadableEvents, got)
+	}
+
+	testFailingRead(c, unicastV6, true /* expectReadError */)
+	testFailingWrite(c, unicastV6, &tcpip.ErrClosedForSend{})
+
+	stats := c.ep.Stats().(*tcpip.TransportEndpointStats)
+	var want uint64 = 1
+	if got := c.s.Stats().UDP.ReceiveBufferErrors.Value(); got != want {
+		t.Errorf("got stats.UDP.ReceiveBufferErrors.Value() = %v, want = %v", got, want)
+	}
+	if got := stats.ReceiveErrors.ClosedReceiver.Value(); got != want {
+		t.Errorf("got EP Stats.ReceiveErrors.ClosedReceiver stats = %v, want = %v", got, want)
+	}
+	if got := stats.WriteErrors.WriteClosed.Value(); got != want {
+		t.Errorf("got EP Stats.WriteErrors.WriteClosed stats = %v, want = %v", got, want)
+	}
+
+	// Shutting down again must not change the stats.
+	if err := c.ep.Shutdown(tcpip.ShutdownRead | tcpip.ShutdownWrite); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	if got := stats.ReceiveErrors.ClosedReceiver.Value(); got != want {
+		t.Errorf("got EP Stats.ReceiveErrors.ClosedReceiver stats = %v, want = %v", got, want)
+	}
+	if got := stats.WriteErrors.WriteClosed.Value(); got != want {
+		t.Errorf("got EP Stats.WriteErrors.WriteClosed stats = %v, want = %v", got, want)
+	}
+}
+
 func (c *testContext) checkEndpointWriteStats(incr uint64, want tcpip.TransportEndpointStats, err tcpip.Error) {
 	got := c.ep.Stats().(*tcpip.TransportEndpointStats).Clone()
 	switch err.(type) {
@@ -2600,3 +8620,51 @@ func TestOutgoingSubnetBroadcast(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkWriteSmall(b *testing.B) {
+	for _, size := range []int{16, 128, 1024} {
+		b.Run(fmt.Sprintf("size:%d", size), func(b *testing.B) {
+			s := stack.New(stack.Options{
+				NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+				TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+			})
+			defer s.Close()
+			linkEP := channel.New(1, defaultMTU, "")
+			if err := s.CreateNIC(1, linkEP); err != nil {
+				b.Fatalf("CreateNIC(1, _): %s", err)
+			}
+			protocolAddr := tcpip.ProtocolAddress{
+				Protocol:          ipv4.ProtocolNumber,
+				AddressWithPrefix: tcpip.Address(stackAddr).WithPrefix(),
+			}
+			if err := s.AddProtocolAddress(1, protocolAddr, stack.AddressProperties{}); err != nil {
+				b.Fatalf("AddProtocolAddress(1, %+v, {}): %s", protocolAddr, err)
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				b.Fatalf("NewEndpoint failed: %s", err)
+			}
+			defer ep.Close()
+			if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+				b.Fatalf("Connect failed: %s", err)
+			}
+
+			payload := make([]byte, size)
+			var r bytes.Reader
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(payload)
+				if _, err := ep.Write(&r, tcpip.WriteOptions{}); err != nil {
+					b.Fatalf("Write failed: %s", err)
+				}
+				if _, ok := linkEP.Read(); !ok {
+					b.Fatal("packet wasn't written out")
+				}
+			}
+		})
+	}
+}